@@ -0,0 +1,186 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/cleanup"
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/config"
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/datamover"
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/util"
+)
+
+// gcCommand runs the plugin binary as a garbage collector of orphaned volumesnapshotcontents instead of as a Velero plugin.
+const gcCommand = "gc-volumesnapshotcontents"
+
+// runGC runs the garbage collector once or, with a positive --interval, periodically until it is terminated, and returns the
+// exit code of the process.
+func runGC(args []string) int {
+	logger := logrus.New()
+	flags := pflag.NewFlagSet(gcCommand, pflag.ContinueOnError)
+	namespace := flags.String("namespace", config.Namespace(), "the Velero namespace, which holds the backups")
+	dryRun := flags.Bool("dry-run", false, "report what would be deleted without deleting it")
+	gracePeriod := flags.Duration("grace-period", 24*time.Hour, "how long after their creation volumesnapshotcontents are left alone")
+	interval := flags.Duration("interval", 0, "how often to collect orphaned volumesnapshotcontents; when 0, collect them once and exit")
+	logLevel := flags.String("log-level", "info", "the level of the logs")
+	failedBackups := flags.Bool("failed-backups", true, "also delete the volumesnapshots created for failed and abandoned backups")
+	topologyStorageClasses := flags.Bool("topology-storage-classes", true, "also delete the storage classes created to restore PVCs in the topology of their volumes once no PVC or PV uses them")
+	dataMoverChunks := flags.Bool("data-mover-chunks", false, "also collect the data mover chunks that no backup references")
+	pluginDir := flags.String("plugin-dir", "", "the directory of the object store plugins of the backup storage locations, required by --data-mover-chunks unless dataMoverObjectStorePath is set")
+	if err := flags.Parse(args); err != nil {
+		if err == pflag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	level, err := logrus.ParseLevel(*logLevel)
+	if err != nil {
+		logger.WithError(err).Error("Invalid log level")
+		return 2
+	}
+	logger.SetLevel(level)
+
+	backupClient, err := util.GetDynamicClient()
+	if err != nil {
+		logger.WithError(err).Error("Failed to create the kubernetes client")
+		return 1
+	}
+	client, snapshotClient, err := util.GetClients()
+	if err != nil {
+		logger.WithError(err).Error("Failed to create the kubernetes client")
+		return 1
+	}
+	collector := &cleanup.OrphanedContentCollector{
+		Log:            logger,
+		Namespace:      *namespace,
+		BackupClient:   backupClient,
+		SnapshotClient: snapshotClient,
+		GracePeriod:    *gracePeriod,
+		DryRun:         *dryRun,
+	}
+	var failedBackupCleaner *cleanup.FailedBackupCleaner
+	if *failedBackups {
+		failedBackupCleaner = &cleanup.FailedBackupCleaner{
+			Log:             logger,
+			Namespace:       *namespace,
+			ConfigMapClient: client.CoreV1(),
+			BackupClient:    backupClient,
+			SnapshotClient:  snapshotClient,
+			DryRun:          *dryRun,
+		}
+	}
+	var storageClassCollector *cleanup.TopologyStorageClassCollector
+	if *topologyStorageClasses {
+		storageClassCollector = &cleanup.TopologyStorageClassCollector{
+			Log:           logger,
+			Namespace:     *namespace,
+			RestoreClient: backupClient,
+			Client:        client,
+			DryRun:        *dryRun,
+		}
+	}
+	var chunkCollector *cleanup.ChunkCollector
+	if *dataMoverChunks {
+		cfg, err := config.Load(client.CoreV1(), *namespace, logger)
+		if err != nil {
+			logger.WithError(err).Error("Failed to load the plugin configuration")
+			return 1
+		}
+		// The repository in dataMoverObjectStorePath is collected without the object store plugins.
+		var objectStores datamover.ObjectStoreGetter
+		if cfg.DataMoverObjectStorePath == "" {
+			if *pluginDir == "" {
+				logger.Errorf("--plugin-dir must be set to the directory of the object store plugins of the backup storage locations to collect data mover chunks in them")
+				return 2
+			}
+			getter, closePlugins, err := datamover.NewPluginObjectStoreGetter(*pluginDir, logger)
+			if err != nil {
+				logger.WithError(err).Error("Failed to load the object store plugins")
+				return 1
+			}
+			defer closePlugins()
+			objectStores = getter
+		}
+		chunkCollector = &cleanup.ChunkCollector{
+			Log:          logger,
+			Namespace:    *namespace,
+			BackupClient: backupClient,
+			Secrets:      client.CoreV1(),
+			ObjectStores: objectStores,
+			Config:       cfg,
+			DryRun:       *dryRun,
+		}
+	}
+	collect := func() bool {
+		ok := true
+		orphans, err := collector.Run()
+		logger.Infof("Found %d orphaned volumesnapshotcontents", len(orphans))
+		if err != nil {
+			logger.WithError(err).Error("Failed to collect orphaned volumesnapshotcontents")
+			ok = false
+		}
+		if failedBackupCleaner != nil {
+			if err := failedBackupCleaner.Run(); err != nil {
+				logger.WithError(err).Error("Failed to clean up the volumesnapshots of failed backups")
+				ok = false
+			}
+		}
+		if storageClassCollector != nil {
+			unused, err := storageClassCollector.Run()
+			logger.Infof("Found %d unused topology storage classes", len(unused))
+			if err != nil {
+				logger.WithError(err).Error("Failed to collect unused topology storage classes")
+				ok = false
+			}
+		}
+		if chunkCollector != nil {
+			unreferenced, err := chunkCollector.Run()
+			logger.Infof("Found %d unreferenced data mover chunks", unreferenced)
+			if err != nil {
+				logger.WithError(err).Error("Failed to collect data mover chunks")
+				ok = false
+			}
+		}
+		return ok
+	}
+
+	if *interval <= 0 {
+		if !collect() {
+			return 1
+		}
+		return 0
+	}
+
+	stopCh := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		close(stopCh)
+	}()
+	logger.Infof("Collecting orphaned volumesnapshotcontents every %s", *interval)
+	wait.Until(func() { collect() }, *interval, stopCh)
+	return 0
+}
@@ -3,8 +3,8 @@ module github.com/vmware-tanzu/velero-plugin-for-csi
 go 1.13
 
 require (
-	github.com/hashicorp/go-hclog v0.12.0 // indirect
-	github.com/hashicorp/go-plugin v1.0.1-0.20190610192547-a1bc61569a26 // indirect
+	github.com/hashicorp/go-hclog v0.12.0
+	github.com/hashicorp/go-plugin v1.0.1-0.20190610192547-a1bc61569a26
 	github.com/hashicorp/yamux v0.0.0-20181012175058-2f1d1f20f75d // indirect
 	github.com/kubernetes-csi/external-snapshotter/client/v4 v4.0.0
 	github.com/pkg/errors v0.9.1
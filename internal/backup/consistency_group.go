@@ -0,0 +1,115 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backup
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+
+	snapshotv1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	snapshotter "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned/typed/volumesnapshot/v1"
+	corev1api "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/config"
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/util"
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/kuberesource"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+)
+
+// snapshotConsistencyGroup returns the volumesnapshot of a PVC that is a member of a consistency group, along with the other
+// members of the group as additional items to back up.
+// The snapshots of all the members are taken when the first member is backed up: the applications using the members are
+// quiesced by their quiesce hooks, or, with cfg.ConsistencyGroupFSFreeze, by freezing the filesystems of the members, the
+// volumesnapshots are created and the applications are thawed once the CSI driver has cut every snapshot. The members
+// backed up later find their volumesnapshot with util.GetVolumeSnapshotForPVC, before this is called.
+// VolumeGroupSnapshots are not used: the pinned external-snapshotter v4 client only has the snapshot.storage.k8s.io/v1
+// API, which has no group snapshots, so this coordinated sequence is used for all CSI drivers.
+func (p *PVCBackupItemAction) snapshotConsistencyGroup(pvc *corev1api.PersistentVolumeClaim, group string, backup *velerov1api.Backup, cfg config.Config,
+	client kubernetes.Interface, snapshotClient snapshotter.SnapshotV1Interface) (*snapshotv1api.VolumeSnapshot, []velero.ResourceIdentifier, error) {
+	members, err := util.GetConsistencyGroupMembers(pvc.Namespace, group, client.CoreV1())
+	if err != nil {
+		return nil, nil, err
+	}
+	memberNames := make([]string, 0, len(members))
+	for _, member := range members {
+		memberNames = append(memberNames, member.Name)
+	}
+	if !util.Contains(memberNames, pvc.Name) {
+		return nil, nil, errors.Errorf("PVC %s/%s is not a member of consistency group %s", pvc.Namespace, pvc.Name, group)
+	}
+	p.Log.Infof("Snapshotting PVCs %v of consistency group %s in namespace %s together", memberNames, group, pvc.Namespace)
+
+	// A retried backup snapshots the group under the same ID. The group is the base of the ID and one of its keys, keyed
+	// alongside the backup and the namespace, as the base is truncated for long group names.
+	groupID := util.DeterministicName("", group, string(backup.UID), pvc.Namespace, group)
+	snapshots := make([]*snapshotv1api.VolumeSnapshot, 0, len(members))
+	for i := range members {
+		member := &members[i]
+		if member.Name != pvc.Name {
+			skipReason, err := p.getSkipReason(member, backup, client.CoreV1())
+			if err != nil {
+				return nil, nil, err
+			}
+			if skipReason != "" {
+				return nil, nil, errors.Errorf("cannot snapshot PVC %s/%s of consistency group %s, %s", member.Namespace, member.Name, group, skipReason)
+			}
+		}
+
+		snapshot, err := p.newVolumeSnapshot(member, backup, cfg, client, snapshotClient)
+		if err != nil {
+			return nil, nil, err
+		}
+		util.AddLabels(&snapshot.ObjectMeta, map[string]string{
+			util.ConsistencyGroupLabel:   group,
+			util.ConsistencyGroupIDLabel: groupID,
+		})
+		util.AddAnnotations(&snapshot.ObjectMeta, map[string]string{
+			util.ConsistencyGroupMembersAnnotation: strings.Join(memberNames, ","),
+		})
+		snapshots = append(snapshots, snapshot)
+	}
+
+	actions, err := getQuiesceActions(members, client.CoreV1(), cfg.ConsistencyGroupFSFreeze)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !cfg.ConsistencyGroupFSFreeze {
+		p.Log.Infof("Not freezing the filesystems of consistency group %s in namespace %s, only the pods with quiesce hooks are quiesced", group, pvc.Namespace)
+	}
+	created, err := p.createVolumeSnapshots(snapshots, actions, backup, cfg, client, snapshotClient)
+	if err != nil {
+		return nil, nil, errors.WithMessagef(err, "failed to snapshot consistency group %s", group)
+	}
+
+	var result *snapshotv1api.VolumeSnapshot
+	additionalItems := []velero.ResourceIdentifier{}
+	for i, vs := range created {
+		if members[i].Name == pvc.Name {
+			result = vs
+			continue
+		}
+		additionalItems = append(additionalItems, velero.ResourceIdentifier{
+			GroupResource: kuberesource.PersistentVolumeClaims,
+			Namespace:     members[i].Namespace,
+			Name:          members[i].Name,
+		})
+	}
+	return result, additionalItems, nil
+}
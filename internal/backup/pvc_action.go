@@ -18,18 +18,24 @@ package backup
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 
-	snapshotv1beta1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1beta1"
+	snapshotv1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	snapshotter "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned/typed/volumesnapshot/v1"
 	corev1api "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/config"
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/datamover"
 	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/util"
 	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
 	"github.com/vmware-tanzu/velero/pkg/kuberesource"
@@ -40,7 +46,8 @@ import (
 
 // PVCBackupItemAction is a backup item action plugin for Velero.
 type PVCBackupItemAction struct {
-	Log logrus.FieldLogger
+	Log    logrus.FieldLogger
+	Config config.Config
 }
 
 // AppliesTo returns information indicating that the PVCBackupItemAction should be invoked to backup PVCs.
@@ -73,98 +80,221 @@ func (p *PVCBackupItemAction) Execute(item runtime.Unstructured, backup *velerov
 		return nil, nil, errors.WithStack(err)
 	}
 
-	p.Log.Debugf("Fetching underlying PV for PVC %s", fmt.Sprintf("%s/%s", pvc.Namespace, pvc.Name))
-	// Do nothing if this is not a CSI provisioned volume
-	pv, err := util.GetPVForPVC(&pvc, client.CoreV1())
+	cfg, err := p.Config.ForBackup(backup)
 	if err != nil {
-		return nil, nil, errors.WithStack(err)
+		return nil, nil, err
 	}
-	if pv.Spec.PersistentVolumeSource.CSI == nil {
-		p.Log.Infof("Skipping PVC %s/%s, associated PV %s is not a CSI volume", pvc.Namespace, pvc.Name, pv.Name)
+
+	// Do nothing if this is not a CSI provisioned volume or if restic is used to backup this PV
+	skipReason, err := p.getSkipReason(&pvc, backup, client.CoreV1())
+	if err != nil {
+		return nil, nil, err
+	}
+	if skipReason != "" {
+		p.Log.Infof("Skipping PVC %s/%s, %s", pvc.Namespace, pvc.Name, skipReason)
 		return item, nil, nil
 	}
 
-	// Do nothing if restic is used to backup this PV
-	isResticUsed, err := util.IsPVCBackedUpByRestic(pvc.Namespace, pvc.Name, client.CoreV1(), boolptr.IsSetToTrue(backup.Spec.DefaultVolumesToRestic))
+	group, err := util.GetConsistencyGroup(&pvc, client.CoreV1())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The action may be invoked again for the PVC, when the backup is retried or the plugin restarted, and then uses the
+	// volumesnapshot it created earlier.
+	upd, err := util.GetVolumeSnapshotForPVC(&pvc, backup, snapshotClient)
+	if err != nil {
+		return nil, nil, err
+	}
+	adopted := false
+	if upd == nil && group == "" {
+		// Applications that snapshot their PVCs themselves may have a recent volumesnapshot to back up instead.
+		if upd, err = p.adoptVolumeSnapshot(&pvc, backup, cfg, snapshotClient); err != nil {
+			return nil, nil, err
+		}
+		adopted = upd != nil
+	}
+	var groupItems []velero.ResourceIdentifier
+	if upd != nil {
+		if !adopted {
+			p.Log.Infof("Using volumesnapshot %s/%s created earlier for PVC %s/%s", upd.Namespace, upd.Name, pvc.Namespace, pvc.Name)
+		}
+	} else if group == "" {
+		snapshot, err := p.newVolumeSnapshot(&pvc, backup, cfg, client, snapshotClient)
+		if err != nil {
+			return nil, nil, err
+		}
+		// Applications that declare quiesce hooks are frozen while the PVC is snapshotted.
+		actions, err := getQuiesceActions([]corev1api.PersistentVolumeClaim{pvc}, client.CoreV1(), false)
+		if err != nil {
+			return nil, nil, err
+		}
+		created, err := p.createVolumeSnapshots([]*snapshotv1api.VolumeSnapshot{snapshot}, actions, backup, cfg, client, snapshotClient)
+		if err != nil {
+			return nil, nil, err
+		}
+		upd = created[0]
+	} else {
+		upd, groupItems, err = p.snapshotConsistencyGroup(&pvc, group, backup, cfg, client, snapshotClient)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	vals := map[string]string{
+		util.VolumeSnapshotLabel:    upd.Name,
+		velerov1api.BackupNameLabel: backup.Name,
+	}
+	util.AddAnnotations(&pvc.ObjectMeta, vals)
+	util.AddLabels(&pvc.ObjectMeta, vals)
+	if err := recordVolumeTopology(&pvc, client.CoreV1()); err != nil {
+		return nil, nil, err
+	}
+	if cfg.DataMover && !adopted {
+		// VolumeSnapshotBackupItemAction copies the data of the volumesnapshot to the data mover object store under this key.
+		util.AddAnnotations(&pvc.ObjectMeta, map[string]string{
+			util.DataMoverManifestAnnotation: datamover.ManifestKey(backup.Name, pvc.Namespace, pvc.Name),
+		})
+	}
+
+	additionalItems := []velero.ResourceIdentifier{
+		{
+			GroupResource: kuberesource.VolumeSnapshots,
+			Namespace:     upd.Namespace,
+			Name:          upd.Name,
+		},
+	}
+	// The other members of a consistency group are backed up along with the PVC, so that their snapshots are not left behind.
+	additionalItems = append(additionalItems, groupItems...)
+
+	p.Log.Infof("Returning from PVCBackupItemAction with %d additionalItems to backup", len(additionalItems))
+	for _, ai := range additionalItems {
+		p.Log.Debugf("%s: %s", ai.GroupResource.String(), ai.Name)
+	}
+
+	pvcMap, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&pvc)
 	if err != nil {
 		return nil, nil, errors.WithStack(err)
 	}
+
+	return &unstructured.Unstructured{Object: pvcMap}, additionalItems, nil
+}
+
+// getSkipReason returns why the PVC should not be snapshotted, or "" if it should be.
+func (p *PVCBackupItemAction) getSkipReason(pvc *corev1api.PersistentVolumeClaim, backup *velerov1api.Backup, corev1 corev1client.CoreV1Interface) (string, error) {
+	p.Log.Debugf("Fetching underlying PV for PVC %s", fmt.Sprintf("%s/%s", pvc.Namespace, pvc.Name))
+	pv, err := util.GetPVForPVC(pvc, corev1)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if pv.Spec.PersistentVolumeSource.CSI == nil {
+		return fmt.Sprintf("associated PV %s is not a CSI volume", pv.Name), nil
+	}
+
+	isResticUsed, err := util.IsPVCBackedUpByRestic(pvc.Namespace, pvc.Name, corev1, boolptr.IsSetToTrue(backup.Spec.DefaultVolumesToRestic))
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
 	if isResticUsed {
-		p.Log.Infof("Skipping  PVC %s/%s, PV %s will be backed up using restic", pvc.Namespace, pvc.Name, pv.Name)
-		return item, nil, nil
+		return fmt.Sprintf("PV %s will be backed up using restic", pv.Name), nil
 	}
+	return "", nil
+}
 
+// recordVolumeTopology records the topology of the volume of the PVC on the PVC, so that PVCRestoreItemAction can restore it
+// where its snapshot can be restored.
+func recordVolumeTopology(pvc *corev1api.PersistentVolumeClaim, corev1 corev1client.PersistentVolumesGetter) error {
+	pv, err := util.GetPVForPVC(pvc, corev1)
+	if err != nil {
+		return err
+	}
+	topology := util.GetVolumeTopology(pv)
+	if len(topology) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(topology)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	util.AddAnnotations(&pvc.ObjectMeta, map[string]string{util.VolumeTopologyAnnotation: string(data)})
+	return nil
+}
+
+// newVolumeSnapshot returns the volumesnapshot to create to snapshot the PVC, using the volumesnapshotclass for its storage class.
+func (p *PVCBackupItemAction) newVolumeSnapshot(pvc *corev1api.PersistentVolumeClaim, backup *velerov1api.Backup, cfg config.Config,
+	client kubernetes.Interface, snapshotClient snapshotter.SnapshotV1Interface) (*snapshotv1api.VolumeSnapshot, error) {
 	// no storage class: we don't know how to map to a VolumeSnapshotClass
 	if pvc.Spec.StorageClassName == nil {
-		return item, nil, errors.Errorf("Cannot snapshot PVC %s/%s, PVC has no storage class.", pvc.Namespace, pvc.Name)
+		return nil, errors.Errorf("Cannot snapshot PVC %s/%s, PVC has no storage class.", pvc.Namespace, pvc.Name)
 	}
 
 	p.Log.Infof("Fetching storage class for PV %s", *pvc.Spec.StorageClassName)
 	storageClass, err := client.StorageV1().StorageClasses().Get(context.TODO(), *pvc.Spec.StorageClassName, metav1.GetOptions{})
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "error getting storage class")
+		return nil, errors.Wrap(err, "error getting storage class")
 	}
 	p.Log.Debugf("Fetching volumesnapshot class for %s", storageClass.Provisioner)
-	snapshotClass, err := util.GetVolumeSnapshotClassForStorageClass(storageClass.Provisioner, snapshotClient.SnapshotV1beta1())
+	snapshotClass, err := util.GetVolumeSnapshotClass(storageClass, pvc, backup, cfg.VolumeSnapshotClasses, snapshotClient, p.Log)
 	if err != nil {
-		return nil, nil, errors.Wrapf(err, "failed to get volumesnapshotclass for storageclass %s", storageClass.Name)
+		return nil, errors.Wrapf(err, "failed to get volumesnapshotclass for storageclass %s", storageClass.Name)
 	}
 	p.Log.Infof("volumesnapshot class=%s", snapshotClass.Name)
 
 	// If deletetionPolicy is not Retain, then in the event of a disaster, the namespace is lost with the volumesnapshot object in it,
 	// the underlying volumesnapshotcontent and the volume snapshot in the storage provider is also deleted.
 	// In such a scenario, the backup objects will be useless as the snapshot handle itself will not be valid.
-	if snapshotClass.DeletionPolicy != snapshotv1beta1api.VolumeSnapshotContentRetain {
+	if snapshotClass.DeletionPolicy != snapshotv1api.VolumeSnapshotContentRetain {
 		p.Log.Warnf("DeletionPolicy on VolumeSnapshotClass %s is not %s; Deletion of VolumeSnapshot objects will lead to deletion of snapshot in the storage provider.",
-			snapshotClass.Name, snapshotv1beta1api.VolumeSnapshotContentRetain)
+			snapshotClass.Name, snapshotv1api.VolumeSnapshotContentRetain)
 	}
-	// Craft the snapshot object to be created
-	snapshot := snapshotv1beta1api.VolumeSnapshot{
+	// Record the storage class of the PVC, so that the volumesnapshot follows the storage class mapping of a restore.
+	annotations := util.BackupOwnerAnnotations(backup)
+	annotations[util.StorageClassAnnotation] = storageClass.Name
+
+	// Craft the snapshot object to be created. Its name is derived from the backup and the PVC, so that a retried backup finds
+	// the volumesnapshot it created earlier.
+	return &snapshotv1api.VolumeSnapshot{
 		ObjectMeta: metav1.ObjectMeta{
-			GenerateName: "velero-" + pvc.Name + "-",
-			Namespace:    pvc.Namespace,
+			Name:      util.DeterministicName("velero-", pvc.Name, string(backup.UID), string(pvc.UID)),
+			Namespace: pvc.Namespace,
 			Labels: map[string]string{
 				velerov1api.BackupNameLabel: label.GetValidName(backup.Name),
+				util.SourcePVCUIDLabel:      string(pvc.UID),
 			},
+			Annotations: annotations,
 		},
-		Spec: snapshotv1beta1api.VolumeSnapshotSpec{
-			Source: snapshotv1beta1api.VolumeSnapshotSource{
+		Spec: snapshotv1api.VolumeSnapshotSpec{
+			Source: snapshotv1api.VolumeSnapshotSource{
 				PersistentVolumeClaimName: &pvc.Name,
 			},
 			VolumeSnapshotClassName: &snapshotClass.Name,
 		},
-	}
+	}, nil
+}
 
-	upd, err := snapshotClient.SnapshotV1beta1().VolumeSnapshots(pvc.Namespace).Create(context.TODO(), &snapshot, metav1.CreateOptions{})
-	if err != nil {
-		return nil, nil, errors.Wrapf(err, "error creating volume snapshot")
+// adoptVolumeSnapshot returns a recent volumesnapshot of the PVC, taken outside of Velero and matching the selector annotation of
+// the PVC or the backup, to back up instead of taking a new snapshot. It returns nil when adopting volumesnapshots is disabled or
+// there is no such volumesnapshot. The adopted volumesnapshot is marked so that deleting the backup never deletes it.
+func (p *PVCBackupItemAction) adoptVolumeSnapshot(pvc *corev1api.PersistentVolumeClaim, backup *velerov1api.Backup, cfg config.Config,
+	snapshotClient snapshotter.SnapshotV1Interface) (*snapshotv1api.VolumeSnapshot, error) {
+	if cfg.AdoptVolumeSnapshotsMaxAge == 0 {
+		return nil, nil
 	}
-	p.Log.Infof("Created volumesnapshot %s", fmt.Sprintf("%s/%s", upd.Namespace, upd.Name))
-
-	vals := map[string]string{
-		util.VolumeSnapshotLabel:    upd.Name,
-		velerov1api.BackupNameLabel: backup.Name,
+	selector, ok := pvc.Annotations[util.AdoptVolumeSnapshotSelectorAnnotation]
+	if !ok {
+		selector, ok = backup.Annotations[util.AdoptVolumeSnapshotSelectorAnnotation]
 	}
-	util.AddAnnotations(&pvc.ObjectMeta, vals)
-	util.AddLabels(&pvc.ObjectMeta, vals)
-
-	additionalItems := []velero.ResourceIdentifier{
-		{
-			GroupResource: kuberesource.VolumeSnapshots,
-			Namespace:     upd.Namespace,
-			Name:          upd.Name,
-		},
+	if !ok {
+		return nil, nil
 	}
 
-	p.Log.Infof("Returning from PVCBackupItemAction with %d additionalItems to backup", len(additionalItems))
-	for _, ai := range additionalItems {
-		p.Log.Debugf("%s: %s", ai.GroupResource.String(), ai.Name)
+	vs, err := util.GetAdoptableVolumeSnapshot(pvc, selector, cfg.AdoptVolumeSnapshotsMaxAge, snapshotClient)
+	if err != nil || vs == nil {
+		return nil, err
 	}
-
-	pvcMap, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&pvc)
-	if err != nil {
-		return nil, nil, errors.WithStack(err)
+	p.Log.Infof("Adopting volumesnapshot %s/%s of PVC %s/%s instead of taking a new snapshot", vs.Namespace, vs.Name, pvc.Namespace, pvc.Name)
+	if err := util.MarkVolumeSnapshotAdopted(vs, snapshotClient); err != nil {
+		return nil, err
 	}
-
-	return &unstructured.Unstructured{Object: pvcMap}, additionalItems, nil
+	return vs, nil
 }
@@ -0,0 +1,444 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	snapshotv1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	snapshotter "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned/typed/volumesnapshot/v1"
+	corev1api "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/util/retry"
+
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/cleanup"
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/config"
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/util"
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+)
+
+const (
+	freezePhase = "freeze"
+	thawPhase   = "thaw"
+
+	// maxHookOutput is the most output of a quiesce command that is recorded on volumesnapshots.
+	maxHookOutput = 1024
+	// maxBackupQuiesceHooks is the largest that the quiesce reports recorded on a backup grow. Beyond it, the output of the
+	// commands is left out of the reports, and only their errors are recorded.
+	maxBackupQuiesceHooks = 128 * 1024
+)
+
+// quiesceAction freezes, and later thaws, the writes of an application to its volumes by running commands in a container.
+type quiesceAction struct {
+	pod       *corev1api.Pod
+	container string
+	freeze    []string
+	thaw      []string
+}
+
+// quiesceHookResult is the outcome of a freeze or thaw command.
+type quiesceHookResult struct {
+	Pod       string   `json:"pod"`
+	Container string   `json:"container"`
+	Phase     string   `json:"phase"`
+	Command   []string `json:"command"`
+	Output    string   `json:"output,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// quiesceReport is recorded on the volumesnapshots taken while applications were quiesced, and on their backup.
+type quiesceReport struct {
+	// PVCs are the namespaced names of the PVCs snapshotted while the applications were quiesced.
+	PVCs []string `json:"pvcs,omitempty"`
+	// TimeoutExpired is set when the applications were thawed by the quiesce timeout, before all the snapshots were cut.
+	TimeoutExpired bool                `json:"timeoutExpired,omitempty"`
+	Hooks          []quiesceHookResult `json:"hooks"`
+	// Error is why the applications could not be quiesced or the snapshots could not be taken.
+	Error string `json:"error,omitempty"`
+}
+
+// getQuiesceActions returns the actions that quiesce the running pods that mount the PVCs. Pods that declare a quiesce hook
+// run it. With useFSFreeze, the filesystems of the PVCs mounted by the other pods are frozen with fsfreeze, which needs the
+// containers mounting them to include fsfreeze and have the CAP_SYS_ADMIN capability. A filesystem mounted by several pods on
+// a node only needs to be frozen once, and block volumes have no filesystem to freeze.
+func getQuiesceActions(pvcs []corev1api.PersistentVolumeClaim, corev1 corev1client.PodsGetter, useFSFreeze bool) ([]quiesceAction, error) {
+	actions := []quiesceAction{}
+	hooked := map[string]bool{}
+	frozen := map[string]bool{}
+	for _, pvc := range pvcs {
+		pods, err := util.GetPodsUsingPVC(pvc.Namespace, pvc.Name, corev1)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get pods using PVC %s/%s", pvc.Namespace, pvc.Name)
+		}
+		for i := range pods {
+			pod := &pods[i]
+			if pod.Status.Phase != corev1api.PodRunning {
+				continue
+			}
+
+			hook, err := util.GetQuiesceHook(pod)
+			if err != nil {
+				return nil, err
+			}
+			if hook != nil {
+				if !hooked[pod.Name] {
+					actions = append(actions, quiesceAction{pod: pod, container: hook.Container, freeze: hook.Freeze, thaw: hook.Thaw})
+					hooked[pod.Name] = true
+				}
+				continue
+			}
+
+			if !useFSFreeze || frozen[pod.Spec.NodeName+"/"+pvc.Name] {
+				continue
+			}
+			volumeName, err := util.GetPodVolumeNameForPVC(*pod, pvc.Name)
+			if err != nil {
+				return nil, err
+			}
+			if action, ok := fsfreezeAction(pod, volumeName); ok {
+				actions = append(actions, action)
+				frozen[pod.Spec.NodeName+"/"+pvc.Name] = true
+			}
+		}
+	}
+	return actions, nil
+}
+
+// fsfreezeAction returns an action freezing the filesystem of the volume with fsfreeze in the first container that mounts it.
+func fsfreezeAction(pod *corev1api.Pod, volumeName string) (quiesceAction, bool) {
+	for _, c := range pod.Spec.Containers {
+		for _, vm := range c.VolumeMounts {
+			if vm.Name == volumeName {
+				return quiesceAction{
+					pod:       pod,
+					container: c.Name,
+					freeze:    []string{"fsfreeze", "--freeze", vm.MountPath},
+					thaw:      []string{"fsfreeze", "--unfreeze", vm.MountPath},
+				}, true
+			}
+		}
+	}
+	return quiesceAction{}, false
+}
+
+// quiescer freezes applications while their volumes are snapshotted and thaws them again, at the latest when its timeout expires.
+type quiescer struct {
+	log logrus.FieldLogger
+	// exec runs a command in a container of a pod, as util.ExecInPod does.
+	exec    func(pod *corev1api.Pod, container string, command []string, stdin io.Reader, stdout, stderr io.Writer) error
+	actions []quiesceAction
+	timeout time.Duration
+
+	thawOnce sync.Once
+	timer    *time.Timer
+
+	lock   sync.Mutex
+	thawed bool
+	frozen []quiesceAction
+	report quiesceReport
+}
+
+// freeze runs the freeze commands and starts the quiesce timeout. If a command fails, the applications already frozen are thawed.
+func (q *quiescer) freeze() error {
+	q.timer = time.AfterFunc(q.timeout, func() {
+		q.log.Warnf("Quiesce timeout of %s expired before the snapshots were cut, thawing applications", q.timeout)
+		q.lock.Lock()
+		q.report.TimeoutExpired = true
+		q.lock.Unlock()
+		q.thaw()
+	})
+
+	for _, action := range q.actions {
+		err := q.run(action, freezePhase, action.freeze)
+
+		q.lock.Lock()
+		thawed := q.thawed
+		if err == nil && !thawed {
+			q.frozen = append(q.frozen, action)
+		}
+		q.lock.Unlock()
+
+		if err != nil {
+			q.thaw()
+			return err
+		}
+		if thawed {
+			// The timeout expired while this command ran, so it was not thawed with the others.
+			q.run(action, thawPhase, action.thaw)
+			return errors.Errorf("quiesce timeout of %s expired while freezing applications", q.timeout)
+		}
+	}
+	return nil
+}
+
+// thaw runs the thaw commands of the frozen applications, in the reverse order of freezing. Failures are recorded and logged.
+func (q *quiescer) thaw() {
+	q.thawOnce.Do(func() {
+		if q.timer != nil {
+			q.timer.Stop()
+		}
+		q.lock.Lock()
+		q.thawed = true
+		frozen := q.frozen
+		q.lock.Unlock()
+
+		for i := len(frozen) - 1; i >= 0; i-- {
+			q.run(frozen[i], thawPhase, frozen[i].thaw)
+		}
+	})
+}
+
+func (q *quiescer) run(action quiesceAction, phase string, command []string) error {
+	var stdout, stderr bytes.Buffer
+	err := q.exec(action.pod, action.container, command, nil, &stdout, &stderr)
+
+	log := q.log.WithFields(logrus.Fields{
+		"pod":       fmt.Sprintf("%s/%s", action.pod.Namespace, action.pod.Name),
+		"container": action.container,
+	})
+	result := quiesceHookResult{
+		Pod:       action.pod.Name,
+		Container: action.container,
+		Phase:     phase,
+		Command:   command,
+		Output:    truncateHookOutput(stdout.String() + stderr.String()),
+	}
+	if result.Output != "" {
+		log.Infof("Output of %s command %v: %s", phase, command, result.Output)
+	}
+	if err != nil {
+		err = errors.WithMessagef(err, "%s command failed: %s", phase, strings.TrimSpace(stderr.String()))
+		result.Error = truncateHookOutput(err.Error())
+		log.WithError(err).Errorf("Failed to run %s command %v", phase, command)
+	} else {
+		log.Infof("Ran %s command %v", phase, command)
+	}
+
+	q.lock.Lock()
+	q.report.Hooks = append(q.report.Hooks, result)
+	q.lock.Unlock()
+	return err
+}
+
+func (q *quiescer) getReport() quiesceReport {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.report
+}
+
+func truncateHookOutput(output string) string {
+	output = strings.TrimSpace(output)
+	if len(output) > maxHookOutput {
+		return output[:maxHookOutput] + "..."
+	}
+	return output
+}
+
+// createVolumeSnapshots creates the volumesnapshots while the actions quiesce the applications writing to the volumes, and waits
+// for the CSI driver to cut every snapshot before thawing the applications. If any snapshot fails, all the volumesnapshots are
+// deleted. The results of the quiesce actions are recorded on the backup, whether the snapshots were taken or not, and on the
+// volumesnapshots.
+func (p *PVCBackupItemAction) createVolumeSnapshots(snapshots []*snapshotv1api.VolumeSnapshot, actions []quiesceAction, backup *velerov1api.Backup,
+	cfg config.Config, client kubernetes.Interface, snapshotClient snapshotter.SnapshotV1Interface) ([]*snapshotv1api.VolumeSnapshot, error) {
+	if len(actions) == 0 {
+		return p.createAndWait(snapshots, false, backup, cfg, client, snapshotClient)
+	}
+
+	restConfig, err := util.GetClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	backupClient, err := util.GetDynamicClient()
+	if err != nil {
+		return nil, err
+	}
+	q := &quiescer{
+		log: p.Log,
+		exec: func(pod *corev1api.Pod, container string, command []string, stdin io.Reader, stdout, stderr io.Writer) error {
+			return util.ExecInPod(client, restConfig, pod, container, command, stdin, stdout, stderr)
+		},
+		actions: actions,
+		timeout: cfg.QuiesceTimeout,
+	}
+	recordReport := func(err error) {
+		report := q.getReport()
+		for _, vs := range snapshots {
+			report.PVCs = append(report.PVCs, fmt.Sprintf("%s/%s", vs.Namespace, *vs.Spec.Source.PersistentVolumeClaimName))
+		}
+		if err != nil {
+			report.Error = err.Error()
+		}
+		if err := recordQuiesceReport(backupClient, backup, report); err != nil {
+			p.Log.WithError(err).Warnf("Failed to record quiesce hook results on backup %s/%s", backup.Namespace, backup.Name)
+		}
+	}
+
+	if err := q.freeze(); err != nil {
+		err = errors.WithMessage(err, "failed to quiesce applications")
+		recordReport(err)
+		return nil, err
+	}
+	created, err := p.createAndWait(snapshots, true, backup, cfg, client, snapshotClient)
+	q.thaw()
+	recordReport(err)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(q.getReport())
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for _, vs := range created {
+		patch, err := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"annotations": map[string]string{util.QuiesceHooksAnnotation: string(data)},
+			},
+		})
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if _, err := snapshotClient.VolumeSnapshots(vs.Namespace).Patch(context.TODO(), vs.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+			p.Log.WithError(err).Warnf("Failed to record quiesce hook results on volumesnapshot %s/%s", vs.Namespace, vs.Name)
+		}
+	}
+	return created, nil
+}
+
+// recordQuiesceReport appends the report to the reports recorded in the annotation of the backup. Once the reports grow
+// beyond maxBackupQuiesceHooks, the output of the commands is left out.
+func recordQuiesceReport(client dynamic.Interface, backup *velerov1api.Backup, report quiesceReport) error {
+	backups := client.Resource(velerov1api.SchemeGroupVersion.WithResource("backups")).Namespace(backup.Namespace)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		obj, err := backups.Get(context.TODO(), backup.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		annotations := obj.GetAnnotations()
+		reports := []quiesceReport{}
+		if val, ok := annotations[util.QuiesceHooksAnnotation]; ok {
+			if err := json.Unmarshal([]byte(val), &reports); err != nil {
+				return errors.Wrapf(err, "failed to parse %s annotation on backup %s/%s", util.QuiesceHooksAnnotation, backup.Namespace, backup.Name)
+			}
+		}
+
+		data, err := json.Marshal(append(reports, report))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if len(data) > maxBackupQuiesceHooks {
+			withoutOutput := report
+			withoutOutput.Hooks = make([]quiesceHookResult, len(report.Hooks))
+			for i, hook := range report.Hooks {
+				hook.Output = ""
+				withoutOutput.Hooks[i] = hook
+			}
+			if data, err = json.Marshal(append(reports, withoutOutput)); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[util.QuiesceHooksAnnotation] = string(data)
+		obj.SetAnnotations(annotations)
+		_, err = backups.Update(context.TODO(), obj, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// createAndWait creates the volumesnapshots, records them as created for the backup and, with wait, waits for the CSI driver
+// to cut their snapshots. If any of them fails, the volumesnapshots already created are deleted along with their snapshots.
+func (p *PVCBackupItemAction) createAndWait(snapshots []*snapshotv1api.VolumeSnapshot, wait bool, backup *velerov1api.Backup, cfg config.Config,
+	client kubernetes.Interface, snapshotClient snapshotter.SnapshotV1Interface) ([]*snapshotv1api.VolumeSnapshot, error) {
+	created := make([]*snapshotv1api.VolumeSnapshot, 0, len(snapshots))
+	deleteCreated := func() {
+		for _, vs := range created {
+			// The volumesnapshotcontents are deleted too, even when their class retains them, or the snapshots of the members
+			// already cut would be left behind in the storage provider.
+			if err := util.DeleteVolumeSnapshot(vs.Namespace, vs.Name, snapshotClient); err != nil {
+				p.Log.WithError(err).Errorf("Failed to delete volumesnapshot %s/%s", vs.Namespace, vs.Name)
+			}
+		}
+	}
+
+	for _, snapshot := range snapshots {
+		vs, err := p.createVolumeSnapshot(snapshot, backup, snapshotClient)
+		if err != nil {
+			deleteCreated()
+			return nil, err
+		}
+		created = append(created, vs)
+
+		// The record allows the volumesnapshot to be cleaned up should the backup fail.
+		if err := cleanup.RecordVolumeSnapshots(client.CoreV1(), backup.Namespace, backup, []*snapshotv1api.VolumeSnapshot{vs}); err != nil {
+			deleteCreated()
+			return nil, err
+		}
+	}
+
+	if wait {
+		// A snapshot is cut once its volumesnapshotcontent has a snapshot handle.
+		for _, vs := range created {
+			if _, err := util.GetVolumeSnapshotContentForVolumeSnapshot(vs, snapshotClient, p.Log, true, cfg.VolumeSnapshotTimeout); err != nil {
+				deleteCreated()
+				return nil, err
+			}
+		}
+	}
+	return created, nil
+}
+
+// createVolumeSnapshot creates the volumesnapshot, or returns the volumesnapshot with the same name created earlier for the
+// same backup, when the backup is retried.
+func (p *PVCBackupItemAction) createVolumeSnapshot(snapshot *snapshotv1api.VolumeSnapshot, backup *velerov1api.Backup,
+	snapshotClient snapshotter.SnapshotV1Interface) (*snapshotv1api.VolumeSnapshot, error) {
+	vs, err := snapshotClient.VolumeSnapshots(snapshot.Namespace).Create(context.TODO(), snapshot, metav1.CreateOptions{})
+	if err == nil {
+		p.Log.Infof("Created volumesnapshot %s", fmt.Sprintf("%s/%s", vs.Namespace, vs.Name))
+		return vs, nil
+	}
+	if !apierrors.IsAlreadyExists(err) {
+		return nil, errors.Wrapf(err, "error creating volume snapshot of PVC %s/%s", snapshot.Namespace, *snapshot.Spec.Source.PersistentVolumeClaimName)
+	}
+
+	vs, err = snapshotClient.VolumeSnapshots(snapshot.Namespace).Get(context.TODO(), snapshot.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting volumesnapshot %s/%s", snapshot.Namespace, snapshot.Name)
+	}
+	if !util.IsCreatedForBackup(&vs.ObjectMeta, backup) {
+		return nil, errors.Errorf("volumesnapshot %s/%s already exists and was not created for backup %s", vs.Namespace, vs.Name, backup.Name)
+	}
+	p.Log.Infof("Using volumesnapshot %s/%s created earlier for the backup", vs.Namespace, vs.Name)
+	return vs, nil
+}
@@ -0,0 +1,290 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	snapshotv1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	snapshotFake "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned/fake"
+	corev1api "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/config"
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/util"
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+)
+
+// fakeQuiesceExec stands in for running the quiesce commands in pods. It records the commands as "<command> <pod>", fails the
+// ones in failing, and calls before and after, when set, before and after recording a command.
+type fakeQuiesceExec struct {
+	lock    sync.Mutex
+	ran     []string
+	failing map[string]bool
+	before  func(command string)
+	after   func(command string)
+}
+
+func (e *fakeQuiesceExec) exec(pod *corev1api.Pod, container string, command []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	ran := strings.Join(command, " ") + " " + pod.Name
+	if e.before != nil {
+		e.before(ran)
+	}
+	e.lock.Lock()
+	e.ran = append(e.ran, ran)
+	e.lock.Unlock()
+	if e.after != nil {
+		e.after(ran)
+	}
+
+	fmt.Fprintf(stdout, "ran %s", ran)
+	if e.failing[ran] {
+		fmt.Fprint(stderr, "permission denied")
+		return errors.New("command terminated with exit code 1")
+	}
+	return nil
+}
+
+func (e *fakeQuiesceExec) commands() []string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return append([]string{}, e.ran...)
+}
+
+func newQuiesceActions(pods ...string) []quiesceAction {
+	actions := []quiesceAction{}
+	for _, name := range pods {
+		actions = append(actions, quiesceAction{
+			pod:       &corev1api.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "ns-1"}},
+			container: "app",
+			freeze:    []string{"freeze"},
+			thaw:      []string{"thaw"},
+		})
+	}
+	return actions
+}
+
+func TestQuiescer(t *testing.T) {
+	testCases := []struct {
+		name             string
+		failing          map[string]bool
+		expectError      bool
+		expectedCommands []string
+		expectedErrors   int
+	}{
+		{
+			name:             "applications are thawed in the reverse order of freezing",
+			expectedCommands: []string{"freeze pod-a", "freeze pod-b", "freeze pod-c", "thaw pod-c", "thaw pod-b", "thaw pod-a"},
+		},
+		{
+			name:             "the applications already frozen are thawed when a freeze command fails",
+			failing:          map[string]bool{"freeze pod-b": true},
+			expectError:      true,
+			expectedCommands: []string{"freeze pod-a", "freeze pod-b", "thaw pod-a"},
+			expectedErrors:   1,
+		},
+		{
+			name:             "thaw failures are recorded and the other applications thawed",
+			failing:          map[string]bool{"thaw pod-b": true},
+			expectedCommands: []string{"freeze pod-a", "freeze pod-b", "freeze pod-c", "thaw pod-c", "thaw pod-b", "thaw pod-a"},
+			expectedErrors:   1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			exec := &fakeQuiesceExec{failing: tc.failing}
+			q := &quiescer{log: logrus.New(), exec: exec.exec, actions: newQuiesceActions("pod-a", "pod-b", "pod-c"), timeout: time.Minute}
+
+			err := q.freeze()
+			if tc.expectError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			q.thaw()
+			// Thawing again, as the quiesce timeout would, does not run the thaw commands twice.
+			q.thaw()
+			assert.Equal(t, tc.expectedCommands, exec.commands())
+
+			report := q.getReport()
+			assert.False(t, report.TimeoutExpired)
+			require.Len(t, report.Hooks, len(tc.expectedCommands))
+			errs := 0
+			for i, hook := range report.Hooks {
+				assert.Equal(t, tc.expectedCommands[i], strings.Join(hook.Command, " ")+" "+hook.Pod)
+				assert.True(t, strings.HasPrefix(hook.Output, "ran "+tc.expectedCommands[i]))
+				if hook.Error != "" {
+					errs++
+					assert.Contains(t, hook.Error, "permission denied")
+				}
+			}
+			assert.Equal(t, tc.expectedErrors, errs)
+		})
+	}
+}
+
+func TestQuiescerTimeout(t *testing.T) {
+	exec := &fakeQuiesceExec{}
+	q := &quiescer{log: logrus.New(), exec: exec.exec, actions: newQuiesceActions("pod-a", "pod-b"), timeout: 10 * time.Millisecond}
+	require.NoError(t, q.freeze())
+
+	// The snapshots are not cut before the timeout expires, so the applications are thawed by the timer.
+	assert.Eventually(t, func() bool { return len(exec.commands()) == 4 }, 5*time.Second, 10*time.Millisecond)
+	q.thaw()
+	assert.Equal(t, []string{"freeze pod-a", "freeze pod-b", "thaw pod-b", "thaw pod-a"}, exec.commands())
+	assert.True(t, q.getReport().TimeoutExpired)
+}
+
+func TestQuiescerTimeoutWhileFreezing(t *testing.T) {
+	thawedA := make(chan struct{})
+	exec := &fakeQuiesceExec{}
+	exec.before = func(command string) {
+		if command == "freeze pod-b" {
+			// The freeze command of pod-b only completes once the timeout has thawed pod-a.
+			select {
+			case <-thawedA:
+			case <-time.After(5 * time.Second):
+			}
+		}
+	}
+	exec.after = func(command string) {
+		if command == "thaw pod-a" {
+			close(thawedA)
+		}
+	}
+	q := &quiescer{log: logrus.New(), exec: exec.exec, actions: newQuiesceActions("pod-a", "pod-b", "pod-c"), timeout: 10 * time.Millisecond}
+
+	assert.Error(t, q.freeze())
+	q.thaw()
+	// pod-b is thawed on its own as the timer had already thawed the others, and pod-c is never frozen.
+	assert.Equal(t, []string{"freeze pod-a", "thaw pod-a", "freeze pod-b", "thaw pod-b"}, exec.commands())
+	assert.True(t, q.getReport().TimeoutExpired)
+}
+
+func newUnstructuredBackup(t *testing.T, annotations map[string]string) (*velerov1api.Backup, runtime.Object) {
+	backup := &velerov1api.Backup{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: velerov1api.SchemeGroupVersion.String(),
+			Kind:       "Backup",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "backup-1",
+			Namespace:   "velero",
+			Annotations: annotations,
+		},
+	}
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(backup)
+	require.NoError(t, err)
+	return backup, &unstructured.Unstructured{Object: obj}
+}
+
+func TestRecordQuiesceReport(t *testing.T) {
+	backup, obj := newUnstructuredBackup(t, map[string]string{"velero.io/other": "kept"})
+	client := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), obj)
+
+	frozen := quiesceReport{
+		PVCs:  []string{"ns-1/pvc-1"},
+		Hooks: []quiesceHookResult{{Pod: "pod-a", Container: "app", Phase: freezePhase, Command: []string{"freeze"}, Output: "frozen"}},
+	}
+	failed := quiesceReport{
+		PVCs:  []string{"ns-1/pvc-2", "ns-1/pvc-3"},
+		Hooks: []quiesceHookResult{{Pod: "pod-b", Container: "app", Phase: freezePhase, Command: []string{"freeze"}, Error: "freeze command failed"}},
+		Error: "failed to quiesce applications: freeze command failed",
+	}
+	large := quiesceReport{
+		PVCs:  []string{"ns-1/pvc-4"},
+		Hooks: []quiesceHookResult{{Pod: "pod-c", Container: "app", Phase: thawPhase, Command: []string{"thaw"}, Output: strings.Repeat("x", maxBackupQuiesceHooks), Error: "thaw command failed"}},
+	}
+	for _, report := range []quiesceReport{frozen, failed, large} {
+		require.NoError(t, recordQuiesceReport(client, backup, report))
+	}
+
+	updated, err := util.GetBackup(client, backup.Namespace, backup.Name)
+	require.NoError(t, err)
+	assert.Equal(t, "kept", updated.Annotations["velero.io/other"])
+	reports := []quiesceReport{}
+	require.NoError(t, json.Unmarshal([]byte(updated.Annotations[util.QuiesceHooksAnnotation]), &reports))
+
+	// The output of the report that does not fit is left out, and its error kept.
+	large.Hooks[0].Output = ""
+	assert.Equal(t, []quiesceReport{frozen, failed, large}, reports)
+}
+
+func TestRecordQuiesceReportMissingBackup(t *testing.T) {
+	backup, _ := newUnstructuredBackup(t, nil)
+	_, other := newUnstructuredBackup(t, nil)
+	other.(*unstructured.Unstructured).SetName("backup-2")
+	client := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), other)
+
+	assert.Error(t, recordQuiesceReport(client, backup, quiesceReport{}))
+}
+
+func TestCreateAndWaitDeletesGroupOnFailure(t *testing.T) {
+	retain := &snapshotv1api.VolumeSnapshotContent{
+		ObjectMeta: metav1.ObjectMeta{Name: "vsc-1"},
+		Spec:       snapshotv1api.VolumeSnapshotContentSpec{DeletionPolicy: snapshotv1api.VolumeSnapshotContentRetain},
+	}
+	snapshotClient := snapshotFake.NewSimpleClientset(retain)
+	// The first member of the group is cut and bound to its retained content, and the second one cannot be created.
+	snapshotClient.PrependReactor("create", "volumesnapshots", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		vs := action.(k8stesting.CreateAction).GetObject().(*snapshotv1api.VolumeSnapshot)
+		if vs.Name == "vs-2" {
+			return true, nil, errors.New("admission webhook denied the request")
+		}
+		content := "vsc-1"
+		vs.Status = &snapshotv1api.VolumeSnapshotStatus{BoundVolumeSnapshotContentName: &content}
+		return false, nil, nil
+	})
+
+	newSnapshot := func(name, pvc string) *snapshotv1api.VolumeSnapshot {
+		return &snapshotv1api.VolumeSnapshot{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "ns-1"},
+			Spec:       snapshotv1api.VolumeSnapshotSpec{Source: snapshotv1api.VolumeSnapshotSource{PersistentVolumeClaimName: &pvc}},
+		}
+	}
+	backup := &velerov1api.Backup{ObjectMeta: metav1.ObjectMeta{Name: "backup-1", Namespace: "velero", UID: "uid-1"}}
+	p := &PVCBackupItemAction{Log: logrus.New()}
+
+	_, err := p.createAndWait([]*snapshotv1api.VolumeSnapshot{newSnapshot("vs-1", "pvc-1"), newSnapshot("vs-2", "pvc-2")}, false, backup,
+		config.Default(), fake.NewSimpleClientset(), snapshotClient.SnapshotV1())
+	assert.Error(t, err)
+
+	_, err = snapshotClient.SnapshotV1().VolumeSnapshots("ns-1").Get(context.TODO(), "vs-1", metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+	vsc, err := snapshotClient.SnapshotV1().VolumeSnapshotContents().Get(context.TODO(), "vsc-1", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, snapshotv1api.VolumeSnapshotContentDelete, vsc.Spec.DeletionPolicy)
+}
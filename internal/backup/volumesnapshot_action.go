@@ -18,18 +18,23 @@ package backup
 
 import (
 	"context"
-	"fmt"
+	"encoding/json"
+	"strconv"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 
-	snapshotv1beta1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1beta1"
+	snapshotv1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	snapshotter "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned/typed/volumesnapshot/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/config"
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/datamover"
 	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/util"
 	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
 	"github.com/vmware-tanzu/velero/pkg/kuberesource"
@@ -40,7 +45,8 @@ import (
 // VolumeSnapshotBackupItemAction is a backup item action plugin to backup
 // CSI VolumeSnapshot objects using Velero
 type VolumeSnapshotBackupItemAction struct {
-	Log logrus.FieldLogger
+	Log    logrus.FieldLogger
+	Config config.Config
 }
 
 // AppliesTo returns information indicating that the VolumeSnapshotBackupItemAction should be invoked to backup volumesnapshots.
@@ -57,16 +63,21 @@ func (p *VolumeSnapshotBackupItemAction) AppliesTo() (velero.ResourceSelector, e
 func (p *VolumeSnapshotBackupItemAction) Execute(item runtime.Unstructured, backup *velerov1api.Backup) (runtime.Unstructured, []velero.ResourceIdentifier, error) {
 	p.Log.Infof("Executing VolumeSnapshotBackupItemAction")
 
-	var vs snapshotv1beta1api.VolumeSnapshot
+	var vs snapshotv1api.VolumeSnapshot
 	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.UnstructuredContent(), &vs); err != nil {
 		return nil, nil, errors.WithStack(err)
 	}
 
-	_, snapshotClient, err := util.GetClients()
+	client, snapshotClient, err := util.GetClients()
 	if err != nil {
 		return nil, nil, errors.WithStack(err)
 	}
 
+	cfg, err := p.Config.ForBackup(backup)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	additionalItems := []velero.ResourceIdentifier{
 		{
 			GroupResource: kuberesource.VolumeSnapshotClasses,
@@ -85,16 +96,34 @@ func (p *VolumeSnapshotBackupItemAction) Execute(item runtime.Unstructured, back
 
 	// We want to await reconciliation of only those volumesnapshots created during the ongoing backup.
 	// For this we will wait only if the backup label exists on the volumesnapshot object and the
-	// backup name is the same as that of the value of the backupLabel
-	backupOngoing := vs.Labels[velerov1api.BackupNameLabel] == label.GetValidName(backup.Name)
+	// backup name is the same as that of the value of the backupLabel. Volumesnapshots created by newer versions of the plugin
+	// are matched by the UID of the backup instead.
+	backupOngoing := util.IsCreatedForBackup(&vs.ObjectMeta, backup)
 
 	p.Log.Infof("Getting VolumesnapshotContent for Volumesnapshot %s/%s", vs.Namespace, vs.Name)
 
-	vsc, err := util.GetVolumeSnapshotContentForVolumeSnapshot(&vs, snapshotClient.SnapshotV1beta1(), p.Log, backupOngoing)
+	vsc, err := util.GetVolumeSnapshotContentForVolumeSnapshot(&vs, snapshotClient, p.Log, backupOngoing, cfg.VolumeSnapshotTimeout)
 	if err != nil {
+		p.deleteFailedVolumeSnapshot(&vs, snapshotClient, err)
 		return nil, nil, errors.WithStack(err)
 	}
 
+	if vsc != nil && backupOngoing && cfg.ShouldWaitForReadyToUse(vsc.Spec.Driver) {
+		p.Log.Infof("Waiting for volumesnapshotcontent %s of volumesnapshot %s/%s to be ready to use", vsc.Name, vs.Namespace, vs.Name)
+		vsc, err = util.WaitForVolumeSnapshotContentReadyToUse(vsc.Name, snapshotClient, p.Log, cfg.ReadyToUseTimeout)
+		if err != nil {
+			p.deleteFailedVolumeSnapshot(&vs, snapshotClient, err)
+			return nil, nil, errors.WithStack(err)
+		}
+	}
+
+	// Volumesnapshots created by Velero are deleted along with the backup that created them, unless other backups include them.
+	if util.IsCreatedForAnyBackup(&vs.ObjectMeta) {
+		if err := p.recordBackupReference(&vs, vsc, backup, snapshotClient); err != nil {
+			return nil, nil, err
+		}
+	}
+
 	if vsc != nil {
 		// when we are backing up volumesnapshots created outside of velero, we will not
 		// await volumesnapshot reconciliation and in this case GetVolumeSnapshotContentForVolumeSnapshot
@@ -108,6 +137,11 @@ func (p *VolumeSnapshotBackupItemAction) Execute(item runtime.Unstructured, back
 		vals := map[string]string{
 			util.CSIVSCDeletionPolicy: string(vsc.Spec.DeletionPolicy),
 		}
+		if util.IsVolumeSnapshotContentHasDeleteSecret(vsc) {
+			// Capture the snapshot deletion secret so that the static volumesnapshotcontent created on restore can delete the snapshot.
+			vals[util.CSIDeleteSnapshotSecretName] = vsc.Annotations[util.DeletionSecretNameAnnotation]
+			vals[util.CSIDeleteSnapshotSecretNamespace] = vsc.Annotations[util.DeletionSecretNamespaceAnnotation]
+		}
 
 		if vsc.Status != nil {
 			if vsc.Status.SnapshotHandle != nil {
@@ -119,7 +153,17 @@ func (p *VolumeSnapshotBackupItemAction) Execute(item runtime.Unstructured, back
 			if vsc.Status.RestoreSize != nil {
 				vals[util.VolumeSnapshotRestoreSize] = resource.NewQuantity(*vsc.Status.RestoreSize, resource.BinarySI).String()
 			}
+			// Record whether the snapshot was ready to use so that restores can refuse snapshots that were not.
+			vals[util.VolumeSnapshotReadyToUseAnnotation] = strconv.FormatBool(vsc.Status.ReadyToUse != nil && *vsc.Status.ReadyToUse)
+		}
+		if backupOngoing && cfg.DataMover {
+			manifestKey, err := p.moveData(&vs, vsc, backup, cfg, client.CoreV1())
+			if err != nil {
+				return nil, nil, err
+			}
+			vals[util.DataMoverManifestAnnotation] = manifestKey
 		}
+
 		// save newly applied annotations into the backed-up volumesnapshot item
 		util.AddAnnotations(&vs.ObjectMeta, vals)
 
@@ -135,9 +179,18 @@ func (p *VolumeSnapshotBackupItemAction) Execute(item runtime.Unstructured, back
 			// as in the storage provider. To avoid piling up of such orphaned resources, we will want to discover and delete the dynamically created
 			// volumesnapshotcontents. We do that by adding the "velero.io/backup-name" label on the volumesnapshotcontent.
 			// Further, we want to add this label only on volumesnapshotcontents that were created during an ongoing velero backup.
+			// The full name and the UID of the backup are recorded in annotations along with the label.
 
-			pb := []byte(fmt.Sprintf(`{"metadata":{"labels":{"%s":"%s"}}}`, velerov1api.BackupNameLabel, label.GetValidName(backup.Name)))
-			if _, vscPatchError := snapshotClient.SnapshotV1beta1().VolumeSnapshotContents().Patch(context.TODO(), vsc.Name, types.MergePatchType, pb, metav1.PatchOptions{}); vscPatchError != nil {
+			pb, err := json.Marshal(map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"labels":      map[string]string{velerov1api.BackupNameLabel: label.GetValidName(backup.Name)},
+					"annotations": util.BackupOwnerAnnotations(backup),
+				},
+			})
+			if err != nil {
+				return nil, nil, errors.WithStack(err)
+			}
+			if _, vscPatchError := snapshotClient.VolumeSnapshotContents().Patch(context.TODO(), vsc.Name, types.MergePatchType, pb, metav1.PatchOptions{}); vscPatchError != nil {
 				p.Log.Warnf("Failed to patch volumesnapshotcontent %s: %v", vsc.Name, vscPatchError)
 			}
 		}
@@ -155,3 +208,61 @@ func (p *VolumeSnapshotBackupItemAction) Execute(item runtime.Unstructured, back
 
 	return &unstructured.Unstructured{Object: vsMap}, additionalItems, nil
 }
+
+// recordBackupReference records the backup as referencing the volumesnapshot and its volumesnapshotcontent, so that deleting
+// another backup that includes them does not delete their snapshot.
+func (p *VolumeSnapshotBackupItemAction) recordBackupReference(vs *snapshotv1api.VolumeSnapshot, vsc *snapshotv1api.VolumeSnapshotContent,
+	backup *velerov1api.Backup, snapshotClient snapshotter.SnapshotV1Interface) error {
+	if err := util.AddVolumeSnapshotReference(vs.Namespace, vs.Name, backup, snapshotClient); err != nil {
+		return errors.Wrapf(err, "failed to record backup %s as referencing volumesnapshot %s/%s", backup.Name, vs.Namespace, vs.Name)
+	}
+	if vsc != nil {
+		if err := util.AddVolumeSnapshotContentReference(vsc.Name, backup, snapshotClient); err != nil {
+			return errors.Wrapf(err, "failed to record backup %s as referencing volumesnapshotcontent %s", backup.Name, vsc.Name)
+		}
+	}
+	return nil
+}
+
+// deleteFailedVolumeSnapshot deletes the volumesnapshot created by the ongoing backup when err reports that the CSI driver
+// failed to take the snapshot, as the volumesnapshot can never be used. Its volumesnapshotcontent, and any partial snapshot
+// the CSI driver took, are deleted with it even when they would be retained.
+func (p *VolumeSnapshotBackupItemAction) deleteFailedVolumeSnapshot(vs *snapshotv1api.VolumeSnapshot, snapshotClient snapshotter.SnapshotV1Interface, err error) {
+	if !util.IsSnapshotError(err) {
+		return
+	}
+	p.Log.WithError(err).Errorf("Deleting volumesnapshot %s/%s that the CSI driver failed to take", vs.Namespace, vs.Name)
+	if delErr := util.DeleteVolumeSnapshot(vs.Namespace, vs.Name, snapshotClient); delErr != nil {
+		p.Log.WithError(delErr).Errorf("Failed to delete volumesnapshot %s/%s", vs.Namespace, vs.Name)
+	}
+}
+
+// moveData copies the data of the volumesnapshot to the data mover repository in the backup storage location of the
+// backup and returns the key of the manifest of the copy.
+func (p *VolumeSnapshotBackupItemAction) moveData(vs *snapshotv1api.VolumeSnapshot, vsc *snapshotv1api.VolumeSnapshotContent, backup *velerov1api.Backup,
+	cfg config.Config, corev1 corev1client.PersistentVolumeClaimsGetter) (string, error) {
+	if vs.Spec.Source.PersistentVolumeClaimName == nil {
+		return "", errors.Errorf("volumesnapshot %s/%s has no source PVC to copy data from", vs.Namespace, vs.Name)
+	}
+	pvc, err := corev1.PersistentVolumeClaims(vs.Namespace).Get(context.TODO(), *vs.Spec.Source.PersistentVolumeClaimName, metav1.GetOptions{})
+	if err != nil {
+		return "", errors.Wrapf(err, "error getting source PVC of volumesnapshot %s/%s", vs.Namespace, vs.Name)
+	}
+
+	var restoreSize *resource.Quantity
+	if vsc.Status != nil && vsc.Status.RestoreSize != nil {
+		restoreSize = resource.NewQuantity(*vsc.Status.RestoreSize, resource.BinarySI)
+	}
+
+	mover, err := datamover.NewMover(cfg, backup.Namespace, backup.Spec.StorageLocation, p.Log)
+	if err != nil {
+		return "", err
+	}
+	defer mover.Close()
+	manifestKey := datamover.ManifestKey(backup.Name, pvc.Namespace, pvc.Name)
+	p.Log.Infof("Copying data of volumesnapshot %s/%s to the data mover object store", vs.Namespace, vs.Name)
+	if _, err := mover.BackupVolumeSnapshot(vs, pvc, restoreSize, manifestKey); err != nil {
+		return "", err
+	}
+	return manifestKey, nil
+}
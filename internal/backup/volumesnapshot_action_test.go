@@ -0,0 +1,83 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backup
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	snapshotv1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	snapshotFake "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned/fake"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/util"
+)
+
+func TestDeleteFailedVolumeSnapshot(t *testing.T) {
+	testCases := []struct {
+		name                   string
+		err                    error
+		expectDeleted          bool
+		expectedDeletionPolicy snapshotv1api.DeletionPolicy
+	}{
+		{
+			name:                   "the retained content of a snapshot the CSI driver failed to take is deleted",
+			err:                    errors.WithStack(&util.SnapshotError{Object: "volumesnapshotcontent vsc-1", Message: "snapshot failed"}),
+			expectDeleted:          true,
+			expectedDeletionPolicy: snapshotv1api.VolumeSnapshotContentDelete,
+		},
+		{
+			name:                   "snapshots that timed out are kept",
+			err:                    errors.New("timed out waiting for volumesnapshot"),
+			expectedDeletionPolicy: snapshotv1api.VolumeSnapshotContentRetain,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			content := "vsc-1"
+			vs := &snapshotv1api.VolumeSnapshot{
+				ObjectMeta: metav1.ObjectMeta{Name: "vs-1", Namespace: "ns-1"},
+				Status:     &snapshotv1api.VolumeSnapshotStatus{BoundVolumeSnapshotContentName: &content},
+			}
+			vsc := &snapshotv1api.VolumeSnapshotContent{
+				ObjectMeta: metav1.ObjectMeta{Name: content},
+				Spec:       snapshotv1api.VolumeSnapshotContentSpec{DeletionPolicy: snapshotv1api.VolumeSnapshotContentRetain},
+			}
+			snapshotClient := snapshotFake.NewSimpleClientset(vs, vsc).SnapshotV1()
+			p := &VolumeSnapshotBackupItemAction{Log: logrus.New()}
+
+			p.deleteFailedVolumeSnapshot(vs, snapshotClient, tc.err)
+
+			_, err := snapshotClient.VolumeSnapshots("ns-1").Get(context.TODO(), "vs-1", metav1.GetOptions{})
+			if tc.expectDeleted {
+				assert.True(t, apierrors.IsNotFound(err))
+			} else {
+				assert.NoError(t, err)
+			}
+			liveVSC, err := snapshotClient.VolumeSnapshotContents().Get(context.TODO(), content, metav1.GetOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedDeletionPolicy, liveVSC.Spec.DeletionPolicy)
+		})
+	}
+}
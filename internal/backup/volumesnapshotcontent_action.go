@@ -20,7 +20,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 
-	snapshotv1beta1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1beta1"
+	snapshotv1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 
@@ -49,7 +49,7 @@ func (p *VolumeSnapshotContentBackupItemAction) AppliesTo() (velero.ResourceSele
 func (p *VolumeSnapshotContentBackupItemAction) Execute(item runtime.Unstructured, backup *velerov1api.Backup) (runtime.Unstructured, []velero.ResourceIdentifier, error) {
 	p.Log.Infof("Executing VolumeSnapshotContentBackupItemAction")
 
-	var snapCont snapshotv1beta1api.VolumeSnapshotContent
+	var snapCont snapshotv1api.VolumeSnapshotContent
 	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.UnstructuredContent(), &snapCont); err != nil {
 		return nil, nil, errors.WithStack(err)
 	}
@@ -61,8 +61,8 @@ func (p *VolumeSnapshotContentBackupItemAction) Execute(item runtime.Unstructure
 		// TODO: add GroupResource for secret into kuberesource
 		additionalItems = append(additionalItems, velero.ResourceIdentifier{
 			GroupResource: schema.GroupResource{Group: "", Resource: "secrets"},
-			Name:          snapCont.Annotations[util.PrefixedSnapshotterSecretNameKey],
-			Namespace:     snapCont.Annotations[util.PrefixedSnapshotterSecretNamespaceKey],
+			Name:          snapCont.Annotations[util.DeletionSecretNameAnnotation],
+			Namespace:     snapCont.Annotations[util.DeletionSecretNamespaceAnnotation],
 		})
 	}
 
@@ -0,0 +1,121 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cleanup
+
+import (
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/dynamic"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/config"
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/datamover"
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/util"
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+)
+
+// ChunkCollector deletes the data mover chunks that no manifest references. Deleting a backup deletes the manifests of the data
+// copied from its volumesnapshots, but keeps their chunks, as the data of other backups may share them.
+type ChunkCollector struct {
+	Log logrus.FieldLogger
+	// Namespace is the Velero namespace, which holds the backups and backup storage locations.
+	Namespace    string
+	BackupClient dynamic.Interface
+	Secrets      corev1client.SecretsGetter
+	ObjectStores datamover.ObjectStoreGetter
+	// Config is the plugin configuration. When it sets DataMoverObjectStorePath, the repository in that directory is collected
+	// instead of the repositories in the backup storage locations.
+	Config config.Config
+	// DryRun reports the unreferenced chunks without deleting them.
+	DryRun bool
+}
+
+// Run deletes the unreferenced chunks, or only reports them with DryRun, and returns how many it found. A repository is left
+// alone while a backup to it is in progress, and the lock objects of the repository keep the garbage from being collected
+// while data is uploaded to it by a backup that started after the backups were listed.
+func (c *ChunkCollector) Run() (int, error) {
+	backups, err := util.ListBackups(c.BackupClient, c.Namespace)
+	if err != nil {
+		return 0, errors.Wrapf(err, "error listing backups in namespace %s", c.Namespace)
+	}
+
+	if c.Config.DataMoverObjectStorePath != "" {
+		if name := inProgressBackup(backups, ""); name != "" {
+			c.Log.Infof("Not collecting data mover chunks, backup %s is in progress", name)
+			return 0, nil
+		}
+		repository, closeRepository, err := datamover.OpenRepository(c.Config, c.Namespace, "", c.Log)
+		if err != nil {
+			return 0, err
+		}
+		defer closeRepository()
+		return repository.CollectGarbage(c.DryRun, c.Log)
+	}
+
+	locations, err := util.ListBackupStorageLocations(c.BackupClient, c.Namespace)
+	if err != nil {
+		return 0, errors.Wrapf(err, "error listing backup storage locations in namespace %s", c.Namespace)
+	}
+	unreferenced := 0
+	var errs []error
+	for i := range locations {
+		location := &locations[i]
+		log := c.Log.WithField("backupStorageLocation", location.Name)
+		if location.Spec.AccessMode == velerov1api.BackupStorageLocationAccessModeReadOnly {
+			log.Info("Not collecting data mover chunks in read-only backup storage location")
+			continue
+		}
+		if name := inProgressBackup(backups, location.Name); name != "" {
+			log.Infof("Not collecting data mover chunks, backup %s is in progress", name)
+			continue
+		}
+
+		repository, removeCredentials, err := datamover.NewRepositoryForLocation(location, c.ObjectStores, c.Secrets)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		n, err := repository.CollectGarbage(c.DryRun, log)
+		removeCredentials()
+		unreferenced += n
+		if err != nil {
+			errs = append(errs, errors.WithMessagef(err, "error collecting data mover chunks in backup storage location %s", location.Name))
+		}
+	}
+	return unreferenced, kerrors.NewAggregate(errs)
+}
+
+// inProgressBackup returns the name of a backup to the backup storage location that has not finished, or "" if there is none.
+// Backups abandoned while in progress are left out. An empty location matches the backups to every location.
+func inProgressBackup(backups []velerov1api.Backup, location string) string {
+	for i, backup := range backups {
+		if location != "" && backup.Spec.StorageLocation != location {
+			continue
+		}
+		switch backup.Status.Phase {
+		case "", velerov1api.BackupPhaseNew:
+			return backup.Name
+		case velerov1api.BackupPhaseInProgress:
+			if startedLater(&backups[i], backups) == "" {
+				return backup.Name
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,201 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cleanup
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/config"
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/datamover"
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+)
+
+const testBucket = "velero-bucket"
+
+// fileSystemObjectStores stands in for the object store plugins, with the root directory of the filesystem object store in the
+// config of the backup storage locations.
+type fileSystemObjectStores struct{}
+
+func (fileSystemObjectStores) GetObjectStore(provider string) (velero.ObjectStore, error) {
+	return datamover.NewFileSystemObjectStore(), nil
+}
+
+func newLocation(t *testing.T, name, root string, accessMode velerov1api.BackupStorageLocationAccessMode) (*velerov1api.BackupStorageLocation, runtime.Object) {
+	location := &velerov1api.BackupStorageLocation{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: velerov1api.SchemeGroupVersion.String(),
+			Kind:       "BackupStorageLocation",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "velero",
+		},
+		Spec: velerov1api.BackupStorageLocationSpec{
+			Provider:    "filesystem",
+			Config:      map[string]string{datamover.RootConfigKey: root},
+			StorageType: velerov1api.StorageType{ObjectStorage: &velerov1api.ObjectStorageLocation{Bucket: testBucket, Prefix: "velero"}},
+			AccessMode:  accessMode,
+		},
+	}
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(location)
+	require.Nil(t, err)
+	return location, &unstructured.Unstructured{Object: obj}
+}
+
+func newBackupToLocation(t *testing.T, name, location string, phase velerov1api.BackupPhase) runtime.Object {
+	backup := &velerov1api.Backup{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: velerov1api.SchemeGroupVersion.String(),
+			Kind:       "Backup",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "velero",
+		},
+		Spec:   velerov1api.BackupSpec{StorageLocation: location},
+		Status: velerov1api.BackupStatus{Phase: phase},
+	}
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(backup)
+	require.Nil(t, err)
+	return &unstructured.Unstructured{Object: obj}
+}
+
+// fillRepository stores data referenced by a manifest and data referenced by none in the repository.
+func fillRepository(t *testing.T, repository *datamover.Repository) *datamover.Manifest {
+	manifest, err := repository.Upload(bytes.NewReader([]byte("referenced data")), datamover.FormatTar, logrus.New())
+	require.Nil(t, err)
+	require.Nil(t, repository.PutManifest(datamover.ManifestKey("backup-1", "ns-1", "pvc-1"), manifest))
+	_, err = repository.Upload(bytes.NewReader([]byte("unreferenced data")), datamover.FormatTar, logrus.New())
+	require.Nil(t, err)
+	return manifest
+}
+
+func countStoredChunks(t *testing.T, root, bucket string) int {
+	store := datamover.NewFileSystemObjectStore()
+	require.Nil(t, store.Init(map[string]string{datamover.RootConfigKey: root}))
+	keys, err := store.ListObjects(bucket, "")
+	require.Nil(t, err)
+	chunks := 0
+	for _, key := range keys {
+		if strings.Contains(key, "chunks/") {
+			chunks++
+		}
+	}
+	return chunks
+}
+
+func TestChunkCollector(t *testing.T) {
+	testCases := []struct {
+		name                 string
+		accessMode           velerov1api.BackupStorageLocationAccessMode
+		backupPhase          velerov1api.BackupPhase
+		dryRun               bool
+		expectedUnreferenced int
+		expectedChunks       int
+	}{
+		{
+			name:                 "unreferenced chunks are deleted",
+			backupPhase:          velerov1api.BackupPhaseCompleted,
+			expectedUnreferenced: 1,
+			expectedChunks:       1,
+		},
+		{
+			name:                 "unreferenced chunks are only reported in dry-run mode",
+			backupPhase:          velerov1api.BackupPhaseCompleted,
+			dryRun:               true,
+			expectedUnreferenced: 1,
+			expectedChunks:       2,
+		},
+		{
+			name:           "chunks of a location with a backup in progress are kept",
+			backupPhase:    velerov1api.BackupPhaseInProgress,
+			expectedChunks: 2,
+		},
+		{
+			name:           "chunks of a read-only location are kept",
+			accessMode:     velerov1api.BackupStorageLocationAccessModeReadOnly,
+			backupPhase:    velerov1api.BackupPhaseCompleted,
+			expectedChunks: 2,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			root, err := ioutil.TempDir("", "chunks")
+			require.Nil(t, err)
+			defer os.RemoveAll(root)
+
+			location, locationObj := newLocation(t, "default", root, tc.accessMode)
+			repository, _, err := datamover.NewRepositoryForLocation(location, fileSystemObjectStores{}, nil)
+			require.Nil(t, err)
+			manifest := fillRepository(t, repository)
+
+			collector := &ChunkCollector{
+				Log:          logrus.New(),
+				Namespace:    "velero",
+				BackupClient: dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), locationObj, newBackupToLocation(t, "backup-1", "default", tc.backupPhase)),
+				ObjectStores: fileSystemObjectStores{},
+				Config:       config.Default(),
+				DryRun:       tc.dryRun,
+			}
+			unreferenced, err := collector.Run()
+			require.Nil(t, err)
+			assert.Equal(t, tc.expectedUnreferenced, unreferenced)
+			assert.Equal(t, tc.expectedChunks, countStoredChunks(t, root, testBucket))
+			assert.Nil(t, repository.Download(manifest, ioutil.Discard))
+		})
+	}
+}
+
+func TestChunkCollectorObjectStorePath(t *testing.T) {
+	root, err := ioutil.TempDir("", "chunks")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	cfg := config.Default()
+	cfg.DataMoverObjectStorePath = root
+	repository, closeRepository, err := datamover.OpenRepository(cfg, "velero", "", logrus.New())
+	require.Nil(t, err)
+	defer closeRepository()
+	manifest := fillRepository(t, repository)
+
+	collector := &ChunkCollector{
+		Log:          logrus.New(),
+		Namespace:    "velero",
+		BackupClient: dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), newBackupToLocation(t, "backup-1", "default", velerov1api.BackupPhaseCompleted)),
+		Config:       cfg,
+	}
+	unreferenced, err := collector.Run()
+	require.Nil(t, err)
+	assert.Equal(t, 1, unreferenced)
+	assert.Equal(t, 1, countStoredChunks(t, root, datamover.Bucket))
+	assert.Nil(t, repository.Download(manifest, ioutil.Discard))
+}
@@ -0,0 +1,198 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cleanup
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	snapshotter "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned/typed/volumesnapshot/v1"
+	corev1api "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/dynamic"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/util"
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+)
+
+// FailedBackupCleaner deletes the volumesnapshots recorded as created for backups that failed or were abandoned before reaching
+// object storage. No backup that can be restored refers to them, and Velero does not delete them when such backups are deleted.
+// The volumesnapshotcontents and the snapshots in the storage provider are deleted along with them.
+type FailedBackupCleaner struct {
+	Log logrus.FieldLogger
+	// Namespace is the Velero namespace, which holds the backups and the volumesnapshot records.
+	Namespace       string
+	ConfigMapClient corev1client.ConfigMapsGetter
+	BackupClient    dynamic.Interface
+	SnapshotClient  snapshotter.SnapshotV1Interface
+	// DryRun reports the volumesnapshots of failed and abandoned backups without deleting them.
+	DryRun bool
+}
+
+// Run processes the records of the volumesnapshots created for backups. The volumesnapshots of failed and abandoned backups are
+// deleted. The records of backups that reached object storage, and of backups that no longer exist, are dropped as Velero takes
+// care of their volumesnapshots.
+func (c *FailedBackupCleaner) Run() error {
+	list, err := c.ConfigMapClient.ConfigMaps(c.Namespace).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=true", util.VolumeSnapshotRecordLabel),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "error listing volumesnapshot records in namespace %s", c.Namespace)
+	}
+	if len(list.Items) == 0 {
+		return nil
+	}
+	backups, err := util.ListBackups(c.BackupClient, c.Namespace)
+	if err != nil {
+		return errors.Wrapf(err, "error listing backups in namespace %s", c.Namespace)
+	}
+
+	var errs []error
+	for i := range list.Items {
+		if err := c.processRecord(&list.Items[i], backups); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return kerrors.NewAggregate(errs)
+}
+
+func (c *FailedBackupCleaner) processRecord(record *corev1api.ConfigMap, backups []velerov1api.Backup) error {
+	backupName := record.Annotations[velerov1api.BackupNameLabel]
+	if backupName == "" {
+		return nil
+	}
+	log := c.Log.WithField("backup", backupName)
+
+	var backup *velerov1api.Backup
+	for i := range backups {
+		if backups[i].Name == backupName {
+			backup = &backups[i]
+		}
+	}
+	if backup == nil {
+		log.Infof("Backup no longer exists, deleting volumesnapshot record %s", record.Name)
+		return c.deleteRecord(record)
+	}
+	if uid, ok := record.Annotations[util.BackupUIDAnnotation]; ok && uid != string(backup.UID) {
+		log.Infof("Backup was recreated since, deleting volumesnapshot record %s", record.Name)
+		return c.deleteRecord(record)
+	}
+
+	switch backup.Status.Phase {
+	case velerov1api.BackupPhaseCompleted, velerov1api.BackupPhasePartiallyFailed, velerov1api.BackupPhaseFailedValidation:
+		log.Debugf("Backup is %s, deleting volumesnapshot record %s", backup.Status.Phase, record.Name)
+		return c.deleteRecord(record)
+	case velerov1api.BackupPhaseFailed:
+		log.Info("Backup failed, deleting the volumesnapshots created for it")
+	case velerov1api.BackupPhaseInProgress:
+		later := startedLater(backup, backups)
+		if later == "" {
+			return nil
+		}
+		log.Infof("Backup was abandoned while in progress, as backup %s started after it, deleting the volumesnapshots created for it", later)
+	default:
+		return nil
+	}
+	if c.DryRun {
+		log.Infof("Not deleting the volumesnapshots recorded in %s in dry-run mode", record.Name)
+		return nil
+	}
+
+	entries, err := getRecordEntries(record)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, entry := range entries {
+		if err := c.deleteVolumeSnapshot(entry.namespace, entry.name, backup, log); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		delete(record.Data, entry.key)
+	}
+	if len(errs) > 0 {
+		// Keep the entries that could not be deleted, to retry them on the next run.
+		if _, err := c.ConfigMapClient.ConfigMaps(record.Namespace).Update(context.TODO(), record, metav1.UpdateOptions{}); err != nil {
+			errs = append(errs, errors.Wrapf(err, "error updating volumesnapshot record %s", record.Name))
+		}
+		return kerrors.NewAggregate(errs)
+	}
+	return c.deleteRecord(record)
+}
+
+// deleteVolumeSnapshot deletes the volumesnapshot, if it still belongs to the backup, after setting the DeletionPolicy of its
+// volumesnapshotcontent to Delete, so that the snapshot in the storage provider is deleted as well.
+func (c *FailedBackupCleaner) deleteVolumeSnapshot(namespace, name string, backup *velerov1api.Backup, log logrus.FieldLogger) error {
+	vs, err := c.SnapshotClient.VolumeSnapshots(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "error getting volumesnapshot %s/%s", namespace, name)
+	}
+	if !util.IsCreatedForBackup(&vs.ObjectMeta, backup) {
+		log.Warnf("Volumesnapshot %s/%s no longer belongs to the backup, not deleting it", namespace, name)
+		return nil
+	}
+	if util.HasLegalHold(&vs.ObjectMeta) {
+		// The volumesnapshot stays recorded, to be deleted once the legal hold is removed.
+		return errors.Errorf("volumesnapshot %s/%s is under legal hold, not deleting it", namespace, name)
+	}
+
+	if vs.Status != nil && vs.Status.BoundVolumeSnapshotContentName != nil {
+		err := util.SetVolumeSnapshotContentDeletionPolicy(*vs.Status.BoundVolumeSnapshotContentName, c.SnapshotClient)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "failed to patch DeletionPolicy of volumesnapshotcontent %s", *vs.Status.BoundVolumeSnapshotContentName)
+		}
+	}
+	if err := c.SnapshotClient.VolumeSnapshots(namespace).Delete(context.TODO(), name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrapf(err, "error deleting volumesnapshot %s/%s", namespace, name)
+	}
+	log.Infof("Deleted volumesnapshot %s/%s", namespace, name)
+	return nil
+}
+
+// startedLater returns the name of a backup that started after the backup, or "" if there is none. Velero processes one backup
+// at a time, so a backup that is still in progress once another one started was abandoned when Velero restarted.
+func startedLater(backup *velerov1api.Backup, backups []velerov1api.Backup) string {
+	for _, other := range backups {
+		if other.Name == backup.Name || other.Status.StartTimestamp == nil {
+			continue
+		}
+		if backup.Status.StartTimestamp == nil || backup.Status.StartTimestamp.Before(other.Status.StartTimestamp) {
+			return other.Name
+		}
+	}
+	return ""
+}
+
+func (c *FailedBackupCleaner) deleteRecord(record *corev1api.ConfigMap) error {
+	if c.DryRun {
+		return nil
+	}
+	err := c.ConfigMapClient.ConfigMaps(record.Namespace).Delete(context.TODO(), record.Name, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrapf(err, "error deleting volumesnapshot record %s", record.Name)
+	}
+	return nil
+}
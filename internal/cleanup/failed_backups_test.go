@@ -0,0 +1,237 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cleanup
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	snapshotv1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	snapshotFake "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned/fake"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/util"
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+)
+
+func newBackup(t *testing.T, name string, phase velerov1api.BackupPhase) runtime.Object {
+	backup := &velerov1api.Backup{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: velerov1api.SchemeGroupVersion.String(),
+			Kind:       "Backup",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "velero",
+		},
+		Status: velerov1api.BackupStatus{Phase: phase},
+	}
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(backup)
+	require.Nil(t, err)
+	return &unstructured.Unstructured{Object: obj}
+}
+
+// startedAt sets the start time of the backup, in minutes after an arbitrary time.
+func startedAt(t *testing.T, backup runtime.Object, minutes int) runtime.Object {
+	start := time.Date(2021, 6, 1, 0, minutes, 0, 0, time.UTC).Format(time.RFC3339)
+	require.Nil(t, unstructured.SetNestedField(backup.(*unstructured.Unstructured).Object, start, "status", "startTimestamp"))
+	return backup
+}
+
+func newVolumeSnapshot(name, backupName, vscName string) *snapshotv1api.VolumeSnapshot {
+	return &snapshotv1api.VolumeSnapshot{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "app",
+			Labels:    map[string]string{velerov1api.BackupNameLabel: backupName},
+		},
+		Status: &snapshotv1api.VolumeSnapshotStatus{
+			BoundVolumeSnapshotContentName: &vscName,
+		},
+	}
+}
+
+func newVolumeSnapshotContent(name string) *snapshotv1api.VolumeSnapshotContent {
+	return &snapshotv1api.VolumeSnapshotContent{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: snapshotv1api.VolumeSnapshotContentSpec{
+			DeletionPolicy: snapshotv1api.VolumeSnapshotContentRetain,
+		},
+	}
+}
+
+func TestFailedBackupCleaner(t *testing.T) {
+	testCases := []struct {
+		name           string
+		backup         runtime.Object
+		otherBackup    runtime.Object
+		dryRun         bool
+		expectDeleted  bool
+		expectRecorded bool
+	}{
+		{
+			name:          "failed backup",
+			backup:        newBackup(t, "backup-1", velerov1api.BackupPhaseFailed),
+			expectDeleted: true,
+		},
+		{
+			name:           "failed backup in dry-run mode",
+			backup:         newBackup(t, "backup-1", velerov1api.BackupPhaseFailed),
+			dryRun:         true,
+			expectRecorded: true,
+		},
+		{
+			name:          "backup abandoned while in progress",
+			backup:        startedAt(t, newBackup(t, "backup-1", velerov1api.BackupPhaseInProgress), 0),
+			otherBackup:   startedAt(t, newBackup(t, "backup-2", velerov1api.BackupPhaseInProgress), 10),
+			expectDeleted: true,
+		},
+		{
+			name:           "backup in progress",
+			backup:         startedAt(t, newBackup(t, "backup-1", velerov1api.BackupPhaseInProgress), 10),
+			otherBackup:    startedAt(t, newBackup(t, "backup-2", velerov1api.BackupPhaseCompleted), 0),
+			expectRecorded: true,
+		},
+		{
+			name:   "completed backup",
+			backup: newBackup(t, "backup-1", velerov1api.BackupPhaseCompleted),
+		},
+		{
+			name:   "partially failed backup",
+			backup: newBackup(t, "backup-1", velerov1api.BackupPhasePartiallyFailed),
+		},
+		{
+			name:        "backup that no longer exists",
+			otherBackup: newBackup(t, "backup-2", velerov1api.BackupPhaseCompleted),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			kubeClient := fake.NewSimpleClientset()
+			snapshotClient := snapshotFake.NewSimpleClientset(
+				newVolumeSnapshot("vs-1", "backup-1", "vsc-1"),
+				newVolumeSnapshotContent("vsc-1"),
+				// The volumesnapshot was recorded for the backup but belongs to another backup now.
+				newVolumeSnapshot("vs-2", "backup-3", "vsc-2"),
+				newVolumeSnapshotContent("vsc-2"),
+			)
+			backups := []runtime.Object{}
+			if tc.backup != nil {
+				backups = append(backups, tc.backup)
+			}
+			if tc.otherBackup != nil {
+				backups = append(backups, tc.otherBackup)
+			}
+			dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), backups...)
+
+			backup := &velerov1api.Backup{ObjectMeta: metav1.ObjectMeta{Name: "backup-1", Namespace: "velero"}}
+			vs1, err := snapshotClient.SnapshotV1().VolumeSnapshots("app").Get(context.TODO(), "vs-1", metav1.GetOptions{})
+			require.Nil(t, err)
+			vs2, err := snapshotClient.SnapshotV1().VolumeSnapshots("app").Get(context.TODO(), "vs-2", metav1.GetOptions{})
+			require.Nil(t, err)
+			require.Nil(t, RecordVolumeSnapshots(kubeClient.CoreV1(), "velero", backup, []*snapshotv1api.VolumeSnapshot{vs1}))
+			require.Nil(t, RecordVolumeSnapshots(kubeClient.CoreV1(), "velero", backup, []*snapshotv1api.VolumeSnapshot{vs2}))
+
+			cleaner := &FailedBackupCleaner{
+				Log:             logrus.New(),
+				Namespace:       "velero",
+				ConfigMapClient: kubeClient.CoreV1(),
+				BackupClient:    dynamicClient,
+				SnapshotClient:  snapshotClient.SnapshotV1(),
+				DryRun:          tc.dryRun,
+			}
+			require.Nil(t, cleaner.Run())
+
+			_, err = snapshotClient.SnapshotV1().VolumeSnapshots("app").Get(context.TODO(), "vs-1", metav1.GetOptions{})
+			vsc, vscErr := snapshotClient.SnapshotV1().VolumeSnapshotContents().Get(context.TODO(), "vsc-1", metav1.GetOptions{})
+			require.Nil(t, vscErr)
+			if tc.expectDeleted {
+				assert.True(t, apierrors.IsNotFound(err), "volumesnapshot should have been deleted")
+				assert.Equal(t, snapshotv1api.VolumeSnapshotContentDelete, vsc.Spec.DeletionPolicy)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, snapshotv1api.VolumeSnapshotContentRetain, vsc.Spec.DeletionPolicy)
+			}
+
+			// volumesnapshots that no longer belong to the backup are never deleted
+			_, err = snapshotClient.SnapshotV1().VolumeSnapshots("app").Get(context.TODO(), "vs-2", metav1.GetOptions{})
+			assert.Nil(t, err)
+
+			_, err = kubeClient.CoreV1().ConfigMaps("velero").Get(context.TODO(), RecordName("backup-1"), metav1.GetOptions{})
+			if tc.expectRecorded {
+				assert.Nil(t, err)
+			} else {
+				assert.True(t, apierrors.IsNotFound(err), "record should have been deleted")
+			}
+		})
+	}
+}
+
+func TestRecordVolumeSnapshots(t *testing.T) {
+	kubeClient := fake.NewSimpleClientset()
+	backup := &velerov1api.Backup{ObjectMeta: metav1.ObjectMeta{Name: "backup-1", Namespace: "velero"}}
+
+	require.Nil(t, RecordVolumeSnapshots(kubeClient.CoreV1(), "velero", backup, []*snapshotv1api.VolumeSnapshot{
+		newVolumeSnapshot("vs-1", "backup-1", "vsc-1"),
+	}))
+	require.Nil(t, RecordVolumeSnapshots(kubeClient.CoreV1(), "velero", backup, []*snapshotv1api.VolumeSnapshot{
+		newVolumeSnapshot("vs-2", "backup-1", "vsc-2"),
+	}))
+
+	cm, err := kubeClient.CoreV1().ConfigMaps("velero").Get(context.TODO(), RecordName("backup-1"), metav1.GetOptions{})
+	require.Nil(t, err)
+	assert.Equal(t, "backup-1", cm.Annotations[velerov1api.BackupNameLabel])
+	assert.Equal(t, "true", cm.Labels["velero.io/exclude-from-backup"])
+
+	entries, err := getRecordEntries(cm)
+	require.Nil(t, err)
+	assert.ElementsMatch(t, []recordedVolumeSnapshot{
+		{key: "app_vs-1", namespace: "app", name: "vs-1"},
+		{key: "app_vs-2", namespace: "app", name: "vs-2"},
+	}, entries)
+}
+
+func TestRecordVolumeSnapshotsOfRecreatedBackup(t *testing.T) {
+	kubeClient := fake.NewSimpleClientset()
+	deleted := &velerov1api.Backup{ObjectMeta: metav1.ObjectMeta{Name: "backup-1", Namespace: "velero", UID: "uid-1"}}
+	recreated := &velerov1api.Backup{ObjectMeta: metav1.ObjectMeta{Name: "backup-1", Namespace: "velero", UID: "uid-2"}}
+
+	require.Nil(t, RecordVolumeSnapshots(kubeClient.CoreV1(), "velero", deleted, []*snapshotv1api.VolumeSnapshot{
+		newVolumeSnapshot("vs-1", "backup-1", "vsc-1"),
+	}))
+	require.Nil(t, RecordVolumeSnapshots(kubeClient.CoreV1(), "velero", recreated, []*snapshotv1api.VolumeSnapshot{
+		newVolumeSnapshot("vs-2", "backup-1", "vsc-2"),
+	}))
+
+	cm, err := kubeClient.CoreV1().ConfigMaps("velero").Get(context.TODO(), RecordName("backup-1"), metav1.GetOptions{})
+	require.Nil(t, err)
+	assert.Equal(t, "uid-2", cm.Annotations[util.BackupUIDAnnotation])
+	entries, err := getRecordEntries(cm)
+	require.Nil(t, err)
+	assert.Equal(t, []recordedVolumeSnapshot{{key: "app_vs-2", namespace: "app", name: "vs-2"}}, entries)
+}
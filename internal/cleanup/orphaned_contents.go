@@ -0,0 +1,151 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cleanup
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	snapshotv1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	snapshotter "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned/typed/volumesnapshot/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/dynamic"
+
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/util"
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/label"
+)
+
+// OrphanedContentCollector deletes the volumesnapshotcontents labelled with the name of a backup that no longer exists.
+// VolumeSnapshotBackupItemAction adds the label to the volumesnapshotcontents created during a backup, so that they can be
+// discovered when their volumesnapshot is deleted outside of the backup deletion process and they are left behind, along with
+// their snapshots in the storage provider.
+type OrphanedContentCollector struct {
+	Log logrus.FieldLogger
+	// Namespace is the Velero namespace, which holds the backups.
+	Namespace      string
+	BackupClient   dynamic.Interface
+	SnapshotClient snapshotter.SnapshotV1Interface
+	// GracePeriod is how long a volumesnapshotcontent is left alone after its creation, so that the backup it was created for
+	// has time to show up.
+	GracePeriod time.Duration
+	// DryRun reports the orphaned volumesnapshotcontents without deleting them.
+	DryRun bool
+}
+
+// Run deletes the orphaned volumesnapshotcontents, or only reports them with DryRun, and returns their names.
+func (c *OrphanedContentCollector) Run() ([]string, error) {
+	// The volumesnapshotcontents are listed before the backups, so that a backup created in between is not missed.
+	vscList, err := c.SnapshotClient.VolumeSnapshotContents().List(context.TODO(), metav1.ListOptions{
+		LabelSelector: velerov1api.BackupNameLabel,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing volumesnapshotcontents")
+	}
+	backups, err := util.ListBackups(c.BackupClient, c.Namespace)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing backups in namespace %s", c.Namespace)
+	}
+	backupNames := map[string]bool{}
+	backupUIDs := map[string]bool{}
+	for _, backup := range backups {
+		backupNames[label.GetValidName(backup.Name)] = true
+		backupUIDs[string(backup.UID)] = true
+	}
+
+	orphans := []string{}
+	var errs []error
+	for i := range vscList.Items {
+		vsc := &vscList.Items[i]
+		backupName := vsc.Labels[velerov1api.BackupNameLabel]
+		// Volumesnapshotcontents labelled before the UID of the backup was recorded are matched by the backup name label.
+		if uid, ok := vsc.Annotations[util.BackupUIDAnnotation]; ok {
+			if backupUIDs[uid] {
+				continue
+			}
+		} else if backupNames[backupName] {
+			continue
+		}
+		log := c.Log.WithFields(logrus.Fields{"volumesnapshotcontent": vsc.Name, "backup": backupName})
+		// Restored volumesnapshotcontents carry the labels of the backup they were restored from, but belong to the restore.
+		if _, ok := vsc.Labels[velerov1api.RestoreNameLabel]; ok {
+			log.Debug("Skipping restored volumesnapshotcontent")
+			continue
+		}
+		if util.HasLegalHold(&vsc.ObjectMeta) {
+			log.Info("Skipping volumesnapshotcontent under legal hold")
+			continue
+		}
+		if age := time.Since(vsc.CreationTimestamp.Time); age < c.GracePeriod {
+			log.Debugf("Skipping volumesnapshotcontent created %s ago, within the grace period of %s", age.Round(time.Second), c.GracePeriod)
+			continue
+		}
+
+		orphans = append(orphans, vsc.Name)
+		if c.DryRun {
+			log.Info("Found orphaned volumesnapshotcontent, not deleting it in dry-run mode")
+			continue
+		}
+		if err := c.deleteContent(vsc, log); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return orphans, kerrors.NewAggregate(errs)
+}
+
+// deleteContent deletes the orphaned volumesnapshotcontent, and its snapshot in the storage provider. A volumesnapshot that is
+// still bound to it and belongs to the same backup is deleted along with it.
+func (c *OrphanedContentCollector) deleteContent(vsc *snapshotv1api.VolumeSnapshotContent, log logrus.FieldLogger) error {
+	ref := vsc.Spec.VolumeSnapshotRef
+	vs, err := c.SnapshotClient.VolumeSnapshots(ref.Namespace).Get(context.TODO(), ref.Name, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrapf(err, "error getting volumesnapshot %s/%s", ref.Namespace, ref.Name)
+	}
+	boundVS := err == nil && vs.Status != nil && vs.Status.BoundVolumeSnapshotContentName != nil &&
+		*vs.Status.BoundVolumeSnapshotContentName == vsc.Name
+	if boundVS && !util.IsCreatedForSameBackup(&vs.ObjectMeta, &vsc.ObjectMeta) {
+		log.Warnf("Volumesnapshotcontent is bound to volumesnapshot %s/%s, which does not belong to the backup, not deleting it", vs.Namespace, vs.Name)
+		return nil
+	}
+	if boundVS && util.HasLegalHold(&vs.ObjectMeta) {
+		log.Infof("Volumesnapshotcontent is bound to volumesnapshot %s/%s, which is under legal hold, not deleting it", vs.Namespace, vs.Name)
+		return nil
+	}
+
+	if err := util.SetVolumeSnapshotContentDeletionPolicy(vsc.Name, c.SnapshotClient); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "failed to patch DeletionPolicy of volumesnapshotcontent %s", vsc.Name)
+	}
+	if boundVS {
+		if err := c.SnapshotClient.VolumeSnapshots(vs.Namespace).Delete(context.TODO(), vs.Name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "error deleting volumesnapshot %s/%s", vs.Namespace, vs.Name)
+		}
+		log.Infof("Deleted orphaned volumesnapshot %s/%s", vs.Namespace, vs.Name)
+	}
+	if err := c.SnapshotClient.VolumeSnapshotContents().Delete(context.TODO(), vsc.Name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrapf(err, "error deleting volumesnapshotcontent %s", vsc.Name)
+	}
+	log.Info("Deleted orphaned volumesnapshotcontent")
+	return nil
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cleanup
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	snapshotv1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	snapshotFake "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned/fake"
+	corev1api "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/util"
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+)
+
+func newLabelledContent(name, backupName string, age time.Duration, vs *snapshotv1api.VolumeSnapshot) *snapshotv1api.VolumeSnapshotContent {
+	vsc := &snapshotv1api.VolumeSnapshotContent{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Labels:            map[string]string{velerov1api.BackupNameLabel: backupName},
+			CreationTimestamp: metav1.NewTime(time.Now().Add(-age)),
+		},
+		Spec: snapshotv1api.VolumeSnapshotContentSpec{
+			DeletionPolicy: snapshotv1api.VolumeSnapshotContentRetain,
+			VolumeSnapshotRef: corev1api.ObjectReference{
+				Namespace: "app",
+				Name:      name,
+			},
+		},
+	}
+	if vs != nil {
+		vsc.Spec.VolumeSnapshotRef.Name = vs.Name
+	}
+	return vsc
+}
+
+func TestOrphanedContentCollector(t *testing.T) {
+	restored := newLabelledContent("vsc-restored", "deleted-backup", 48*time.Hour, nil)
+	restored.Labels[velerov1api.RestoreNameLabel] = "restore-1"
+	held := newLabelledContent("vsc-held", "deleted-backup", 48*time.Hour, nil)
+	held.Annotations = map[string]string{util.LegalHoldAnnotation: "case 1234"}
+	recreated := newLabelledContent("vsc-1", "backup-1", 48*time.Hour, nil)
+	recreated.Annotations = map[string]string{util.BackupUIDAnnotation: "old-backup-uid"}
+
+	testCases := []struct {
+		name                    string
+		objects                 []runtime.Object
+		dryRun                  bool
+		expectedOrphans         []string
+		expectedDeleted         []string
+		expectedDeletedSnapshot bool
+	}{
+		{
+			name: "content of an existing backup is kept",
+			objects: []runtime.Object{
+				newLabelledContent("vsc-1", "backup-1", 48*time.Hour, nil),
+			},
+			expectedOrphans: []string{},
+		},
+		{
+			name: "content of a deleted backup is deleted",
+			objects: []runtime.Object{
+				newLabelledContent("vsc-1", "deleted-backup", 48*time.Hour, nil),
+			},
+			expectedOrphans: []string{"vsc-1"},
+			expectedDeleted: []string{"vsc-1"},
+		},
+		{
+			name: "content of a deleted backup whose name was reused is deleted",
+			objects: []runtime.Object{
+				recreated,
+			},
+			expectedOrphans: []string{"vsc-1"},
+			expectedDeleted: []string{"vsc-1"},
+		},
+		{
+			name: "content within the grace period is kept",
+			objects: []runtime.Object{
+				newLabelledContent("vsc-1", "deleted-backup", time.Hour, nil),
+			},
+			expectedOrphans: []string{},
+		},
+		{
+			name: "orphans are only reported in dry-run mode",
+			objects: []runtime.Object{
+				newLabelledContent("vsc-1", "deleted-backup", 48*time.Hour, nil),
+			},
+			dryRun:          true,
+			expectedOrphans: []string{"vsc-1"},
+		},
+		{
+			name: "restored content is kept",
+			objects: []runtime.Object{
+				restored,
+			},
+			expectedOrphans: []string{},
+		},
+		{
+			name: "content under legal hold is kept",
+			objects: []runtime.Object{
+				held,
+			},
+			expectedOrphans: []string{},
+		},
+		{
+			name: "volumesnapshot of the deleted backup is deleted along with its content",
+			objects: []runtime.Object{
+				newVolumeSnapshot("vs-1", "deleted-backup", "vsc-1"),
+				newLabelledContent("vsc-1", "deleted-backup", 48*time.Hour, newVolumeSnapshot("vs-1", "deleted-backup", "vsc-1")),
+			},
+			expectedOrphans:         []string{"vsc-1"},
+			expectedDeleted:         []string{"vsc-1"},
+			expectedDeletedSnapshot: true,
+		},
+		{
+			name: "content bound to a volumesnapshot of another backup is kept",
+			objects: []runtime.Object{
+				newVolumeSnapshot("vs-1", "backup-1", "vsc-1"),
+				newLabelledContent("vsc-1", "deleted-backup", 48*time.Hour, newVolumeSnapshot("vs-1", "backup-1", "vsc-1")),
+			},
+			expectedOrphans: []string{"vsc-1"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			snapshotClient := snapshotFake.NewSimpleClientset(tc.objects...)
+			backupClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), newBackup(t, "backup-1", velerov1api.BackupPhaseCompleted))
+
+			collector := &OrphanedContentCollector{
+				Log:            logrus.New(),
+				Namespace:      "velero",
+				BackupClient:   backupClient,
+				SnapshotClient: snapshotClient.SnapshotV1(),
+				GracePeriod:    24 * time.Hour,
+				DryRun:         tc.dryRun,
+			}
+			orphans, err := collector.Run()
+			require.Nil(t, err)
+			assert.Equal(t, tc.expectedOrphans, orphans)
+
+			vscList, err := snapshotClient.SnapshotV1().VolumeSnapshotContents().List(context.TODO(), metav1.ListOptions{})
+			require.Nil(t, err)
+			remaining := []string{}
+			for _, vsc := range vscList.Items {
+				remaining = append(remaining, vsc.Name)
+			}
+			for _, obj := range tc.objects {
+				if vsc, ok := obj.(*snapshotv1api.VolumeSnapshotContent); ok {
+					assert.Equal(t, !util.Contains(tc.expectedDeleted, vsc.Name), util.Contains(remaining, vsc.Name), vsc.Name)
+				}
+			}
+
+			for _, obj := range tc.objects {
+				if vs, ok := obj.(*snapshotv1api.VolumeSnapshot); ok {
+					_, err = snapshotClient.SnapshotV1().VolumeSnapshots(vs.Namespace).Get(context.TODO(), vs.Name, metav1.GetOptions{})
+					assert.Equal(t, tc.expectedDeletedSnapshot, apierrors.IsNotFound(err), vs.Name)
+				}
+			}
+		})
+	}
+}
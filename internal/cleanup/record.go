@@ -0,0 +1,119 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cleanup
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	snapshotv1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	corev1api "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/util/retry"
+
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/util"
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/label"
+)
+
+// recordNamePrefix prefixes the names of the configmaps recording the volumesnapshots created for backups.
+const recordNamePrefix = "csi-volumesnapshots-"
+
+// RecordName returns the name of the configmap recording the volumesnapshots created for the backup.
+func RecordName(backupName string) string {
+	return label.GetValidName(recordNamePrefix + backupName)
+}
+
+// RecordVolumeSnapshots adds the volumesnapshots to the configmap, in the Velero namespace, that records the volumesnapshots
+// created for the backup. The configmap is created if it does not exist yet, and reset if it was created for another backup
+// with the same name.
+func RecordVolumeSnapshots(client corev1client.ConfigMapsGetter, namespace string, backup *velerov1api.Backup, snapshots []*snapshotv1api.VolumeSnapshot) error {
+	retriable := func(err error) bool { return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err) }
+	err := retry.OnError(retry.DefaultRetry, retriable, func() error {
+		cm, err := client.ConfigMaps(namespace).Get(context.TODO(), RecordName(backup.Name), metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			cm = &corev1api.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      RecordName(backup.Name),
+					Namespace: namespace,
+					Labels: map[string]string{
+						util.VolumeSnapshotRecordLabel: "true",
+						util.ExcludeFromBackupLabel:    "true",
+						velerov1api.BackupNameLabel:    label.GetValidName(backup.Name),
+					},
+					Annotations: map[string]string{
+						velerov1api.BackupNameLabel: backup.Name,
+						util.BackupUIDAnnotation:    string(backup.UID),
+					},
+				},
+				Data: map[string]string{},
+			}
+			addRecordEntries(cm, snapshots)
+			_, err = client.ConfigMaps(namespace).Create(context.TODO(), cm, metav1.CreateOptions{})
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		// The record left behind by a deleted backup with the same name no longer belongs to any backup, and is taken over
+		// by the backup.
+		if uid, ok := cm.Annotations[util.BackupUIDAnnotation]; ok && uid != string(backup.UID) {
+			cm.Annotations[velerov1api.BackupNameLabel] = backup.Name
+			cm.Annotations[util.BackupUIDAnnotation] = string(backup.UID)
+			cm.Data = map[string]string{}
+		}
+		addRecordEntries(cm, snapshots)
+		_, err = client.ConfigMaps(namespace).Update(context.TODO(), cm, metav1.UpdateOptions{})
+		return err
+	})
+	return errors.Wrapf(err, "error recording volumesnapshots created for backup %s", backup.Name)
+}
+
+// addRecordEntries adds an entry for each volumesnapshot to the record. The key of an entry is <namespace>_<name>, which is
+// unique as neither can contain an underscore, and its value is <namespace>/<name>.
+func addRecordEntries(cm *corev1api.ConfigMap, snapshots []*snapshotv1api.VolumeSnapshot) {
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	for _, vs := range snapshots {
+		cm.Data[vs.Namespace+"_"+vs.Name] = vs.Namespace + "/" + vs.Name
+	}
+}
+
+// recordedVolumeSnapshot is a volumesnapshot recorded as created for a backup.
+type recordedVolumeSnapshot struct {
+	key       string
+	namespace string
+	name      string
+}
+
+func getRecordEntries(cm *corev1api.ConfigMap) ([]recordedVolumeSnapshot, error) {
+	entries := []recordedVolumeSnapshot{}
+	for k, v := range cm.Data {
+		parts := strings.SplitN(v, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.Errorf("invalid entry %s=%s in volumesnapshot record %s/%s", k, v, cm.Namespace, cm.Name)
+		}
+		entries = append(entries, recordedVolumeSnapshot{key: k, namespace: parts[0], name: parts[1]})
+	}
+	return entries, nil
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cleanup
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/util"
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/label"
+)
+
+// TopologyStorageClassCollector deletes the storage classes created on restore to constrain the restored PVCs to the topology
+// of their backed-up volumes, once no PVC or PV uses them and the restore that last used them is over. Velero does not tell
+// plugins when a restore is done, so they are otherwise left behind.
+type TopologyStorageClassCollector struct {
+	Log logrus.FieldLogger
+	// Namespace is the Velero namespace, which holds the restores.
+	Namespace     string
+	RestoreClient dynamic.Interface
+	Client        kubernetes.Interface
+	// DryRun reports the unused storage classes without deleting them.
+	DryRun bool
+}
+
+// Run deletes the unused storage classes, or only reports them with DryRun, and returns their names.
+func (c *TopologyStorageClassCollector) Run() ([]string, error) {
+	// The storage classes are listed before the PVCs, PVs and restores, so that a PVC or a restore created in between is not
+	// missed.
+	scList, err := c.Client.StorageV1().StorageClasses().List(context.TODO(), metav1.ListOptions{
+		LabelSelector: util.TopologyStorageClassLabel,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing storage classes")
+	}
+	if len(scList.Items) == 0 {
+		return []string{}, nil
+	}
+
+	used := map[string]bool{}
+	pvcList, err := c.Client.CoreV1().PersistentVolumeClaims(metav1.NamespaceAll).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing PVCs")
+	}
+	for _, pvc := range pvcList.Items {
+		if pvc.Spec.StorageClassName != nil {
+			used[*pvc.Spec.StorageClassName] = true
+		}
+	}
+	pvList, err := c.Client.CoreV1().PersistentVolumes().List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing PVs")
+	}
+	for _, pv := range pvList.Items {
+		used[pv.Spec.StorageClassName] = true
+	}
+	restores, err := util.ListRestores(c.RestoreClient, c.Namespace)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing restores in namespace %s", c.Namespace)
+	}
+	restoring := map[string]bool{}
+	for _, restore := range restores {
+		if restore.Status.Phase == "" || restore.Status.Phase == velerov1api.RestorePhaseNew || restore.Status.Phase == velerov1api.RestorePhaseInProgress {
+			restoring[label.GetValidName(restore.Name)] = true
+		}
+	}
+
+	unused := []string{}
+	var errs []error
+	for _, sc := range scList.Items {
+		if used[sc.Name] || restoring[sc.Labels[velerov1api.RestoreNameLabel]] {
+			continue
+		}
+		unused = append(unused, sc.Name)
+		if c.DryRun {
+			c.Log.Infof("Not deleting unused storage class %s in dry-run mode", sc.Name)
+			continue
+		}
+		if err := c.Client.StorageV1().StorageClasses().Delete(context.TODO(), sc.Name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			errs = append(errs, errors.Wrapf(err, "error deleting storage class %s", sc.Name))
+			continue
+		}
+		c.Log.Infof("Deleted unused storage class %s", sc.Name)
+	}
+	return unused, kerrors.NewAggregate(errs)
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cleanup
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	corev1api "k8s.io/api/core/v1"
+	storagev1api "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/util"
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+)
+
+func newRestore(t *testing.T, name string, phase velerov1api.RestorePhase) runtime.Object {
+	restore := &velerov1api.Restore{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: velerov1api.SchemeGroupVersion.String(),
+			Kind:       "Restore",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "velero",
+		},
+		Status: velerov1api.RestoreStatus{Phase: phase},
+	}
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(restore)
+	require.Nil(t, err)
+	return &unstructured.Unstructured{Object: obj}
+}
+
+func TestTopologyStorageClassCollector(t *testing.T) {
+	newStorageClass := func(name, restoreName string) *storagev1api.StorageClass {
+		return &storagev1api.StorageClass{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: name,
+				Labels: map[string]string{
+					util.TopologyStorageClassLabel: "gp2",
+					velerov1api.RestoreNameLabel:   restoreName,
+				},
+			},
+		}
+	}
+	scName := "gp2-topology"
+
+	testCases := []struct {
+		name          string
+		restore       runtime.Object
+		pvc           *corev1api.PersistentVolumeClaim
+		pv            *corev1api.PersistentVolume
+		dryRun        bool
+		expectDeleted bool
+	}{
+		{
+			name:          "unused storage class of a completed restore",
+			restore:       newRestore(t, "restore-1", velerov1api.RestorePhaseCompleted),
+			expectDeleted: true,
+		},
+		{
+			name:          "unused storage class of a restore that no longer exists",
+			expectDeleted: true,
+		},
+		{
+			name:    "unused storage class in dry-run mode",
+			restore: newRestore(t, "restore-1", velerov1api.RestorePhasePartiallyFailed),
+			dryRun:  true,
+		},
+		{
+			name:    "storage class of a restore in progress",
+			restore: newRestore(t, "restore-1", velerov1api.RestorePhaseInProgress),
+		},
+		{
+			name:    "storage class of a PVC",
+			restore: newRestore(t, "restore-1", velerov1api.RestorePhaseCompleted),
+			pvc: &corev1api.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: "data", Namespace: "app"},
+				Spec:       corev1api.PersistentVolumeClaimSpec{StorageClassName: &scName},
+			},
+		},
+		{
+			name:    "storage class of a PV",
+			restore: newRestore(t, "restore-1", velerov1api.RestorePhaseCompleted),
+			pv: &corev1api.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{Name: "pv-1"},
+				Spec:       corev1api.PersistentVolumeSpec{StorageClassName: scName},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			objects := []runtime.Object{
+				newStorageClass(scName, "restore-1"),
+				// Storage classes that were not created on restore are never deleted.
+				&storagev1api.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "gp2"}},
+			}
+			if tc.pvc != nil {
+				objects = append(objects, tc.pvc)
+			}
+			if tc.pv != nil {
+				objects = append(objects, tc.pv)
+			}
+			client := fake.NewSimpleClientset(objects...)
+			restores := []runtime.Object{}
+			if tc.restore != nil {
+				restores = append(restores, tc.restore)
+			}
+
+			collector := &TopologyStorageClassCollector{
+				Log:           logrus.New(),
+				Namespace:     "velero",
+				RestoreClient: dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), restores...),
+				Client:        client,
+				DryRun:        tc.dryRun,
+			}
+			unused, err := collector.Run()
+			require.Nil(t, err)
+
+			_, err = client.StorageV1().StorageClasses().Get(context.TODO(), scName, metav1.GetOptions{})
+			if tc.expectDeleted {
+				assert.Equal(t, []string{scName}, unused)
+				assert.True(t, apierrors.IsNotFound(err), "storage class should have been deleted")
+			} else {
+				assert.Nil(t, err)
+			}
+			if tc.dryRun {
+				assert.Equal(t, []string{scName}, unused)
+			}
+			_, err = client.StorageV1().StorageClasses().Get(context.TODO(), "gp2", metav1.GetOptions{})
+			assert.Nil(t, err)
+		})
+	}
+}
@@ -0,0 +1,361 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+)
+
+const (
+	// PluginConfigLabel is the label Velero uses to identify plugin configmaps.
+	PluginConfigLabel = "velero.io/plugin-config"
+	// PluginName is the label that, together with PluginConfigLabel, identifies the configmap of this plugin.
+	// Its value is the PluginKind. The configuration applies to every action served by the plugin.
+	PluginName = "velero.io/csi-pvc-backupper"
+	PluginKind = "BackupItemAction"
+
+	// Keys in the data of the plugin configmap.
+	VolumeSnapshotTimeoutKey      = "volumeSnapshotTimeout"
+	VolumeSnapshotClassKeyPrefix  = "volumeSnapshotClass_"
+	WaitForReadyToUseKey          = "waitForReadyToUse"
+	WaitForReadyToUseKeyPrefix    = "waitForReadyToUse_"
+	ReadyToUseTimeoutKey          = "readyToUseTimeout"
+	DataMoverKey                  = "dataMover"
+	DataMoverObjectStorePathKey   = "dataMoverObjectStorePath"
+	DataMoverImageKey             = "dataMoverImage"
+	DataMoverTimeoutKey           = "dataMoverTimeout"
+	QuiesceTimeoutKey             = "quiesceTimeout"
+	ConsistencyGroupFSFreezeKey   = "consistencyGroupFSFreeze"
+	AdoptVolumeSnapshotsMaxAgeKey = "adoptVolumeSnapshotsMaxAge"
+	DriverNameKeyPrefix           = "driverName_"
+	HandleTranslatorKeyPrefix     = "handleTranslator_"
+	RestoreTopologyKey            = "restoreTopology"
+	ZoneKeyPrefix                 = "zone_"
+
+	// Types of the snapshot handle translators that the handleTranslator_ keys configure, as a "<type>:<path>" value.
+	HandleTranslatorFile = "file"
+	HandleTranslatorExec = "exec"
+
+	// Annotations on a backup that override the plugin configuration for that backup.
+	VolumeSnapshotTimeoutAnnotation      = "velero.io/csi-volumesnapshot-timeout"
+	DataMoverAnnotation                  = "velero.io/csi-data-mover"
+	AdoptVolumeSnapshotsMaxAgeAnnotation = "velero.io/csi-adopt-volumesnapshots-max-age"
+
+	defaultVeleroNamespace       = "velero"
+	defaultVolumeSnapshotTimeout = 10 * time.Minute
+	defaultReadyToUseTimeout     = 10 * time.Minute
+	defaultDataMoverImage        = "busybox:1.33.1"
+	defaultDataMoverTimeout      = 30 * time.Minute
+	defaultQuiesceTimeout        = 2 * time.Minute
+)
+
+// Config is the configuration of the CSI plugin.
+type Config struct {
+	// VolumeSnapshotTimeout is how long to wait for the CSI driver to reconcile a volumesnapshot created during a backup.
+	VolumeSnapshotTimeout time.Duration
+	// VolumeSnapshotClasses maps CSI driver names to the volumesnapshotclass to use for volumes provisioned by the driver
+	// when the class is not selected by an annotation on the PVC, its storage class or the backup.
+	VolumeSnapshotClasses map[string]string
+	// WaitForReadyToUse is whether to wait for snapshots to be ready to use, rather than only for them to have a snapshot handle,
+	// before backing up their volumesnapshots.
+	WaitForReadyToUse bool
+	// WaitForReadyToUseDrivers overrides WaitForReadyToUse for snapshots taken by the named CSI drivers.
+	WaitForReadyToUseDrivers map[string]bool
+	// ReadyToUseTimeout is how long to wait for a snapshot to be ready to use once it has a snapshot handle.
+	ReadyToUseTimeout time.Duration
+	// DataMover is whether to copy the data of snapshots taken during backups to the data mover object store.
+	DataMover bool
+	// DataMoverObjectStorePath is the directory, in the Velero pod, of the object store the data mover copies data to.
+	// When it is empty, the data mover copies data to the object storage of the backup storage location of the backup.
+	DataMoverObjectStorePath string
+	// DataMoverImage is the image of the pods that read data from and write data to volumes for the data mover.
+	// It must provide sh, cat and tar.
+	DataMoverImage string
+	// DataMoverTimeout is how long to wait for a data mover pod to start.
+	DataMoverTimeout time.Duration
+	// QuiesceTimeout is the longest that applications stay frozen while their volumes are snapshotted. Frozen applications
+	// are thawed when it expires, even if the snapshots have not been cut yet.
+	QuiesceTimeout time.Duration
+	// ConsistencyGroupFSFreeze is whether to freeze, with fsfreeze, the filesystems of the PVCs of a consistency group that are
+	// mounted by pods without quiesce hooks. The snapshots of those PVCs are otherwise only crash consistent with each other.
+	ConsistencyGroupFSFreeze bool
+	// AdoptVolumeSnapshotsMaxAge is the age up to which a ready to use volumesnapshot of a PVC, taken outside of Velero, is
+	// backed up instead of taking a new snapshot of the PVC. Zero disables adopting volumesnapshots.
+	AdoptVolumeSnapshotsMaxAge time.Duration
+	// DriverNames maps the names of CSI drivers that took backed-up snapshots to the names of the drivers that restore them,
+	// for drivers that were renamed.
+	DriverNames map[string]string
+	// HandleTranslators maps CSI driver names to the translator of the handles of the snapshots they restore.
+	HandleTranslators map[string]HandleTranslator
+	// RestoreTopology is whether to constrain PVCs restored from volumesnapshots to the topology, such as the zones, of their
+	// backed-up volumes. It is off by default, as it creates storage classes that are left behind after the restore.
+	RestoreTopology bool
+	// Zones maps the zones, or other topology values, of backed-up volumes to the ones their PVCs are restored in.
+	Zones map[string]string
+}
+
+// HandleTranslator configures how the handles of backed-up snapshots are translated to the handles of the snapshots to
+// restore, when the snapshots were copied to another region or account.
+type HandleTranslator struct {
+	// Type is HandleTranslatorFile, for a lookup table in a file, or HandleTranslatorExec, for an external executable.
+	Type string
+	// Path is the path, in the Velero pod, of the lookup table or the executable.
+	Path string
+}
+
+// Default returns the configuration used when the plugin configmap does not set a value.
+func Default() Config {
+	return Config{
+		VolumeSnapshotTimeout:    defaultVolumeSnapshotTimeout,
+		VolumeSnapshotClasses:    map[string]string{},
+		WaitForReadyToUseDrivers: map[string]bool{},
+		DriverNames:              map[string]string{},
+		HandleTranslators:        map[string]HandleTranslator{},
+		Zones:                    map[string]string{},
+		ReadyToUseTimeout:        defaultReadyToUseTimeout,
+		DataMoverImage:           defaultDataMoverImage,
+		DataMoverTimeout:         defaultDataMoverTimeout,
+		QuiesceTimeout:           defaultQuiesceTimeout,
+	}
+}
+
+// Namespace returns the namespace Velero, and so the plugin configmap, is installed in.
+func Namespace() string {
+	if ns := os.Getenv("VELERO_NAMESPACE"); ns != "" {
+		return ns
+	}
+	return defaultVeleroNamespace
+}
+
+// Load reads the plugin configmap from the supplied namespace and returns the resulting configuration.
+// The default configuration is returned when no plugin configmap exists.
+func Load(client corev1client.ConfigMapsGetter, namespace string, log logrus.FieldLogger) (Config, error) {
+	opts := metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s,%s=%s", PluginConfigLabel, PluginName, PluginKind),
+	}
+	list, err := client.ConfigMaps(namespace).List(context.TODO(), opts)
+	if err != nil {
+		return Config{}, errors.Wrapf(err, "error listing plugin configmaps in namespace %s", namespace)
+	}
+
+	switch len(list.Items) {
+	case 0:
+		log.Debugf("No plugin configmap found in namespace %s, using the default configuration", namespace)
+		return Default(), nil
+	case 1:
+		cm := list.Items[0]
+		log.Debugf("Using plugin configmap %s/%s", cm.Namespace, cm.Name)
+		cfg, err := Parse(cm.Data)
+		if err != nil {
+			return Config{}, errors.Wrapf(err, "invalid plugin configmap %s/%s", cm.Namespace, cm.Name)
+		}
+		return cfg, nil
+	default:
+		return Config{}, errors.Errorf("found more than one plugin configmap with labels %s in namespace %s", opts.LabelSelector, namespace)
+	}
+}
+
+// Parse returns the configuration described by the data of a plugin configmap, applying defaults for unset values.
+func Parse(data map[string]string) (Config, error) {
+	cfg := Default()
+	for k, v := range data {
+		var err error
+		switch {
+		case k == VolumeSnapshotTimeoutKey:
+			cfg.VolumeSnapshotTimeout, err = parseDuration(k, v)
+		case strings.HasPrefix(k, VolumeSnapshotClassKeyPrefix):
+			driver := strings.TrimPrefix(k, VolumeSnapshotClassKeyPrefix)
+			if driver == "" || v == "" {
+				err = errors.Errorf("%s must be of the form %s<driver name> with the name of a volumesnapshotclass as its value", k, VolumeSnapshotClassKeyPrefix)
+			}
+			cfg.VolumeSnapshotClasses[driver] = v
+		case k == WaitForReadyToUseKey:
+			cfg.WaitForReadyToUse, err = parseBool(k, v)
+		case strings.HasPrefix(k, WaitForReadyToUseKeyPrefix):
+			driver := strings.TrimPrefix(k, WaitForReadyToUseKeyPrefix)
+			if driver == "" {
+				err = errors.Errorf("%s must be of the form %s<driver name>", k, WaitForReadyToUseKeyPrefix)
+				break
+			}
+			cfg.WaitForReadyToUseDrivers[driver], err = parseBool(k, v)
+		case k == ReadyToUseTimeoutKey:
+			cfg.ReadyToUseTimeout, err = parseDuration(k, v)
+		case k == DataMoverKey:
+			cfg.DataMover, err = parseBool(k, v)
+		case k == DataMoverObjectStorePathKey:
+			cfg.DataMoverObjectStorePath = v
+		case k == DataMoverImageKey:
+			cfg.DataMoverImage = v
+		case k == DataMoverTimeoutKey:
+			cfg.DataMoverTimeout, err = parseDuration(k, v)
+		case k == QuiesceTimeoutKey:
+			cfg.QuiesceTimeout, err = parseDuration(k, v)
+		case k == ConsistencyGroupFSFreezeKey:
+			cfg.ConsistencyGroupFSFreeze, err = parseBool(k, v)
+		case k == AdoptVolumeSnapshotsMaxAgeKey:
+			cfg.AdoptVolumeSnapshotsMaxAge, err = parseDuration(k, v)
+		case strings.HasPrefix(k, DriverNameKeyPrefix):
+			driver := strings.TrimPrefix(k, DriverNameKeyPrefix)
+			if driver == "" || v == "" {
+				err = errors.Errorf("%s must be of the form %s<driver name> with the name of a CSI driver as its value", k, DriverNameKeyPrefix)
+			}
+			cfg.DriverNames[driver] = v
+		case strings.HasPrefix(k, HandleTranslatorKeyPrefix):
+			driver := strings.TrimPrefix(k, HandleTranslatorKeyPrefix)
+			if driver == "" {
+				err = errors.Errorf("%s must be of the form %s<driver name>", k, HandleTranslatorKeyPrefix)
+				break
+			}
+			cfg.HandleTranslators[driver], err = parseHandleTranslator(k, v)
+		case k == RestoreTopologyKey:
+			cfg.RestoreTopology, err = parseBool(k, v)
+		case strings.HasPrefix(k, ZoneKeyPrefix):
+			zone := strings.TrimPrefix(k, ZoneKeyPrefix)
+			if zone == "" || v == "" {
+				err = errors.Errorf("%s must be of the form %s<zone> with the name of a zone as its value", k, ZoneKeyPrefix)
+			}
+			cfg.Zones[zone] = v
+		default:
+			err = errors.Errorf("unknown key %s", k)
+		}
+		if err != nil {
+			return Config{}, err
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// ForBackup returns the configuration to use for the supplied backup, with the settings overridden by its annotations applied.
+// Only the volumesnapshot timeout, the data mover and the maximum age of adopted volumesnapshots can be overridden; the other
+// settings apply to all backups.
+func (c Config) ForBackup(backup *velerov1api.Backup) (Config, error) {
+	cfg := c
+	if v, ok := backup.Annotations[VolumeSnapshotTimeoutAnnotation]; ok {
+		d, err := parseDuration(VolumeSnapshotTimeoutAnnotation, v)
+		if err != nil {
+			return Config{}, errors.Wrapf(err, "invalid annotation on backup %s/%s", backup.Namespace, backup.Name)
+		}
+		cfg.VolumeSnapshotTimeout = d
+	}
+	if v, ok := backup.Annotations[DataMoverAnnotation]; ok {
+		b, err := parseBool(DataMoverAnnotation, v)
+		if err != nil {
+			return Config{}, errors.Wrapf(err, "invalid annotation on backup %s/%s", backup.Namespace, backup.Name)
+		}
+		cfg.DataMover = b
+	}
+	if v, ok := backup.Annotations[AdoptVolumeSnapshotsMaxAgeAnnotation]; ok {
+		d, err := parseDuration(AdoptVolumeSnapshotsMaxAgeAnnotation, v)
+		if err != nil {
+			return Config{}, errors.Wrapf(err, "invalid annotation on backup %s/%s", backup.Namespace, backup.Name)
+		}
+		cfg.AdoptVolumeSnapshotsMaxAge = d
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return Config{}, errors.Wrapf(err, "invalid annotations on backup %s/%s", backup.Namespace, backup.Name)
+	}
+	return cfg, nil
+}
+
+// Validate returns an error if the configuration is not usable.
+func (c Config) Validate() error {
+	if c.VolumeSnapshotTimeout <= 0 {
+		return errors.Errorf("%s must be positive, got %s", VolumeSnapshotTimeoutKey, c.VolumeSnapshotTimeout)
+	}
+	if c.ReadyToUseTimeout <= 0 {
+		return errors.Errorf("%s must be positive, got %s", ReadyToUseTimeoutKey, c.ReadyToUseTimeout)
+	}
+	if c.DataMoverTimeout <= 0 {
+		return errors.Errorf("%s must be positive, got %s", DataMoverTimeoutKey, c.DataMoverTimeout)
+	}
+	if c.QuiesceTimeout <= 0 {
+		return errors.Errorf("%s must be positive, got %s", QuiesceTimeoutKey, c.QuiesceTimeout)
+	}
+	if c.AdoptVolumeSnapshotsMaxAge < 0 {
+		return errors.Errorf("%s must not be negative, got %s", AdoptVolumeSnapshotsMaxAgeKey, c.AdoptVolumeSnapshotsMaxAge)
+	}
+	if c.DataMoverImage == "" {
+		return errors.Errorf("%s must not be empty", DataMoverImageKey)
+	}
+	return nil
+}
+
+// ShouldWaitForReadyToUse returns whether to wait for snapshots taken by the named CSI driver to be ready to use.
+func (c Config) ShouldWaitForReadyToUse(driver string) bool {
+	if wait, ok := c.WaitForReadyToUseDrivers[driver]; ok {
+		return wait
+	}
+	return c.WaitForReadyToUse
+}
+
+// MapDriverName returns the name of the CSI driver that restores snapshots taken by the named CSI driver.
+func (c Config) MapDriverName(driver string) string {
+	if mapped, ok := c.DriverNames[driver]; ok {
+		return mapped
+	}
+	return driver
+}
+
+// MapZone returns the zone, or other topology value, that volumes of the zone are restored in.
+func (c Config) MapZone(zone string) string {
+	if mapped, ok := c.Zones[zone]; ok {
+		return mapped
+	}
+	return zone
+}
+
+func parseBool(key, value string) (bool, error) {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to parse %s", key)
+	}
+	return b, nil
+}
+
+func parseHandleTranslator(key, value string) (HandleTranslator, error) {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 || (parts[0] != HandleTranslatorFile && parts[0] != HandleTranslatorExec) || parts[1] == "" {
+		return HandleTranslator{}, errors.Errorf("%s must be %s:<path> or %s:<path>, got %q", key, HandleTranslatorFile, HandleTranslatorExec, value)
+	}
+	return HandleTranslator{Type: parts[0], Path: parts[1]}, nil
+}
+
+func parseDuration(key, value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to parse %s", key)
+	}
+	return d, nil
+}
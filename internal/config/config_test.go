@@ -0,0 +1,374 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	corev1api "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+)
+
+// defaultWith returns the default configuration as changed by modify.
+func defaultWith(modify func(*Config)) Config {
+	c := Default()
+	modify(&c)
+	return c
+}
+
+func TestParse(t *testing.T) {
+	testCases := []struct {
+		name        string
+		data        map[string]string
+		expected    Config
+		expectError bool
+	}{
+		{
+			name:     "empty data should result in the default configuration",
+			data:     map[string]string{},
+			expected: Default(),
+		},
+		{
+			name: "should parse all supported keys",
+			data: map[string]string{
+				VolumeSnapshotTimeoutKey:                             "30m",
+				VolumeSnapshotClassKeyPrefix + "hostpath.csi.k8s.io": "gold",
+			},
+			expected: defaultWith(func(c *Config) {
+				c.VolumeSnapshotTimeout = 30 * time.Minute
+				c.VolumeSnapshotClasses["hostpath.csi.k8s.io"] = "gold"
+			}),
+		},
+		{
+			name: "should parse the ready to use settings",
+			data: map[string]string{
+				WaitForReadyToUseKey: "true",
+				WaitForReadyToUseKeyPrefix + "hostpath.csi.k8s.io": "false",
+				ReadyToUseTimeoutKey: "1h",
+			},
+			expected: defaultWith(func(c *Config) {
+				c.WaitForReadyToUse = true
+				c.WaitForReadyToUseDrivers["hostpath.csi.k8s.io"] = false
+				c.ReadyToUseTimeout = time.Hour
+			}),
+		},
+		{
+			name: "should parse the data mover settings",
+			data: map[string]string{
+				DataMoverKey:                "true",
+				DataMoverObjectStorePathKey: "/data-mover",
+				DataMoverImageKey:           "registry.example.com/busybox:1.33.1",
+				DataMoverTimeoutKey:         "5m",
+			},
+			expected: defaultWith(func(c *Config) {
+				c.DataMover = true
+				c.DataMoverObjectStorePath = "/data-mover"
+				c.DataMoverImage = "registry.example.com/busybox:1.33.1"
+				c.DataMoverTimeout = 5 * time.Minute
+			}),
+		},
+		{
+			name:     "should parse the quiesce timeout",
+			data:     map[string]string{QuiesceTimeoutKey: "30s"},
+			expected: defaultWith(func(c *Config) { c.QuiesceTimeout = 30 * time.Second }),
+		},
+		{
+			name:     "should parse whether to freeze the filesystems of consistency groups",
+			data:     map[string]string{ConsistencyGroupFSFreezeKey: "true"},
+			expected: defaultWith(func(c *Config) { c.ConsistencyGroupFSFreeze = true }),
+		},
+		{
+			name:        "should reject a non-positive quiesce timeout",
+			data:        map[string]string{QuiesceTimeoutKey: "-1s"},
+			expectError: true,
+		},
+		{
+			name:     "should parse the maximum age of adopted volumesnapshots",
+			data:     map[string]string{AdoptVolumeSnapshotsMaxAgeKey: "2h"},
+			expected: defaultWith(func(c *Config) { c.AdoptVolumeSnapshotsMaxAge = 2 * time.Hour }),
+		},
+		{
+			name:        "should reject a negative maximum age of adopted volumesnapshots",
+			data:        map[string]string{AdoptVolumeSnapshotsMaxAgeKey: "-2h"},
+			expectError: true,
+		},
+		{
+			name:     "should parse the driver name mapping",
+			data:     map[string]string{DriverNameKeyPrefix + "foo.csi.vendor.io": "csi.vendor.com"},
+			expected: defaultWith(func(c *Config) { c.DriverNames["foo.csi.vendor.io"] = "csi.vendor.com" }),
+		},
+		{
+			name:        "should reject a driver name key without a value",
+			data:        map[string]string{DriverNameKeyPrefix + "foo.csi.vendor.io": ""},
+			expectError: true,
+		},
+		{
+			name: "should parse the handle translators",
+			data: map[string]string{
+				HandleTranslatorKeyPrefix + "ebs.csi.aws.com":       "file:/etc/velero/handles.json",
+				HandleTranslatorKeyPrefix + "pd.csi.storage.gke.io": "exec:/plugins/translate-handle",
+			},
+			expected: defaultWith(func(c *Config) {
+				c.HandleTranslators["ebs.csi.aws.com"] = HandleTranslator{Type: HandleTranslatorFile, Path: "/etc/velero/handles.json"}
+				c.HandleTranslators["pd.csi.storage.gke.io"] = HandleTranslator{Type: HandleTranslatorExec, Path: "/plugins/translate-handle"}
+			}),
+		},
+		{
+			name:        "should reject an unknown handle translator type",
+			data:        map[string]string{HandleTranslatorKeyPrefix + "ebs.csi.aws.com": "http://translator"},
+			expectError: true,
+		},
+		{
+			name:        "should reject a handle translator without a path",
+			data:        map[string]string{HandleTranslatorKeyPrefix + "ebs.csi.aws.com": "exec:"},
+			expectError: true,
+		},
+		{
+			name: "should parse the topology settings",
+			data: map[string]string{
+				RestoreTopologyKey:           "true",
+				ZoneKeyPrefix + "us-east-1a": "us-west-2b",
+			},
+			expected: defaultWith(func(c *Config) {
+				c.RestoreTopology = true
+				c.Zones["us-east-1a"] = "us-west-2b"
+			}),
+		},
+		{
+			name:        "should reject a zone key without a value",
+			data:        map[string]string{ZoneKeyPrefix + "us-east-1a": ""},
+			expectError: true,
+		},
+		{
+			name:     "should use the backup storage location for the data mover without an object store path",
+			data:     map[string]string{DataMoverKey: "true"},
+			expected: defaultWith(func(c *Config) { c.DataMover = true }),
+		},
+		{
+			name:        "should reject unparsable booleans",
+			data:        map[string]string{WaitForReadyToUseKey: "sometimes"},
+			expectError: true,
+		},
+		{
+			name:        "should reject a ready to use key without a driver",
+			data:        map[string]string{WaitForReadyToUseKeyPrefix: "true"},
+			expectError: true,
+		},
+		{
+			name:        "should reject unknown keys",
+			data:        map[string]string{"volumeSnapshotTimeoutt": "30m"},
+			expectError: true,
+		},
+		{
+			name:        "should reject unparsable durations",
+			data:        map[string]string{VolumeSnapshotTimeoutKey: "ten minutes"},
+			expectError: true,
+		},
+		{
+			name:        "should reject non-positive durations",
+			data:        map[string]string{VolumeSnapshotTimeoutKey: "0s"},
+			expectError: true,
+		},
+		{
+			name:        "should reject a volumesnapshotclass key without a driver",
+			data:        map[string]string{VolumeSnapshotClassKeyPrefix: "gold"},
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := Parse(tc.data)
+			if tc.expectError {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func TestForBackup(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		expected    Config
+		expectError bool
+	}{
+		{
+			name:     "backup without annotations should use the plugin configuration",
+			expected: Default(),
+		},
+		{
+			name:        "backup annotations should override the plugin configuration",
+			annotations: map[string]string{VolumeSnapshotTimeoutAnnotation: "1h"},
+			expected: defaultWith(func(c *Config) {
+				c.VolumeSnapshotTimeout = time.Hour
+			}),
+		},
+		{
+			name:        "backup annotation should enable adopting volumesnapshots",
+			annotations: map[string]string{AdoptVolumeSnapshotsMaxAgeAnnotation: "30m"},
+			expected: defaultWith(func(c *Config) {
+				c.AdoptVolumeSnapshotsMaxAge = 30 * time.Minute
+			}),
+		},
+		{
+			name:        "backup annotation should enable the data mover",
+			annotations: map[string]string{DataMoverAnnotation: "true"},
+			expected:    defaultWith(func(c *Config) { c.DataMover = true }),
+		},
+		{
+			name:        "invalid backup annotations should be rejected",
+			annotations: map[string]string{VolumeSnapshotTimeoutAnnotation: "-1m"},
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			backup := &velerov1api.Backup{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "velero",
+					Name:        "backup-1",
+					Annotations: tc.annotations,
+				},
+			}
+			actual, err := Default().ForBackup(backup)
+			if tc.expectError {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	pluginConfigMap := func(name string, data map[string]string) *corev1api.ConfigMap {
+		return &corev1api.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "velero",
+				Name:      name,
+				Labels: map[string]string{
+					PluginConfigLabel: "",
+					PluginName:        PluginKind,
+				},
+			},
+			Data: data,
+		}
+	}
+
+	testCases := []struct {
+		name        string
+		objs        []runtime.Object
+		expected    Config
+		expectError bool
+	}{
+		{
+			name:     "should use the default configuration without a plugin configmap",
+			expected: Default(),
+		},
+		{
+			name: "should ignore configmaps of other plugins",
+			objs: []runtime.Object{
+				&corev1api.ConfigMap{
+					ObjectMeta: metav1.ObjectMeta{
+						Namespace: "velero",
+						Name:      "change-storage-class-config",
+						Labels: map[string]string{
+							PluginConfigLabel:                "",
+							"velero.io/change-storage-class": "RestoreItemAction",
+						},
+					},
+					Data: map[string]string{"foo": "bar"},
+				},
+			},
+			expected: Default(),
+		},
+		{
+			name: "should read the plugin configmap",
+			objs: []runtime.Object{pluginConfigMap("csi-config", map[string]string{VolumeSnapshotTimeoutKey: "20m"})},
+			expected: defaultWith(func(c *Config) {
+				c.VolumeSnapshotTimeout = 20 * time.Minute
+			}),
+		},
+		{
+			name:        "should reject an invalid plugin configmap",
+			objs:        []runtime.Object{pluginConfigMap("csi-config", map[string]string{VolumeSnapshotTimeoutKey: "forever"})},
+			expectError: true,
+		},
+		{
+			name: "should reject more than one plugin configmap",
+			objs: []runtime.Object{
+				pluginConfigMap("csi-config-1", map[string]string{}),
+				pluginConfigMap("csi-config-2", map[string]string{}),
+			},
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset(tc.objs...)
+			actual, err := Load(client.CoreV1(), "velero", logrus.New())
+			if tc.expectError {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func TestShouldWaitForReadyToUse(t *testing.T) {
+	cfg := defaultWith(func(c *Config) {
+		c.WaitForReadyToUse = true
+		c.WaitForReadyToUseDrivers["slow.csi.k8s.io"] = true
+		c.WaitForReadyToUseDrivers["fast.csi.k8s.io"] = false
+	})
+	assert.True(t, cfg.ShouldWaitForReadyToUse("slow.csi.k8s.io"))
+	assert.False(t, cfg.ShouldWaitForReadyToUse("fast.csi.k8s.io"))
+	assert.True(t, cfg.ShouldWaitForReadyToUse("other.csi.k8s.io"))
+
+	cfg.WaitForReadyToUse = false
+	assert.True(t, cfg.ShouldWaitForReadyToUse("slow.csi.k8s.io"))
+	assert.False(t, cfg.ShouldWaitForReadyToUse("other.csi.k8s.io"))
+}
+
+func TestMapDriverName(t *testing.T) {
+	cfg := defaultWith(func(c *Config) { c.DriverNames["foo.csi.vendor.io"] = "csi.vendor.com" })
+	assert.Equal(t, "csi.vendor.com", cfg.MapDriverName("foo.csi.vendor.io"))
+	assert.Equal(t, "hostpath.csi.k8s.io", cfg.MapDriverName("hostpath.csi.k8s.io"))
+}
+
+func TestMapZone(t *testing.T) {
+	cfg := defaultWith(func(c *Config) { c.Zones["us-east-1a"] = "us-west-2b" })
+	assert.Equal(t, "us-west-2b", cfg.MapZone("us-east-1a"))
+	assert.Equal(t, "us-east-1b", cfg.MapZone("us-east-1b"))
+}
@@ -0,0 +1,204 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package datamover
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+)
+
+// RootConfigKey is the key of the directory the FileSystemObjectStore keeps its buckets in.
+const RootConfigKey = "root"
+
+// FileSystemObjectStore is a velero.ObjectStore that keeps objects as files in a directory. Each bucket is
+// a sub directory of the root directory and each object a file below it, at the path given by its key.
+// The directory may be a mounted network filesystem or object storage bucket.
+type FileSystemObjectStore struct {
+	root string
+}
+
+var _ velero.ObjectStore = &FileSystemObjectStore{}
+
+// NewFileSystemObjectStore returns a FileSystemObjectStore that has not been initialized.
+func NewFileSystemObjectStore() *FileSystemObjectStore {
+	return &FileSystemObjectStore{}
+}
+
+// Init sets the root directory of the object store from the config and creates it if it does not exist.
+func (s *FileSystemObjectStore) Init(config map[string]string) error {
+	root := config[RootConfigKey]
+	if root == "" {
+		return errors.Errorf("%s must be set", RootConfigKey)
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return errors.Wrapf(err, "error creating object store root directory %s", root)
+	}
+	s.root = root
+	return nil
+}
+
+func (s *FileSystemObjectStore) objectPath(bucket, key string) (string, error) {
+	if bucket == "" || strings.ContainsAny(bucket, `/\`) || bucket == "." || bucket == ".." {
+		return "", errors.Errorf("invalid bucket name %q", bucket)
+	}
+	clean := path.Clean("/" + key)
+	if key == "" || strings.HasSuffix(key, "/") || clean != "/"+key {
+		return "", errors.Errorf("invalid object key %q", key)
+	}
+	return filepath.Join(s.root, bucket, filepath.FromSlash(key)), nil
+}
+
+// PutObject writes the object to a temporary file first and renames it into place,
+// so that readers never see a partially written object.
+func (s *FileSystemObjectStore) PutObject(bucket, key string, body io.Reader) error {
+	p, err := s.objectPath(bucket, key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return errors.Wrapf(err, "error creating directory for object %s", key)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(p), ".tmp-"+filepath.Base(p)+"-")
+	if err != nil {
+		return errors.Wrapf(err, "error creating temporary file for object %s", key)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "error writing object %s", key)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "error syncing object %s", key)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrapf(err, "error closing object %s", key)
+	}
+	return errors.Wrapf(os.Rename(tmp.Name(), p), "error renaming temporary file to object %s", key)
+}
+
+func (s *FileSystemObjectStore) ObjectExists(bucket, key string) (bool, error) {
+	p, err := s.objectPath(bucket, key)
+	if err != nil {
+		return false, err
+	}
+	info, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "error checking for object %s", key)
+	}
+	return info.Mode().IsRegular(), nil
+}
+
+func (s *FileSystemObjectStore) GetObject(bucket, key string) (io.ReadCloser, error) {
+	p, err := s.objectPath(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error opening object %s", key)
+	}
+	return f, nil
+}
+
+// ListCommonPrefixes returns the distinct prefixes of the keys that start with prefix, up to and including
+// the first delimiter after prefix.
+func (s *FileSystemObjectStore) ListCommonPrefixes(bucket, prefix, delimiter string) ([]string, error) {
+	keys, err := s.ListObjects(bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	prefixes := []string{}
+	for _, key := range keys {
+		i := strings.Index(key[len(prefix):], delimiter)
+		if i < 0 {
+			continue
+		}
+		p := key[:len(prefix)+i+len(delimiter)]
+		if !seen[p] {
+			seen[p] = true
+			prefixes = append(prefixes, p)
+		}
+	}
+	return prefixes, nil
+}
+
+// ListObjects returns the keys of all objects in the bucket that start with prefix, in lexical order.
+func (s *FileSystemObjectStore) ListObjects(bucket, prefix string) ([]string, error) {
+	if _, err := s.objectPath(bucket, "probe"); err != nil {
+		return nil, err
+	}
+	bucketDir := filepath.Join(s.root, bucket)
+
+	keys := []string{}
+	err := filepath.Walk(bucketDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), ".tmp-") {
+			return nil
+		}
+		rel, err := filepath.Rel(bucketDir, p)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing objects in bucket %s", bucket)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *FileSystemObjectStore) DeleteObject(bucket, key string) error {
+	p, err := s.objectPath(bucket, key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "error deleting object %s", key)
+	}
+	return nil
+}
+
+func (s *FileSystemObjectStore) CreateSignedURL(bucket, key string, ttl time.Duration) (string, error) {
+	return "", errors.New("signed URLs are not supported by the filesystem object store")
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package datamover
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileSystemObjectStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "objectstore")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	store := NewFileSystemObjectStore()
+	assert.NotNil(t, store.Init(map[string]string{}))
+	require.Nil(t, store.Init(map[string]string{RootConfigKey: dir}))
+
+	exists, err := store.ObjectExists("bucket", "a/b/c")
+	require.Nil(t, err)
+	assert.False(t, exists)
+
+	for _, key := range []string{"a/b/c", "a/b/d", "a/e", "f"} {
+		require.Nil(t, store.PutObject("bucket", key, strings.NewReader("content of "+key)))
+	}
+	require.Nil(t, store.PutObject("other-bucket", "a/x", strings.NewReader("other")))
+
+	exists, err = store.ObjectExists("bucket", "a/b/c")
+	require.Nil(t, err)
+	assert.True(t, exists)
+
+	obj, err := store.GetObject("bucket", "a/b/c")
+	require.Nil(t, err)
+	content, err := ioutil.ReadAll(obj)
+	obj.Close()
+	require.Nil(t, err)
+	assert.Equal(t, "content of a/b/c", string(content))
+
+	require.Nil(t, store.PutObject("bucket", "a/b/c", strings.NewReader("replaced")))
+	obj, err = store.GetObject("bucket", "a/b/c")
+	require.Nil(t, err)
+	content, err = ioutil.ReadAll(obj)
+	obj.Close()
+	require.Nil(t, err)
+	assert.Equal(t, "replaced", string(content))
+
+	keys, err := store.ListObjects("bucket", "a/")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"a/b/c", "a/b/d", "a/e"}, keys)
+
+	keys, err = store.ListObjects("empty-bucket", "")
+	require.Nil(t, err)
+	assert.Empty(t, keys)
+
+	prefixes, err := store.ListCommonPrefixes("bucket", "", "/")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"a/"}, prefixes)
+
+	prefixes, err = store.ListCommonPrefixes("bucket", "a/", "/")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"a/b/"}, prefixes)
+
+	require.Nil(t, store.DeleteObject("bucket", "a/b/c"))
+	require.Nil(t, store.DeleteObject("bucket", "a/b/c"))
+	exists, err = store.ObjectExists("bucket", "a/b/c")
+	require.Nil(t, err)
+	assert.False(t, exists)
+
+	_, err = store.CreateSignedURL("bucket", "f", 0)
+	assert.NotNil(t, err)
+}
+
+func TestFileSystemObjectStoreRejectsInvalidNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "objectstore")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	store := NewFileSystemObjectStore()
+	require.Nil(t, store.Init(map[string]string{RootConfigKey: dir}))
+
+	for _, key := range []string{"", "../escape", "a/../../escape", "/absolute", "a//b", "a/", "./a"} {
+		assert.NotNil(t, store.PutObject("bucket", key, strings.NewReader("data")), "key %q should be rejected", key)
+	}
+	for _, bucket := range []string{"", "..", "a/b"} {
+		assert.NotNil(t, store.PutObject(bucket, "key", strings.NewReader("data")), "bucket %q should be rejected", bucket)
+	}
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package datamover
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// uploadLocksPrefix holds a lock object for every upload in progress, and gcLockKey is the lock object of the garbage
+	// collection. An upload writes its lock and then looks for the lock of the garbage collection, while the garbage collection
+	// writes its lock and then looks for the locks of uploads, so that at least one of them sees the other and backs off.
+	uploadLocksPrefix = "locks/uploads/"
+	gcLockKey         = "locks/gc"
+
+	defaultLockRefreshInterval = time.Minute
+	// defaultLockExpiry is how long after it was last refreshed a lock is considered left behind by a process that died.
+	defaultLockExpiry        = 10 * time.Minute
+	defaultLockRetryPeriod   = 5 * time.Second
+	defaultUploadLockTimeout = time.Hour
+)
+
+// lockRecord is the content of a lock object.
+type lockRecord struct {
+	// Time is when the lock was last refreshed.
+	Time time.Time `json:"time"`
+}
+
+// Lock is a lock object in the repository, refreshed until it is released.
+type Lock struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// LockForUpload takes a lock that keeps CollectGarbage from deleting chunks until it is released, and returns it. The lock is
+// to be held from before the data is uploaded until its manifest is stored, as the chunks that an upload finds already
+// stored are only referenced once its manifest is. While the garbage is collected, it waits for the garbage collection to
+// finish.
+func (r *Repository) LockForUpload(log logrus.FieldLogger) (*Lock, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	key := uploadLocksPrefix + hex.EncodeToString(id)
+	deadline := time.Now().Add(r.uploadLockTimeout)
+	for {
+		if err := r.putLock(key); err != nil {
+			return nil, err
+		}
+		collecting, err := r.isLocked(gcLockKey)
+		if err != nil {
+			r.deleteLock(key, log)
+			return nil, err
+		}
+		if !collecting {
+			return r.startLock(key, log), nil
+		}
+		r.deleteLock(key, log)
+		if time.Now().After(deadline) {
+			return nil, errors.Errorf("timed out waiting for the garbage collection of the data mover repository to finish")
+		}
+		log.Infof("Waiting for the garbage collection of the data mover repository to finish")
+		time.Sleep(r.lockRetryPeriod)
+	}
+}
+
+// lockForGarbageCollection takes the lock of the garbage collection and returns it, or returns nil if an upload is in
+// progress.
+func (r *Repository) lockForGarbageCollection(log logrus.FieldLogger) (*Lock, error) {
+	if err := r.putLock(gcLockKey); err != nil {
+		return nil, err
+	}
+	keys, err := r.store.ListObjects(r.bucket, r.key(uploadLocksPrefix))
+	if err != nil {
+		r.deleteLock(gcLockKey, log)
+		return nil, errors.Wrap(err, "error listing upload locks")
+	}
+	for _, key := range keys {
+		uploading, err := r.isLockedAt(key)
+		if err != nil {
+			r.deleteLock(gcLockKey, log)
+			return nil, err
+		}
+		if uploading {
+			r.deleteLock(gcLockKey, log)
+			return nil, nil
+		}
+	}
+	return r.startLock(gcLockKey, log), nil
+}
+
+// startLock refreshes the lock object with the key until the returned Lock is released.
+func (r *Repository) startLock(key string, log logrus.FieldLogger) *Lock {
+	l := &Lock{stop: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(l.done)
+		ticker := time.NewTicker(r.lockRefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-l.stop:
+				r.deleteLock(key, log)
+				return
+			case <-ticker.C:
+				if err := r.putLock(key); err != nil {
+					log.WithError(err).Warnf("Failed to refresh data mover repository lock %s", key)
+				}
+			}
+		}
+	}()
+	return l
+}
+
+// Release deletes the lock object.
+func (l *Lock) Release() {
+	close(l.stop)
+	<-l.done
+}
+
+func (r *Repository) putLock(key string) error {
+	data, err := json.Marshal(lockRecord{Time: time.Now().UTC()})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.Wrapf(r.store.PutObject(r.bucket, r.key(key), bytes.NewReader(data)), "error storing data mover repository lock %s", key)
+}
+
+func (r *Repository) deleteLock(key string, log logrus.FieldLogger) {
+	if err := r.store.DeleteObject(r.bucket, r.key(key)); err != nil {
+		log.WithError(err).Warnf("Failed to delete data mover repository lock %s", key)
+	}
+}
+
+// isLocked returns whether the lock object with the key exists and was refreshed within the lock expiry.
+func (r *Repository) isLocked(key string) (bool, error) {
+	return r.isLockedAt(r.key(key))
+}
+
+// isLockedAt returns whether the lock object with the key in the bucket exists and was refreshed within the lock expiry.
+func (r *Repository) isLockedAt(key string) (bool, error) {
+	exists, err := r.store.ObjectExists(r.bucket, key)
+	if err != nil {
+		return false, errors.Wrapf(err, "error checking for data mover repository lock %s", key)
+	}
+	if !exists {
+		return false, nil
+	}
+	obj, err := r.store.GetObject(r.bucket, key)
+	if err != nil {
+		// The lock was released meanwhile.
+		return false, nil
+	}
+	defer obj.Close()
+	record := lockRecord{}
+	if err := json.NewDecoder(obj).Decode(&record); err != nil {
+		return false, errors.Wrapf(err, "error decoding data mover repository lock %s", key)
+	}
+	return time.Since(record.Time) < r.lockExpiry, nil
+}
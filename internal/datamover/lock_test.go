@@ -0,0 +1,106 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package datamover
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// putLockRecord stores a lock object refreshed at the time.
+func putLockRecord(t *testing.T, store *FileSystemObjectStore, key string, refreshed time.Time) {
+	data, err := json.Marshal(lockRecord{Time: refreshed})
+	require.Nil(t, err)
+	require.Nil(t, store.PutObject(Bucket, key, bytes.NewReader(data)))
+}
+
+func TestCollectGarbageWhileUploading(t *testing.T) {
+	testCases := []struct {
+		name               string
+		uploadLockTime     time.Time
+		expectUnreferenced int
+	}{
+		{
+			name:               "the garbage is not collected while an upload holds a lock",
+			uploadLockTime:     time.Now(),
+			expectUnreferenced: 0,
+		},
+		{
+			name:               "the expired lock of an upload that died is ignored",
+			uploadLockTime:     time.Now().Add(-time.Hour),
+			expectUnreferenced: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			repository, store, cleanup := newTestRepository(t)
+			defer cleanup()
+			// The chunk is not referenced yet, as the upload has not stored its manifest.
+			_, err := repository.Upload(bytes.NewReader(randomData(11, 1024)), FormatTar, logrus.New())
+			require.Nil(t, err)
+			putLockRecord(t, store, uploadLocksPrefix+"upload-1", tc.uploadLockTime)
+
+			unreferenced, err := repository.CollectGarbage(false, logrus.New())
+			require.Nil(t, err)
+			assert.Equal(t, tc.expectUnreferenced, unreferenced)
+			assert.Equal(t, 1-tc.expectUnreferenced, countChunks(t, store))
+			exists, err := store.ObjectExists(Bucket, gcLockKey)
+			require.Nil(t, err)
+			assert.False(t, exists, "the lock of the garbage collection is released")
+		})
+	}
+}
+
+func TestLockForUpload(t *testing.T) {
+	repository, store, cleanup := newTestRepository(t)
+	defer cleanup()
+	repository.lockRetryPeriod = 10 * time.Millisecond
+	repository.uploadLockTimeout = 50 * time.Millisecond
+
+	// Uploads wait for the garbage collection, and fail once they waited too long.
+	putLockRecord(t, store, gcLockKey, time.Now())
+	_, err := repository.LockForUpload(logrus.New())
+	assert.Error(t, err)
+	keys, err := store.ListObjects(Bucket, uploadLocksPrefix)
+	require.Nil(t, err)
+	assert.Empty(t, keys)
+
+	// The expired lock of a garbage collection that died is ignored.
+	putLockRecord(t, store, gcLockKey, time.Now().Add(-time.Hour))
+	lock, err := repository.LockForUpload(logrus.New())
+	require.Nil(t, err)
+	keys, err = store.ListObjects(Bucket, uploadLocksPrefix)
+	require.Nil(t, err)
+	assert.Len(t, keys, 1)
+
+	// The garbage is not collected while the lock is held.
+	unreferenced, err := repository.CollectGarbage(false, logrus.New())
+	require.Nil(t, err)
+	assert.Zero(t, unreferenced)
+
+	lock.Release()
+	keys, err = store.ListObjects(Bucket, uploadLocksPrefix)
+	require.Nil(t, err)
+	assert.Empty(t, keys)
+}
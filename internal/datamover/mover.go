@@ -0,0 +1,395 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package datamover
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	snapshotv1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	corev1api "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/config"
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/util"
+)
+
+const (
+	// Bucket is the bucket of the object store that the data mover keeps chunks and manifests in.
+	Bucket = "velero-plugin-for-csi"
+
+	// DataMoverLabel is set on the temporary PVCs and pods created by the data mover.
+	DataMoverLabel = "velero.io/csi-data-mover"
+
+	moverContainerName = "data-mover"
+	moverVolumeName    = "data"
+	moverMountPath     = "/data"
+	moverDevicePath    = "/dev/data"
+)
+
+// Mover copies the data of volumes between the cluster and a Repository. Volumes are accessed through
+// short-lived pods, whose output or input is streamed through the API server.
+type Mover struct {
+	Client     kubernetes.Interface
+	RestConfig *rest.Config
+	Repository *Repository
+	// Image is the image of the mover pods.
+	Image string
+	// Timeout is how long to wait for a mover pod to start.
+	Timeout time.Duration
+	Log     logrus.FieldLogger
+
+	// execInPod runs commands in the mover pods. It defaults to util.ExecInPod.
+	execInPod func(pod *corev1api.Pod, container string, command []string, stdin io.Reader, stdout, stderr io.Writer) error
+	// closeRepository releases the object store of the repository.
+	closeRepository func()
+}
+
+// OpenRepository returns the Repository of the data mover in the object storage of the named backup storage location, along
+// with a function that releases the object store plugin it runs and the credentials written for it. With
+// cfg.DataMoverObjectStorePath set, the repository is in that directory instead, whatever the backup storage location.
+func OpenRepository(cfg config.Config, namespace, location string, log logrus.FieldLogger) (*Repository, func(), error) {
+	if cfg.DataMoverObjectStorePath != "" {
+		store := NewFileSystemObjectStore()
+		if err := store.Init(map[string]string{RootConfigKey: cfg.DataMoverObjectStorePath}); err != nil {
+			return nil, nil, errors.Wrap(err, "error initializing data mover object store")
+		}
+		return NewRepository(store, Bucket, ""), func() {}, nil
+	}
+
+	if location == "" {
+		return nil, nil, errors.Errorf("no backup storage location to keep the data mover repository in, set %s to use a directory instead", config.DataMoverObjectStorePathKey)
+	}
+	dynamicClient, err := util.GetDynamicClient()
+	if err != nil {
+		return nil, nil, err
+	}
+	client, _, err := util.GetClients()
+	if err != nil {
+		return nil, nil, err
+	}
+	bsl, err := util.GetBackupStorageLocation(dynamicClient, namespace, location)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "error getting backup storage location %s/%s", namespace, location)
+	}
+	getter, closePlugins, err := NewPluginObjectStoreGetter(DefaultPluginDir, log)
+	if err != nil {
+		return nil, nil, err
+	}
+	repository, removeCredentials, err := NewRepositoryForLocation(bsl, getter, client.CoreV1())
+	if err != nil {
+		closePlugins()
+		return nil, nil, err
+	}
+	return repository, func() {
+		closePlugins()
+		removeCredentials()
+	}, nil
+}
+
+// NewMover returns a Mover for the cluster the plugin runs in that copies data to the repository of the named backup storage
+// location, as OpenRepository does. The Mover must be closed once done.
+func NewMover(cfg config.Config, namespace, location string, log logrus.FieldLogger) (*Mover, error) {
+	restConfig, err := util.GetClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	repository, closeRepository, err := OpenRepository(cfg, namespace, location, log)
+	if err != nil {
+		return nil, err
+	}
+	return &Mover{
+		Client:          client,
+		RestConfig:      restConfig,
+		Repository:      repository,
+		Image:           cfg.DataMoverImage,
+		Timeout:         cfg.DataMoverTimeout,
+		Log:             log,
+		closeRepository: closeRepository,
+	}, nil
+}
+
+// Close releases the object store of the repository.
+func (m *Mover) Close() {
+	if m.closeRepository != nil {
+		m.closeRepository()
+	}
+}
+
+// BackupVolumeSnapshot provisions a temporary PVC from the volumesnapshot of sourcePVC, uploads its data to the
+// repository and stores the manifest of the upload under manifestKey.
+func (m *Mover) BackupVolumeSnapshot(vs *snapshotv1api.VolumeSnapshot, sourcePVC *corev1api.PersistentVolumeClaim, restoreSize *resource.Quantity,
+	manifestKey string) (*Manifest, error) {
+	storage := sourcePVC.Spec.Resources.Requests[corev1api.ResourceStorage]
+	if restoreSize != nil && storage.Cmp(*restoreSize) < 0 {
+		storage = *restoreSize
+	}
+	pvc := &corev1api.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "velero-data-mover-",
+			Namespace:    vs.Namespace,
+			Labels:       moverLabels(),
+		},
+		Spec: corev1api.PersistentVolumeClaimSpec{
+			AccessModes:      sourcePVC.Spec.AccessModes,
+			StorageClassName: sourcePVC.Spec.StorageClassName,
+			VolumeMode:       sourcePVC.Spec.VolumeMode,
+			Resources: corev1api.ResourceRequirements{
+				Requests: corev1api.ResourceList{corev1api.ResourceStorage: storage},
+			},
+			DataSource: &corev1api.TypedLocalObjectReference{
+				APIGroup: &snapshotv1api.SchemeGroupVersion.Group,
+				Kind:     "VolumeSnapshot",
+				Name:     vs.Name,
+			},
+		},
+	}
+	pvc, err := m.Client.CoreV1().PersistentVolumeClaims(pvc.Namespace).Create(context.TODO(), pvc, metav1.CreateOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating PVC from volumesnapshot %s/%s", vs.Namespace, vs.Name)
+	}
+	m.Log.Infof("Created PVC %s/%s from volumesnapshot %s/%s to upload its data", pvc.Namespace, pvc.Name, vs.Namespace, vs.Name)
+	defer m.deletePVC(pvc)
+
+	block := isBlock(pvc)
+	pod, err := m.startPod(pvc, block, true)
+	if err != nil {
+		return nil, err
+	}
+	defer m.deletePod(pod)
+
+	format, command := FormatTar, []string{"tar", "-cf", "-", "-C", moverMountPath, "."}
+	if block {
+		format, command = FormatBlock, []string{"cat", moverDevicePath}
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(m.exec(pod, command, nil, pw))
+	}()
+	// The chunks found already stored must not be collected before the manifest referencing them is stored.
+	lock, err := m.Repository.LockForUpload(m.Log)
+	if err != nil {
+		pr.CloseWithError(errors.New("upload stopped"))
+		return nil, err
+	}
+	defer lock.Release()
+	manifest, err := m.Repository.Upload(pr, format, m.Log)
+	pr.CloseWithError(errors.New("upload stopped"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error uploading data of volumesnapshot %s/%s", vs.Namespace, vs.Name)
+	}
+
+	if err := m.Repository.PutManifest(manifestKey, manifest); err != nil {
+		return nil, err
+	}
+	m.Log.Infof("Uploaded %s from volumesnapshot %s/%s", manifest, vs.Namespace, vs.Name)
+	return manifest, nil
+}
+
+// RestorePVC creates pvc and populates its volume with the data uploaded under manifestKey.
+// The PVC is deleted again if it cannot be populated.
+func (m *Mover) RestorePVC(pvc *corev1api.PersistentVolumeClaim, manifestKey string) error {
+	manifest, err := m.Repository.GetManifest(manifestKey)
+	if err != nil {
+		return err
+	}
+	if block := isBlock(pvc); block != (manifest.Format == FormatBlock) {
+		return errors.Errorf("cannot restore %s to PVC %s/%s with volume mode %s", manifest, pvc.Namespace, pvc.Name, volumeMode(pvc))
+	}
+
+	created, err := m.Client.CoreV1().PersistentVolumeClaims(pvc.Namespace).Create(context.TODO(), pvc, metav1.CreateOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "error creating PVC %s/%s", pvc.Namespace, pvc.Name)
+	}
+	m.Log.Infof("Created PVC %s/%s to restore %s into", created.Namespace, created.Name, manifest)
+
+	if err := m.populate(created, manifest); err != nil {
+		m.deletePVC(created)
+		return errors.Wrapf(err, "error restoring data to PVC %s/%s", created.Namespace, created.Name)
+	}
+	m.Log.Infof("Restored %s to PVC %s/%s", manifest, created.Namespace, created.Name)
+	return nil
+}
+
+func (m *Mover) populate(pvc *corev1api.PersistentVolumeClaim, manifest *Manifest) error {
+	pod, err := m.startPod(pvc, manifest.Format == FormatBlock, false)
+	if err != nil {
+		return err
+	}
+	defer m.deletePod(pod)
+
+	command := []string{"tar", "-xf", "-", "-C", moverMountPath}
+	if manifest.Format == FormatBlock {
+		command = []string{"sh", "-c", "cat > " + moverDevicePath}
+	}
+
+	pr, pw := io.Pipe()
+	downloadErr := make(chan error, 1)
+	go func() {
+		err := m.Repository.Download(manifest, pw)
+		pw.CloseWithError(err)
+		downloadErr <- err
+	}()
+	execErr := m.exec(pod, command, pr, nil)
+	pr.CloseWithError(errors.New("restore stopped"))
+	if err := <-downloadErr; err != nil {
+		return err
+	}
+	return execErr
+}
+
+// startPod creates a pod that mounts the PVC, or attaches it as a device when block is set, and waits for it to run.
+func (m *Mover) startPod(pvc *corev1api.PersistentVolumeClaim, block, readOnly bool) (*corev1api.Pod, error) {
+	var root int64
+	container := corev1api.Container{
+		Name:    moverContainerName,
+		Image:   m.Image,
+		Command: []string{"sh", "-c", "trap 'exit 0' TERM; while true; do sleep 1; done"},
+		SecurityContext: &corev1api.SecurityContext{
+			RunAsUser: &root,
+		},
+	}
+	if block {
+		container.VolumeDevices = []corev1api.VolumeDevice{{Name: moverVolumeName, DevicePath: moverDevicePath}}
+	} else {
+		container.VolumeMounts = []corev1api.VolumeMount{{Name: moverVolumeName, MountPath: moverMountPath, ReadOnly: readOnly}}
+	}
+
+	pod := &corev1api.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "velero-data-mover-",
+			Namespace:    pvc.Namespace,
+			Labels:       moverLabels(),
+		},
+		Spec: corev1api.PodSpec{
+			Containers:    []corev1api.Container{container},
+			RestartPolicy: corev1api.RestartPolicyNever,
+			Volumes: []corev1api.Volume{
+				{
+					Name: moverVolumeName,
+					VolumeSource: corev1api.VolumeSource{
+						PersistentVolumeClaim: &corev1api.PersistentVolumeClaimVolumeSource{
+							ClaimName: pvc.Name,
+							ReadOnly:  readOnly,
+						},
+					},
+				},
+			},
+		},
+	}
+	pod, err := m.Client.CoreV1().Pods(pvc.Namespace).Create(context.TODO(), pod, metav1.CreateOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating data mover pod for PVC %s/%s", pvc.Namespace, pvc.Name)
+	}
+	m.Log.Infof("Created data mover pod %s/%s for PVC %s/%s", pod.Namespace, pod.Name, pvc.Namespace, pvc.Name)
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+	defer cancel()
+	lw := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", pod.Name).String()
+			return m.Client.CoreV1().Pods(pod.Namespace).List(ctx, options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", pod.Name).String()
+			return m.Client.CoreV1().Pods(pod.Namespace).Watch(ctx, options)
+		},
+	}
+	_, err = util.WaitForObject(ctx, lw, &corev1api.Pod{}, pod.Namespace, pod.Name, func(obj runtime.Object) (bool, error) {
+		switch phase := obj.(*corev1api.Pod).Status.Phase; phase {
+		case corev1api.PodRunning:
+			return true, nil
+		case corev1api.PodSucceeded, corev1api.PodFailed:
+			return false, errors.Errorf("data mover pod %s/%s exited with phase %s", pod.Namespace, pod.Name, phase)
+		}
+		m.Log.Infof("Waiting for data mover pod %s/%s to run", pod.Namespace, pod.Name)
+		return false, nil
+	})
+	if err != nil {
+		m.deletePod(pod)
+		return nil, errors.Wrapf(err, "error waiting for data mover pod %s/%s to run", pod.Namespace, pod.Name)
+	}
+	return pod, nil
+}
+
+// exec runs command in the mover container of pod, streaming stdin to it and its output to stdout.
+func (m *Mover) exec(pod *corev1api.Pod, command []string, stdin io.Reader, stdout io.Writer) error {
+	execInPod := m.execInPod
+	if execInPod == nil {
+		execInPod = func(pod *corev1api.Pod, container string, command []string, stdin io.Reader, stdout, stderr io.Writer) error {
+			return util.ExecInPod(m.Client, m.RestConfig, pod, container, command, stdin, stdout, stderr)
+		}
+	}
+
+	var stderr bytes.Buffer
+	if err := execInPod(pod, moverContainerName, command, stdin, stdout, &stderr); err != nil {
+		return errors.Wrapf(err, "error in data mover pod: %s", stderr.String())
+	}
+	return nil
+}
+
+func (m *Mover) deletePod(pod *corev1api.Pod) {
+	var gracePeriod int64
+	err := m.Client.CoreV1().Pods(pod.Namespace).Delete(context.TODO(), pod.Name, metav1.DeleteOptions{GracePeriodSeconds: &gracePeriod})
+	if err != nil && !apierrors.IsNotFound(err) {
+		m.Log.WithError(err).Errorf("Failed to delete data mover pod %s/%s", pod.Namespace, pod.Name)
+	}
+}
+
+func (m *Mover) deletePVC(pvc *corev1api.PersistentVolumeClaim) {
+	err := m.Client.CoreV1().PersistentVolumeClaims(pvc.Namespace).Delete(context.TODO(), pvc.Name, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		m.Log.WithError(err).Errorf("Failed to delete PVC %s/%s", pvc.Namespace, pvc.Name)
+	}
+}
+
+func moverLabels() map[string]string {
+	return map[string]string{
+		DataMoverLabel:              "true",
+		util.ExcludeFromBackupLabel: "true",
+	}
+}
+
+func isBlock(pvc *corev1api.PersistentVolumeClaim) bool {
+	return volumeMode(pvc) == corev1api.PersistentVolumeBlock
+}
+
+func volumeMode(pvc *corev1api.PersistentVolumeClaim) corev1api.PersistentVolumeMode {
+	if pvc.Spec.VolumeMode == nil {
+		return corev1api.PersistentVolumeFilesystem
+	}
+	return *pvc.Spec.VolumeMode
+}
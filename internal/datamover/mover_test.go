@@ -0,0 +1,289 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package datamover
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	snapshotv1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	corev1api "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// fakeExec stands in for running commands in the mover pods. It writes output to the stdout of the commands, keeps what is
+// streamed to their stdin, and fails them with err.
+type fakeExec struct {
+	output   []byte
+	err      error
+	pods     []*corev1api.Pod
+	commands [][]string
+	input    bytes.Buffer
+}
+
+func (e *fakeExec) execInPod(pod *corev1api.Pod, container string, command []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	e.pods = append(e.pods, pod)
+	e.commands = append(e.commands, command)
+	if e.err != nil {
+		fmt.Fprint(stderr, "command failed")
+		return e.err
+	}
+	if stdin != nil {
+		if _, err := io.Copy(&e.input, stdin); err != nil {
+			return err
+		}
+	}
+	if stdout != nil {
+		if _, err := stdout.Write(e.output); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newTestClientset returns a fake clientset that names the objects created with a generate name, and runs the pods created
+// through it at once.
+func newTestClientset() *fake.Clientset {
+	client := fake.NewSimpleClientset()
+	generated := 0
+	client.PrependReactor("create", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		obj := action.(k8stesting.CreateAction).GetObject()
+		accessor, err := meta.Accessor(obj)
+		if err != nil {
+			return false, nil, err
+		}
+		if accessor.GetName() == "" && accessor.GetGenerateName() != "" {
+			generated++
+			accessor.SetName(fmt.Sprintf("%s%d", accessor.GetGenerateName(), generated))
+		}
+		if pod, ok := obj.(*corev1api.Pod); ok {
+			pod.Status.Phase = corev1api.PodRunning
+		}
+		return false, nil, nil
+	})
+	return client
+}
+
+func newTestMover(t *testing.T, exec *fakeExec) (*Mover, *fake.Clientset, func()) {
+	repository, _, cleanup := newTestRepository(t)
+	client := newTestClientset()
+	return &Mover{
+		Client:     client,
+		Repository: repository,
+		Image:      "busybox",
+		Timeout:    5 * time.Second,
+		Log:        logrus.New(),
+		execInPod:  exec.execInPod,
+	}, client, cleanup
+}
+
+func newTestPVC(name string, volumeMode corev1api.PersistentVolumeMode) *corev1api.PersistentVolumeClaim {
+	return &corev1api.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "ns-1",
+		},
+		Spec: corev1api.PersistentVolumeClaimSpec{
+			AccessModes: []corev1api.PersistentVolumeAccessMode{corev1api.ReadWriteOnce},
+			VolumeMode:  &volumeMode,
+			Resources: corev1api.ResourceRequirements{
+				Requests: corev1api.ResourceList{corev1api.ResourceStorage: resource.MustParse("1Gi")},
+			},
+		},
+	}
+}
+
+// assertMoverResourcesDeleted asserts that the temporary PVCs and pods of the data mover are gone.
+func assertMoverResourcesDeleted(t *testing.T, client *fake.Clientset) {
+	selector := metav1.ListOptions{LabelSelector: DataMoverLabel}
+	pvcs, err := client.CoreV1().PersistentVolumeClaims("ns-1").List(context.TODO(), selector)
+	require.Nil(t, err)
+	assert.Empty(t, pvcs.Items)
+	pods, err := client.CoreV1().Pods("ns-1").List(context.TODO(), metav1.ListOptions{})
+	require.Nil(t, err)
+	assert.Empty(t, pods.Items)
+}
+
+func TestBackupVolumeSnapshot(t *testing.T) {
+	data := bytes.Repeat([]byte("volume data "), 4096)
+	vs := &snapshotv1api.VolumeSnapshot{ObjectMeta: metav1.ObjectMeta{Name: "vs-1", Namespace: "ns-1"}}
+
+	testCases := []struct {
+		name            string
+		volumeMode      corev1api.PersistentVolumeMode
+		execErr         error
+		expectedCommand []string
+		expectedFormat  string
+		expectError     bool
+	}{
+		{
+			name:            "filesystem volumes are streamed as a tar archive",
+			volumeMode:      corev1api.PersistentVolumeFilesystem,
+			expectedCommand: []string{"tar", "-cf", "-", "-C", "/data", "."},
+			expectedFormat:  FormatTar,
+		},
+		{
+			name:            "block volumes are streamed from the device",
+			volumeMode:      corev1api.PersistentVolumeBlock,
+			expectedCommand: []string{"cat", "/dev/data"},
+			expectedFormat:  FormatBlock,
+		},
+		{
+			name:            "the PVC and pod are deleted when the data cannot be read",
+			volumeMode:      corev1api.PersistentVolumeFilesystem,
+			execErr:         errors.New("container not found"),
+			expectedCommand: []string{"tar", "-cf", "-", "-C", "/data", "."},
+			expectError:     true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			exec := &fakeExec{output: data, err: tc.execErr}
+			m, client, cleanup := newTestMover(t, exec)
+			defer cleanup()
+
+			manifestKey := ManifestKey("backup-1", "ns-1", "pvc-1")
+			manifest, err := m.BackupVolumeSnapshot(vs, newTestPVC("pvc-1", tc.volumeMode), nil, manifestKey)
+			assertMoverResourcesDeleted(t, client)
+			require.Len(t, exec.commands, 1)
+			assert.Equal(t, tc.expectedCommand, exec.commands[0])
+			if tc.expectError {
+				assert.Error(t, err)
+				_, err := m.Repository.GetManifest(manifestKey)
+				assert.Error(t, err)
+				return
+			}
+			require.Nil(t, err)
+
+			pvcs := createdPVCs(client)
+			require.Len(t, pvcs, 1)
+			assert.Equal(t, "VolumeSnapshot", pvcs[0].Spec.DataSource.Kind)
+			assert.Equal(t, "vs-1", pvcs[0].Spec.DataSource.Name)
+			require.Len(t, exec.pods, 1)
+			// The temporary PVC is the first object named by the fake clientset.
+			assert.Equal(t, "velero-data-mover-1", exec.pods[0].Spec.Volumes[0].PersistentVolumeClaim.ClaimName)
+			assert.True(t, exec.pods[0].Spec.Volumes[0].PersistentVolumeClaim.ReadOnly)
+
+			assert.Equal(t, tc.expectedFormat, manifest.Format)
+			stored, err := m.Repository.GetManifest(manifestKey)
+			require.Nil(t, err)
+			var downloaded bytes.Buffer
+			require.Nil(t, m.Repository.Download(stored, &downloaded))
+			assert.Equal(t, data, downloaded.Bytes())
+		})
+	}
+}
+
+func TestRestorePVC(t *testing.T) {
+	data := bytes.Repeat([]byte("volume data "), 4096)
+
+	testCases := []struct {
+		name            string
+		volumeMode      corev1api.PersistentVolumeMode
+		format          string
+		execErr         error
+		expectedCommand []string
+		expectError     bool
+	}{
+		{
+			name:            "filesystem volumes are populated from a tar archive",
+			volumeMode:      corev1api.PersistentVolumeFilesystem,
+			format:          FormatTar,
+			expectedCommand: []string{"tar", "-xf", "-", "-C", "/data"},
+		},
+		{
+			name:            "block volumes are populated through the device",
+			volumeMode:      corev1api.PersistentVolumeBlock,
+			format:          FormatBlock,
+			expectedCommand: []string{"sh", "-c", "cat > /dev/data"},
+		},
+		{
+			name:            "the PVC is deleted when it cannot be populated",
+			volumeMode:      corev1api.PersistentVolumeFilesystem,
+			format:          FormatTar,
+			execErr:         errors.New("container not found"),
+			expectedCommand: []string{"tar", "-xf", "-", "-C", "/data"},
+			expectError:     true,
+		},
+		{
+			name:        "data of another volume mode is not restored",
+			volumeMode:  corev1api.PersistentVolumeBlock,
+			format:      FormatTar,
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			exec := &fakeExec{err: tc.execErr}
+			m, client, cleanup := newTestMover(t, exec)
+			defer cleanup()
+
+			manifestKey := ManifestKey("backup-1", "ns-1", "pvc-1")
+			manifest, err := m.Repository.Upload(bytes.NewReader(data), tc.format, m.Log)
+			require.Nil(t, err)
+			require.Nil(t, m.Repository.PutManifest(manifestKey, manifest))
+
+			err = m.RestorePVC(newTestPVC("pvc-1", tc.volumeMode), manifestKey)
+			assertMoverResourcesDeleted(t, client)
+			if tc.expectedCommand != nil {
+				require.Len(t, exec.commands, 1)
+				assert.Equal(t, tc.expectedCommand, exec.commands[0])
+			} else {
+				assert.Empty(t, exec.commands)
+			}
+
+			_, getErr := client.CoreV1().PersistentVolumeClaims("ns-1").Get(context.TODO(), "pvc-1", metav1.GetOptions{})
+			if tc.expectError {
+				assert.Error(t, err)
+				assert.Error(t, getErr)
+				return
+			}
+			require.Nil(t, err)
+			assert.Nil(t, getErr)
+			require.Len(t, exec.pods, 1)
+			assert.Equal(t, "pvc-1", exec.pods[0].Spec.Volumes[0].PersistentVolumeClaim.ClaimName)
+			assert.Equal(t, data, exec.input.Bytes())
+		})
+	}
+}
+
+// createdPVCs returns the PVCs created through the fake clientset.
+func createdPVCs(client *fake.Clientset) []*corev1api.PersistentVolumeClaim {
+	created := []*corev1api.PersistentVolumeClaim{}
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "create" && action.GetResource().Resource == "persistentvolumeclaims" {
+			created = append(created, action.(k8stesting.CreateAction).GetObject().(*corev1api.PersistentVolumeClaim))
+		}
+	}
+	return created
+}
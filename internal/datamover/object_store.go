@@ -0,0 +1,303 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package datamover
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	hclog "github.com/hashicorp/go-hclog"
+	plugin "github.com/hashicorp/go-plugin"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	corev1api "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+)
+
+const (
+	// DefaultPluginDir is the directory that Velero runs its plugins, among which the object store plugins, from.
+	DefaultPluginDir = "/plugins"
+
+	// locationPrefix is the directory, below the prefix of a backup storage location, that the repository is kept in.
+	// Velero leaves the plugins directory of backup storage locations to plugins.
+	locationPrefix = "plugins/velero-plugin-for-csi/"
+
+	// credentialsFilePrefix is the prefix of the temporary files that the credentials of backup storage locations are written to
+	// for the object store plugins.
+	credentialsFilePrefix = "velero-plugin-for-csi-credentials-"
+)
+
+var (
+	discoveryLock sync.Mutex
+	// discovered caches, per plugin directory, the executables that serve the object store plugins, as discovering them runs
+	// every executable in the directory.
+	discovered = map[string]map[string]string{}
+)
+
+// ObjectStoreGetter returns the object store of a provider, as the Velero plugin manager does.
+type ObjectStoreGetter interface {
+	GetObjectStore(provider string) (velero.ObjectStore, error)
+}
+
+// pluginObjectStores runs the object store plugins in a directory, as the Velero server does.
+type pluginObjectStores struct {
+	log logrus.FieldLogger
+	// output logs the output of the plugins.
+	output *io.PipeWriter
+	// commands maps the names of the object store plugins to the executables that serve them.
+	commands map[string]string
+
+	lock    sync.Mutex
+	clients map[string]*plugin.Client
+}
+
+// NewPluginObjectStoreGetter returns an ObjectStoreGetter that runs the object store plugins in pluginDir, along with a function
+// that stops the plugins it ran. The plugins in pluginDir are only discovered once per process.
+func NewPluginObjectStoreGetter(pluginDir string, log logrus.FieldLogger) (ObjectStoreGetter, func(), error) {
+	commands, err := discoverObjectStores(pluginDir, log)
+	if err != nil {
+		return nil, nil, err
+	}
+	s := &pluginObjectStores{log: log, output: newLogWriter(log), commands: commands, clients: map[string]*plugin.Client{}}
+	return s, s.close, nil
+}
+
+// discoverObjectStores returns the names of the object store plugins in pluginDir mapped to the executables that serve them.
+// The executable of the plugin itself, which serves no object store, is skipped.
+func discoverObjectStores(pluginDir string, log logrus.FieldLogger) (map[string]string, error) {
+	discoveryLock.Lock()
+	defer discoveryLock.Unlock()
+	if commands, ok := discovered[pluginDir]; ok {
+		return commands, nil
+	}
+
+	var self os.FileInfo
+	if executable, err := os.Executable(); err == nil {
+		self, _ = os.Stat(executable)
+	}
+	output := newLogWriter(log)
+	defer output.Close()
+	commands := map[string]string{}
+	err := filepath.Walk(pluginDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == pluginDir {
+				return nil
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() || info.Mode()&0111 == 0 || (self != nil && os.SameFile(info, self)) {
+			return nil
+		}
+		return discover(p, commands, log, output)
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error discovering plugins in %s", pluginDir)
+	}
+	if len(commands) == 0 {
+		return nil, errors.Errorf("no object store plugins found in %s", pluginDir)
+	}
+	discovered[pluginDir] = commands
+	return commands, nil
+}
+
+// discover records in commands the object store plugins served by the executable.
+func discover(command string, commands map[string]string, log logrus.FieldLogger, output io.Writer) error {
+	client := newPluginClient(command, log, output)
+	defer client.Kill()
+	lister, err := dispense(client, framework.PluginKindPluginLister)
+	if err != nil {
+		return errors.WithMessagef(err, "error listing the plugins of %s", command)
+	}
+	ids, err := lister.(framework.PluginLister).ListPlugins()
+	if err != nil {
+		return errors.Wrapf(err, "error listing the plugins of %s", command)
+	}
+	for _, id := range ids {
+		if id.Kind == framework.PluginKindObjectStore {
+			commands[id.Name] = command
+		}
+	}
+	return nil
+}
+
+// GetObjectStore returns the object store plugin of the provider, running its executable if it does not run yet. As in Velero,
+// providers without a namespace are in the velero.io namespace.
+func (s *pluginObjectStores) GetObjectStore(provider string) (velero.ObjectStore, error) {
+	name := provider
+	if !strings.Contains(name, "/") {
+		name = "velero.io/" + name
+	}
+	command, ok := s.commands[name]
+	if !ok {
+		return nil, errors.Errorf("object store plugin %s not found", name)
+	}
+
+	s.lock.Lock()
+	client, ok := s.clients[command]
+	if !ok {
+		client = newPluginClient(command, s.log, s.output)
+		s.clients[command] = client
+	}
+	s.lock.Unlock()
+
+	dispenser, err := dispense(client, framework.PluginKindObjectStore)
+	if err != nil {
+		return nil, err
+	}
+	store, ok := dispenser.(framework.ClientDispenser).ClientFor(name).(velero.ObjectStore)
+	if !ok {
+		return nil, errors.Errorf("plugin %s is not an object store", name)
+	}
+	return store, nil
+}
+
+func (s *pluginObjectStores) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for command, client := range s.clients {
+		client.Kill()
+		delete(s.clients, command)
+	}
+	s.output.Close()
+}
+
+func newPluginClient(command string, log logrus.FieldLogger, output io.Writer) *plugin.Client {
+	return plugin.NewClient(&plugin.ClientConfig{
+		HandshakeConfig:  framework.Handshake(),
+		AllowedProtocols: []plugin.Protocol{plugin.ProtocolGRPC},
+		Plugins: map[string]plugin.Plugin{
+			string(framework.PluginKindObjectStore):  framework.NewObjectStorePlugin(framework.ClientLogger(log)),
+			string(framework.PluginKindPluginLister): &framework.PluginListerPlugin{},
+		},
+		Logger: hclog.New(&hclog.LoggerOptions{Name: filepath.Base(command), Output: output, Level: hclog.Info}),
+		Cmd:    exec.Command(command),
+	})
+}
+
+func dispense(client *plugin.Client, kind framework.PluginKind) (interface{}, error) {
+	protocolClient, err := client.Client()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	dispensed, err := protocolClient.Dispense(string(kind))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return dispensed, nil
+}
+
+// newLogWriter returns a writer that logs each line written to it, until it is closed.
+func newLogWriter(log logrus.FieldLogger) *io.PipeWriter {
+	r, w := io.Pipe()
+	go func() {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			log.Info(scanner.Text())
+		}
+	}()
+	return w
+}
+
+// NewRepositoryForLocation returns the Repository in the object storage of the backup storage location, through the object
+// store plugin of its provider configured as Velero configures it for the location, along with a function that removes the
+// credentials written for the plugin once the repository is no longer used.
+func NewRepositoryForLocation(location *velerov1api.BackupStorageLocation, getter ObjectStoreGetter, secrets corev1client.SecretsGetter) (*Repository, func(), error) {
+	if location.Spec.ObjectStorage == nil {
+		return nil, nil, errors.Errorf("backup storage location %s/%s does not use object storage", location.Namespace, location.Name)
+	}
+	if location.Spec.Provider == "" {
+		return nil, nil, errors.Errorf("backup storage location %s/%s has no provider", location.Namespace, location.Name)
+	}
+
+	bucket := strings.Trim(location.Spec.ObjectStorage.Bucket, "/")
+	prefix := strings.Trim(location.Spec.ObjectStorage.Prefix, "/")
+	cfg := map[string]string{}
+	for k, v := range location.Spec.Config {
+		cfg[k] = v
+	}
+	cfg["bucket"] = bucket
+	cfg["prefix"] = prefix
+	if location.Spec.ObjectStorage.CACert != nil {
+		cfg["caCert"] = string(location.Spec.ObjectStorage.CACert)
+	}
+	removeCredentials := func() {}
+	if location.Spec.Credential != nil {
+		credentialsFile, err := writeCredentialsFile(location.Namespace, location.Spec.Credential, secrets)
+		if err != nil {
+			return nil, nil, errors.WithMessagef(err, "error getting the credentials of backup storage location %s/%s", location.Namespace, location.Name)
+		}
+		cfg["credentialsFile"] = credentialsFile
+		removeCredentials = func() { os.Remove(credentialsFile) }
+	}
+
+	store, err := getter.GetObjectStore(location.Spec.Provider)
+	if err != nil {
+		removeCredentials()
+		return nil, nil, errors.Wrapf(err, "error getting object store plugin %s of backup storage location %s/%s", location.Spec.Provider, location.Namespace, location.Name)
+	}
+	if err := store.Init(cfg); err != nil {
+		removeCredentials()
+		return nil, nil, errors.Wrapf(err, "error initializing the object store of backup storage location %s/%s", location.Namespace, location.Name)
+	}
+
+	repositoryPrefix := locationPrefix
+	if prefix != "" {
+		repositoryPrefix = prefix + "/" + locationPrefix
+	}
+	return NewRepository(store, bucket, repositoryPrefix), removeCredentials, nil
+}
+
+// writeCredentialsFile writes the key of the secret in the namespace to a new temporary file and returns its path.
+func writeCredentialsFile(namespace string, selector *corev1api.SecretKeySelector, secrets corev1client.SecretsGetter) (string, error) {
+	secret, err := secrets.Secrets(namespace).Get(context.TODO(), selector.Name, metav1.GetOptions{})
+	if err != nil {
+		return "", errors.Wrapf(err, "error getting secret %s/%s", namespace, selector.Name)
+	}
+	data, ok := secret.Data[selector.Key]
+	if !ok {
+		return "", errors.Errorf("secret %s/%s has no key %s", namespace, selector.Name, selector.Key)
+	}
+
+	// Temporary files are only readable by their owner.
+	f, err := ioutil.TempFile("", credentialsFilePrefix)
+	if err != nil {
+		return "", errors.Wrap(err, "error creating credentials file")
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", errors.Wrapf(err, "error writing credentials file %s", f.Name())
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", errors.Wrapf(err, "error writing credentials file %s", f.Name())
+	}
+	return f.Name(), nil
+}
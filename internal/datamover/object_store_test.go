@@ -0,0 +1,172 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package datamover
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	corev1api "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+)
+
+// recordingObjectStores returns filesystem object stores and keeps the config they were initialized with.
+type recordingObjectStores struct {
+	config map[string]string
+}
+
+func (r *recordingObjectStores) GetObjectStore(provider string) (velero.ObjectStore, error) {
+	return &recordingObjectStore{FileSystemObjectStore: NewFileSystemObjectStore(), stores: r}, nil
+}
+
+type recordingObjectStore struct {
+	*FileSystemObjectStore
+	stores *recordingObjectStores
+}
+
+func (s *recordingObjectStore) Init(config map[string]string) error {
+	s.stores.config = config
+	return s.FileSystemObjectStore.Init(config)
+}
+
+func TestNewRepositoryForLocation(t *testing.T) {
+	root, err := ioutil.TempDir("", "location")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	newLocation := func(prefix string, credential *corev1api.SecretKeySelector) *velerov1api.BackupStorageLocation {
+		return &velerov1api.BackupStorageLocation{
+			ObjectMeta: metav1.ObjectMeta{Name: "default", Namespace: "velero"},
+			Spec: velerov1api.BackupStorageLocationSpec{
+				Provider:    "filesystem",
+				Config:      map[string]string{RootConfigKey: root, "region": "us-east-1"},
+				StorageType: velerov1api.StorageType{ObjectStorage: &velerov1api.ObjectStorageLocation{Bucket: "bucket", Prefix: prefix}},
+				Credential:  credential,
+			},
+		}
+	}
+	secrets := fake.NewSimpleClientset(&corev1api.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "cloud-credentials", Namespace: "velero"},
+		Data:       map[string][]byte{"cloud": []byte("secret key")},
+	}).CoreV1()
+
+	testCases := []struct {
+		name                string
+		location            *velerov1api.BackupStorageLocation
+		expectedManifestKey string
+		expectCredentials   bool
+		expectError         bool
+	}{
+		{
+			name:                "repository below the prefix of the location",
+			location:            newLocation("/cluster-1/", nil),
+			expectedManifestKey: "cluster-1/plugins/velero-plugin-for-csi/manifests/backup-1/ns-1/pvc-1.json",
+		},
+		{
+			name:                "repository at the root of the bucket without prefix",
+			location:            newLocation("", nil),
+			expectedManifestKey: "plugins/velero-plugin-for-csi/manifests/backup-1/ns-1/pvc-1.json",
+		},
+		{
+			name:                "credentials of the location",
+			location:            newLocation("", &corev1api.SecretKeySelector{LocalObjectReference: corev1api.LocalObjectReference{Name: "cloud-credentials"}, Key: "cloud"}),
+			expectedManifestKey: "plugins/velero-plugin-for-csi/manifests/backup-1/ns-1/pvc-1.json",
+			expectCredentials:   true,
+		},
+		{
+			name:        "missing credentials",
+			location:    newLocation("", &corev1api.SecretKeySelector{LocalObjectReference: corev1api.LocalObjectReference{Name: "cloud-credentials"}, Key: "other"}),
+			expectError: true,
+		},
+		{
+			name: "location without object storage",
+			location: &velerov1api.BackupStorageLocation{
+				ObjectMeta: metav1.ObjectMeta{Name: "default", Namespace: "velero"},
+				Spec:       velerov1api.BackupStorageLocationSpec{Provider: "filesystem"},
+			},
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stores := &recordingObjectStores{}
+			repository, removeCredentials, err := NewRepositoryForLocation(tc.location, stores, secrets)
+			if tc.expectError {
+				assert.Error(t, err)
+				return
+			}
+			require.Nil(t, err)
+			defer removeCredentials()
+			assert.Equal(t, "bucket", stores.config["bucket"])
+			assert.Equal(t, "us-east-1", stores.config["region"])
+
+			manifest, err := repository.Upload(bytes.NewReader([]byte("data")), FormatTar, logrus.New())
+			require.Nil(t, err)
+			require.Nil(t, repository.PutManifest(ManifestKey("backup-1", "ns-1", "pvc-1"), manifest))
+			store := NewFileSystemObjectStore()
+			require.Nil(t, store.Init(map[string]string{RootConfigKey: root}))
+			exists, err := store.ObjectExists("bucket", tc.expectedManifestKey)
+			require.Nil(t, err)
+			assert.True(t, exists)
+
+			credentialsFile, ok := stores.config["credentialsFile"]
+			assert.Equal(t, tc.expectCredentials, ok)
+			if ok {
+				data, err := ioutil.ReadFile(credentialsFile)
+				require.Nil(t, err)
+				assert.Equal(t, "secret key", string(data))
+				info, err := os.Stat(credentialsFile)
+				require.Nil(t, err)
+				assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+				removeCredentials()
+				_, err = os.Stat(credentialsFile)
+				assert.True(t, os.IsNotExist(err))
+			}
+		})
+	}
+}
+
+func TestPluginObjectStoreGetterWithoutPlugins(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plugins")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	_, _, err = NewPluginObjectStoreGetter(filepath.Join(dir, "missing"), logrus.New())
+	assert.EqualError(t, err, "no object store plugins found in "+filepath.Join(dir, "missing"))
+
+	// The executable of the plugin itself is not run to discover its plugins.
+	executable, err := os.Executable()
+	require.Nil(t, err)
+	if err := os.Link(executable, filepath.Join(dir, "velero-plugin-for-csi")); err != nil {
+		t.Skipf("cannot link the test executable into the plugin directory: %v", err)
+	}
+	_, _, err = NewPluginObjectStoreGetter(dir, logrus.New())
+	assert.EqualError(t, err, "no object store plugins found in "+dir)
+}
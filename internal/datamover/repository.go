@@ -0,0 +1,350 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package datamover
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+)
+
+const (
+	// FormatTar is the format of data uploaded from volumes with a Filesystem volume mode.
+	FormatTar = "tar"
+	// FormatBlock is the format of data uploaded from volumes with a Block volume mode.
+	FormatBlock = "block"
+
+	compressionGzip = "gzip"
+
+	chunksPrefix    = "chunks/"
+	manifestsPrefix = "manifests/"
+
+	defaultMinChunkSize = 512 * 1024
+	defaultMaxChunkSize = 8 * 1024 * 1024
+	// With a mask of 20 bits, a chunk boundary is found on average every 1MiB after the minimum chunk size.
+	defaultChunkMask = 1<<20 - 1
+)
+
+// gearTable holds the random values the rolling hash of the chunker adds for each byte value.
+// It is derived from sha256 so that chunk boundaries, and so deduplication, are stable across releases.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	for i := range table {
+		sum := sha256.Sum256([]byte{byte(i)})
+		table[i] = binary.LittleEndian.Uint64(sum[:8])
+	}
+	return table
+}()
+
+// Manifest describes the data uploaded from a volume, as the ordered list of chunks it was split into.
+type Manifest struct {
+	// Format is the format of the uploaded data, FormatTar or FormatBlock.
+	Format string `json:"format"`
+	// Compression is the compression applied to each chunk.
+	Compression string `json:"compression"`
+	// Size is the total size of the uploaded data, before compression.
+	Size int64 `json:"size"`
+	// Chunks are the chunks the data was split into, in order.
+	Chunks []Chunk `json:"chunks"`
+}
+
+// Chunk is a piece of uploaded data, stored once under the sha256 digest of its content.
+type Chunk struct {
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+}
+
+// Repository stores data in a velero.ObjectStore as content-defined, deduplicated and compressed chunks.
+type Repository struct {
+	store  velero.ObjectStore
+	bucket string
+	// prefix is prepended to the keys of the chunks and manifests in the bucket.
+	prefix string
+
+	minChunkSize int
+	maxChunkSize int
+	chunkMask    uint64
+
+	lockRefreshInterval time.Duration
+	lockExpiry          time.Duration
+	lockRetryPeriod     time.Duration
+	uploadLockTimeout   time.Duration
+}
+
+// NewRepository returns a repository that keeps its chunks and manifests in the bucket of store, below prefix.
+func NewRepository(store velero.ObjectStore, bucket, prefix string) *Repository {
+	return &Repository{
+		store:        store,
+		bucket:       bucket,
+		prefix:       prefix,
+		minChunkSize: defaultMinChunkSize,
+		maxChunkSize: defaultMaxChunkSize,
+		chunkMask:    defaultChunkMask,
+
+		lockRefreshInterval: defaultLockRefreshInterval,
+		lockExpiry:          defaultLockExpiry,
+		lockRetryPeriod:     defaultLockRetryPeriod,
+		uploadLockTimeout:   defaultUploadLockTimeout,
+	}
+}
+
+// ManifestKey returns the key of the manifest of the data uploaded from a PVC during a backup.
+func ManifestKey(backupName, namespace, pvcName string) string {
+	return path.Join(manifestsPrefix, backupName, namespace, pvcName+".json")
+}
+
+func chunkKey(digest string) string {
+	return chunksPrefix + digest[:2] + "/" + digest
+}
+
+// key returns the key in the bucket of the object of the repository with the supplied key.
+func (r *Repository) key(key string) string {
+	return r.prefix + key
+}
+
+// Upload splits data into chunks and stores the chunks that are not in the repository yet. A lock taken with LockForUpload must
+// be held until the manifest of the upload is stored.
+// Chunk boundaries are chosen by a rolling hash of the content, so data that is shifted by an insertion,
+// as happens in tar streams, still deduplicates against earlier uploads.
+func (r *Repository) Upload(data io.Reader, format string, log logrus.FieldLogger) (*Manifest, error) {
+	manifest := &Manifest{Format: format, Compression: compressionGzip, Chunks: []Chunk{}}
+	uploaded := map[string]bool{}
+	var newChunks, newBytes int64
+
+	reader := bufio.NewReaderSize(data, 1024*1024)
+	for {
+		chunk, err := r.nextChunk(reader)
+		if len(chunk) > 0 {
+			sum := sha256.Sum256(chunk)
+			digest := hex.EncodeToString(sum[:])
+			manifest.Chunks = append(manifest.Chunks, Chunk{Digest: digest, Size: int64(len(chunk))})
+			manifest.Size += int64(len(chunk))
+
+			if !uploaded[digest] {
+				stored, putErr := r.putChunk(digest, chunk)
+				if putErr != nil {
+					return nil, putErr
+				}
+				if stored {
+					newChunks++
+					newBytes += int64(len(chunk))
+				}
+				uploaded[digest] = true
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading data to upload")
+		}
+	}
+
+	log.Infof("Uploaded %d bytes in %d chunks, %d new chunks with %d bytes were stored", manifest.Size, len(manifest.Chunks), newChunks, newBytes)
+	return manifest, nil
+}
+
+// nextChunk reads the next chunk from reader. It returns io.EOF along with the last chunk.
+func (r *Repository) nextChunk(reader *bufio.Reader) ([]byte, error) {
+	chunk := make([]byte, 0, r.minChunkSize)
+	var hash uint64
+	for len(chunk) < r.maxChunkSize {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return chunk, err
+		}
+		chunk = append(chunk, b)
+		hash = hash<<1 + gearTable[b]
+		if len(chunk) >= r.minChunkSize && hash&r.chunkMask == 0 {
+			break
+		}
+	}
+	return chunk, nil
+}
+
+// putChunk stores the compressed chunk unless a chunk with the same digest is already stored.
+// It returns whether the chunk was stored.
+func (r *Repository) putChunk(digest string, chunk []byte) (bool, error) {
+	key := r.key(chunkKey(digest))
+	exists, err := r.store.ObjectExists(r.bucket, key)
+	if err != nil {
+		return false, errors.Wrapf(err, "error checking for chunk %s", digest)
+	}
+	if exists {
+		return false, nil
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(chunk); err != nil {
+		return false, errors.Wrapf(err, "error compressing chunk %s", digest)
+	}
+	if err := zw.Close(); err != nil {
+		return false, errors.Wrapf(err, "error compressing chunk %s", digest)
+	}
+	if err := r.store.PutObject(r.bucket, key, &buf); err != nil {
+		return false, errors.Wrapf(err, "error storing chunk %s", digest)
+	}
+	return true, nil
+}
+
+// Download writes the data described by manifest to w, verifying the digest of every chunk.
+func (r *Repository) Download(manifest *Manifest, w io.Writer) error {
+	if manifest.Compression != compressionGzip {
+		return errors.Errorf("unsupported compression %q", manifest.Compression)
+	}
+	for i, c := range manifest.Chunks {
+		chunk, err := r.getChunk(c)
+		if err != nil {
+			return errors.Wrapf(err, "error reading chunk %d of %d", i+1, len(manifest.Chunks))
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return errors.Wrap(err, "error writing downloaded data")
+		}
+	}
+	return nil
+}
+
+func (r *Repository) getChunk(c Chunk) ([]byte, error) {
+	obj, err := r.store.GetObject(r.bucket, r.key(chunkKey(c.Digest)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting chunk %s", c.Digest)
+	}
+	defer obj.Close()
+
+	zr, err := gzip.NewReader(obj)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error decompressing chunk %s", c.Digest)
+	}
+	chunk, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error decompressing chunk %s", c.Digest)
+	}
+
+	sum := sha256.Sum256(chunk)
+	if digest := hex.EncodeToString(sum[:]); digest != c.Digest || int64(len(chunk)) != c.Size {
+		return nil, errors.Errorf("chunk %s is corrupt, got %d bytes with digest %s", c.Digest, len(chunk), digest)
+	}
+	return chunk, nil
+}
+
+// PutManifest stores the manifest under key.
+func (r *Repository) PutManifest(key string, manifest *Manifest) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.Wrapf(r.store.PutObject(r.bucket, r.key(key), bytes.NewReader(data)), "error storing manifest %s", key)
+}
+
+// GetManifest returns the manifest stored under key.
+func (r *Repository) GetManifest(key string) (*Manifest, error) {
+	return r.getManifest(r.key(key))
+}
+
+// getManifest returns the manifest stored under the key in the bucket.
+func (r *Repository) getManifest(key string) (*Manifest, error) {
+	obj, err := r.store.GetObject(r.bucket, key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting manifest %s", key)
+	}
+	defer obj.Close()
+
+	manifest := &Manifest{}
+	if err := json.NewDecoder(obj).Decode(manifest); err != nil {
+		return nil, errors.Wrapf(err, "error decoding manifest %s", key)
+	}
+	return manifest, nil
+}
+
+// DeleteManifest deletes the manifest stored under key. The chunks it references are kept,
+// as they may be shared with other manifests, until CollectGarbage finds them unreferenced.
+func (r *Repository) DeleteManifest(key string) error {
+	return errors.Wrapf(r.store.DeleteObject(r.bucket, r.key(key)), "error deleting manifest %s", key)
+}
+
+// CollectGarbage deletes the chunks that no manifest references and returns how many it found. With dryRun, the chunks are
+// only reported. Chunks are stored before the manifest that references them, so the garbage is not collected while an upload
+// holds a lock taken with LockForUpload, and uploads wait for the garbage collection to finish.
+func (r *Repository) CollectGarbage(dryRun bool, log logrus.FieldLogger) (int, error) {
+	lock, err := r.lockForGarbageCollection(log)
+	if err != nil {
+		return 0, err
+	}
+	if lock == nil {
+		log.Info("Not collecting data mover chunks, data is being uploaded to the repository")
+		return 0, nil
+	}
+	defer lock.Release()
+
+	manifestKeys, err := r.store.ListObjects(r.bucket, r.key(manifestsPrefix))
+	if err != nil {
+		return 0, errors.Wrap(err, "error listing manifests")
+	}
+	referenced := map[string]bool{}
+	for _, key := range manifestKeys {
+		manifest, err := r.getManifest(key)
+		if err != nil {
+			// The chunks of a manifest that cannot be read are unknown, so none can be deleted safely.
+			return 0, err
+		}
+		for _, c := range manifest.Chunks {
+			referenced[c.Digest] = true
+		}
+	}
+
+	chunkKeys, err := r.store.ListObjects(r.bucket, r.key(chunksPrefix))
+	if err != nil {
+		return 0, errors.Wrap(err, "error listing chunks")
+	}
+	unreferenced := 0
+	for _, key := range chunkKeys {
+		digest := path.Base(key)
+		if referenced[digest] {
+			continue
+		}
+		unreferenced++
+		if dryRun {
+			log.Infof("Chunk %s is not referenced by any manifest", digest)
+			continue
+		}
+		if err := r.store.DeleteObject(r.bucket, key); err != nil {
+			return unreferenced, errors.Wrapf(err, "error deleting chunk %s", digest)
+		}
+		log.Debugf("Deleted chunk %s", digest)
+	}
+	log.Infof("Found %d chunks referenced by %d manifests and %d unreferenced chunks", len(chunkKeys)-unreferenced, len(manifestKeys), unreferenced)
+	return unreferenced, nil
+}
+
+func (m *Manifest) String() string {
+	return fmt.Sprintf("%s data of %d bytes in %d chunks", m.Format, m.Size, len(m.Chunks))
+}
@@ -0,0 +1,234 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package datamover
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestRepository returns a repository in a filesystem object store in a temporary directory,
+// with small chunks so that tests can work with little data.
+func newTestRepository(t *testing.T) (*Repository, *FileSystemObjectStore, func()) {
+	dir, err := ioutil.TempDir("", "datamover")
+	require.Nil(t, err)
+
+	store := NewFileSystemObjectStore()
+	require.Nil(t, store.Init(map[string]string{RootConfigKey: dir}))
+
+	repository := NewRepository(store, Bucket, "")
+	repository.minChunkSize = 1024
+	repository.maxChunkSize = 16 * 1024
+	repository.chunkMask = 4*1024 - 1
+	return repository, store, func() { os.RemoveAll(dir) }
+}
+
+func randomData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func countChunks(t *testing.T, store *FileSystemObjectStore) int {
+	keys, err := store.ListObjects(Bucket, chunksPrefix)
+	require.Nil(t, err)
+	return len(keys)
+}
+
+func TestUploadDownload(t *testing.T) {
+	testCases := []struct {
+		name string
+		data []byte
+	}{
+		{
+			name: "empty data",
+			data: []byte{},
+		},
+		{
+			name: "data smaller than the minimum chunk size",
+			data: randomData(1, 100),
+		},
+		{
+			name: "data split into many chunks",
+			data: randomData(2, 300*1024),
+		},
+		{
+			name: "highly compressible data",
+			data: bytes.Repeat([]byte("velero"), 50*1024),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			repository, _, cleanup := newTestRepository(t)
+			defer cleanup()
+
+			manifest, err := repository.Upload(bytes.NewReader(tc.data), FormatTar, logrus.New())
+			require.Nil(t, err)
+			assert.Equal(t, FormatTar, manifest.Format)
+			assert.Equal(t, int64(len(tc.data)), manifest.Size)
+
+			var total int64
+			for _, c := range manifest.Chunks {
+				assert.True(t, c.Size <= int64(repository.maxChunkSize))
+				total += c.Size
+			}
+			assert.Equal(t, manifest.Size, total)
+
+			var out bytes.Buffer
+			require.Nil(t, repository.Download(manifest, &out))
+			assert.True(t, bytes.Equal(tc.data, out.Bytes()), "downloaded data differs from the uploaded data")
+		})
+	}
+}
+
+func TestUploadDeduplicates(t *testing.T) {
+	repository, store, cleanup := newTestRepository(t)
+	defer cleanup()
+
+	data := randomData(3, 256*1024)
+	first, err := repository.Upload(bytes.NewReader(data), FormatTar, logrus.New())
+	require.Nil(t, err)
+	chunks := countChunks(t, store)
+	assert.True(t, chunks > 10, "expected the data to be split into many chunks, got %d", chunks)
+
+	// uploading the same data again stores nothing new
+	second, err := repository.Upload(bytes.NewReader(data), FormatTar, logrus.New())
+	require.Nil(t, err)
+	assert.Equal(t, first, second)
+	assert.Equal(t, chunks, countChunks(t, store))
+
+	// inserting data at the start only changes the chunks around the insertion, as chunk boundaries are content-defined
+	shifted := append(randomData(4, 100), data...)
+	_, err = repository.Upload(bytes.NewReader(shifted), FormatTar, logrus.New())
+	require.Nil(t, err)
+	assert.True(t, countChunks(t, store)-chunks <= 2, "expected at most 2 new chunks, got %d", countChunks(t, store)-chunks)
+}
+
+func TestDownloadDetectsCorruption(t *testing.T) {
+	repository, store, cleanup := newTestRepository(t)
+	defer cleanup()
+
+	manifest, err := repository.Upload(bytes.NewReader(randomData(5, 64*1024)), FormatBlock, logrus.New())
+	require.Nil(t, err)
+	require.NotEmpty(t, manifest.Chunks)
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err = zw.Write([]byte("not the original data"))
+	require.Nil(t, err)
+	require.Nil(t, zw.Close())
+	require.Nil(t, store.PutObject(Bucket, chunkKey(manifest.Chunks[0].Digest), &buf))
+
+	assert.NotNil(t, repository.Download(manifest, ioutil.Discard))
+}
+
+func TestManifests(t *testing.T) {
+	repository, store, cleanup := newTestRepository(t)
+	defer cleanup()
+
+	key := ManifestKey("backup-1", "ns-1", "pvc-1")
+	assert.Equal(t, "manifests/backup-1/ns-1/pvc-1.json", key)
+
+	manifest, err := repository.Upload(bytes.NewReader(randomData(6, 32*1024)), FormatTar, logrus.New())
+	require.Nil(t, err)
+	require.Nil(t, repository.PutManifest(key, manifest))
+
+	actual, err := repository.GetManifest(key)
+	require.Nil(t, err)
+	assert.Equal(t, manifest, actual)
+
+	chunks := countChunks(t, store)
+	require.Nil(t, repository.DeleteManifest(key))
+	_, err = repository.GetManifest(key)
+	assert.NotNil(t, err)
+	assert.Equal(t, chunks, countChunks(t, store), "chunks should be kept when a manifest is deleted")
+}
+
+func TestRepositoryPrefix(t *testing.T) {
+	_, store, cleanup := newTestRepository(t)
+	defer cleanup()
+	repository := NewRepository(store, Bucket, "velero/plugins/velero-plugin-for-csi/")
+
+	key := ManifestKey("backup-1", "ns-1", "pvc-1")
+	manifest, err := repository.Upload(bytes.NewReader(randomData(7, 1024)), FormatTar, logrus.New())
+	require.Nil(t, err)
+	require.Nil(t, repository.PutManifest(key, manifest))
+
+	keys, err := store.ListObjects(Bucket, "")
+	require.Nil(t, err)
+	require.NotEmpty(t, keys)
+	for _, k := range keys {
+		assert.True(t, strings.HasPrefix(k, "velero/plugins/velero-plugin-for-csi/"), "key %s is not below the prefix", k)
+	}
+	actual, err := repository.GetManifest(key)
+	require.Nil(t, err)
+	assert.Equal(t, manifest, actual)
+}
+
+func TestCollectGarbage(t *testing.T) {
+	testCases := []struct {
+		name   string
+		dryRun bool
+	}{
+		{
+			name: "should delete the chunks no manifest references",
+		},
+		{
+			name:   "should only report the chunks no manifest references in a dry run",
+			dryRun: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			repository, store, cleanup := newTestRepository(t)
+			defer cleanup()
+
+			shared := randomData(8, 64*1024)
+			kept, err := repository.Upload(bytes.NewReader(append(shared, randomData(9, 64*1024)...)), FormatTar, logrus.New())
+			require.Nil(t, err)
+			require.Nil(t, repository.PutManifest(ManifestKey("backup-1", "ns-1", "pvc-1"), kept))
+			deleted, err := repository.Upload(bytes.NewReader(append(shared, randomData(10, 64*1024)...)), FormatTar, logrus.New())
+			require.Nil(t, err)
+			require.Nil(t, repository.PutManifest(ManifestKey("backup-2", "ns-1", "pvc-1"), deleted))
+			chunks := countChunks(t, store)
+
+			require.Nil(t, repository.DeleteManifest(ManifestKey("backup-2", "ns-1", "pvc-1")))
+			unreferenced, err := repository.CollectGarbage(tc.dryRun, logrus.New())
+			require.Nil(t, err)
+			assert.True(t, unreferenced > 0, "expected the chunks of the deleted manifest to be unreferenced")
+
+			if tc.dryRun {
+				assert.Equal(t, chunks, countChunks(t, store))
+			} else {
+				assert.Equal(t, chunks-unreferenced, countChunks(t, store))
+			}
+			// The chunks shared with the remaining manifest are always kept.
+			assert.Nil(t, repository.Download(kept, ioutil.Discard))
+		})
+	}
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package delete
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+
+	corev1api "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/util"
+)
+
+// legalHoldEventReason is the reason of the warning events recorded when a deletion is refused because of a legal hold.
+const legalHoldEventReason = "LegalHold"
+
+// heldObject is an object whose legal hold forbids a deletion.
+type heldObject struct {
+	// description identifies the object in errors and events, such as "backup velero/backup-1".
+	description string
+	// meta is nil when the object does not exist.
+	meta *metav1.ObjectMeta
+}
+
+// legalHoldError is returned when a deletion is refused because of a legal hold.
+type legalHoldError struct {
+	object string
+	heldBy string
+	reason string
+}
+
+func (e *legalHoldError) Error() string {
+	msg := fmt.Sprintf("refusing to delete %s: %s is under legal hold", e.object, e.heldBy)
+	if e.reason != "" {
+		msg += " (" + e.reason + ")"
+	}
+	return msg
+}
+
+// checkLegalHold returns an error if any of the held objects has a legal hold, and records the refused deletion as a warning
+// event about the object being deleted.
+func checkLegalHold(object corev1api.ObjectReference, held []heldObject, events corev1client.EventsGetter, log logrus.FieldLogger) error {
+	for _, h := range held {
+		if h.meta == nil || !util.HasLegalHold(h.meta) {
+			continue
+		}
+		err := &legalHoldError{
+			object: fmt.Sprintf("%s %s", object.Kind, object.Name),
+			heldBy: h.description,
+			reason: h.meta.Annotations[util.LegalHoldAnnotation],
+		}
+		if object.Namespace != "" {
+			err.object = fmt.Sprintf("%s %s/%s", object.Kind, object.Namespace, object.Name)
+		}
+		if eventErr := util.RecordWarningEvent(events, object, legalHoldEventReason, err.Error()); eventErr != nil {
+			log.WithError(eventErr).Warnf("Failed to record refused deletion of %s", err.object)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package delete
+
+import (
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/util"
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+)
+
+// releaseBackupReference removes the backup being deleted from the backups referencing a volumesnapshot or volumesnapshotcontent,
+// using remove, and returns whether the object and its snapshot may be deleted. That is when Velero created the object, the backup
+// created or references it, and no other existing backup references it. item is the backed-up object and live the object in
+// the cluster, if it still exists. Objects backed up before references were recorded are only referenced by the backup that
+// created them.
+func releaseBackupReference(backup *velerov1api.Backup, item, live *metav1.ObjectMeta, remove func() ([]string, error),
+	log logrus.FieldLogger) (bool, error) {
+	// The live object tells which backup created it, unless it is gone.
+	creator := item
+	referenced := false
+	remaining := []string{}
+	if live != nil {
+		creator = live
+		remaining = util.GetReferencingBackups(live)
+		if util.ContainsBackupReference(remaining, backup) {
+			var err error
+			if remaining, err = remove(); err != nil {
+				if !apierrors.IsNotFound(err) {
+					return false, errors.Wrapf(err, "failed to remove backup %s from the backups referencing %s", backup.Name, live.Name)
+				}
+				remaining = []string{}
+			}
+			referenced = true
+		}
+	}
+
+	if !util.IsCreatedForAnyBackup(creator) || (!referenced && !util.IsCreatedForBackup(item, backup)) {
+		return false, nil
+	}
+
+	createdByOther := !util.IsCreatedForBackup(creator, backup)
+	if len(remaining) == 0 && !createdByOther {
+		return true, nil
+	}
+	client, err := util.GetDynamicClient()
+	if err != nil {
+		return false, err
+	}
+	backups, err := util.ListBackups(client, backup.Namespace)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to list backups in namespace %s", backup.Namespace)
+	}
+	for i := range backups {
+		b := &backups[i]
+		if b.UID == backup.UID {
+			continue
+		}
+		if util.ContainsBackupReference(remaining, b) || (createdByOther && util.IsCreatedForBackup(creator, b)) {
+			log.Infof("%s is still referenced by backup %s, not deleting it", item.Name, b.Name)
+			return false, nil
+		}
+	}
+	return true, nil
+}
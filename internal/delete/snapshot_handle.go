@@ -0,0 +1,116 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package delete
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	snapshotv1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	snapshotter "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned/typed/volumesnapshot/v1"
+	corev1api "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/util"
+)
+
+// deletedSnapshots holds the snapshots, keyed by CSI driver and snapshot handle, deleted while deleting a backup. Velero
+// invokes both delete item actions from the same plugin process while deleting a backup. Once one of them has deleted the
+// snapshot, along with the volumesnapshot or volumesnapshotcontent, the other finds its object gone and must not try to
+// delete the snapshot through a temporary volumesnapshotcontent.
+var deletedSnapshots sync.Map
+
+// snapshotHandle identifies a snapshot in the storage provider, for deleting it when no volumesnapshotcontent refers to it anymore.
+type snapshotHandle struct {
+	handle string
+	driver string
+	// deleteSecret is the secret the CSI driver needs to delete the snapshot, if any.
+	deleteSecret *corev1api.SecretReference
+}
+
+func (s snapshotHandle) key() string {
+	return s.driver + "/" + s.handle
+}
+
+// deleteSnapshotByHandle deletes the snapshot in the storage provider when its volumesnapshot and volumesnapshotcontent are gone,
+// as when the namespace of the volumesnapshot was deleted or the backup was synced into another cluster. A temporary static
+// volumesnapshotcontent with a DeletionPolicy of Delete is created for the snapshot and, once the CSI driver has found the
+// snapshot, deleted, which deletes the snapshot as well.
+func deleteSnapshotByHandle(snapshot snapshotHandle, snapClient snapshotter.SnapshotV1Interface, log logrus.FieldLogger, timeout time.Duration) error {
+	key := snapshot.key()
+	if _, ok := deletedSnapshots.Load(key); ok {
+		log.Infof("Snapshot %s of CSI driver %s was already deleted", snapshot.handle, snapshot.driver)
+		return nil
+	}
+
+	name := fmt.Sprintf("velero-delete-%x", sha256.Sum256([]byte(key)))[:46]
+	vsc := &snapshotv1api.VolumeSnapshotContent{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Spec: snapshotv1api.VolumeSnapshotContentSpec{
+			DeletionPolicy: snapshotv1api.VolumeSnapshotContentDelete,
+			Driver:         snapshot.driver,
+			// The volumesnapshotcontent must refer to a volumesnapshot, but is never bound to one.
+			VolumeSnapshotRef: corev1api.ObjectReference{
+				Kind:      "VolumeSnapshot",
+				Namespace: name,
+				Name:      name,
+			},
+			Source: snapshotv1api.VolumeSnapshotContentSource{
+				SnapshotHandle: &snapshot.handle,
+			},
+		},
+	}
+	if snapshot.deleteSecret != nil {
+		util.AddAnnotations(&vsc.ObjectMeta, map[string]string{
+			util.DeletionSecretNameAnnotation:      snapshot.deleteSecret.Name,
+			util.DeletionSecretNamespaceAnnotation: snapshot.deleteSecret.Namespace,
+		})
+	}
+
+	// A volumesnapshotcontent left behind by an earlier attempt is reused.
+	if _, err := snapClient.VolumeSnapshotContents().Create(context.TODO(), vsc, metav1.CreateOptions{}); err != nil && !apierrors.IsAlreadyExists(err) {
+		return errors.Wrapf(err, "failed to create volumesnapshotcontent %s to delete snapshot %s", name, snapshot.handle)
+	}
+	log.Infof("Created volumesnapshotcontent %s to delete snapshot %s of CSI driver %s", name, snapshot.handle, snapshot.driver)
+
+	// The CSI external-snapshotter only deletes the snapshot of a volumesnapshotcontent that it has reconciled.
+	_, waitErr := util.WaitForVolumeSnapshotContentReadyToUse(name, snapClient, log, timeout)
+	if err := snapClient.VolumeSnapshotContents().Delete(context.TODO(), name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrapf(err, "failed to delete volumesnapshotcontent %s", name)
+	}
+	if waitErr != nil {
+		return errors.WithMessagef(waitErr, "failed to delete snapshot %s of CSI driver %s", snapshot.handle, snapshot.driver)
+	}
+	log.Infof("Deleted volumesnapshotcontent %s, and with it snapshot %s", name, snapshot.handle)
+
+	markSnapshotDeleted(snapshot)
+	return nil
+}
+
+// markSnapshotDeleted records that the snapshot was deleted.
+func markSnapshotDeleted(snapshot snapshotHandle) {
+	deletedSnapshots.Store(snapshot.key(), true)
+}
@@ -0,0 +1,261 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package delete
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	snapshotv1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	snapshotFake "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned/fake"
+	corev1api "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/util"
+)
+
+const testTimeout = time.Second
+
+// newSnapshotClientset returns a fake snapshot clientset standing in for the CSI external-snapshotter: volumesnapshotcontents
+// created through it are ready to use at once, or carry a driver error if driverErr is set.
+func newSnapshotClientset(driverErr bool, objects ...runtime.Object) *snapshotFake.Clientset {
+	client := snapshotFake.NewSimpleClientset(objects...)
+	client.PrependReactor("create", "volumesnapshotcontents", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		vsc := action.(k8stesting.CreateAction).GetObject().(*snapshotv1api.VolumeSnapshotContent)
+		readyToUse := !driverErr
+		vsc.Status = &snapshotv1api.VolumeSnapshotContentStatus{ReadyToUse: &readyToUse}
+		if driverErr {
+			message := "snapshot not found"
+			vsc.Status.Error = &snapshotv1api.VolumeSnapshotError{Message: &message}
+		}
+		return false, nil, nil
+	})
+	return client
+}
+
+// createdVolumeSnapshotContents returns the volumesnapshotcontents created through the fake clientset.
+func createdVolumeSnapshotContents(client *snapshotFake.Clientset) []*snapshotv1api.VolumeSnapshotContent {
+	created := []*snapshotv1api.VolumeSnapshotContent{}
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "create" && action.GetResource().Resource == "volumesnapshotcontents" {
+			created = append(created, action.(k8stesting.CreateAction).GetObject().(*snapshotv1api.VolumeSnapshotContent))
+		}
+	}
+	return created
+}
+
+// resetDeletedSnapshots forgets the snapshots deleted by earlier test cases.
+func resetDeletedSnapshots() {
+	deletedSnapshots.Range(func(key, _ interface{}) bool {
+		deletedSnapshots.Delete(key)
+		return true
+	})
+}
+
+func isSnapshotDeleted(snapshot snapshotHandle) bool {
+	_, ok := deletedSnapshots.Load(snapshot.key())
+	return ok
+}
+
+func TestDeleteSnapshotByHandle(t *testing.T) {
+	snapshot := snapshotHandle{
+		handle: "snap-1",
+		driver: "csi.example.com",
+		deleteSecret: &corev1api.SecretReference{
+			Name:      "delete-secret",
+			Namespace: "secret-ns",
+		},
+	}
+	leftover := &snapshotv1api.VolumeSnapshotContent{
+		ObjectMeta: metav1.ObjectMeta{Name: "velero-delete-leftover"},
+	}
+
+	testCases := []struct {
+		name            string
+		snapshot        snapshotHandle
+		alreadyDeleted  bool
+		driverErr       bool
+		objects         []runtime.Object
+		expectedCreates int
+		expectErr       bool
+		expectDeleted   bool
+	}{
+		{
+			name:            "should delete the snapshot through a temporary volumesnapshotcontent",
+			snapshot:        snapshot,
+			expectedCreates: 1,
+			expectDeleted:   true,
+		},
+		{
+			name:            "should delete a snapshot without a deletion secret",
+			snapshot:        snapshotHandle{handle: "snap-2", driver: "csi.example.com"},
+			expectedCreates: 1,
+			expectDeleted:   true,
+		},
+		{
+			name:           "should not delete a snapshot deleted earlier while deleting the backup",
+			snapshot:       snapshot,
+			alreadyDeleted: true,
+			expectDeleted:  true,
+		},
+		{
+			name:            "should fail when the CSI driver cannot find the snapshot",
+			snapshot:        snapshot,
+			driverErr:       true,
+			expectedCreates: 1,
+			expectErr:       true,
+		},
+		{
+			name:            "should leave other volumesnapshotcontents alone",
+			snapshot:        snapshot,
+			objects:         []runtime.Object{leftover},
+			expectedCreates: 1,
+			expectDeleted:   true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resetDeletedSnapshots()
+			if tc.alreadyDeleted {
+				markSnapshotDeleted(tc.snapshot)
+			}
+			client := newSnapshotClientset(tc.driverErr, tc.objects...)
+
+			err := deleteSnapshotByHandle(tc.snapshot, client.SnapshotV1(), logrus.New(), testTimeout)
+			if tc.expectErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tc.expectDeleted, isSnapshotDeleted(tc.snapshot))
+
+			created := createdVolumeSnapshotContents(client)
+			require.Len(t, created, tc.expectedCreates)
+			for _, vsc := range created {
+				assert.Equal(t, snapshotv1api.VolumeSnapshotContentDelete, vsc.Spec.DeletionPolicy)
+				assert.Equal(t, tc.snapshot.driver, vsc.Spec.Driver)
+				assert.Equal(t, tc.snapshot.handle, *vsc.Spec.Source.SnapshotHandle)
+				if tc.snapshot.deleteSecret != nil {
+					assert.Equal(t, map[string]string{
+						"snapshot.storage.kubernetes.io/deletion-secret-name":      tc.snapshot.deleteSecret.Name,
+						"snapshot.storage.kubernetes.io/deletion-secret-namespace": tc.snapshot.deleteSecret.Namespace,
+					}, vsc.Annotations)
+				} else {
+					assert.Empty(t, vsc.Annotations)
+				}
+
+				// The temporary volumesnapshotcontent is deleted, whether the snapshot could be deleted or not.
+				_, err := client.SnapshotV1().VolumeSnapshotContents().Get(context.TODO(), vsc.Name, metav1.GetOptions{})
+				assert.True(t, apierrors.IsNotFound(err))
+			}
+			for _, obj := range tc.objects {
+				vsc := obj.(*snapshotv1api.VolumeSnapshotContent)
+				_, err := client.SnapshotV1().VolumeSnapshotContents().Get(context.TODO(), vsc.Name, metav1.GetOptions{})
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestDeleteSnapshotByHandleReusesLeftover(t *testing.T) {
+	resetDeletedSnapshots()
+	snapshot := snapshotHandle{handle: "snap-1", driver: "csi.example.com"}
+	client := newSnapshotClientset(false)
+	// An earlier attempt created the temporary volumesnapshotcontent but failed before deleting it.
+	require.NoError(t, deleteSnapshotByHandle(snapshot, client.SnapshotV1(), logrus.New(), testTimeout))
+	resetDeletedSnapshots()
+	name := createdVolumeSnapshotContents(client)[0].Name
+	readyToUse := true
+	_, err := client.SnapshotV1().VolumeSnapshotContents().Create(context.TODO(), &snapshotv1api.VolumeSnapshotContent{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status:     &snapshotv1api.VolumeSnapshotContentStatus{ReadyToUse: &readyToUse},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	assert.NoError(t, deleteSnapshotByHandle(snapshot, client.SnapshotV1(), logrus.New(), testTimeout))
+	assert.True(t, isSnapshotDeleted(snapshot))
+	_, err = client.SnapshotV1().VolumeSnapshotContents().Get(context.TODO(), name, metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+}
+
+func TestGetVolumeSnapshotContentHandle(t *testing.T) {
+	statusHandle := "status-handle"
+	sourceHandle := "source-handle"
+	testCases := []struct {
+		name     string
+		vsc      *snapshotv1api.VolumeSnapshotContent
+		expected snapshotHandle
+		ok       bool
+	}{
+		{
+			name: "should use the snapshot handle in the status",
+			vsc: &snapshotv1api.VolumeSnapshotContent{
+				Spec: snapshotv1api.VolumeSnapshotContentSpec{
+					Driver: "csi.example.com",
+					Source: snapshotv1api.VolumeSnapshotContentSource{SnapshotHandle: &sourceHandle},
+				},
+				Status: &snapshotv1api.VolumeSnapshotContentStatus{SnapshotHandle: &statusHandle},
+			},
+			expected: snapshotHandle{handle: statusHandle, driver: "csi.example.com"},
+			ok:       true,
+		},
+		{
+			name: "should use the snapshot handle of a pre-provisioned volumesnapshotcontent",
+			vsc: &snapshotv1api.VolumeSnapshotContent{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						util.DeletionSecretNameAnnotation:      "delete-secret",
+						util.DeletionSecretNamespaceAnnotation: "secret-ns",
+					},
+				},
+				Spec: snapshotv1api.VolumeSnapshotContentSpec{
+					Driver: "csi.example.com",
+					Source: snapshotv1api.VolumeSnapshotContentSource{SnapshotHandle: &sourceHandle},
+				},
+			},
+			expected: snapshotHandle{
+				handle:       sourceHandle,
+				driver:       "csi.example.com",
+				deleteSecret: &corev1api.SecretReference{Name: "delete-secret", Namespace: "secret-ns"},
+			},
+			ok: true,
+		},
+		{
+			name: "should not return a snapshot for a volumesnapshotcontent without a snapshot handle",
+			vsc: &snapshotv1api.VolumeSnapshotContent{
+				Spec: snapshotv1api.VolumeSnapshotContentSpec{Driver: "csi.example.com"},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			snapshot, ok := getVolumeSnapshotContentHandle(tc.vsc)
+			assert.Equal(t, tc.ok, ok)
+			assert.Equal(t, tc.expected, snapshot)
+		})
+	}
+}
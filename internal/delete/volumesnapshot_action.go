@@ -6,18 +6,25 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/config"
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/datamover"
 	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/util"
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 
-	snapshotv1beta1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1beta1"
+	snapshotv1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	snapshotter "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned/typed/volumesnapshot/v1"
+	corev1api "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 )
 
 // VolumeSnapshotDeleteItemAction is a backup item action plugin for Velero.
 type VolumeSnapshotDeleteItemAction struct {
-	Log logrus.FieldLogger
+	Log    logrus.FieldLogger
+	Config config.Config
 }
 
 // AppliesTo returns information indicating that the VolumeSnapshotBackupItemAction should be invoked to backup volumesnapshots.
@@ -32,40 +39,177 @@ func (p *VolumeSnapshotDeleteItemAction) AppliesTo() (velero.ResourceSelector, e
 func (p *VolumeSnapshotDeleteItemAction) Execute(input *velero.DeleteItemActionExecuteInput) error {
 	p.Log.Info("Starting VolumeSnapshotDeleteItemAction for volumeSnapshot")
 
-	var vs snapshotv1beta1api.VolumeSnapshot
+	var vs snapshotv1api.VolumeSnapshot
 
 	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(input.Item.UnstructuredContent(), &vs); err != nil {
 		return errors.Wrapf(err, "failed to convert input.Item from unstructured")
 	}
 
+	client, snapClient, err := util.GetClients()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err := p.checkLegalHold(&vs, input.Backup, client.CoreV1(), snapClient); err != nil {
+		return err
+	}
+
+	if util.IsAdoptedVolumeSnapshot(&vs.ObjectMeta) {
+		p.Log.Infof("VolumeSnapshot %s/%s was adopted by backup %s and belongs to the application that took it, skipping deletion", vs.Namespace, vs.Name, input.Backup.Name)
+		return nil
+	}
+
+	if manifestKey, ok := vs.Annotations[util.DataMoverManifestAnnotation]; ok && util.IsCreatedForBackup(&vs.ObjectMeta, input.Backup) {
+		p.Log.Infof("Deleting data mover manifest %s of volumesnapshot %s/%s", manifestKey, vs.Namespace, vs.Name)
+		repository, closeRepository, err := datamover.OpenRepository(p.Config, input.Backup.Namespace, input.Backup.Spec.StorageLocation, p.Log)
+		if err != nil {
+			return err
+		}
+		err = repository.DeleteManifest(manifestKey)
+		closeRepository()
+		if err != nil {
+			return err
+		}
+	}
+
 	// We don't want this DeleteItemAction plugin to delete Volumesnapshot taken outside of Velero.
 	// So skip deleting Volumesnapshot objects that were not created in the process of creating
-	// the Velero backup being deleted.
-	if !util.HasBackupLabel(&vs.ObjectMeta, input.Backup.Name) {
-		p.Log.Info("VolumeSnapshot %s/%s was not taken by backup %s, skipping deletion", vs.Namespace, vs.Name, input.Backup.Name)
+	// a Velero backup, or that other backups still include.
+	deletable, err := p.releaseBackupReference(&vs, input.Backup, snapClient)
+	if err != nil {
+		return err
+	}
+	if !deletable {
+		p.Log.Infof("VolumeSnapshot %s/%s was not taken by backup %s or is included in other backups, skipping deletion", vs.Namespace, vs.Name, input.Backup.Name)
 		return nil
 	}
 
+	return p.deleteVolumeSnapshot(&vs, snapClient)
+}
+
+// deleteVolumeSnapshot deletes the volumesnapshot along with its volumesnapshotcontent and the snapshot in the storage provider.
+func (p *VolumeSnapshotDeleteItemAction) deleteVolumeSnapshot(vs *snapshotv1api.VolumeSnapshot, snapClient snapshotter.SnapshotV1Interface) error {
 	p.Log.Infof("Deleting Volumesnapshot %s/%s", vs.Namespace, vs.Name)
-	_, snapClient, err := util.GetClients()
-	if err != nil {
-		return errors.WithStack(err)
-	}
+	snapshotDeleted := false
 	if vs.Status != nil && vs.Status.BoundVolumeSnapshotContentName != nil {
 		// we patch the DeletionPolicy of the volumesnapshotcontent to set it to Delete.
 		// This ensures that the volume snapshot in the storage provider is also deleted.
-		err := util.SetVolumeSnapshotContentDeletionPolicy(*vs.Status.BoundVolumeSnapshotContentName, snapClient.SnapshotV1beta1())
+		err := util.SetVolumeSnapshotContentDeletionPolicy(*vs.Status.BoundVolumeSnapshotContentName, snapClient)
 		if err != nil && !apierrors.IsNotFound(err) {
 			return errors.Wrapf(err, fmt.Sprintf("failed to patch DeletionPolicy of volume snapshot %s/%s", vs.Namespace, vs.Name))
 		}
 
 		if apierrors.IsNotFound(err) {
-			return nil
+			// The volumesnapshotcontent is gone, so the snapshot in the storage provider is deleted using the snapshot handle
+			// recorded on the backed-up volumesnapshot.
+			if err := p.deleteSnapshot(vs, snapClient); err != nil {
+				return err
+			}
+		} else {
+			snapshotDeleted = true
 		}
 	}
-	err = snapClient.SnapshotV1beta1().VolumeSnapshots(vs.Namespace).Delete(context.TODO(), vs.Name, metav1.DeleteOptions{})
+	err := snapClient.VolumeSnapshots(vs.Namespace).Delete(context.TODO(), vs.Name, metav1.DeleteOptions{})
 	if err != nil && !apierrors.IsNotFound(err) {
 		return err
 	}
+	if snapshot, ok := getVolumeSnapshotHandle(vs); ok && snapshotDeleted {
+		// The volumesnapshotcontent, and the snapshot, are deleted along with the volumesnapshot.
+		markSnapshotDeleted(snapshot)
+	}
 	return nil
 }
+
+// checkLegalHold returns an error if the backup, the volumesnapshot or its volumesnapshotcontent is under legal hold.
+func (p *VolumeSnapshotDeleteItemAction) checkLegalHold(vs *snapshotv1api.VolumeSnapshot, backup *velerov1api.Backup,
+	events corev1client.EventsGetter, snapClient snapshotter.SnapshotV1Interface) error {
+	object := corev1api.ObjectReference{
+		APIVersion: snapshotv1api.SchemeGroupVersion.String(),
+		Kind:       "VolumeSnapshot",
+		Namespace:  vs.Namespace,
+		Name:       vs.Name,
+	}
+	held := []heldObject{
+		{description: fmt.Sprintf("backup %s/%s", backup.Namespace, backup.Name), meta: &backup.ObjectMeta},
+		{description: fmt.Sprintf("volumesnapshot %s/%s", vs.Namespace, vs.Name), meta: &vs.ObjectMeta},
+	}
+
+	live, err := snapClient.VolumeSnapshots(vs.Namespace).Get(context.TODO(), vs.Name, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrapf(err, "failed to get volumesnapshot %s/%s", vs.Namespace, vs.Name)
+	}
+	if err == nil {
+		object.UID = live.UID
+		held = append(held, heldObject{description: fmt.Sprintf("volumesnapshot %s/%s", vs.Namespace, vs.Name), meta: &live.ObjectMeta})
+	}
+	if vs.Status != nil && vs.Status.BoundVolumeSnapshotContentName != nil {
+		vscName := *vs.Status.BoundVolumeSnapshotContentName
+		vsc, err := snapClient.VolumeSnapshotContents().Get(context.TODO(), vscName, metav1.GetOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "failed to get volumesnapshotcontent %s", vscName)
+		}
+		if err == nil {
+			held = append(held, heldObject{description: "volumesnapshotcontent " + vscName, meta: &vsc.ObjectMeta})
+		}
+	}
+	return checkLegalHold(object, held, events, p.Log)
+}
+
+// releaseBackupReference removes the backup from the backups referencing the volumesnapshot and returns whether the
+// volumesnapshot may be deleted. Once the volumesnapshot is gone, the backups referencing its volumesnapshotcontent are used.
+func (p *VolumeSnapshotDeleteItemAction) releaseBackupReference(vs *snapshotv1api.VolumeSnapshot, backup *velerov1api.Backup,
+	snapClient snapshotter.SnapshotV1Interface) (bool, error) {
+	live, err := snapClient.VolumeSnapshots(vs.Namespace).Get(context.TODO(), vs.Name, metav1.GetOptions{})
+	if err == nil {
+		return releaseBackupReference(backup, &vs.ObjectMeta, &live.ObjectMeta, func() ([]string, error) {
+			return util.RemoveVolumeSnapshotReference(vs.Namespace, vs.Name, backup, snapClient)
+		}, p.Log)
+	}
+	if !apierrors.IsNotFound(err) {
+		return false, errors.Wrapf(err, "failed to get volumesnapshot %s/%s", vs.Namespace, vs.Name)
+	}
+
+	if vs.Status != nil && vs.Status.BoundVolumeSnapshotContentName != nil {
+		vscName := *vs.Status.BoundVolumeSnapshotContentName
+		vsc, err := snapClient.VolumeSnapshotContents().Get(context.TODO(), vscName, metav1.GetOptions{})
+		if err == nil {
+			return releaseBackupReference(backup, &vs.ObjectMeta, &vsc.ObjectMeta, func() ([]string, error) {
+				return util.RemoveVolumeSnapshotContentReference(vscName, backup, snapClient)
+			}, p.Log)
+		}
+		if !apierrors.IsNotFound(err) {
+			return false, errors.Wrapf(err, "failed to get volumesnapshotcontent %s", vscName)
+		}
+	}
+	return releaseBackupReference(backup, &vs.ObjectMeta, nil, nil, p.Log)
+}
+
+// deleteSnapshot deletes the snapshot of the backed-up volumesnapshot in the storage provider through a temporary
+// volumesnapshotcontent. Volumesnapshots backed up without a snapshot handle have no snapshot to delete.
+func (p *VolumeSnapshotDeleteItemAction) deleteSnapshot(vs *snapshotv1api.VolumeSnapshot, snapClient snapshotter.SnapshotV1Interface) error {
+	snapshot, ok := getVolumeSnapshotHandle(vs)
+	if !ok {
+		p.Log.Warnf("Volumesnapshot %s/%s has no volumesnapshotcontent and no snapshot handle, skipping deletion of its snapshot", vs.Namespace, vs.Name)
+		return nil
+	}
+	p.Log.Infof("Deleting snapshot %s of volumesnapshot %s/%s, whose volumesnapshotcontent is gone", snapshot.handle, vs.Namespace, vs.Name)
+	return deleteSnapshotByHandle(snapshot, snapClient, p.Log, p.Config.ReadyToUseTimeout)
+}
+
+// getVolumeSnapshotHandle returns the snapshot recorded on the backed-up volumesnapshot, if any.
+func getVolumeSnapshotHandle(vs *snapshotv1api.VolumeSnapshot) (snapshotHandle, bool) {
+	handle, hasHandle := vs.Annotations[util.VolumeSnapshotHandleAnnotation]
+	driver, hasDriver := vs.Annotations[util.CSIDriverNameAnnotation]
+	if !hasHandle || !hasDriver {
+		return snapshotHandle{}, false
+	}
+
+	snapshot := snapshotHandle{handle: handle, driver: driver}
+	if util.IsVolumeSnapshotHasVSCDeleteSecret(vs) {
+		snapshot.deleteSecret = &corev1api.SecretReference{
+			Name:      vs.Annotations[util.CSIDeleteSnapshotSecretName],
+			Namespace: vs.Annotations[util.CSIDeleteSnapshotSecretNamespace],
+		}
+	}
+	return snapshot, true
+}
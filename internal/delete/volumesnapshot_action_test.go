@@ -0,0 +1,178 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package delete
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	snapshotv1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/config"
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/util"
+)
+
+func newBackedUpVolumeSnapshot(vscName string, annotations map[string]string) *snapshotv1api.VolumeSnapshot {
+	return &snapshotv1api.VolumeSnapshot{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "vs-1",
+			Namespace:   "ns",
+			Annotations: annotations,
+		},
+		Status: &snapshotv1api.VolumeSnapshotStatus{
+			BoundVolumeSnapshotContentName: &vscName,
+		},
+	}
+}
+
+func newVolumeSnapshotContent(name, handle string) *snapshotv1api.VolumeSnapshotContent {
+	return &snapshotv1api.VolumeSnapshotContent{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: snapshotv1api.VolumeSnapshotContentSpec{
+			DeletionPolicy: snapshotv1api.VolumeSnapshotContentRetain,
+			Driver:         "csi.example.com",
+			Source:         snapshotv1api.VolumeSnapshotContentSource{SnapshotHandle: &handle},
+		},
+	}
+}
+
+func TestDeleteVolumeSnapshot(t *testing.T) {
+	handleAnnotations := map[string]string{
+		util.VolumeSnapshotHandleAnnotation:   "snap-1",
+		util.CSIDriverNameAnnotation:          "csi.example.com",
+		util.CSIDeleteSnapshotSecretName:      "delete-secret",
+		util.CSIDeleteSnapshotSecretNamespace: "secret-ns",
+	}
+	snapshot := snapshotHandle{handle: "snap-1", driver: "csi.example.com"}
+
+	testCases := []struct {
+		name              string
+		vs                *snapshotv1api.VolumeSnapshot
+		objects           []runtime.Object
+		alreadyDeleted    bool
+		expectedTemporary int
+		expectDeleted     bool
+	}{
+		{
+			name: "should delete the snapshot along with the volumesnapshotcontent",
+			vs:   newBackedUpVolumeSnapshot("vsc-1", handleAnnotations),
+			objects: []runtime.Object{
+				newBackedUpVolumeSnapshot("vsc-1", handleAnnotations),
+				newVolumeSnapshotContent("vsc-1", "snap-1"),
+			},
+			expectDeleted: true,
+		},
+		{
+			name:              "should delete the snapshot by its handle when the volumesnapshotcontent is gone",
+			vs:                newBackedUpVolumeSnapshot("vsc-1", handleAnnotations),
+			expectedTemporary: 1,
+			expectDeleted:     true,
+		},
+		{
+			name:           "should not delete the snapshot by its handle when the volumesnapshotcontent action deleted it",
+			vs:             newBackedUpVolumeSnapshot("vsc-1", handleAnnotations),
+			alreadyDeleted: true,
+			expectDeleted:  true,
+		},
+		{
+			name: "should skip the snapshot when neither the volumesnapshotcontent nor a snapshot handle is left",
+			vs:   newBackedUpVolumeSnapshot("vsc-1", nil),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resetDeletedSnapshots()
+			if tc.alreadyDeleted {
+				markSnapshotDeleted(snapshot)
+			}
+			client := newSnapshotClientset(false, tc.objects...)
+			p := &VolumeSnapshotDeleteItemAction{Log: logrus.New(), Config: config.Config{ReadyToUseTimeout: testTimeout}}
+
+			assert.NoError(t, p.deleteVolumeSnapshot(tc.vs, client.SnapshotV1()))
+			assert.Equal(t, tc.expectDeleted, isSnapshotDeleted(snapshot))
+
+			created := createdVolumeSnapshotContents(client)
+			require.Len(t, created, tc.expectedTemporary)
+			for _, vsc := range created {
+				assert.Equal(t, "delete-secret", vsc.Annotations[util.DeletionSecretNameAnnotation])
+				assert.Equal(t, "secret-ns", vsc.Annotations[util.DeletionSecretNamespaceAnnotation])
+			}
+
+			_, err := client.SnapshotV1().VolumeSnapshots(tc.vs.Namespace).Get(context.TODO(), tc.vs.Name, metav1.GetOptions{})
+			assert.True(t, apierrors.IsNotFound(err))
+			if len(tc.objects) > 0 {
+				vsc, err := client.SnapshotV1().VolumeSnapshotContents().Get(context.TODO(), "vsc-1", metav1.GetOptions{})
+				require.NoError(t, err)
+				assert.Equal(t, snapshotv1api.VolumeSnapshotContentDelete, vsc.Spec.DeletionPolicy)
+			}
+		})
+	}
+}
+
+// The volumesnapshot and volumesnapshotcontent delete item actions both run while deleting a backup. The snapshot must be
+// deleted once, along with the volumesnapshotcontent, whichever action runs first.
+func TestDeleteActionsDeleteSnapshotOnce(t *testing.T) {
+	handleAnnotations := map[string]string{
+		util.VolumeSnapshotHandleAnnotation: "snap-1",
+		util.CSIDriverNameAnnotation:        "csi.example.com",
+	}
+	vsc := newVolumeSnapshotContent("vsc-1", "snap-1")
+
+	testCases := []struct {
+		name                string
+		volumeSnapshotFirst bool
+	}{
+		{
+			name:                "volumesnapshot deleted first",
+			volumeSnapshotFirst: true,
+		},
+		{
+			name: "volumesnapshotcontent deleted first",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resetDeletedSnapshots()
+			vs := newBackedUpVolumeSnapshot("vsc-1", handleAnnotations)
+			client := newSnapshotClientset(false, vs.DeepCopy(), vsc.DeepCopy())
+			vsAction := &VolumeSnapshotDeleteItemAction{Log: logrus.New(), Config: config.Config{ReadyToUseTimeout: testTimeout}}
+			vscAction := &VolumeSnapshotContentDeleteItemAction{Log: logrus.New(), Config: config.Config{ReadyToUseTimeout: testTimeout}}
+
+			if tc.volumeSnapshotFirst {
+				require.NoError(t, vsAction.deleteVolumeSnapshot(vs, client.SnapshotV1()))
+				// The fake clientset does not garbage collect the volumesnapshotcontent of the deleted volumesnapshot.
+				require.NoError(t, client.SnapshotV1().VolumeSnapshotContents().Delete(context.TODO(), vsc.Name, metav1.DeleteOptions{}))
+				require.NoError(t, vscAction.deleteVolumeSnapshotContent(vsc, client.SnapshotV1()))
+			} else {
+				require.NoError(t, vscAction.deleteVolumeSnapshotContent(vsc, client.SnapshotV1()))
+				require.NoError(t, vsAction.deleteVolumeSnapshot(vs, client.SnapshotV1()))
+			}
+
+			assert.Empty(t, createdVolumeSnapshotContents(client))
+			assert.True(t, isSnapshotDeleted(snapshotHandle{handle: "snap-1", driver: "csi.example.com"}))
+		})
+	}
+}
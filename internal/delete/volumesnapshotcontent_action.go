@@ -6,18 +6,24 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/config"
 	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/util"
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 
-	snapshotv1beta1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1beta1"
+	snapshotv1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	snapshotter "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned/typed/volumesnapshot/v1"
+	corev1api "k8s.io/api/core/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 )
 
 // VolumeSnapshotContentDeleteItemAction is a restore item action plugin for Velero
 type VolumeSnapshotContentDeleteItemAction struct {
-	Log logrus.FieldLogger
+	Log    logrus.FieldLogger
+	Config config.Config
 }
 
 // AppliesTo returns information indicating VolumeSnapshotContentRestoreItemAction action should be invoked while restoring
@@ -31,40 +37,146 @@ func (p *VolumeSnapshotContentDeleteItemAction) AppliesTo() (velero.ResourceSele
 func (p *VolumeSnapshotContentDeleteItemAction) Execute(input *velero.DeleteItemActionExecuteInput) error {
 	p.Log.Info("Starting VolumeSnapshotContentDeleteItemAction")
 
-	var snapCont snapshotv1beta1api.VolumeSnapshotContent
+	var snapCont snapshotv1api.VolumeSnapshotContent
 	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(input.Item.UnstructuredContent(), &snapCont); err != nil {
 		return errors.Wrapf(err, "failed to convert input.Item from unstructured")
 	}
 
+	client, snapClient, err := util.GetClients()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err := p.checkLegalHold(&snapCont, input.Backup, client.CoreV1(), snapClient); err != nil {
+		return err
+	}
+
+	if util.IsAdoptedVolumeSnapshot(&snapCont.ObjectMeta) {
+		p.Log.Infof("VolumeSnapshotContent %s was adopted by backup %s and belongs to the application that took it, skipping deletion", snapCont.Name, input.Backup.Name)
+		return nil
+	}
+
 	// We don't want this DeleteItemAction plugin to delete VolumesnapshotContent taken outside of Velero.
 	// So skip deleting VolumesnapshotContent objects that were not created in the process of creating
-	// the Velero backup being deleted.
-	if !util.HasBackupLabel(&snapCont.ObjectMeta, input.Backup.Name) {
-		p.Log.Info("VolumeSnapshotContent %s was not taken by backup %s, skipping deletion", snapCont.Name, input.Backup.Name)
+	// a Velero backup, or that other backups still include.
+	deletable, err := p.releaseBackupReference(&snapCont, input.Backup, snapClient)
+	if err != nil {
+		return err
+	}
+	if !deletable {
+		p.Log.Infof("VolumeSnapshotContent %s was not taken by backup %s or is included in other backups, skipping deletion", snapCont.Name, input.Backup.Name)
 		return nil
 	}
 
-	p.Log.Infof("Deleting VolumeSnapshotContent %s", snapCont.Name)
+	return p.deleteVolumeSnapshotContent(&snapCont, snapClient)
+}
 
-	_, snapClient, err := util.GetClients()
-	if err != nil {
-		return errors.WithStack(err)
-	}
+// deleteVolumeSnapshotContent deletes the volumesnapshotcontent along with the snapshot in the storage provider.
+func (p *VolumeSnapshotContentDeleteItemAction) deleteVolumeSnapshotContent(snapCont *snapshotv1api.VolumeSnapshotContent,
+	snapClient snapshotter.SnapshotV1Interface) error {
+	p.Log.Infof("Deleting VolumeSnapshotContent %s", snapCont.Name)
 
-	err = util.SetVolumeSnapshotContentDeletionPolicy(snapCont.Name, snapClient.SnapshotV1beta1())
+	err := util.SetVolumeSnapshotContentDeletionPolicy(snapCont.Name, snapClient)
 	if err != nil {
 		if apierrors.IsNotFound(err) {
 			p.Log.Infof("VolumeSnapshotContent %s not found", snapCont.Name)
-			return nil
+			return p.deleteSnapshot(snapCont, snapClient)
 		}
 		return errors.Wrapf(err, fmt.Sprintf("failed to set DeletionPolicy on volumesnapshotcontent %s. Skipping deletion", snapCont.Name))
 	}
 
-	err = snapClient.SnapshotV1beta1().VolumeSnapshotContents().Delete(context.TODO(), snapCont.Name, metav1.DeleteOptions{})
+	err = snapClient.VolumeSnapshotContents().Delete(context.TODO(), snapCont.Name, metav1.DeleteOptions{})
 	if err != nil && !apierrors.IsNotFound(err) {
 		p.Log.Infof("VolumeSnapshotContent %s not found", snapCont.Name)
 		return err
 	}
+	if snapshot, ok := getVolumeSnapshotContentHandle(snapCont); ok {
+		markSnapshotDeleted(snapshot)
+	}
 
 	return nil
 }
+
+// checkLegalHold returns an error if the backup, the volumesnapshotcontent or its volumesnapshot is under legal hold.
+func (p *VolumeSnapshotContentDeleteItemAction) checkLegalHold(snapCont *snapshotv1api.VolumeSnapshotContent, backup *velerov1api.Backup,
+	events corev1client.EventsGetter, snapClient snapshotter.SnapshotV1Interface) error {
+	object := corev1api.ObjectReference{
+		APIVersion: snapshotv1api.SchemeGroupVersion.String(),
+		Kind:       "VolumeSnapshotContent",
+		Name:       snapCont.Name,
+	}
+	held := []heldObject{
+		{description: fmt.Sprintf("backup %s/%s", backup.Namespace, backup.Name), meta: &backup.ObjectMeta},
+		{description: "volumesnapshotcontent " + snapCont.Name, meta: &snapCont.ObjectMeta},
+	}
+
+	live, err := snapClient.VolumeSnapshotContents().Get(context.TODO(), snapCont.Name, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrapf(err, "failed to get volumesnapshotcontent %s", snapCont.Name)
+	}
+	if err == nil {
+		object.UID = live.UID
+		held = append(held, heldObject{description: "volumesnapshotcontent " + snapCont.Name, meta: &live.ObjectMeta})
+	}
+	ref := snapCont.Spec.VolumeSnapshotRef
+	if ref.Name != "" {
+		vs, err := snapClient.VolumeSnapshots(ref.Namespace).Get(context.TODO(), ref.Name, metav1.GetOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "failed to get volumesnapshot %s/%s", ref.Namespace, ref.Name)
+		}
+		if err == nil {
+			held = append(held, heldObject{description: fmt.Sprintf("volumesnapshot %s/%s", ref.Namespace, ref.Name), meta: &vs.ObjectMeta})
+		}
+	}
+	return checkLegalHold(object, held, events, p.Log)
+}
+
+// releaseBackupReference removes the backup from the backups referencing the volumesnapshotcontent and returns whether the
+// volumesnapshotcontent may be deleted.
+func (p *VolumeSnapshotContentDeleteItemAction) releaseBackupReference(snapCont *snapshotv1api.VolumeSnapshotContent, backup *velerov1api.Backup,
+	snapClient snapshotter.SnapshotV1Interface) (bool, error) {
+	live, err := snapClient.VolumeSnapshotContents().Get(context.TODO(), snapCont.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return releaseBackupReference(backup, &snapCont.ObjectMeta, nil, nil, p.Log)
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to get volumesnapshotcontent %s", snapCont.Name)
+	}
+	return releaseBackupReference(backup, &snapCont.ObjectMeta, &live.ObjectMeta, func() ([]string, error) {
+		return util.RemoveVolumeSnapshotContentReference(snapCont.Name, backup, snapClient)
+	}, p.Log)
+}
+
+// deleteSnapshot deletes the snapshot of the backed-up volumesnapshotcontent in the storage provider through a temporary
+// volumesnapshotcontent. Volumesnapshotcontents backed up without a snapshot handle have no snapshot to delete.
+func (p *VolumeSnapshotContentDeleteItemAction) deleteSnapshot(snapCont *snapshotv1api.VolumeSnapshotContent, snapClient snapshotter.SnapshotV1Interface) error {
+	snapshot, ok := getVolumeSnapshotContentHandle(snapCont)
+	if !ok {
+		p.Log.Warnf("VolumeSnapshotContent %s has no snapshot handle, skipping deletion of its snapshot", snapCont.Name)
+		return nil
+	}
+	p.Log.Infof("Deleting snapshot %s of volumesnapshotcontent %s, which is gone", snapshot.handle, snapCont.Name)
+	return deleteSnapshotByHandle(snapshot, snapClient, p.Log, p.Config.ReadyToUseTimeout)
+}
+
+// getVolumeSnapshotContentHandle returns the snapshot of the backed-up volumesnapshotcontent, if it has one.
+func getVolumeSnapshotContentHandle(snapCont *snapshotv1api.VolumeSnapshotContent) (snapshotHandle, bool) {
+	var handle *string
+	if snapCont.Status != nil && snapCont.Status.SnapshotHandle != nil {
+		handle = snapCont.Status.SnapshotHandle
+	} else {
+		handle = snapCont.Spec.Source.SnapshotHandle
+	}
+	if handle == nil {
+		return snapshotHandle{}, false
+	}
+
+	snapshot := snapshotHandle{handle: *handle, driver: snapCont.Spec.Driver}
+	if util.IsVolumeSnapshotContentHasDeleteSecret(snapCont) {
+		snapshot.deleteSecret = &corev1api.SecretReference{
+			Name:      snapCont.Annotations[util.DeletionSecretNameAnnotation],
+			Namespace: snapCont.Annotations[util.DeletionSecretNamespaceAnnotation],
+		}
+	}
+	return snapshot, true
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package delete
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	snapshotv1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/config"
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/util"
+)
+
+func TestDeleteVolumeSnapshotContent(t *testing.T) {
+	withSecret := newVolumeSnapshotContent("vsc-1", "snap-1")
+	withSecret.Annotations = map[string]string{
+		util.DeletionSecretNameAnnotation:      "delete-secret",
+		util.DeletionSecretNamespaceAnnotation: "secret-ns",
+	}
+	withoutHandle := newVolumeSnapshotContent("vsc-1", "")
+	withoutHandle.Spec.Source.SnapshotHandle = nil
+	snapshot := snapshotHandle{handle: "snap-1", driver: "csi.example.com"}
+
+	testCases := []struct {
+		name              string
+		vsc               *snapshotv1api.VolumeSnapshotContent
+		objects           []runtime.Object
+		alreadyDeleted    bool
+		expectedTemporary int
+		expectDeleted     bool
+	}{
+		{
+			name:          "should delete the snapshot along with the volumesnapshotcontent",
+			vsc:           withSecret,
+			objects:       []runtime.Object{withSecret.DeepCopy()},
+			expectDeleted: true,
+		},
+		{
+			name:              "should delete the snapshot by its handle when the volumesnapshotcontent is gone",
+			vsc:               withSecret,
+			expectedTemporary: 1,
+			expectDeleted:     true,
+		},
+		{
+			name:           "should not delete the snapshot by its handle when the volumesnapshot action deleted it",
+			vsc:            withSecret,
+			alreadyDeleted: true,
+			expectDeleted:  true,
+		},
+		{
+			name: "should skip the snapshot when the volumesnapshotcontent is gone and has no snapshot handle",
+			vsc:  withoutHandle,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resetDeletedSnapshots()
+			if tc.alreadyDeleted {
+				markSnapshotDeleted(snapshot)
+			}
+			client := newSnapshotClientset(false, tc.objects...)
+			p := &VolumeSnapshotContentDeleteItemAction{Log: logrus.New(), Config: config.Config{ReadyToUseTimeout: testTimeout}}
+
+			assert.NoError(t, p.deleteVolumeSnapshotContent(tc.vsc, client.SnapshotV1()))
+			assert.Equal(t, tc.expectDeleted, isSnapshotDeleted(snapshot))
+
+			created := createdVolumeSnapshotContents(client)
+			require.Len(t, created, tc.expectedTemporary)
+			for _, vsc := range created {
+				assert.Equal(t, "delete-secret", vsc.Annotations[util.DeletionSecretNameAnnotation])
+				assert.Equal(t, "secret-ns", vsc.Annotations[util.DeletionSecretNamespaceAnnotation])
+			}
+
+			_, err := client.SnapshotV1().VolumeSnapshotContents().Get(context.TODO(), tc.vsc.Name, metav1.GetOptions{})
+			assert.True(t, apierrors.IsNotFound(err))
+		})
+	}
+}
@@ -0,0 +1,329 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package legalhold places and removes legal holds on backups, volumesnapshots and volumesnapshotcontents, and keeps an
+// audit record of them. The delete item actions refuse to delete the snapshots under legal hold.
+//
+// Only the legal holds placed and removed through the Manager are recorded in the audit record. Legal hold annotations edited
+// directly on the objects are not, and neither are the deletions refused by the delete item actions, which are recorded as
+// events on the objects instead.
+package legalhold
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	snapshotter "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned/typed/volumesnapshot/v1"
+	corev1api "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/util/retry"
+
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/util"
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+)
+
+const (
+	// AuditRecordName is the name of the first configmap, in the Velero namespace, that records the placement and removal of legal
+	// holds. Once it is full, the audit record continues in configmaps named after it with the suffixes -1, -2 and so on.
+	AuditRecordName = "csi-legal-hold-audit"
+
+	// The kinds of objects a legal hold can be placed on.
+	KindBackup                = "backup"
+	KindVolumeSnapshot        = "volumesnapshot"
+	KindVolumeSnapshotContent = "volumesnapshotcontent"
+
+	// The actions recorded in the audit record.
+	ActionPlace  = "place"
+	ActionRemove = "remove"
+
+	// auditKeyFormat formats the time of an audit entry into its key, which sorts in time order.
+	auditKeyFormat = "20060102T150405.000000000Z"
+
+	// maxAuditEntries and maxAuditRecordSize bound each configmap of the audit record, well below the 1MiB size limit of
+	// configmaps. Entries that do not fit are recorded in the next configmap.
+	maxAuditEntries    = 1000
+	maxAuditRecordSize = 512 * 1024
+)
+
+// Target is an object that a legal hold is placed on.
+type Target struct {
+	Kind      string
+	Namespace string
+	Name      string
+}
+
+func (t Target) String() string {
+	if t.Namespace == "" {
+		return t.Kind + "/" + t.Name
+	}
+	return t.Kind + "/" + t.Namespace + "/" + t.Name
+}
+
+// ParseTarget parses a target of the form backup/<name>, volumesnapshot/<namespace>/<name> or volumesnapshotcontent/<name>.
+// Backups are in the Velero namespace.
+func ParseTarget(s, veleroNamespace string) (Target, error) {
+	parts := strings.Split(s, "/")
+	switch {
+	case len(parts) == 2 && parts[0] == KindBackup && parts[1] != "":
+		return Target{Kind: KindBackup, Namespace: veleroNamespace, Name: parts[1]}, nil
+	case len(parts) == 3 && parts[0] == KindVolumeSnapshot && parts[1] != "" && parts[2] != "":
+		return Target{Kind: KindVolumeSnapshot, Namespace: parts[1], Name: parts[2]}, nil
+	case len(parts) == 2 && parts[0] == KindVolumeSnapshotContent && parts[1] != "":
+		return Target{Kind: KindVolumeSnapshotContent, Name: parts[1]}, nil
+	}
+	return Target{}, errors.Errorf("invalid legal hold target %q, expected %s/<name>, %s/<namespace>/<name> or %s/<name>",
+		s, KindBackup, KindVolumeSnapshot, KindVolumeSnapshotContent)
+}
+
+// AuditEntry records the placement or removal of a legal hold.
+type AuditEntry struct {
+	Time      metav1.Time `json:"time"`
+	Action    string      `json:"action"`
+	Target    string      `json:"target"`
+	Reason    string      `json:"reason,omitempty"`
+	Requester string      `json:"requester,omitempty"`
+}
+
+// Manager places and removes legal holds.
+type Manager struct {
+	Log logrus.FieldLogger
+	// Namespace is the Velero namespace, which holds the backups and the audit record.
+	Namespace       string
+	ConfigMapClient corev1client.ConfigMapsGetter
+	BackupClient    dynamic.Interface
+	SnapshotClient  snapshotter.SnapshotV1Interface
+}
+
+// Place places a legal hold on the target, or updates the reason of its legal hold, and records it in the audit record.
+func (m *Manager) Place(target Target, reason, requester string) error {
+	previous, err := m.getHold(target)
+	if err != nil {
+		return err
+	}
+	if err := m.patchHold(target, &reason); err != nil {
+		return err
+	}
+	if err := m.auditOrRollback(target, previous, AuditEntry{Action: ActionPlace, Target: target.String(), Reason: reason, Requester: requester}); err != nil {
+		return err
+	}
+	m.Log.Infof("Placed legal hold on %s", target)
+	return nil
+}
+
+// Remove removes the legal hold from the target and records it in the audit record.
+func (m *Manager) Remove(target Target, requester string) error {
+	previous, err := m.getHold(target)
+	if err != nil {
+		return err
+	}
+	if previous == nil {
+		return errors.Errorf("%s is not under legal hold", target)
+	}
+	if err := m.patchHold(target, nil); err != nil {
+		return err
+	}
+	if err := m.auditOrRollback(target, previous, AuditEntry{Action: ActionRemove, Target: target.String(), Requester: requester}); err != nil {
+		return err
+	}
+	m.Log.Infof("Removed legal hold from %s", target)
+	return nil
+}
+
+// auditOrRollback records the entry in the audit record. If it cannot be recorded, the legal hold of the target is set back to
+// previous, so that no legal hold changes without a record of it.
+func (m *Manager) auditOrRollback(target Target, previous *string, entry AuditEntry) error {
+	err := m.audit(entry)
+	if err == nil {
+		return nil
+	}
+	if rollbackErr := m.patchHold(target, previous); rollbackErr != nil {
+		return errors.Wrapf(err, "legal hold of %s changed without being recorded, as it could not be rolled back (%v)", target, rollbackErr)
+	}
+	return err
+}
+
+// getHold returns the reason of the legal hold of the target, or nil if it is not under legal hold.
+func (m *Manager) getHold(target Target) (*string, error) {
+	var meta metav1.Object
+	var err error
+	switch target.Kind {
+	case KindBackup:
+		meta, err = m.BackupClient.Resource(velerov1api.SchemeGroupVersion.WithResource("backups")).Namespace(target.Namespace).
+			Get(context.TODO(), target.Name, metav1.GetOptions{})
+	case KindVolumeSnapshot:
+		meta, err = m.SnapshotClient.VolumeSnapshots(target.Namespace).Get(context.TODO(), target.Name, metav1.GetOptions{})
+	case KindVolumeSnapshotContent:
+		meta, err = m.SnapshotClient.VolumeSnapshotContents().Get(context.TODO(), target.Name, metav1.GetOptions{})
+	default:
+		return nil, errors.Errorf("unknown legal hold target kind %s", target.Kind)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting %s", target)
+	}
+	reason, held := meta.GetAnnotations()[util.LegalHoldAnnotation]
+	if !held {
+		return nil, nil
+	}
+	return &reason, nil
+}
+
+// patchHold sets the legal hold annotation of the target to reason, or removes it when reason is nil.
+func (m *Manager) patchHold(target Target, reason *string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]*string{util.LegalHoldAnnotation: reason},
+		},
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	switch target.Kind {
+	case KindBackup:
+		_, err = m.BackupClient.Resource(velerov1api.SchemeGroupVersion.WithResource("backups")).Namespace(target.Namespace).
+			Patch(context.TODO(), target.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	case KindVolumeSnapshot:
+		_, err = m.SnapshotClient.VolumeSnapshots(target.Namespace).Patch(context.TODO(), target.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	case KindVolumeSnapshotContent:
+		_, err = m.SnapshotClient.VolumeSnapshotContents().Patch(context.TODO(), target.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	default:
+		return errors.Errorf("unknown legal hold target kind %s", target.Kind)
+	}
+	return errors.Wrapf(err, "error patching legal hold of %s", target)
+}
+
+// audit appends the entry to the last configmap of the audit record. The next configmap of the record is created when there is
+// none yet or the last one is full.
+func (m *Manager) audit(entry AuditEntry) error {
+	entry.Time = metav1.NewTime(time.Now().UTC())
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if len(data)+len(auditKeyFormat) > maxAuditRecordSize {
+		return errors.Errorf("audit entry of the %s of legal hold on %s is too large to be recorded", entry.Action, entry.Target)
+	}
+
+	name := AuditRecordName
+	retriable := func(err error) bool { return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err) }
+	err = retry.OnError(retry.DefaultRetry, retriable, func() error {
+		cm, index, err := m.lastAuditRecord()
+		if err != nil {
+			return err
+		}
+		if cm == nil || !hasRoomForAuditEntry(cm, entry.Time.Time, string(data)) {
+			if cm != nil {
+				index++
+			}
+			name = auditRecordName(index)
+			cm = &corev1api.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      name,
+					Namespace: m.Namespace,
+					Labels: map[string]string{
+						util.LegalHoldAuditLabel:    "true",
+						util.ExcludeFromBackupLabel: "true",
+					},
+				},
+			}
+			addAuditEntry(cm, entry.Time.Time, string(data))
+			_, err = m.ConfigMapClient.ConfigMaps(m.Namespace).Create(context.TODO(), cm, metav1.CreateOptions{})
+			return err
+		}
+		name = cm.Name
+		addAuditEntry(cm, entry.Time.Time, string(data))
+		_, err = m.ConfigMapClient.ConfigMaps(m.Namespace).Update(context.TODO(), cm, metav1.UpdateOptions{})
+		return err
+	})
+	return errors.Wrapf(err, "error recording %s of legal hold on %s in audit record %s/%s", entry.Action, entry.Target, m.Namespace, name)
+}
+
+// lastAuditRecord returns the configmap of the audit record with the highest index, and its index, or nil if there is none.
+func (m *Manager) lastAuditRecord() (*corev1api.ConfigMap, int, error) {
+	list, err := m.ConfigMapClient.ConfigMaps(m.Namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: util.LegalHoldAuditLabel})
+	if err != nil {
+		return nil, 0, err
+	}
+	var last *corev1api.ConfigMap
+	lastIndex := 0
+	for i := range list.Items {
+		index, ok := auditRecordIndex(list.Items[i].Name)
+		if ok && (last == nil || index > lastIndex) {
+			last, lastIndex = &list.Items[i], index
+		}
+	}
+	return last, lastIndex, nil
+}
+
+// auditRecordName returns the name of the configmap of the audit record with the index.
+func auditRecordName(index int) string {
+	if index == 0 {
+		return AuditRecordName
+	}
+	return fmt.Sprintf("%s-%d", AuditRecordName, index)
+}
+
+// auditRecordIndex returns the index of the configmap of the audit record with the name.
+func auditRecordIndex(name string) (int, bool) {
+	if name == AuditRecordName {
+		return 0, true
+	}
+	index, err := strconv.Atoi(strings.TrimPrefix(name, AuditRecordName+"-"))
+	if err != nil || !strings.HasPrefix(name, AuditRecordName+"-") || index <= 0 {
+		return 0, false
+	}
+	return index, true
+}
+
+// hasRoomForAuditEntry returns whether the entry fits in the configmap of the audit record.
+func hasRoomForAuditEntry(cm *corev1api.ConfigMap, t time.Time, entry string) bool {
+	if len(cm.Data) >= maxAuditEntries {
+		return false
+	}
+	// Suffixed keys are a few bytes longer, which the margin of maxAuditRecordSize below the size limit of configmaps absorbs.
+	size := len(t.Format(auditKeyFormat)) + len(entry)
+	for k, v := range cm.Data {
+		size += len(k) + len(v)
+	}
+	return size <= maxAuditRecordSize
+}
+
+// addAuditEntry adds the entry to the configmap of the audit record, keyed by its time. Entries recorded at the same time get a
+// suffix.
+func addAuditEntry(cm *corev1api.ConfigMap, t time.Time, entry string) {
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	key := t.Format(auditKeyFormat)
+	for i := 1; ; i++ {
+		if _, ok := cm.Data[key]; !ok {
+			break
+		}
+		key = fmt.Sprintf("%s-%d", t.Format(auditKeyFormat), i)
+	}
+	cm.Data[key] = entry
+}
@@ -0,0 +1,304 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package legalhold
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	snapshotv1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	snapshotFake "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned/fake"
+	corev1api "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/util"
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+)
+
+func TestParseTarget(t *testing.T) {
+	testCases := []struct {
+		name        string
+		target      string
+		expected    Target
+		expectError bool
+	}{
+		{
+			name:     "backup",
+			target:   "backup/backup-1",
+			expected: Target{Kind: KindBackup, Namespace: "velero", Name: "backup-1"},
+		},
+		{
+			name:     "volumesnapshot",
+			target:   "volumesnapshot/app/vs-1",
+			expected: Target{Kind: KindVolumeSnapshot, Namespace: "app", Name: "vs-1"},
+		},
+		{
+			name:     "volumesnapshotcontent",
+			target:   "volumesnapshotcontent/vsc-1",
+			expected: Target{Kind: KindVolumeSnapshotContent, Name: "vsc-1"},
+		},
+		{
+			name:        "volumesnapshot without namespace",
+			target:      "volumesnapshot/vs-1",
+			expectError: true,
+		},
+		{
+			name:        "unknown kind",
+			target:      "pvc/app/data",
+			expectError: true,
+		},
+		{
+			name:        "missing name",
+			target:      "backup/",
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			target, err := ParseTarget(tc.target, "velero")
+			if tc.expectError {
+				assert.NotNil(t, err)
+				return
+			}
+			require.Nil(t, err)
+			assert.Equal(t, tc.expected, target)
+		})
+	}
+}
+
+// getAuditEntries returns the entries of the configmaps of the audit record, in the order of the configmaps.
+func getAuditEntries(t *testing.T, m *Manager) []AuditEntry {
+	entries := []AuditEntry{}
+	for index := 0; ; index++ {
+		cm, err := m.ConfigMapClient.ConfigMaps("velero").Get(context.TODO(), auditRecordName(index), metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return entries
+		}
+		require.Nil(t, err)
+		keys := []string{}
+		for k := range cm.Data {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			entry := AuditEntry{}
+			require.Nil(t, json.Unmarshal([]byte(cm.Data[k]), &entry))
+			entries = append(entries, entry)
+		}
+	}
+}
+
+func TestPlaceAndRemove(t *testing.T) {
+	backup := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": velerov1api.SchemeGroupVersion.String(),
+		"kind":       "Backup",
+		"metadata": map[string]interface{}{
+			"name":      "backup-1",
+			"namespace": "velero",
+		},
+	}}
+	vs := &snapshotv1api.VolumeSnapshot{ObjectMeta: metav1.ObjectMeta{Name: "vs-1", Namespace: "app"}}
+	vsc := &snapshotv1api.VolumeSnapshotContent{ObjectMeta: metav1.ObjectMeta{Name: "vsc-1"}}
+
+	m := &Manager{
+		Log:             logrus.New(),
+		Namespace:       "velero",
+		ConfigMapClient: fake.NewSimpleClientset().CoreV1(),
+		BackupClient:    dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), backup),
+		SnapshotClient:  snapshotFake.NewSimpleClientset(vs, vsc).SnapshotV1(),
+	}
+	targets := []Target{
+		{Kind: KindBackup, Namespace: "velero", Name: "backup-1"},
+		{Kind: KindVolumeSnapshot, Namespace: "app", Name: "vs-1"},
+		{Kind: KindVolumeSnapshotContent, Name: "vsc-1"},
+	}
+
+	for _, target := range targets {
+		require.Nil(t, m.Place(target, "case 1234", "alice"))
+		reason, err := m.getHold(target)
+		require.Nil(t, err)
+		assert.NotNil(t, reason, target.String())
+	}
+	liveVS, err := m.SnapshotClient.VolumeSnapshots("app").Get(context.TODO(), "vs-1", metav1.GetOptions{})
+	require.Nil(t, err)
+	assert.Equal(t, "case 1234", liveVS.Annotations[util.LegalHoldAnnotation])
+
+	for _, target := range targets {
+		require.Nil(t, m.Remove(target, "bob"))
+		reason, err := m.getHold(target)
+		require.Nil(t, err)
+		assert.Nil(t, reason, target.String())
+	}
+	assert.NotNil(t, m.Remove(targets[0], "bob"), "removing a legal hold that is not placed should fail")
+
+	cm, err := m.ConfigMapClient.ConfigMaps("velero").Get(context.TODO(), AuditRecordName, metav1.GetOptions{})
+	require.Nil(t, err)
+	assert.Equal(t, "true", cm.Labels[util.ExcludeFromBackupLabel])
+	assert.Equal(t, "true", cm.Labels[util.LegalHoldAuditLabel])
+	entries := getAuditEntries(t, m)
+	require.Len(t, entries, 6)
+	for i, target := range targets {
+		assert.Equal(t, ActionPlace, entries[i].Action)
+		assert.Equal(t, target.String(), entries[i].Target)
+		assert.Equal(t, "case 1234", entries[i].Reason)
+		assert.Equal(t, "alice", entries[i].Requester)
+
+		assert.Equal(t, ActionRemove, entries[i+3].Action)
+		assert.Equal(t, target.String(), entries[i+3].Target)
+		assert.Equal(t, "bob", entries[i+3].Requester)
+	}
+}
+
+func TestAuditRollsOver(t *testing.T) {
+	start := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	// newRecord returns the configmap of the audit record with the index, holding n entries with reasons of the given size.
+	newRecord := func(index, n, size int) *corev1api.ConfigMap {
+		cm := &corev1api.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      auditRecordName(index),
+				Namespace: "velero",
+				Labels:    map[string]string{util.LegalHoldAuditLabel: "true"},
+			},
+			Data: map[string]string{},
+		}
+		for i := 0; i < n; i++ {
+			cm.Data[start.Add(time.Duration(i)*time.Second).Format(auditKeyFormat)] = `{"action":"place","target":"backup/old","reason":"` +
+				strings.Repeat("x", size) + `"}`
+		}
+		return cm
+	}
+
+	testCases := []struct {
+		name            string
+		records         []runtime.Object
+		expectedRecord  string
+		expectedEntries int
+	}{
+		{
+			name:            "the first configmap is created",
+			expectedRecord:  AuditRecordName,
+			expectedEntries: 1,
+		},
+		{
+			name:            "entries are added to the last configmap",
+			records:         []runtime.Object{newRecord(0, maxAuditEntries, 10), newRecord(1, 3, 10)},
+			expectedRecord:  AuditRecordName + "-1",
+			expectedEntries: 4,
+		},
+		{
+			name:            "the next configmap is created when the last one holds too many entries",
+			records:         []runtime.Object{newRecord(0, maxAuditEntries, 10)},
+			expectedRecord:  AuditRecordName + "-1",
+			expectedEntries: 1,
+		},
+		{
+			name:            "the next configmap is created when the last one is too large",
+			records:         []runtime.Object{newRecord(0, maxAuditEntries, 10), newRecord(1, 2, maxAuditRecordSize/2)},
+			expectedRecord:  AuditRecordName + "-2",
+			expectedEntries: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := &Manager{
+				Log:             logrus.New(),
+				Namespace:       "velero",
+				ConfigMapClient: fake.NewSimpleClientset(tc.records...).CoreV1(),
+			}
+			require.Nil(t, m.audit(AuditEntry{Action: ActionPlace, Target: "backup/backup-1", Reason: "case 1234", Requester: "alice"}))
+
+			cm, err := m.ConfigMapClient.ConfigMaps("velero").Get(context.TODO(), tc.expectedRecord, metav1.GetOptions{})
+			require.Nil(t, err)
+			assert.Len(t, cm.Data, tc.expectedEntries)
+			// No entry is dropped from the configmaps that are full.
+			for _, obj := range tc.records {
+				record := obj.(*corev1api.ConfigMap)
+				live, err := m.ConfigMapClient.ConfigMaps("velero").Get(context.TODO(), record.Name, metav1.GetOptions{})
+				require.Nil(t, err)
+				if record.Name != tc.expectedRecord {
+					assert.Equal(t, record.Data, live.Data)
+				}
+			}
+			entries := getAuditEntries(t, m)
+			assert.Equal(t, "backup/backup-1", entries[len(entries)-1].Target)
+		})
+	}
+}
+
+func TestAuditTooLargeEntry(t *testing.T) {
+	m := &Manager{
+		Log:             logrus.New(),
+		Namespace:       "velero",
+		ConfigMapClient: fake.NewSimpleClientset().CoreV1(),
+	}
+	assert.Error(t, m.audit(AuditEntry{Action: ActionPlace, Target: "backup/backup-1", Reason: strings.Repeat("x", maxAuditRecordSize)}))
+}
+
+func TestPlaceAndRemoveRollBackWhenAuditFails(t *testing.T) {
+	held := &snapshotv1api.VolumeSnapshot{ObjectMeta: metav1.ObjectMeta{
+		Name:        "vs-held",
+		Namespace:   "app",
+		Annotations: map[string]string{util.LegalHoldAnnotation: "case 1"},
+	}}
+	free := &snapshotv1api.VolumeSnapshot{ObjectMeta: metav1.ObjectMeta{Name: "vs-free", Namespace: "app"}}
+	configMapClient := fake.NewSimpleClientset()
+	configMapClient.PrependReactor("create", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("configmaps is forbidden")
+	})
+	m := &Manager{
+		Log:             logrus.New(),
+		Namespace:       "velero",
+		ConfigMapClient: configMapClient.CoreV1(),
+		SnapshotClient:  snapshotFake.NewSimpleClientset(held, free).SnapshotV1(),
+	}
+	heldTarget := Target{Kind: KindVolumeSnapshot, Namespace: "app", Name: "vs-held"}
+	freeTarget := Target{Kind: KindVolumeSnapshot, Namespace: "app", Name: "vs-free"}
+
+	assert.Error(t, m.Place(freeTarget, "case 2", "alice"))
+	reason, err := m.getHold(freeTarget)
+	require.Nil(t, err)
+	assert.Nil(t, reason)
+
+	assert.Error(t, m.Place(heldTarget, "case 2", "alice"))
+	reason, err = m.getHold(heldTarget)
+	require.Nil(t, err)
+	require.NotNil(t, reason)
+	assert.Equal(t, "case 1", *reason)
+
+	assert.Error(t, m.Remove(heldTarget, "bob"))
+	reason, err = m.getHold(heldTarget)
+	require.Nil(t, err)
+	require.NotNil(t, reason)
+	assert.Equal(t, "case 1", *reason)
+}
@@ -0,0 +1,48 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package restore
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/config"
+)
+
+// mapDriverName replaces the name of the CSI driver at the path of fields in the item with the name it is mapped to by the
+// plugin configuration, if any.
+func mapDriverName(item runtime.Unstructured, cfg config.Config, log logrus.FieldLogger, fields ...string) error {
+	obj := &unstructured.Unstructured{Object: item.UnstructuredContent()}
+	driver, found, err := unstructured.NestedString(obj.Object, fields...)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get %s of %s %s", strings.Join(fields, "."), obj.GetKind(), obj.GetName())
+	}
+	if !found {
+		return nil
+	}
+	mapped := cfg.MapDriverName(driver)
+	if mapped == driver {
+		return nil
+	}
+	log.Infof("Mapping CSI driver of %s %s from %s to %s", obj.GetKind(), obj.GetName(), driver, mapped)
+	return errors.WithStack(unstructured.SetNestedField(obj.Object, mapped, fields...))
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package restore
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/config"
+)
+
+func TestMapDriverName(t *testing.T) {
+	cfg := config.Default()
+	cfg.DriverNames["foo.csi.vendor.io"] = "csi.vendor.com"
+
+	testCases := []struct {
+		name     string
+		object   map[string]interface{}
+		fields   []string
+		expected map[string]interface{}
+	}{
+		{
+			name: "mapped driver of a volumesnapshotclass",
+			object: map[string]interface{}{
+				"kind":   "VolumeSnapshotClass",
+				"driver": "foo.csi.vendor.io",
+			},
+			fields: []string{"driver"},
+			expected: map[string]interface{}{
+				"kind":   "VolumeSnapshotClass",
+				"driver": "csi.vendor.com",
+			},
+		},
+		{
+			name: "mapped driver of a volumesnapshotcontent",
+			object: map[string]interface{}{
+				"kind": "VolumeSnapshotContent",
+				"spec": map[string]interface{}{"driver": "foo.csi.vendor.io"},
+			},
+			fields: []string{"spec", "driver"},
+			expected: map[string]interface{}{
+				"kind": "VolumeSnapshotContent",
+				"spec": map[string]interface{}{"driver": "csi.vendor.com"},
+			},
+		},
+		{
+			name: "driver not mapped",
+			object: map[string]interface{}{
+				"kind":   "VolumeSnapshotClass",
+				"driver": "hostpath.csi.k8s.io",
+			},
+			fields: []string{"driver"},
+			expected: map[string]interface{}{
+				"kind":   "VolumeSnapshotClass",
+				"driver": "hostpath.csi.k8s.io",
+			},
+		},
+		{
+			name:     "no driver",
+			object:   map[string]interface{}{"kind": "VolumeSnapshotContent"},
+			fields:   []string{"spec", "driver"},
+			expected: map[string]interface{}{"kind": "VolumeSnapshotContent"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			item := &unstructured.Unstructured{Object: tc.object}
+			assert.NoError(t, mapDriverName(item, cfg, logrus.New(), tc.fields...))
+			assert.Equal(t, tc.expected, item.Object)
+		})
+	}
+}
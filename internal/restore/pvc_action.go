@@ -19,18 +19,27 @@ package restore
 import (
 	"context"
 	"fmt"
+	"strings"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 
-	snapshotv1beta1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1beta1"
+	snapshotv1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	snapshotter "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned/typed/volumesnapshot/v1"
 	corev1api "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/config"
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/datamover"
 	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/util"
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
 )
 
@@ -43,7 +52,8 @@ const (
 
 // PVCRestoreItemAction is a restore item action plugin for Velero
 type PVCRestoreItemAction struct {
-	Log logrus.FieldLogger
+	Log    logrus.FieldLogger
+	Config config.Config
 }
 
 // AppliesTo returns information indicating that the PVCRestoreItemAction should be run while restoring PVCs.
@@ -71,7 +81,7 @@ func resetPVCSpec(pvc *corev1api.PersistentVolumeClaim, vsName string) {
 	// So clear out the volume name, which is a ref to the PV
 	pvc.Spec.VolumeName = ""
 	pvc.Spec.DataSource = &corev1api.TypedLocalObjectReference{
-		APIGroup: &snapshotv1beta1api.SchemeGroupVersion.Group,
+		APIGroup: &snapshotv1api.SchemeGroupVersion.Group,
 		Kind:     "VolumeSnapshot",
 		Name:     vsName,
 	}
@@ -92,6 +102,164 @@ func setPVCStorageResourceRequest(pvc *corev1api.PersistentVolumeClaim, restoreS
 	}
 }
 
+// shouldRestoreFromDataMover returns whether the PVC, whose data was copied to the data mover object store during backup,
+// should be restored from there. That is the case when the restore asks for it or when no usable volumesnapshot is available:
+// either the volumesnapshot was not restored, the CSI driver that took it is not installed in the cluster, or the storage class
+// of the PVC is provisioned by another driver.
+func (p *PVCRestoreItemAction) shouldRestoreFromDataMover(pvc *corev1api.PersistentVolumeClaim, volumeSnapshotName string, restore *velerov1api.Restore,
+	client kubernetes.Interface, snapClient snapshotter.SnapshotV1Interface) (bool, error) {
+	if restore.Annotations[util.RestoreFromDataMoverAnnotation] == "true" {
+		p.Log.Infof("Restoring PVC %s/%s from the data mover object store as requested by restore %s", pvc.Namespace, pvc.Name, restore.Name)
+		return true, nil
+	}
+
+	vs, err := snapClient.VolumeSnapshots(pvc.Namespace).Get(context.TODO(), volumeSnapshotName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		p.Log.Infof("Restoring PVC %s/%s from the data mover object store, volumesnapshot %s was not restored", pvc.Namespace, pvc.Name, volumeSnapshotName)
+		return true, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to get volumesnapshot %s/%s", pvc.Namespace, volumeSnapshotName)
+	}
+
+	driver := vs.Annotations[util.CSIDriverNameAnnotation]
+	if driver == "" {
+		return false, nil
+	}
+	_, err = client.StorageV1().CSIDrivers().Get(context.TODO(), driver, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		p.Log.Infof("Restoring PVC %s/%s from the data mover object store, CSI driver %s of volumesnapshot %s is not installed",
+			pvc.Namespace, pvc.Name, driver, volumeSnapshotName)
+		return true, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to get CSI driver %s", driver)
+	}
+	mismatch, err := checkStorageClassDriver(pvcStorageClassName(pvc), driver, client.StorageV1())
+	if err != nil {
+		return false, err
+	}
+	if mismatch != "" {
+		p.Log.Infof("Restoring PVC %s/%s from the data mover object store, %s", pvc.Namespace, pvc.Name, mismatch)
+		return true, nil
+	}
+	return false, nil
+}
+
+// restoreWithoutDataSource restores the PVC as an empty volume, because its storage class cannot be provisioned from the
+// volumesnapshot for reason, when the restore allows it. Otherwise, restoring the PVC fails.
+func (p *PVCRestoreItemAction) restoreWithoutDataSource(pvc *corev1api.PersistentVolumeClaim, vs *snapshotv1api.VolumeSnapshot, reason string,
+	restore *velerov1api.Restore, client corev1client.EventsGetter) (*velero.RestoreItemActionExecuteOutput, error) {
+	allowed := restore.Annotations[util.AllowEmptyVolumeAnnotation] == "true"
+	msg := fmt.Sprintf("Cannot restore PVC %s/%s from volumesnapshot %s/%s, %s", pvc.Namespace, pvc.Name, vs.Namespace, vs.Name, reason)
+	if allowed {
+		msg = fmt.Sprintf("Restoring PVC %s/%s without data from volumesnapshot %s/%s, %s", pvc.Namespace, pvc.Name, vs.Namespace, vs.Name, reason)
+	}
+	p.Log.Error(msg)
+	ref := corev1api.ObjectReference{
+		APIVersion: velerov1api.SchemeGroupVersion.String(),
+		Kind:       "Restore",
+		Namespace:  restore.Namespace,
+		Name:       restore.Name,
+		UID:        restore.UID,
+	}
+	if err := util.RecordWarningEvent(client, ref, "StorageClassMismatch", msg); err != nil {
+		p.Log.WithError(err).Warnf("Failed to record event about PVC %s/%s on restore %s", pvc.Namespace, pvc.Name, restore.Name)
+	}
+	if !allowed {
+		return nil, errors.Errorf("refusing to restore PVC %s/%s as an empty volume, volumesnapshot %s/%s cannot be restored, %s. Annotate the restore with %s=true to restore it as an empty volume",
+			pvc.Namespace, pvc.Name, vs.Namespace, vs.Name, reason, util.AllowEmptyVolumeAnnotation)
+	}
+
+	pvc.Spec.VolumeName = ""
+	pvc.Spec.DataSource = nil
+	pvcMap, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pvc)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &velero.RestoreItemActionExecuteOutput{
+		UpdatedItem: &unstructured.Unstructured{Object: pvcMap},
+	}, nil
+}
+
+// restoreFromDataMover creates the PVC and populates it from the data mover repository of the backup. Velero is told to skip restoring the
+// PVC, as it already exists.
+func (p *PVCRestoreItemAction) restoreFromDataMover(pvc *corev1api.PersistentVolumeClaim, manifestKey string, input *velero.RestoreItemActionExecuteInput,
+	corev1 corev1client.PersistentVolumeClaimsGetter) (*velero.RestoreItemActionExecuteOutput, error) {
+	_, err := corev1.PersistentVolumeClaims(pvc.Namespace).Get(context.TODO(), pvc.Name, metav1.GetOptions{})
+	if err == nil {
+		p.Log.Infof("PVC %s/%s already exists, not restoring it from the data mover object store", pvc.Namespace, pvc.Name)
+		return &velero.RestoreItemActionExecuteOutput{
+			UpdatedItem: input.Item,
+		}, nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return nil, errors.Wrapf(err, "failed to get PVC %s/%s", pvc.Namespace, pvc.Name)
+	}
+
+	// The data was copied to the repository in the backup storage location of the backup.
+	backupClient, err := util.GetDynamicClient()
+	if err != nil {
+		return nil, err
+	}
+	backup, err := util.GetBackup(backupClient, input.Restore.Namespace, input.Restore.Spec.BackupName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get backup %s/%s", input.Restore.Namespace, input.Restore.Spec.BackupName)
+	}
+
+	resetPVCForDataMover(pvc)
+	mover, err := datamover.NewMover(p.Config, backup.Namespace, backup.Spec.StorageLocation, p.Log)
+	if err != nil {
+		return nil, err
+	}
+	defer mover.Close()
+	if err := mover.RestorePVC(pvc, manifestKey); err != nil {
+		return nil, err
+	}
+
+	return &velero.RestoreItemActionExecuteOutput{
+		UpdatedItem: input.Item,
+		SkipRestore: true,
+	}, nil
+}
+
+func resetPVCForDataMover(pvc *corev1api.PersistentVolumeClaim) {
+	// The PVC is provisioned empty and populated by the data mover, so it has neither a volume nor a data source.
+	pvc.ResourceVersion = ""
+	pvc.UID = ""
+	pvc.Spec.VolumeName = ""
+	pvc.Spec.DataSource = nil
+	pvc.Status = corev1api.PersistentVolumeClaimStatus{}
+}
+
+// checkConsistencyGroup returns an error if the volumesnapshot was taken together with the other members of a consistency group
+// and the volumesnapshots of some of the members were not restored, unless the restore allows partial consistency groups.
+func (p *PVCRestoreItemAction) checkConsistencyGroup(vs *snapshotv1api.VolumeSnapshot, restore *velerov1api.Restore, snapClient snapshotter.SnapshotV1Interface) error {
+	groupID := vs.Labels[util.ConsistencyGroupIDLabel]
+	if groupID == "" {
+		return nil
+	}
+	members := strings.Split(vs.Annotations[util.ConsistencyGroupMembersAnnotation], ",")
+
+	selector := labels.SelectorFromSet(labels.Set{util.ConsistencyGroupIDLabel: groupID}).String()
+	vsList, err := snapClient.VolumeSnapshots(vs.Namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return errors.Wrapf(err, "failed to list volumesnapshots of consistency group %s", groupID)
+	}
+	if len(vsList.Items) >= len(members) {
+		return nil
+	}
+
+	msg := fmt.Sprintf("only %d of the %d volumesnapshots of the consistency group of PVCs %s in namespace %s were restored",
+		len(vsList.Items), len(members), strings.Join(members, ", "), vs.Namespace)
+	if restore.Annotations[util.AllowPartialConsistencyGroupAnnotation] == "true" {
+		p.Log.Warnf("Restoring volumesnapshot %s/%s although %s", vs.Namespace, vs.Name, msg)
+		return nil
+	}
+	return errors.Errorf("refusing to restore volumesnapshot %s/%s, %s. Annotate the restore with %s=true to restore part of the group",
+		vs.Namespace, vs.Name, msg, util.AllowPartialConsistencyGroupAnnotation)
+}
+
 // Execute modifies the PVC's spec to use the volumesnapshot object as the data source ensuring that the newly provisioned volume
 // can be pre-populated with data from the volumesnapshot.
 func (p *PVCRestoreItemAction) Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
@@ -104,6 +272,18 @@ func (p *PVCRestoreItemAction) Execute(input *velero.RestoreItemActionExecuteInp
 	removePVCAnnotations(&pvc,
 		[]string{AnnBindCompleted, AnnBoundByController, AnnStorageProvisioner, AnnSelectedNode})
 
+	// The rename mapping names PVCs by their backed-up namespace, so apply it before mapping the namespace. The item is
+	// renamed too, as it is restored as is when the PVC already exists.
+	name, err := renamedPVCName(&pvc, input.Restore)
+	if err != nil {
+		return nil, err
+	}
+	if name != pvc.Name {
+		p.Log.Infof("Restoring PVC %s/%s as %s", pvc.Namespace, pvc.Name, name)
+		pvc.Name = name
+		(&unstructured.Unstructured{Object: input.Item.UnstructuredContent()}).SetName(name)
+	}
+
 	// If cross-namespace restore is configured, change the namespace
 	// for PVC object to be restored
 	if val, ok := input.Restore.Spec.NamespaceMapping[pvc.GetNamespace()]; ok {
@@ -118,16 +298,51 @@ func (p *PVCRestoreItemAction) Execute(input *velero.RestoreItemActionExecuteInp
 		}, nil
 	}
 
-	_, snapClient, err := util.GetClients()
+	client, snapClient, err := util.GetClients()
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
-	vs, err := snapClient.SnapshotV1beta1().VolumeSnapshots(pvc.Namespace).Get(context.TODO(), volumeSnapshotName, metav1.GetOptions{})
+	// Velero's change-storage-class restore item action may run after this one, so map the storage class here, before checking
+	// that it can be provisioned from the volumesnapshot.
+	if storageClass := pvcStorageClassName(&pvc); storageClass != "" {
+		mapped, err := mapStorageClass(storageClass, input.Restore, client.CoreV1())
+		if err != nil {
+			return nil, err
+		}
+		if mapped != storageClass {
+			p.Log.Infof("Mapping storage class of PVC %s/%s from %s to %s", pvc.Namespace, pvc.Name, storageClass, mapped)
+			pvc.Spec.StorageClassName = &mapped
+		}
+	}
+
+	if manifestKey, ok := pvc.Annotations[util.DataMoverManifestAnnotation]; ok {
+		useDataMover, err := p.shouldRestoreFromDataMover(&pvc, volumeSnapshotName, input.Restore, client, snapClient)
+		if err != nil {
+			return nil, err
+		}
+		if useDataMover {
+			return p.restoreFromDataMover(&pvc, manifestKey, input, client.CoreV1())
+		}
+	}
+
+	vs, err := snapClient.VolumeSnapshots(pvc.Namespace).Get(context.TODO(), volumeSnapshotName, metav1.GetOptions{})
 	if err != nil {
 		return nil, errors.Wrapf(err, fmt.Sprintf("Failed to get Volumesnapshot %s/%s to restore PVC %s/%s", pvc.Namespace, volumeSnapshotName, pvc.Namespace, pvc.Name))
 	}
 
+	if err := p.checkConsistencyGroup(vs, input.Restore, snapClient); err != nil {
+		return nil, err
+	}
+
+	mismatch, err := checkStorageClassDriver(pvcStorageClassName(&pvc), vs.Annotations[util.CSIDriverNameAnnotation], client.StorageV1())
+	if err != nil {
+		return nil, err
+	}
+	if mismatch != "" {
+		return p.restoreWithoutDataSource(&pvc, vs, mismatch, input.Restore, client.CoreV1())
+	}
+
 	if _, exists := vs.Annotations[util.VolumeSnapshotRestoreSize]; exists {
 		restoreSize, err := resource.ParseQuantity(vs.Annotations[util.VolumeSnapshotRestoreSize])
 		if err != nil {
@@ -143,6 +358,10 @@ func (p *PVCRestoreItemAction) Execute(input *velero.RestoreItemActionExecuteInp
 		setPVCStorageResourceRequest(&pvc, restoreSize, p.Log)
 	}
 
+	if err := p.applyVolumeTopology(&pvc, input.Restore, client.StorageV1()); err != nil {
+		return nil, err
+	}
+
 	resetPVCSpec(&pvc, volumeSnapshotName)
 
 	pvcMap, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&pvc)
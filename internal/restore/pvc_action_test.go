@@ -17,14 +17,23 @@ limitations under the License.
 package restore
 
 import (
+	"context"
 	"testing"
 
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
+	snapshotv1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	snapshotFake "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned/fake"
 	corev1api "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/util"
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
 )
 
 func TestRemovePVCAnnotations(t *testing.T) {
@@ -325,3 +334,119 @@ func TestResetPVCResourceRequest(t *testing.T) {
 		})
 	}
 }
+
+func TestCheckConsistencyGroup(t *testing.T) {
+	groupVS := func(name, groupID string) *snapshotv1api.VolumeSnapshot {
+		return &snapshotv1api.VolumeSnapshot{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   "default",
+				Labels:      map[string]string{util.ConsistencyGroupIDLabel: groupID},
+				Annotations: map[string]string{util.ConsistencyGroupMembersAnnotation: "pvc-1,pvc-2"},
+			},
+		}
+	}
+
+	testCases := []struct {
+		name        string
+		vs          *snapshotv1api.VolumeSnapshot
+		restored    []runtime.Object
+		restore     *velerov1api.Restore
+		expectError bool
+	}{
+		{
+			name:     "volumesnapshot without consistency group",
+			vs:       &snapshotv1api.VolumeSnapshot{ObjectMeta: metav1.ObjectMeta{Name: "vs-1", Namespace: "default"}},
+			restore:  &velerov1api.Restore{},
+			restored: []runtime.Object{},
+		},
+		{
+			name:     "all volumesnapshots of the group restored",
+			vs:       groupVS("vs-1", "group-1"),
+			restored: []runtime.Object{groupVS("vs-1", "group-1"), groupVS("vs-2", "group-1")},
+			restore:  &velerov1api.Restore{},
+		},
+		{
+			name:        "volumesnapshot of the group missing",
+			vs:          groupVS("vs-1", "group-1"),
+			restored:    []runtime.Object{groupVS("vs-1", "group-1"), groupVS("vs-2", "group-2")},
+			restore:     &velerov1api.Restore{},
+			expectError: true,
+		},
+		{
+			name:     "volumesnapshot of the group missing, partial groups allowed",
+			vs:       groupVS("vs-1", "group-1"),
+			restored: []runtime.Object{groupVS("vs-1", "group-1")},
+			restore: &velerov1api.Restore{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{util.AllowPartialConsistencyGroupAnnotation: "true"},
+				},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &PVCRestoreItemAction{Log: logrus.New()}
+			snapClient := snapshotFake.NewSimpleClientset(tc.restored...)
+			err := p.checkConsistencyGroup(tc.vs, tc.restore, snapClient.SnapshotV1())
+			if tc.expectError {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+			}
+		})
+	}
+}
+
+func TestRestoreWithoutDataSource(t *testing.T) {
+	testCases := []struct {
+		name        string
+		restore     *velerov1api.Restore
+		expectError bool
+	}{
+		{
+			name:        "restoring an empty volume fails the PVC",
+			restore:     &velerov1api.Restore{ObjectMeta: metav1.ObjectMeta{Name: "restore-1", Namespace: "velero"}},
+			expectError: true,
+		},
+		{
+			name: "the restore allows restoring empty volumes",
+			restore: &velerov1api.Restore{ObjectMeta: metav1.ObjectMeta{
+				Name:        "restore-1",
+				Namespace:   "velero",
+				Annotations: map[string]string{util.AllowEmptyVolumeAnnotation: "true"},
+			}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &PVCRestoreItemAction{Log: logrus.New()}
+			client := fake.NewSimpleClientset()
+			vs := &snapshotv1api.VolumeSnapshot{ObjectMeta: metav1.ObjectMeta{Name: "vs-1", Namespace: "default"}}
+			pvc := &corev1api.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: "pvc-1", Namespace: "default"},
+				Spec: corev1api.PersistentVolumeClaimSpec{
+					VolumeName: "pv-1",
+					DataSource: &corev1api.TypedLocalObjectReference{Kind: "VolumeSnapshot", Name: "vs-1"},
+				},
+			}
+
+			output, err := p.restoreWithoutDataSource(pvc, vs, "storage class gp3 is provisioned by driver other.csi.io", tc.restore, client.CoreV1())
+			events, listErr := client.CoreV1().Events("velero").List(context.TODO(), metav1.ListOptions{})
+			require.Nil(t, listErr)
+			require.Len(t, events.Items, 1)
+			assert.Equal(t, "StorageClassMismatch", events.Items[0].Reason)
+			if tc.expectError {
+				assert.Error(t, err)
+				return
+			}
+			require.Nil(t, err)
+			restored := corev1api.PersistentVolumeClaim{}
+			require.Nil(t, runtime.DefaultUnstructuredConverter.FromUnstructured(output.UpdatedItem.UnstructuredContent(), &restored))
+			assert.Nil(t, restored.Spec.DataSource)
+			assert.Empty(t, restored.Spec.VolumeName)
+		})
+	}
+}
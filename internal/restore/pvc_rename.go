@@ -0,0 +1,80 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package restore
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	corev1api "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/util"
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+)
+
+// pvcNameMapping returns the PVC rename mapping in the annotation of the restore, or nil if it has none.
+func pvcNameMapping(restore *velerov1api.Restore) (map[string]string, error) {
+	val, ok := restore.Annotations[util.PVCNameMappingAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	mapping := map[string]string{}
+	if err := json.Unmarshal([]byte(val), &mapping); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s annotation on restore %s/%s", util.PVCNameMappingAnnotation, restore.Namespace, restore.Name)
+	}
+	for from, to := range mapping {
+		if errs := validation.IsDNS1123Subdomain(to); len(errs) > 0 {
+			return nil, errors.Errorf("invalid %s annotation on restore %s/%s, PVC %s cannot be renamed to %q: %s",
+				util.PVCNameMappingAnnotation, restore.Namespace, restore.Name, from, to, strings.Join(errs, ", "))
+		}
+	}
+	return mapping, nil
+}
+
+// mapPVCName returns the name that the PVC with the name in the backed-up namespace is restored under.
+func mapPVCName(mapping map[string]string, namespace, name string) string {
+	if mapped, ok := mapping[namespace+"/"+name]; ok {
+		return mapped
+	}
+	if mapped, ok := mapping[name]; ok {
+		return mapped
+	}
+	return name
+}
+
+// renamedPVCName returns the name that the PVC is restored under. Only PVCs restored from a CSI volumesnapshot or by the data
+// mover get a new volume and can be renamed: the volumes of other PVCs are bound to the backed-up name.
+func renamedPVCName(pvc *corev1api.PersistentVolumeClaim, restore *velerov1api.Restore) (string, error) {
+	mapping, err := pvcNameMapping(restore)
+	if err != nil {
+		return "", err
+	}
+	name := mapPVCName(mapping, pvc.Namespace, pvc.Name)
+	if name == pvc.Name {
+		return name, nil
+	}
+	_, hasVolumeSnapshot := pvc.Annotations[util.VolumeSnapshotLabel]
+	_, hasDataMoverManifest := pvc.Annotations[util.DataMoverManifestAnnotation]
+	if !hasVolumeSnapshot && !hasDataMoverManifest {
+		return "", errors.Errorf("cannot restore PVC %s/%s as %s, as set by the %s annotation on restore %s/%s: the PVC was not backed up with a CSI volumesnapshot or the data mover, so its volume is bound to its name",
+			pvc.Namespace, pvc.Name, name, util.PVCNameMappingAnnotation, restore.Namespace, restore.Name)
+	}
+	return name, nil
+}
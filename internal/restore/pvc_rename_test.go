@@ -0,0 +1,174 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package restore
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	corev1api "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/util"
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+)
+
+func TestPVCNameMapping(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		expected    map[string]string
+		expectError bool
+	}{
+		{
+			name: "no mapping",
+		},
+		{
+			name:        "mapping",
+			annotations: map[string]string{util.PVCNameMappingAnnotation: `{"db/data-db-0": "data-db-0-copy", "cache": "cache-copy"}`},
+			expected:    map[string]string{"db/data-db-0": "data-db-0-copy", "cache": "cache-copy"},
+		},
+		{
+			name:        "invalid JSON",
+			annotations: map[string]string{util.PVCNameMappingAnnotation: `db/data-db-0=data-db-0-copy`},
+			expectError: true,
+		},
+		{
+			name:        "invalid PVC name",
+			annotations: map[string]string{util.PVCNameMappingAnnotation: `{"data-db-0": "Data_DB_0"}`},
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			restore := &velerov1api.Restore{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "restore",
+					Namespace:   "velero",
+					Annotations: tc.annotations,
+				},
+			}
+			mapping, err := pvcNameMapping(restore)
+			if tc.expectError {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, mapping)
+		})
+	}
+}
+
+func TestMapPVCName(t *testing.T) {
+	mapping := map[string]string{
+		"db/data-db-0": "data-db-0-copy",
+		"data-db-0":    "data-db-0-other",
+		"cache":        "cache-copy",
+	}
+	assert.Equal(t, "data-db-0-copy", mapPVCName(mapping, "db", "data-db-0"))
+	assert.Equal(t, "data-db-0-other", mapPVCName(mapping, "other", "data-db-0"))
+	assert.Equal(t, "cache-copy", mapPVCName(mapping, "db", "cache"))
+	assert.Equal(t, "logs", mapPVCName(mapping, "db", "logs"))
+	assert.Equal(t, "logs", mapPVCName(nil, "db", "logs"))
+}
+
+func TestRenamedPVCName(t *testing.T) {
+	restore := &velerov1api.Restore{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "restore",
+			Namespace:   "velero",
+			Annotations: map[string]string{util.PVCNameMappingAnnotation: `{"db/data-db-0": "data-db-0-copy"}`},
+		},
+	}
+	testCases := []struct {
+		name        string
+		pvcName     string
+		annotations map[string]string
+		expected    string
+		expectError bool
+	}{
+		{
+			name:        "PVC backed up with a CSI volumesnapshot",
+			pvcName:     "data-db-0",
+			annotations: map[string]string{util.VolumeSnapshotLabel: "velero-data-db-0-abcde"},
+			expected:    "data-db-0-copy",
+		},
+		{
+			name:        "PVC backed up by the data mover",
+			pvcName:     "data-db-0",
+			annotations: map[string]string{util.DataMoverManifestAnnotation: "backup/db/data-db-0"},
+			expected:    "data-db-0-copy",
+		},
+		{
+			name:        "PVC backed up without a CSI volumesnapshot",
+			pvcName:     "data-db-0",
+			expectError: true,
+		},
+		{
+			name:     "PVC not in the mapping",
+			pvcName:  "logs",
+			expected: "logs",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pvc := &corev1api.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        tc.pvcName,
+					Namespace:   "db",
+					Annotations: tc.annotations,
+				},
+			}
+			name, err := renamedPVCName(pvc, restore)
+			if tc.expectError {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, name)
+		})
+	}
+}
+
+func TestPVCRestoreItemActionRefusesToRenameNonCSIPVC(t *testing.T) {
+	restore := &velerov1api.Restore{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "restore",
+			Namespace:   "velero",
+			Annotations: map[string]string{util.PVCNameMappingAnnotation: `{"db/data-db-0": "data-db-0-copy"}`},
+		},
+	}
+	pvc := &corev1api.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "data-db-0", Namespace: "db"},
+		Spec:       corev1api.PersistentVolumeClaimSpec{VolumeName: "pv-1"},
+	}
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pvc)
+	assert.Nil(t, err)
+	item := &unstructured.Unstructured{Object: obj}
+
+	p := &PVCRestoreItemAction{Log: logrus.New()}
+	_, err = p.Execute(&velero.RestoreItemActionExecuteInput{Item: item, ItemFromBackup: item.DeepCopy(), Restore: restore})
+	assert.NotNil(t, err)
+	assert.Equal(t, "data-db-0", item.GetName())
+}
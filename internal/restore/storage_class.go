@@ -0,0 +1,77 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package restore
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	corev1api "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	storagev1client "k8s.io/client-go/kubernetes/typed/storage/v1"
+
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/util"
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+)
+
+// mapStorageClass returns the storage class that storageClass is mapped to by the change-storage-class configmap in the Velero
+// namespace of the restore, or storageClass itself if it is not mapped.
+func mapStorageClass(storageClass string, restore *velerov1api.Restore, client corev1client.ConfigMapsGetter) (string, error) {
+	if storageClass == "" {
+		return storageClass, nil
+	}
+	mapping, err := util.GetStorageClassMapping(client, restore.Namespace)
+	if err != nil {
+		return "", err
+	}
+	if mapped, ok := mapping[storageClass]; ok && mapped != "" {
+		return mapped, nil
+	}
+	return storageClass, nil
+}
+
+// checkStorageClassDriver returns why volumes of the storage class cannot be provisioned from snapshots taken by the CSI driver,
+// or "" if they can or the storage class does not exist in the cluster.
+func checkStorageClassDriver(storageClass, driver string, client storagev1client.StorageClassesGetter) (string, error) {
+	if storageClass == "" || driver == "" {
+		return "", nil
+	}
+	sc, err := client.StorageClasses().Get(context.TODO(), storageClass, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get storage class %s", storageClass)
+	}
+	if sc.Provisioner != driver {
+		return fmt.Sprintf("storage class %s is provisioned by %s, which cannot restore snapshots taken by CSI driver %s",
+			sc.Name, sc.Provisioner, driver), nil
+	}
+	return "", nil
+}
+
+// pvcStorageClassName returns the name of the storage class of the PVC, or "" if it has none.
+func pvcStorageClassName(pvc *corev1api.PersistentVolumeClaim) string {
+	if pvc.Spec.StorageClassName == nil {
+		return ""
+	}
+	return *pvc.Spec.StorageClassName
+}
@@ -0,0 +1,203 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package restore
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	snapshotv1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	snapshotFake "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned/fake"
+	corev1api "k8s.io/api/core/v1"
+	storagev1api "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/util"
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+)
+
+func storageClassMappingObjects() []runtime.Object {
+	return []runtime.Object{
+		&corev1api.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "change-storage-class-config",
+				Namespace: "velero",
+				Labels: map[string]string{
+					"velero.io/plugin-config":    "",
+					util.ChangeStorageClassLabel: "RestoreItemAction",
+				},
+			},
+			Data: map[string]string{
+				"old-sc":   "new-sc",
+				"other-sc": "foreign-sc",
+			},
+		},
+		&storagev1api.StorageClass{
+			ObjectMeta:  metav1.ObjectMeta{Name: "new-sc"},
+			Provisioner: "csi.example.com",
+		},
+		&storagev1api.StorageClass{
+			ObjectMeta:  metav1.ObjectMeta{Name: "foreign-sc"},
+			Provisioner: "csi.other.com",
+		},
+	}
+}
+
+func TestMapStorageClass(t *testing.T) {
+	restore := &velerov1api.Restore{ObjectMeta: metav1.ObjectMeta{Name: "restore", Namespace: "velero"}}
+	testCases := []struct {
+		name         string
+		storageClass string
+		objects      []runtime.Object
+		expected     string
+	}{
+		{
+			name:         "mapped storage class",
+			storageClass: "old-sc",
+			objects:      storageClassMappingObjects(),
+			expected:     "new-sc",
+		},
+		{
+			name:         "storage class not in the mapping",
+			storageClass: "new-sc",
+			objects:      storageClassMappingObjects(),
+			expected:     "new-sc",
+		},
+		{
+			name:         "no mapping configured",
+			storageClass: "old-sc",
+			expected:     "old-sc",
+		},
+		{
+			name:     "no storage class",
+			objects:  storageClassMappingObjects(),
+			expected: "",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset(tc.objects...)
+			mapped, err := mapStorageClass(tc.storageClass, restore, client.CoreV1())
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, mapped)
+		})
+	}
+}
+
+func TestCheckStorageClassDriver(t *testing.T) {
+	testCases := []struct {
+		name         string
+		storageClass string
+		driver       string
+		mismatch     bool
+	}{
+		{
+			name:         "same driver",
+			storageClass: "new-sc",
+			driver:       "csi.example.com",
+		},
+		{
+			name:         "other driver",
+			storageClass: "foreign-sc",
+			driver:       "csi.example.com",
+			mismatch:     true,
+		},
+		{
+			name:         "storage class does not exist",
+			storageClass: "missing-sc",
+			driver:       "csi.example.com",
+		},
+		{
+			name:         "driver not recorded",
+			storageClass: "foreign-sc",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset(storageClassMappingObjects()...)
+			mismatch, err := checkStorageClassDriver(tc.storageClass, tc.driver, client.StorageV1())
+			assert.NoError(t, err)
+			assert.Equal(t, tc.mismatch, mismatch != "", mismatch)
+		})
+	}
+}
+
+func TestMapVolumeSnapshotClass(t *testing.T) {
+	restore := &velerov1api.Restore{ObjectMeta: metav1.ObjectMeta{Name: "restore", Namespace: "velero"}}
+	snapshotClass := &snapshotv1api.VolumeSnapshotClass{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "new-vsclass",
+			Labels: map[string]string{util.VolumeSnapshotClassSelectorLabel: "true"},
+		},
+		Driver: "csi.example.com",
+	}
+	testCases := []struct {
+		name                 string
+		storageClass         string
+		expectedClass        *string
+		expectedStorageClass string
+	}{
+		{
+			name:                 "mapped to a storage class of the same driver",
+			storageClass:         "old-sc",
+			expectedClass:        &snapshotClass.Name,
+			expectedStorageClass: "new-sc",
+		},
+		{
+			name:                 "mapped to a storage class of another driver",
+			storageClass:         "other-sc",
+			expectedStorageClass: "other-sc",
+		},
+		{
+			name:                 "not mapped",
+			storageClass:         "new-sc",
+			expectedStorageClass: "new-sc",
+		},
+		{
+			name: "storage class not recorded",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			vs := &snapshotv1api.VolumeSnapshot{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "vs",
+					Namespace:   "ns",
+					Annotations: map[string]string{},
+				},
+			}
+			if tc.storageClass != "" {
+				vs.Annotations[util.StorageClassAnnotation] = tc.storageClass
+			}
+			client := fake.NewSimpleClientset(storageClassMappingObjects()...)
+			snapClient := snapshotFake.NewSimpleClientset(snapshotClass)
+			p := &VolumeSnapshotRestoreItemAction{Log: logrus.New()}
+
+			class, err := p.mapVolumeSnapshotClass(vs, "csi.example.com", restore, client, snapClient.SnapshotV1())
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedClass, class)
+			assert.Equal(t, tc.expectedStorageClass, vs.Annotations[util.StorageClassAnnotation])
+		})
+	}
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package restore
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+
+	"github.com/pkg/errors"
+
+	corev1api "k8s.io/api/core/v1"
+	storagev1api "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	storagev1client "k8s.io/client-go/kubernetes/typed/storage/v1"
+
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/config"
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/util"
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/label"
+)
+
+// allowedTopologies returns the allowed topologies of a storage class that constrain volumes to the topology of a backed-up
+// volume, with the zones mapped by the configuration. Only requirements that a storage class can express, which are those
+// with the In operator, are kept.
+func allowedTopologies(terms []corev1api.NodeSelectorTerm, cfg config.Config) []corev1api.TopologySelectorTerm {
+	var topologies []corev1api.TopologySelectorTerm
+	for _, term := range terms {
+		var requirements []corev1api.TopologySelectorLabelRequirement
+		for _, requirement := range term.MatchExpressions {
+			if requirement.Operator != corev1api.NodeSelectorOpIn || len(requirement.Values) == 0 {
+				continue
+			}
+			values := make([]string, 0, len(requirement.Values))
+			for _, value := range requirement.Values {
+				values = append(values, cfg.MapZone(value))
+			}
+			requirements = append(requirements, corev1api.TopologySelectorLabelRequirement{Key: requirement.Key, Values: values})
+		}
+		if len(requirements) > 0 {
+			topologies = append(topologies, corev1api.TopologySelectorTerm{MatchLabelExpressions: requirements})
+		}
+	}
+	return topologies
+}
+
+// applyVolumeTopology constrains the PVC to the topology recorded for its backed-up volume, where its snapshot can be restored,
+// by pointing it at a copy of its storage class that only allows that topology. The copies are named after the storage class
+// and the topology, shared by the PVCs restored in the same topology, and labelled with the last restore that used them. As
+// plugins are not told when a restore is done, they are left behind for the garbage collector, which deletes those that no
+// PVC or PV uses once their restore is over. Only PVCs restored from volumesnapshots are constrained, as the data of the
+// others does not depend on the zone of the snapshot.
+func (p *PVCRestoreItemAction) applyVolumeTopology(pvc *corev1api.PersistentVolumeClaim, restore *velerov1api.Restore,
+	client storagev1client.StorageClassesGetter) error {
+	val, ok := pvc.Annotations[util.VolumeTopologyAnnotation]
+	if !ok || !p.Config.RestoreTopology {
+		return nil
+	}
+	var terms []corev1api.NodeSelectorTerm
+	if err := json.Unmarshal([]byte(val), &terms); err != nil {
+		return errors.Wrapf(err, "failed to parse %s annotation on PVC %s/%s", util.VolumeTopologyAnnotation, pvc.Namespace, pvc.Name)
+	}
+	topologies := allowedTopologies(terms, p.Config)
+	storageClass := pvcStorageClassName(pvc)
+	if len(topologies) == 0 || storageClass == "" {
+		return nil
+	}
+
+	sc, err := client.StorageClasses().Get(context.TODO(), storageClass, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		p.Log.Warnf("Not constraining PVC %s/%s to the topology of its volume, storage class %s does not exist", pvc.Namespace, pvc.Name, storageClass)
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to get storage class %s", storageClass)
+	}
+	if reflect.DeepEqual(sc.AllowedTopologies, topologies) {
+		return nil
+	}
+
+	data, err := json.Marshal(topologies)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	constrained := &storagev1api.StorageClass{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: util.DeterministicName("", sc.Name, string(data)),
+			Labels: map[string]string{
+				util.TopologyStorageClassLabel: label.GetValidName(sc.Name),
+				velerov1api.RestoreNameLabel:   label.GetValidName(restore.Name),
+			},
+		},
+		Provisioner:          sc.Provisioner,
+		Parameters:           sc.Parameters,
+		ReclaimPolicy:        sc.ReclaimPolicy,
+		MountOptions:         sc.MountOptions,
+		AllowVolumeExpansion: sc.AllowVolumeExpansion,
+		VolumeBindingMode:    sc.VolumeBindingMode,
+		AllowedTopologies:    topologies,
+	}
+	_, err = client.StorageClasses().Create(context.TODO(), constrained, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		// The storage class is taken over by this restore, so that it is not collected while the restore is in progress.
+		patch, patchErr := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"labels": map[string]string{velerov1api.RestoreNameLabel: constrained.Labels[velerov1api.RestoreNameLabel]},
+			},
+		})
+		if patchErr != nil {
+			return errors.WithStack(patchErr)
+		}
+		_, err = client.StorageClasses().Patch(context.TODO(), constrained.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to create storage class %s", constrained.Name)
+	}
+	p.Log.Infof("Constraining PVC %s/%s to the topology of its volume %s with storage class %s", pvc.Namespace, pvc.Name, string(data), constrained.Name)
+	pvc.Spec.StorageClassName = &constrained.Name
+	return nil
+}
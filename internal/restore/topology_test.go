@@ -0,0 +1,169 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package restore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	corev1api "k8s.io/api/core/v1"
+	storagev1api "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/config"
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/util"
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+)
+
+const zoneKey = "topology.ebs.csi.aws.com/zone"
+
+func TestAllowedTopologies(t *testing.T) {
+	cfg := config.Default()
+	cfg.Zones["us-east-1a"] = "us-west-2b"
+
+	terms := []corev1api.NodeSelectorTerm{
+		{MatchExpressions: []corev1api.NodeSelectorRequirement{
+			{Key: zoneKey, Operator: corev1api.NodeSelectorOpIn, Values: []string{"us-east-1a", "us-east-1c"}},
+			{Key: "example.com/rack", Operator: corev1api.NodeSelectorOpNotIn, Values: []string{"rack-1"}},
+		}},
+		{MatchExpressions: []corev1api.NodeSelectorRequirement{
+			{Key: "example.com/gpu", Operator: corev1api.NodeSelectorOpExists},
+		}},
+	}
+	expected := []corev1api.TopologySelectorTerm{
+		{MatchLabelExpressions: []corev1api.TopologySelectorLabelRequirement{
+			{Key: zoneKey, Values: []string{"us-west-2b", "us-east-1c"}},
+		}},
+	}
+	assert.Equal(t, expected, allowedTopologies(terms, cfg))
+	assert.Nil(t, allowedTopologies(nil, cfg))
+}
+
+func TestApplyVolumeTopology(t *testing.T) {
+	topology := `[{"matchExpressions":[{"key":"topology.ebs.csi.aws.com/zone","operator":"In","values":["us-east-1a"]}]}]`
+	gp2 := &storagev1api.StorageClass{
+		ObjectMeta:  metav1.ObjectMeta{Name: "gp2"},
+		Provisioner: "ebs.csi.aws.com",
+		Parameters:  map[string]string{"type": "gp2"},
+	}
+	zonal := &storagev1api.StorageClass{
+		ObjectMeta:  metav1.ObjectMeta{Name: "gp2-zonal"},
+		Provisioner: "ebs.csi.aws.com",
+		AllowedTopologies: []corev1api.TopologySelectorTerm{
+			{MatchLabelExpressions: []corev1api.TopologySelectorLabelRequirement{{Key: zoneKey, Values: []string{"us-west-2b"}}}},
+		},
+	}
+
+	testCases := []struct {
+		name                string
+		storageClass        string
+		topology            string
+		disabled            bool
+		expectedTopology    []string
+		expectConstrainedSC bool
+		expectError         bool
+	}{
+		{
+			name:                "storage class constrained to the mapped zone",
+			storageClass:        "gp2",
+			topology:            topology,
+			expectedTopology:    []string{"us-west-2b"},
+			expectConstrainedSC: true,
+		},
+		{
+			name:         "storage class already constrained to the zone",
+			storageClass: "gp2-zonal",
+			topology:     topology,
+		},
+		{
+			name:         "no recorded topology",
+			storageClass: "gp2",
+		},
+		{
+			name:         "disabled",
+			storageClass: "gp2",
+			topology:     topology,
+			disabled:     true,
+		},
+		{
+			name:         "storage class does not exist",
+			storageClass: "missing",
+			topology:     topology,
+		},
+		{
+			name:         "invalid topology",
+			storageClass: "gp2",
+			topology:     "us-east-1a",
+			expectError:  true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := config.Default()
+			cfg.Zones["us-east-1a"] = "us-west-2b"
+			cfg.RestoreTopology = !tc.disabled
+			p := &PVCRestoreItemAction{Log: logrus.New(), Config: cfg}
+			client := fake.NewSimpleClientset(gp2, zonal)
+
+			storageClass := tc.storageClass
+			pvc := &corev1api.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: "data", Namespace: "app", Annotations: map[string]string{}},
+				Spec:       corev1api.PersistentVolumeClaimSpec{StorageClassName: &storageClass},
+			}
+			if tc.topology != "" {
+				pvc.Annotations[util.VolumeTopologyAnnotation] = tc.topology
+			}
+
+			restore := &velerov1api.Restore{ObjectMeta: metav1.ObjectMeta{Name: "restore-1", Namespace: "velero"}}
+			err := p.applyVolumeTopology(pvc, restore, client.StorageV1())
+			if tc.expectError {
+				assert.NotNil(t, err)
+				return
+			}
+			require.Nil(t, err)
+			if !tc.expectConstrainedSC {
+				assert.Equal(t, tc.storageClass, *pvc.Spec.StorageClassName)
+				return
+			}
+
+			assert.NotEqual(t, tc.storageClass, *pvc.Spec.StorageClassName)
+			sc, err := client.StorageV1().StorageClasses().Get(context.TODO(), *pvc.Spec.StorageClassName, metav1.GetOptions{})
+			require.Nil(t, err)
+			assert.Equal(t, tc.storageClass, sc.Labels[util.TopologyStorageClassLabel])
+			assert.Equal(t, "restore-1", sc.Labels[velerov1api.RestoreNameLabel])
+			assert.Equal(t, gp2.Provisioner, sc.Provisioner)
+			assert.Equal(t, gp2.Parameters, sc.Parameters)
+			assert.Equal(t, tc.expectedTopology, sc.AllowedTopologies[0].MatchLabelExpressions[0].Values)
+
+			// PVCs restored in the same topology share the storage class, which is labelled with the last restore using it.
+			constrained := *pvc.Spec.StorageClassName
+			pvc.Spec.StorageClassName = &storageClass
+			restore.Name = "restore-2"
+			require.Nil(t, p.applyVolumeTopology(pvc, restore, client.StorageV1()))
+			assert.Equal(t, constrained, *pvc.Spec.StorageClassName)
+			sc, err = client.StorageV1().StorageClasses().Get(context.TODO(), constrained, metav1.GetOptions{})
+			require.Nil(t, err)
+			assert.Equal(t, "restore-2", sc.Labels[velerov1api.RestoreNameLabel])
+		})
+	}
+}
@@ -18,16 +18,24 @@ package restore
 
 import (
 	"context"
+	"strconv"
+	"strings"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 
-	snapshotv1beta1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1beta1"
+	snapshotv1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	snapshotter "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned/typed/volumesnapshot/v1"
 	core_v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
 
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/config"
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/translator"
 	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/util"
 	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
 	"github.com/vmware-tanzu/velero/pkg/label"
@@ -36,7 +44,8 @@ import (
 
 // VolumeSnapshotRestoreItemAction is a Velero restore item action plugin for VolumeSnapshots
 type VolumeSnapshotRestoreItemAction struct {
-	Log logrus.FieldLogger
+	Log    logrus.FieldLogger
+	Config config.Config
 }
 
 // AppliesTo returns information indicating that VolumeSnapshotRestoreItemAction should be invoked while restoring
@@ -47,18 +56,144 @@ func (p *VolumeSnapshotRestoreItemAction) AppliesTo() (velero.ResourceSelector,
 	}, nil
 }
 
-func resetVolumeSnapshotSpecForRestore(vs *snapshotv1beta1api.VolumeSnapshot, vscName *string) {
+func resetVolumeSnapshotSpecForRestore(vs *snapshotv1api.VolumeSnapshot, vscName *string) {
 	// Spec of the backed-up object used the PVC as the source of the volumeSnapshot.
 	// Restore operation will however, restore the volumesnapshot from the volumesnapshotcontent
 	vs.Spec.Source.PersistentVolumeClaimName = nil
 	vs.Spec.Source.VolumeSnapshotContentName = vscName
 }
 
+// checkVolumeSnapshotReadyToUse returns an error if the volumesnapshot was recorded as not ready to use when it was backed up.
+// Volumesnapshots backed up before readiness was recorded are assumed to be ready.
+func checkVolumeSnapshotReadyToUse(vs *snapshotv1api.VolumeSnapshot) error {
+	val, ok := vs.Annotations[util.VolumeSnapshotReadyToUseAnnotation]
+	if !ok {
+		return nil
+	}
+	ready, err := strconv.ParseBool(val)
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse %s annotation on volumesnapshot %s/%s", util.VolumeSnapshotReadyToUseAnnotation, vs.Namespace, vs.Name)
+	}
+	if !ready {
+		return errors.Errorf("volumesnapshot %s/%s was not ready to use when it was backed up, refusing to restore it", vs.Namespace, vs.Name)
+	}
+	return nil
+}
+
+// setDeleteSnapshotSecret sets the snapshot deletion secret recorded on the backed-up volumesnapshot on its static
+// volumesnapshotcontent, so that the CSI driver can delete the snapshot, and returns the secret as an additional item to restore.
+// Velero restores the secret into the namespace its namespace is mapped to, which the volumesnapshotcontent refers to.
+func setDeleteSnapshotSecret(vs *snapshotv1api.VolumeSnapshot, vsc *snapshotv1api.VolumeSnapshotContent, restore *velerov1api.Restore) []velero.ResourceIdentifier {
+	if !util.IsVolumeSnapshotHasVSCDeleteSecret(vs) {
+		return nil
+	}
+	name := vs.Annotations[util.CSIDeleteSnapshotSecretName]
+	namespace := vs.Annotations[util.CSIDeleteSnapshotSecretNamespace]
+	restoredNamespace := namespace
+	if val, ok := restore.Spec.NamespaceMapping[namespace]; ok {
+		restoredNamespace = val
+	}
+	util.AddAnnotations(&vsc.ObjectMeta, map[string]string{
+		util.DeletionSecretNameAnnotation:      name,
+		util.DeletionSecretNamespaceAnnotation: restoredNamespace,
+	})
+	return []velero.ResourceIdentifier{
+		{
+			// TODO: add GroupResource for secret into kuberesource
+			GroupResource: schema.GroupResource{Group: "", Resource: "secrets"},
+			Name:          name,
+			Namespace:     namespace,
+		},
+	}
+}
+
+// mapVolumeSnapshotClass applies the storage class mapping of the restore to the storage class recorded on the volumesnapshot, and
+// returns the volumesnapshotclass for the CSI driver, to be used by the restored volumesnapshot and its volumesnapshotcontent. It
+// returns nil when the storage class is not mapped, or is mapped to a storage class of another driver, which cannot restore the
+// snapshot and makes PVCRestoreItemAction restore the PVC without it.
+func (p *VolumeSnapshotRestoreItemAction) mapVolumeSnapshotClass(vs *snapshotv1api.VolumeSnapshot, driver string, restore *velerov1api.Restore,
+	client kubernetes.Interface, snapClient snapshotter.SnapshotV1Interface) (*string, error) {
+	storageClass := vs.Annotations[util.StorageClassAnnotation]
+	mapped, err := mapStorageClass(storageClass, restore, client.CoreV1())
+	if err != nil {
+		return nil, err
+	}
+	if mapped == storageClass {
+		return nil, nil
+	}
+	mismatch, err := checkStorageClassDriver(mapped, driver, client.StorageV1())
+	if err != nil {
+		return nil, err
+	}
+	if mismatch != "" {
+		p.Log.Warnf("Not mapping storage class %s of volumesnapshot %s/%s to %s, %s", storageClass, vs.Namespace, vs.Name, mapped, mismatch)
+		return nil, nil
+	}
+
+	p.Log.Infof("Mapping storage class of volumesnapshot %s/%s from %s to %s", vs.Namespace, vs.Name, storageClass, mapped)
+	vs.Annotations[util.StorageClassAnnotation] = mapped
+	snapshotClass, err := util.GetVolumeSnapshotClassForStorageClass(driver, snapClient)
+	if err != nil {
+		p.Log.WithError(err).Warnf("Keeping the volumesnapshotclass of volumesnapshot %s/%s", vs.Namespace, vs.Name)
+		return nil, nil
+	}
+	return &snapshotClass.Name, nil
+}
+
+// translateSnapshotHandle returns the handle of the snapshot to restore for the volumesnapshot, translated by the snapshot handle
+// translator configured for the CSI driver, if any. The restored volumesnapshot records the translated handle.
+func (p *VolumeSnapshotRestoreItemAction) translateSnapshotHandle(vs *snapshotv1api.VolumeSnapshot, driver, snapHandle string,
+	restore *velerov1api.Restore) (string, error) {
+	handleTranslator, err := translator.ForDriver(p.Config, driver)
+	if err != nil || handleTranslator == nil {
+		return snapHandle, err
+	}
+	translated, err := handleTranslator.Translate(translator.Request{
+		Driver:                  driver,
+		SnapshotHandle:          snapHandle,
+		VolumeSnapshotNamespace: vs.Namespace,
+		VolumeSnapshotName:      vs.Name,
+		RestoreName:             restore.Name,
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to translate snapshot handle of volumesnapshot %s/%s", vs.Namespace, vs.Name)
+	}
+	if translated != snapHandle {
+		p.Log.Infof("Translated snapshot handle of volumesnapshot %s/%s from %s to %s", vs.Namespace, vs.Name, snapHandle, translated)
+		vs.Annotations[util.VolumeSnapshotHandleAnnotation] = translated
+	}
+	return translated, nil
+}
+
+// createVolumeSnapshotContent creates the static volumesnapshotcontent, or returns the volumesnapshotcontent with the same name
+// created earlier for the same volumesnapshot, when the restore is retried.
+func (p *VolumeSnapshotRestoreItemAction) createVolumeSnapshotContent(vsc *snapshotv1api.VolumeSnapshotContent, snapClient snapshotter.SnapshotV1Interface) (*snapshotv1api.VolumeSnapshotContent, error) {
+	ref := vsc.Spec.VolumeSnapshotRef
+	created, err := snapClient.VolumeSnapshotContents().Create(context.TODO(), vsc, metav1.CreateOptions{})
+	if err == nil {
+		p.Log.Infof("Created VolumesnapshotContents %s with static binding to volumesnapshot %s/%s", created.Name, ref.Namespace, ref.Name)
+		return created, nil
+	}
+	if !apierrors.IsAlreadyExists(err) {
+		return nil, errors.Wrapf(err, "failed to create volumesnapshotcontents %s", vsc.Name)
+	}
+
+	existing, err := snapClient.VolumeSnapshotContents().Get(context.TODO(), vsc.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get volumesnapshotcontents %s", vsc.Name)
+	}
+	if existing.Spec.VolumeSnapshotRef.Namespace != ref.Namespace || existing.Spec.VolumeSnapshotRef.Name != ref.Name {
+		return nil, errors.Errorf("volumesnapshotcontents %s already exists and is not bound to volumesnapshot %s/%s", vsc.Name, ref.Namespace, ref.Name)
+	}
+	p.Log.Infof("Using VolumesnapshotContents %s created earlier with static binding to volumesnapshot %s/%s", existing.Name, ref.Namespace, ref.Name)
+	return existing, nil
+}
+
 // Execute uses the data such as CSI driver name, storage snapshot handle, snapshot deletion secret (if any) from the annotations
 // to recreate a volumesnapshotcontent object and statically bind the Volumesnapshot object being restored.
 func (p *VolumeSnapshotRestoreItemAction) Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
 	p.Log.Info("Starting VolumeSnapshotRestoreItemAction")
-	var vs snapshotv1beta1api.VolumeSnapshot
+	var vs snapshotv1api.VolumeSnapshot
 
 	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(input.Item.UnstructuredContent(), &vs); err != nil {
 		return &velero.RestoreItemActionExecuteOutput{}, errors.Wrapf(err, "failed to convert input.Item from unstructured")
@@ -70,12 +205,17 @@ func (p *VolumeSnapshotRestoreItemAction) Execute(input *velero.RestoreItemActio
 		vs.SetNamespace(val)
 	}
 
-	_, snapClient, err := util.GetClients()
+	client, snapClient, err := util.GetClients()
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
-	if !util.IsVolumeSnapshotExists(&vs, snapClient.SnapshotV1beta1()) {
+	additionalItems := []velero.ResourceIdentifier{}
+	if !util.IsVolumeSnapshotExists(&vs, snapClient) {
+		if err := checkVolumeSnapshotReadyToUse(&vs); err != nil {
+			return nil, err
+		}
+
 		snapHandle, exists := vs.Annotations[util.VolumeSnapshotHandleAnnotation]
 		if !exists {
 			return nil, errors.Errorf("Volumesnapshot %s/%s does not have a %s annotation", vs.Namespace, vs.Name, util.VolumeSnapshotHandleAnnotation)
@@ -85,47 +225,69 @@ func (p *VolumeSnapshotRestoreItemAction) Execute(input *velero.RestoreItemActio
 		if !exists {
 			return nil, errors.Errorf("Volumesnapshot %s/%s does not have a %s annotation", vs.Namespace, vs.Name, util.CSIDriverNameAnnotation)
 		}
+		// The restored volumesnapshot records the mapped driver, which PVCRestoreItemAction checks the storage class of the PVC against.
+		if mapped := p.Config.MapDriverName(csiDriverName); mapped != csiDriverName {
+			p.Log.Infof("Mapping CSI driver of volumesnapshot %s/%s from %s to %s", vs.Namespace, vs.Name, csiDriverName, mapped)
+			csiDriverName = mapped
+			vs.Annotations[util.CSIDriverNameAnnotation] = mapped
+		}
+
+		snapHandle, err = p.translateSnapshotHandle(&vs, csiDriverName, snapHandle, input.Restore)
+		if err != nil {
+			return nil, err
+		}
 
 		deletionPolicy, exists := vs.Annotations[util.CSIVSCDeletionPolicy]
 		if !exists {
 			p.Log.Infof("Volumesnapshot %s/%s does not have a %s annotation using DeletionPolicy Retain for volumesnapshotcontent",
 				vs.Namespace, vs.Name, util.CSIVSCDeletionPolicy)
-			deletionPolicy = string(snapshotv1beta1api.VolumeSnapshotContentRetain)
+			deletionPolicy = string(snapshotv1api.VolumeSnapshotContentRetain)
 		}
 
-		// TODO: generated name will be like velero-velero-something. Fix that.
-		vsc := snapshotv1beta1api.VolumeSnapshotContent{
+		snapshotClass, err := p.mapVolumeSnapshotClass(&vs, csiDriverName, input.Restore, client, snapClient)
+		if err != nil {
+			return nil, err
+		}
+		if snapshotClass != nil {
+			vs.Spec.VolumeSnapshotClassName = snapshotClass
+		}
+
+		// The name of the volumesnapshotcontent is derived from the restore and the volumesnapshot, so that a retried restore
+		// finds the volumesnapshotcontent it created earlier. Volumesnapshots created by Velero are already prefixed.
+		vsc := snapshotv1api.VolumeSnapshotContent{
 			ObjectMeta: metav1.ObjectMeta{
-				GenerateName: "velero-" + vs.Name + "-",
+				Name: util.DeterministicName("velero-", strings.TrimPrefix(vs.Name, "velero-"), string(input.Restore.UID), vs.Namespace, vs.Name),
 				Labels: map[string]string{
 					velerov1api.RestoreNameLabel: label.GetValidName(input.Restore.Name),
 				},
 			},
-			Spec: snapshotv1beta1api.VolumeSnapshotContentSpec{
-				DeletionPolicy: snapshotv1beta1api.DeletionPolicy(deletionPolicy),
-				Driver:         csiDriverName,
+			Spec: snapshotv1api.VolumeSnapshotContentSpec{
+				DeletionPolicy:          snapshotv1api.DeletionPolicy(deletionPolicy),
+				Driver:                  csiDriverName,
+				VolumeSnapshotClassName: snapshotClass,
 				VolumeSnapshotRef: core_v1.ObjectReference{
 					Kind:      "VolumeSnapshot",
 					Namespace: vs.Namespace,
 					Name:      vs.Name,
 				},
-				Source: snapshotv1beta1api.VolumeSnapshotContentSource{
+				Source: snapshotv1api.VolumeSnapshotContentSource{
 					SnapshotHandle: &snapHandle,
 				},
 			},
 		}
 
+		additionalItems = append(additionalItems, setDeleteSnapshotSecret(&vs, &vsc, input.Restore)...)
+
 		// we create the volumesnapshotcontent here instead of relying on the restore flow because we want to statically
 		// bind this volumesnapshot with a volumesnapshotcontent that will be used as its source for pre-populating the
 		// volume that will be created as a result of the restore. To perform this static binding, a bi-didrectional link
 		// between the volumesnapshotcontent and volumesnapshot objects have to be setup.
 		// Further, it is disallowed to convert a dynamically created volumesnapshotcontent for static binding.
 		// See: https://github.com/kubernetes-csi/external-snapshotter/issues/274
-		vscupd, err := snapClient.SnapshotV1beta1().VolumeSnapshotContents().Create(context.TODO(), &vsc, metav1.CreateOptions{})
+		vscupd, err := p.createVolumeSnapshotContent(&vsc, snapClient)
 		if err != nil {
-			return nil, errors.Wrapf(err, "failed to create volumesnapshotcontents %s", vsc.GenerateName)
+			return nil, err
 		}
-		p.Log.Infof("Created VolumesnapshotContents %s with static binding to volumesnapshot %s/%s", vscupd, vs.Namespace, vs.Name)
 
 		// Reset Spec to convert the volumesnapshot from using the dyanamic volumesnapshotcontent to the static one.
 		resetVolumeSnapshotSpecForRestore(&vs, &vscupd.Name)
@@ -136,10 +298,10 @@ func (p *VolumeSnapshotRestoreItemAction) Execute(input *velero.RestoreItemActio
 		return nil, errors.WithStack(err)
 	}
 
-	p.Log.Infof("Returning from VolumeSnapshotRestoreItemAction with no additionalItems")
+	p.Log.Infof("Returning from VolumeSnapshotRestoreItemAction with %d additionalItems", len(additionalItems))
 
 	return &velero.RestoreItemActionExecuteOutput{
-		UpdatedItem:     &unstructured.Unstructured{Object: vsMap},
-		AdditionalItems: []velero.ResourceIdentifier{},
+		UpdatedItem:     util.ConvertSnapshotItem(&unstructured.Unstructured{Object: vsMap}, snapClient),
+		AdditionalItems: additionalItems,
 	}, nil
 }
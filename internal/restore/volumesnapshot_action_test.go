@@ -17,12 +17,22 @@ limitations under the License.
 package restore
 
 import (
+	"context"
 	"testing"
 
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
-	snapshotv1beta1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1beta1"
+	snapshotv1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	snapshotFake "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned/fake"
+	corev1api "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/util"
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
 )
 
 var (
@@ -34,18 +44,18 @@ var (
 func TestResetVolumeSnapshotSpecForRestore(t *testing.T) {
 	testCases := []struct {
 		name    string
-		vs      snapshotv1beta1api.VolumeSnapshot
+		vs      snapshotv1api.VolumeSnapshot
 		vscName string
 	}{
 		{
 			name: "should reset spec as expected",
-			vs: snapshotv1beta1api.VolumeSnapshot{
+			vs: snapshotv1api.VolumeSnapshot{
 				ObjectMeta: metav1.ObjectMeta{
 					Name:      "test-vs",
 					Namespace: "test-ns",
 				},
-				Spec: snapshotv1beta1api.VolumeSnapshotSpec{
-					Source: snapshotv1beta1api.VolumeSnapshotSource{
+				Spec: snapshotv1api.VolumeSnapshotSpec{
+					Source: snapshotv1api.VolumeSnapshotSource{
 						PersistentVolumeClaimName: &testPVC,
 					},
 					VolumeSnapshotClassName: &testSnapClass,
@@ -55,13 +65,13 @@ func TestResetVolumeSnapshotSpecForRestore(t *testing.T) {
 		},
 		{
 			name: "should reset spec and overwriting value for Source.VolumeSnapshotContentName",
-			vs: snapshotv1beta1api.VolumeSnapshot{
+			vs: snapshotv1api.VolumeSnapshot{
 				ObjectMeta: metav1.ObjectMeta{
 					Name:      "test-vs",
 					Namespace: "test-ns",
 				},
-				Spec: snapshotv1beta1api.VolumeSnapshotSpec{
-					Source: snapshotv1beta1api.VolumeSnapshotSource{
+				Spec: snapshotv1api.VolumeSnapshotSpec{
+					Source: snapshotv1api.VolumeSnapshotSource{
 						VolumeSnapshotContentName: &randText,
 					},
 					VolumeSnapshotClassName: &testSnapClass,
@@ -88,3 +98,167 @@ func TestResetVolumeSnapshotSpecForRestore(t *testing.T) {
 		})
 	}
 }
+
+func TestCheckVolumeSnapshotReadyToUse(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		expectError bool
+	}{
+		{
+			name: "volumesnapshot backed up without the annotation should be restored",
+		},
+		{
+			name:        "volumesnapshot that was ready to use should be restored",
+			annotations: map[string]string{util.VolumeSnapshotReadyToUseAnnotation: "true"},
+		},
+		{
+			name:        "volumesnapshot that was not ready to use should not be restored",
+			annotations: map[string]string{util.VolumeSnapshotReadyToUseAnnotation: "false"},
+			expectError: true,
+		},
+		{
+			name:        "volumesnapshot with an invalid annotation should not be restored",
+			annotations: map[string]string{util.VolumeSnapshotReadyToUseAnnotation: "maybe"},
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			vs := &snapshotv1api.VolumeSnapshot{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "test-vs",
+					Namespace:   "test-ns",
+					Annotations: tc.annotations,
+				},
+			}
+			err := checkVolumeSnapshotReadyToUse(vs)
+			if tc.expectError {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+		})
+	}
+}
+
+func TestSetDeleteSnapshotSecret(t *testing.T) {
+	secretAnnotations := map[string]string{
+		util.CSIDeleteSnapshotSecretName:      "snap-secret",
+		util.CSIDeleteSnapshotSecretNamespace: "secret-ns",
+	}
+	testCases := []struct {
+		name                string
+		annotations         map[string]string
+		namespaceMapping    map[string]string
+		expectedAnnotations map[string]string
+		expectedItems       []velero.ResourceIdentifier
+	}{
+		{
+			name: "volumesnapshot without a deletion secret should not set one",
+		},
+		{
+			name:        "deletion secret should be set and restored",
+			annotations: secretAnnotations,
+			expectedAnnotations: map[string]string{
+				"snapshot.storage.kubernetes.io/deletion-secret-name":      "snap-secret",
+				"snapshot.storage.kubernetes.io/deletion-secret-namespace": "secret-ns",
+			},
+			expectedItems: []velero.ResourceIdentifier{
+				{GroupResource: schema.GroupResource{Resource: "secrets"}, Name: "snap-secret", Namespace: "secret-ns"},
+			},
+		},
+		{
+			name:             "deletion secret should refer to the namespace the secret is mapped to",
+			annotations:      secretAnnotations,
+			namespaceMapping: map[string]string{"secret-ns": "new-secret-ns"},
+			expectedAnnotations: map[string]string{
+				"snapshot.storage.kubernetes.io/deletion-secret-name":      "snap-secret",
+				"snapshot.storage.kubernetes.io/deletion-secret-namespace": "new-secret-ns",
+			},
+			expectedItems: []velero.ResourceIdentifier{
+				{GroupResource: schema.GroupResource{Resource: "secrets"}, Name: "snap-secret", Namespace: "secret-ns"},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			vs := &snapshotv1api.VolumeSnapshot{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "test-vs",
+					Namespace:   "test-ns",
+					Annotations: tc.annotations,
+				},
+			}
+			vsc := &snapshotv1api.VolumeSnapshotContent{
+				ObjectMeta: metav1.ObjectMeta{Name: "velero-test-vs-0123456789"},
+				Spec: snapshotv1api.VolumeSnapshotContentSpec{
+					VolumeSnapshotRef: corev1api.ObjectReference{Namespace: "test-ns", Name: "test-vs"},
+				},
+			}
+			restore := &velerov1api.Restore{
+				Spec: velerov1api.RestoreSpec{NamespaceMapping: tc.namespaceMapping},
+			}
+			items := setDeleteSnapshotSecret(vs, vsc, restore)
+			assert.Equal(t, tc.expectedItems, items)
+
+			// The CSI snapshotter sidecar reads the secret from the annotations of the static volumesnapshotcontent.
+			client := snapshotFake.NewSimpleClientset()
+			p := &VolumeSnapshotRestoreItemAction{Log: logrus.New()}
+			_, err := p.createVolumeSnapshotContent(vsc, client.SnapshotV1())
+			require.Nil(t, err)
+			created, err := client.SnapshotV1().VolumeSnapshotContents().Get(context.TODO(), vsc.Name, metav1.GetOptions{})
+			require.Nil(t, err)
+			assert.Equal(t, tc.expectedAnnotations, created.Annotations)
+		})
+	}
+}
+
+func TestCreateVolumeSnapshotContent(t *testing.T) {
+	newVSC := func(vsNamespace, vsName string) *snapshotv1api.VolumeSnapshotContent {
+		return &snapshotv1api.VolumeSnapshotContent{
+			ObjectMeta: metav1.ObjectMeta{Name: "velero-vs-1-0123456789"},
+			Spec: snapshotv1api.VolumeSnapshotContentSpec{
+				VolumeSnapshotRef: corev1api.ObjectReference{Namespace: vsNamespace, Name: vsName},
+			},
+		}
+	}
+	testCases := []struct {
+		name        string
+		existing    *snapshotv1api.VolumeSnapshotContent
+		expectError bool
+	}{
+		{
+			name: "volumesnapshotcontent should be created",
+		},
+		{
+			name:     "volumesnapshotcontent created earlier for the volumesnapshot should be reused",
+			existing: newVSC("test-ns", "vs-1"),
+		},
+		{
+			name:        "volumesnapshotcontent bound to another volumesnapshot should not be reused",
+			existing:    newVSC("other-ns", "vs-1"),
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := snapshotFake.NewSimpleClientset()
+			if tc.existing != nil {
+				client = snapshotFake.NewSimpleClientset(tc.existing)
+			}
+			p := &VolumeSnapshotRestoreItemAction{Log: logrus.New()}
+			vsc, err := p.createVolumeSnapshotContent(newVSC("test-ns", "vs-1"), client.SnapshotV1())
+			if tc.expectError {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, "velero-vs-1-0123456789", vsc.Name)
+			assert.Equal(t, "test-ns", vsc.Spec.VolumeSnapshotRef.Namespace)
+		})
+	}
+}
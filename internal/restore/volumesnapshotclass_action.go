@@ -20,17 +20,19 @@ import (
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 
-	snapshotv1beta1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1beta1"
+	snapshotv1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/config"
 	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/util"
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
 )
 
 // VolumeSnapshotClassRestoreItemAction is a Velero restore item action plugin for VolumeSnapshotClass
 type VolumeSnapshotClassRestoreItemAction struct {
-	Log logrus.FieldLogger
+	Log    logrus.FieldLogger
+	Config config.Config
 }
 
 // AppliesTo returns information indicating that VolumeSnapshotClassRestoreItemAction should be invoked while restoring
@@ -41,16 +43,26 @@ func (p *VolumeSnapshotClassRestoreItemAction) AppliesTo() (velero.ResourceSelec
 	}, nil
 }
 
-// Execute restores volumesnapshotclass objects returning any snapshotlister secret as additional items to restore
+// Execute restores volumesnapshotclass objects, with the CSI driver mapped by the plugin configuration, returning any snapshotlister
+// secret as additional items to restore
 func (p *VolumeSnapshotClassRestoreItemAction) Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
 	p.Log.Info("Starting VolumeSnapshotClassRestoreItemAction")
 
-	var snapClass snapshotv1beta1api.VolumeSnapshotClass
+	var snapClass snapshotv1api.VolumeSnapshotClass
 
 	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(input.Item.UnstructuredContent(), &snapClass); err != nil {
 		return &velero.RestoreItemActionExecuteOutput{}, errors.Wrapf(err, "failed to convert input.Item from unstructured")
 	}
 
+	if err := mapDriverName(input.Item, p.Config, p.Log, "driver"); err != nil {
+		return nil, err
+	}
+
+	_, snapClient, err := util.GetClients()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
 	additionalItems := []velero.ResourceIdentifier{}
 	if util.IsVolumeSnapshotClassHasListerSecret(&snapClass) {
 		additionalItems = append(additionalItems, velero.ResourceIdentifier{
@@ -63,7 +75,7 @@ func (p *VolumeSnapshotClassRestoreItemAction) Execute(input *velero.RestoreItem
 	p.Log.Infof("Returning from VolumeSnapshotClassRestoreItemAction with %d additionalItems", len(additionalItems))
 
 	return &velero.RestoreItemActionExecuteOutput{
-		UpdatedItem:     input.Item,
+		UpdatedItem:     util.ConvertSnapshotItem(input.Item, snapClient),
 		AdditionalItems: additionalItems,
 	}, nil
 }
@@ -20,17 +20,20 @@ import (
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 
-	snapshotv1beta1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1beta1"
+	snapshotv1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/config"
 	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/util"
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
 )
 
 // VolumeSnapshotContentRestoreItemAction is a restore item action plugin for Velero
 type VolumeSnapshotContentRestoreItemAction struct {
-	Log logrus.FieldLogger
+	Log    logrus.FieldLogger
+	Config config.Config
 }
 
 // AppliesTo returns information indicating VolumeSnapshotContentRestoreItemAction action should be invoked while restoring
@@ -41,30 +44,47 @@ func (p *VolumeSnapshotContentRestoreItemAction) AppliesTo() (velero.ResourceSel
 	}, nil
 }
 
-// Execute restores a volumesnapshotcontent object without modification returning the snapshot lister secret, if any, as
-// additional items to restore.
+// Execute restores a volumesnapshotcontent object using the snapshot API version served by the cluster, with the CSI driver mapped by the
+// plugin configuration, returning the snapshot deletion secret, if any, as additional items to restore.
 func (p *VolumeSnapshotContentRestoreItemAction) Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
 	p.Log.Info("Starting VolumeSnapshotContentRestoreItemAction")
-	var snapCont snapshotv1beta1api.VolumeSnapshotContent
+	var snapCont snapshotv1api.VolumeSnapshotContent
 
 	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(input.Item.UnstructuredContent(), &snapCont); err != nil {
 		return &velero.RestoreItemActionExecuteOutput{}, errors.Wrapf(err, "failed to convert input.Item from unstructured")
 	}
 
+	if err := mapDriverName(input.Item, p.Config, p.Log, "spec", "driver"); err != nil {
+		return nil, err
+	}
+
+	_, snapClient, err := util.GetClients()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
 	additionalItems := []velero.ResourceIdentifier{}
 	if util.IsVolumeSnapshotContentHasDeleteSecret(&snapCont) {
+		namespace := snapCont.Annotations[util.DeletionSecretNamespaceAnnotation]
 		additionalItems = append(additionalItems,
 			velero.ResourceIdentifier{
 				GroupResource: schema.GroupResource{Group: "", Resource: "secrets"},
-				Name:          snapCont.Annotations[util.CSIDeleteSnapshotSecretName],
-				Namespace:     snapCont.Annotations[util.CSIDeleteSnapshotSecretNamespace],
+				Name:          snapCont.Annotations[util.DeletionSecretNameAnnotation],
+				Namespace:     namespace,
 			},
 		)
+		// Velero restores the secret into the namespace its namespace is mapped to.
+		if val, ok := input.Restore.Spec.NamespaceMapping[namespace]; ok {
+			item := &unstructured.Unstructured{Object: input.Item.UnstructuredContent()}
+			annotations := item.GetAnnotations()
+			annotations[util.DeletionSecretNamespaceAnnotation] = val
+			item.SetAnnotations(annotations)
+		}
 	}
 
 	p.Log.Infof("Returning from VolumeSnapshotContentRestoreItemAction with %d additionalItems", len(additionalItems))
 	return &velero.RestoreItemActionExecuteOutput{
-		UpdatedItem:     input.Item,
+		UpdatedItem:     util.ConvertSnapshotItem(input.Item, snapClient),
 		AdditionalItems: additionalItems,
 	}, nil
 }
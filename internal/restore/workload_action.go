@@ -0,0 +1,100 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package restore
+
+import (
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+)
+
+// WorkloadRestoreItemAction is a restore item action plugin for Velero that points the PVC references of pods, and of the pod
+// templates of deployments, statefulsets and jobs, to the PVCs renamed by PVCRestoreItemAction.
+type WorkloadRestoreItemAction struct {
+	Log logrus.FieldLogger
+}
+
+// AppliesTo returns information indicating that the WorkloadRestoreItemAction should be run while restoring pods, deployments,
+// statefulsets and jobs.
+func (p *WorkloadRestoreItemAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+		IncludedResources: []string{"pods", "deployments.apps", "statefulsets.apps", "jobs.batch"},
+	}, nil
+}
+
+// Execute rewrites the claim names of the persistentVolumeClaim volumes of the item that refer to PVCs renamed by the PVC rename
+// mapping of the restore. Volume claim templates of statefulsets are not rewritten, as the names of the PVCs they create are
+// derived from the template, the statefulset and the ordinal of the pod.
+func (p *WorkloadRestoreItemAction) Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
+	mapping, err := pvcNameMapping(input.Restore)
+	if err != nil {
+		return nil, err
+	}
+	if len(mapping) == 0 {
+		return &velero.RestoreItemActionExecuteOutput{
+			UpdatedItem: input.Item,
+		}, nil
+	}
+
+	obj := &unstructured.Unstructured{Object: input.Item.UnstructuredContent()}
+	fields := []string{"spec", "template", "spec", "volumes"}
+	if obj.GetKind() == "Pod" {
+		fields = []string{"spec", "volumes"}
+	}
+	volumes, found, err := unstructured.NestedSlice(obj.Object, fields...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get volumes of %s %s/%s", obj.GetKind(), obj.GetNamespace(), obj.GetName())
+	}
+	if !found {
+		return &velero.RestoreItemActionExecuteOutput{
+			UpdatedItem: input.Item,
+		}, nil
+	}
+
+	renamed := false
+	for _, v := range volumes {
+		volume, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		claimName, found, err := unstructured.NestedString(volume, "persistentVolumeClaim", "claimName")
+		if err != nil || !found {
+			continue
+		}
+		mapped := mapPVCName(mapping, obj.GetNamespace(), claimName)
+		if mapped == claimName {
+			continue
+		}
+		p.Log.Infof("Pointing volume %v of %s %s/%s to PVC %s instead of %s", volume["name"], obj.GetKind(), obj.GetNamespace(), obj.GetName(), mapped, claimName)
+		if err := unstructured.SetNestedField(volume, mapped, "persistentVolumeClaim", "claimName"); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		renamed = true
+	}
+	if renamed {
+		if err := unstructured.SetNestedSlice(obj.Object, volumes, fields...); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	return &velero.RestoreItemActionExecuteOutput{
+		UpdatedItem: obj,
+	}, nil
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package restore
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/util"
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+)
+
+// podVolumes returns a configmap volume and a volume for each PVC, named as the PVC was backed up and mapped to claimNames.
+func podVolumes(claimNames map[string]string) []interface{} {
+	volumes := []interface{}{
+		map[string]interface{}{
+			"name":      "config",
+			"configMap": map[string]interface{}{"name": "data-db-0"},
+		},
+	}
+	for _, name := range []string{"data-db-0", "logs"} {
+		if claimName, ok := claimNames[name]; ok {
+			volumes = append(volumes, map[string]interface{}{
+				"name":                  name,
+				"persistentVolumeClaim": map[string]interface{}{"claimName": claimName},
+			})
+		}
+	}
+	return volumes
+}
+
+func TestWorkloadRestoreItemActionExecute(t *testing.T) {
+	mapping := `{"db/data-db-0": "data-db-0-copy"}`
+	testCases := []struct {
+		name     string
+		mapping  string
+		item     map[string]interface{}
+		expected map[string]interface{}
+	}{
+		{
+			name:    "pod",
+			mapping: mapping,
+			item: map[string]interface{}{
+				"kind":     "Pod",
+				"metadata": map[string]interface{}{"name": "db-0", "namespace": "db"},
+				"spec":     map[string]interface{}{"volumes": podVolumes(map[string]string{"data-db-0": "data-db-0", "logs": "logs"})},
+			},
+			expected: map[string]interface{}{
+				"kind":     "Pod",
+				"metadata": map[string]interface{}{"name": "db-0", "namespace": "db"},
+				"spec":     map[string]interface{}{"volumes": podVolumes(map[string]string{"data-db-0": "data-db-0-copy", "logs": "logs"})},
+			},
+		},
+		{
+			name:    "deployment",
+			mapping: mapping,
+			item: map[string]interface{}{
+				"kind":     "Deployment",
+				"metadata": map[string]interface{}{"name": "db", "namespace": "db"},
+				"spec": map[string]interface{}{"template": map[string]interface{}{
+					"spec": map[string]interface{}{"volumes": podVolumes(map[string]string{"data-db-0": "data-db-0"})},
+				}},
+			},
+			expected: map[string]interface{}{
+				"kind":     "Deployment",
+				"metadata": map[string]interface{}{"name": "db", "namespace": "db"},
+				"spec": map[string]interface{}{"template": map[string]interface{}{
+					"spec": map[string]interface{}{"volumes": podVolumes(map[string]string{"data-db-0": "data-db-0-copy"})},
+				}},
+			},
+		},
+		{
+			name:    "PVC of another namespace",
+			mapping: mapping,
+			item: map[string]interface{}{
+				"kind":     "Job",
+				"metadata": map[string]interface{}{"name": "db", "namespace": "other"},
+				"spec": map[string]interface{}{"template": map[string]interface{}{
+					"spec": map[string]interface{}{"volumes": podVolumes(map[string]string{"data-db-0": "data-db-0"})},
+				}},
+			},
+			expected: map[string]interface{}{
+				"kind":     "Job",
+				"metadata": map[string]interface{}{"name": "db", "namespace": "other"},
+				"spec": map[string]interface{}{"template": map[string]interface{}{
+					"spec": map[string]interface{}{"volumes": podVolumes(map[string]string{"data-db-0": "data-db-0"})},
+				}},
+			},
+		},
+		{
+			name:    "no volumes",
+			mapping: mapping,
+			item: map[string]interface{}{
+				"kind":     "StatefulSet",
+				"metadata": map[string]interface{}{"name": "db", "namespace": "db"},
+			},
+			expected: map[string]interface{}{
+				"kind":     "StatefulSet",
+				"metadata": map[string]interface{}{"name": "db", "namespace": "db"},
+			},
+		},
+		{
+			name: "no mapping",
+			item: map[string]interface{}{
+				"kind":     "Pod",
+				"metadata": map[string]interface{}{"name": "db-0", "namespace": "db"},
+				"spec":     map[string]interface{}{"volumes": podVolumes(map[string]string{"data-db-0": "data-db-0"})},
+			},
+			expected: map[string]interface{}{
+				"kind":     "Pod",
+				"metadata": map[string]interface{}{"name": "db-0", "namespace": "db"},
+				"spec":     map[string]interface{}{"volumes": podVolumes(map[string]string{"data-db-0": "data-db-0"})},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			restore := &velerov1api.Restore{ObjectMeta: metav1.ObjectMeta{Name: "restore", Namespace: "velero"}}
+			if tc.mapping != "" {
+				restore.Annotations = map[string]string{util.PVCNameMappingAnnotation: tc.mapping}
+			}
+			p := &WorkloadRestoreItemAction{Log: logrus.New()}
+			output, err := p.Execute(&velero.RestoreItemActionExecuteInput{
+				Item:    &unstructured.Unstructured{Object: tc.item},
+				Restore: restore,
+			})
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, output.UpdatedItem.UnstructuredContent())
+		})
+	}
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultExecTimeout is how long an ExecTranslator waits for the executable to translate a handle.
+const defaultExecTimeout = time.Minute
+
+// Response is what the executable of an ExecTranslator writes to its standard output.
+type Response struct {
+	// SnapshotHandle is the handle of the snapshot to restore.
+	SnapshotHandle string `json:"snapshotHandle"`
+}
+
+// ExecTranslator translates snapshot handles with an external executable. The executable reads a Request as JSON from its
+// standard input, writes a Response as JSON to its standard output and exits with status 0. Any other exit status fails the
+// translation, with the standard error of the executable as the reason.
+type ExecTranslator struct {
+	Path    string
+	Timeout time.Duration
+}
+
+var _ HandleTranslator = &ExecTranslator{}
+
+// Translate runs the executable for the request and returns the handle it responds with.
+func (t *ExecTranslator) Translate(request Request) (string, error) {
+	input, err := json.Marshal(request)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), t.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, t.Path)
+	cmd.Stdin = bytes.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", errors.Errorf("snapshot handle translator %s did not complete within %s", t.Path, t.Timeout)
+		}
+		return "", errors.Wrapf(err, "snapshot handle translator %s failed: %s", t.Path, strings.TrimSpace(stderr.String()))
+	}
+
+	var response Response
+	if err := json.Unmarshal(stdout.Bytes(), &response); err != nil {
+		return "", errors.Wrapf(err, "error parsing the response of snapshot handle translator %s", t.Path)
+	}
+	if response.SnapshotHandle == "" {
+		return "", errors.Errorf("snapshot handle translator %s responded without a snapshot handle for %s", t.Path, request.SnapshotHandle)
+	}
+	return response.SnapshotHandle, nil
+}
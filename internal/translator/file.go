@@ -0,0 +1,51 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// FileTranslator translates snapshot handles with a lookup table: a file holding a JSON object that maps the handles of
+// backed-up snapshots to the handles of their copies. The file is read for every translation, so that it can be updated,
+// for instance as a mounted configmap, while restores run.
+type FileTranslator struct {
+	Path string
+}
+
+var _ HandleTranslator = &FileTranslator{}
+
+// Translate returns the handle the lookup table maps the handle of the request to. Handles missing from the table are an error,
+// as the snapshot they identify is not available where the driver restores it.
+func (t *FileTranslator) Translate(request Request) (string, error) {
+	data, err := ioutil.ReadFile(t.Path)
+	if err != nil {
+		return "", errors.Wrapf(err, "error reading snapshot handle lookup table %s", t.Path)
+	}
+	table := map[string]string{}
+	if err := json.Unmarshal(data, &table); err != nil {
+		return "", errors.Wrapf(err, "error parsing snapshot handle lookup table %s", t.Path)
+	}
+	handle := table[request.SnapshotHandle]
+	if handle == "" {
+		return "", errors.Errorf("snapshot handle %s is not in lookup table %s", request.SnapshotHandle, t.Path)
+	}
+	return handle, nil
+}
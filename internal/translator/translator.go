@@ -0,0 +1,63 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/config"
+)
+
+// Request describes a backed-up snapshot whose handle is to be translated.
+type Request struct {
+	// Driver is the name of the CSI driver that restores the snapshot.
+	Driver string `json:"driver"`
+	// SnapshotHandle is the handle of the backed-up snapshot.
+	SnapshotHandle string `json:"snapshotHandle"`
+	// VolumeSnapshotNamespace and VolumeSnapshotName identify the volumesnapshot being restored.
+	VolumeSnapshotNamespace string `json:"volumeSnapshotNamespace"`
+	VolumeSnapshotName      string `json:"volumeSnapshotName"`
+	// RestoreName is the name of the Velero restore.
+	RestoreName string `json:"restoreName"`
+}
+
+// HandleTranslator translates the handle of a backed-up snapshot to the handle of the snapshot to restore, for snapshots
+// that were copied to another region or account, where they have other handles.
+type HandleTranslator interface {
+	Translate(request Request) (string, error)
+}
+
+// New returns the HandleTranslator configured for a CSI driver.
+func New(cfg config.HandleTranslator) (HandleTranslator, error) {
+	switch cfg.Type {
+	case config.HandleTranslatorFile:
+		return &FileTranslator{Path: cfg.Path}, nil
+	case config.HandleTranslatorExec:
+		return &ExecTranslator{Path: cfg.Path, Timeout: defaultExecTimeout}, nil
+	default:
+		return nil, errors.Errorf("unknown snapshot handle translator type %q", cfg.Type)
+	}
+}
+
+// ForDriver returns the HandleTranslator configured for the CSI driver, or nil if handles of its snapshots are not translated.
+func ForDriver(cfg config.Config, driver string) (HandleTranslator, error) {
+	translatorConfig, ok := cfg.HandleTranslators[driver]
+	if !ok {
+		return nil, nil
+	}
+	return New(translatorConfig)
+}
@@ -0,0 +1,189 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/config"
+)
+
+func TestForDriver(t *testing.T) {
+	cfg := config.Default()
+	cfg.HandleTranslators["ebs.csi.aws.com"] = config.HandleTranslator{Type: config.HandleTranslatorFile, Path: "/etc/velero/handles.json"}
+	cfg.HandleTranslators["pd.csi.storage.gke.io"] = config.HandleTranslator{Type: config.HandleTranslatorExec, Path: "/plugins/translate-handle"}
+
+	translator, err := ForDriver(cfg, "ebs.csi.aws.com")
+	assert.Nil(t, err)
+	assert.Equal(t, &FileTranslator{Path: "/etc/velero/handles.json"}, translator)
+
+	translator, err = ForDriver(cfg, "pd.csi.storage.gke.io")
+	assert.Nil(t, err)
+	assert.Equal(t, &ExecTranslator{Path: "/plugins/translate-handle", Timeout: defaultExecTimeout}, translator)
+
+	translator, err = ForDriver(cfg, "hostpath.csi.k8s.io")
+	assert.Nil(t, err)
+	assert.Nil(t, translator)
+}
+
+func TestFileTranslator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "translator")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "handles.json")
+	require.Nil(t, ioutil.WriteFile(path, []byte(`{"snap-us-east-1": "snap-us-west-2"}`), 0644))
+	invalid := filepath.Join(dir, "invalid.json")
+	require.Nil(t, ioutil.WriteFile(invalid, []byte(`snap-us-east-1: snap-us-west-2`), 0644))
+
+	testCases := []struct {
+		name        string
+		path        string
+		handle      string
+		expected    string
+		expectError bool
+	}{
+		{
+			name:     "handle in the table",
+			path:     path,
+			handle:   "snap-us-east-1",
+			expected: "snap-us-west-2",
+		},
+		{
+			name:        "handle not in the table",
+			path:        path,
+			handle:      "snap-eu-west-1",
+			expectError: true,
+		},
+		{
+			name:        "missing table",
+			path:        filepath.Join(dir, "missing.json"),
+			handle:      "snap-us-east-1",
+			expectError: true,
+		},
+		{
+			name:        "invalid table",
+			path:        invalid,
+			handle:      "snap-us-east-1",
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			translator := &FileTranslator{Path: tc.path}
+			handle, err := translator.Translate(Request{SnapshotHandle: tc.handle})
+			if tc.expectError {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, handle)
+		})
+	}
+}
+
+func TestExecTranslator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "translator")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	requestPath := filepath.Join(dir, "request.json")
+	writeScript := func(name, body string) string {
+		path := filepath.Join(dir, name)
+		require.Nil(t, ioutil.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0755))
+		return path
+	}
+
+	testCases := []struct {
+		name        string
+		path        string
+		timeout     time.Duration
+		expected    string
+		expectError bool
+	}{
+		{
+			name:     "translated handle",
+			path:     writeScript("translate", `cat > `+requestPath+`; echo '{"snapshotHandle": "snap-copy"}'`),
+			expected: "snap-copy",
+		},
+		{
+			name:        "failing executable",
+			path:        writeScript("fail", `echo "no copy of the snapshot" >&2; exit 1`),
+			expectError: true,
+		},
+		{
+			name:        "invalid response",
+			path:        writeScript("invalid", `echo snap-copy`),
+			expectError: true,
+		},
+		{
+			name:        "response without a handle",
+			path:        writeScript("empty", `echo '{}'`),
+			expectError: true,
+		},
+		{
+			name:        "executable that does not complete in time",
+			path:        writeScript("slow", `exec sleep 5`),
+			timeout:     100 * time.Millisecond,
+			expectError: true,
+		},
+		{
+			name:        "missing executable",
+			path:        filepath.Join(dir, "missing"),
+			expectError: true,
+		},
+	}
+
+	request := Request{
+		Driver:                  "ebs.csi.aws.com",
+		SnapshotHandle:          "snap-original",
+		VolumeSnapshotNamespace: "ns",
+		VolumeSnapshotName:      "vs",
+		RestoreName:             "restore",
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			timeout := tc.timeout
+			if timeout == 0 {
+				timeout = defaultExecTimeout
+			}
+			translator := &ExecTranslator{Path: tc.path, Timeout: timeout}
+			handle, err := translator.Translate(request)
+			if tc.expectError {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, handle)
+
+			data, err := ioutil.ReadFile(requestPath)
+			require.Nil(t, err)
+			var received Request
+			require.Nil(t, json.Unmarshal(data, &received))
+			assert.Equal(t, request, received)
+		})
+	}
+}
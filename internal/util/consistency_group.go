@@ -0,0 +1,111 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	corev1api "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// GetConsistencyGroup returns the name of the consistency group of the PVC, or "" if the PVC is not in one.
+// The group is named by the ConsistencyGroupLabel on the PVC or, failing that, by the ConsistencyGroupLabel annotation
+// on the pods mounting the PVC. Annotating the pod template of a workload puts all the PVCs of the workload in a group.
+func GetConsistencyGroup(pvc *corev1api.PersistentVolumeClaim, corev1 corev1client.PodsGetter) (string, error) {
+	if group := pvc.Labels[ConsistencyGroupLabel]; group != "" {
+		return group, nil
+	}
+
+	pods, err := GetPodsUsingPVC(pvc.Namespace, pvc.Name, corev1)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get pods using PVC %s/%s", pvc.Namespace, pvc.Name)
+	}
+	group := ""
+	for _, pod := range pods {
+		podGroup := pod.Annotations[ConsistencyGroupLabel]
+		if podGroup == "" {
+			continue
+		}
+		if group != "" && podGroup != group {
+			return "", errors.Errorf("PVC %s/%s is mounted by pods of different consistency groups %s and %s", pvc.Namespace, pvc.Name, group, podGroup)
+		}
+		group = podGroup
+	}
+	if group == "" {
+		return "", nil
+	}
+	if errs := validation.IsValidLabelValue(group); len(errs) > 0 {
+		return "", errors.Errorf("invalid consistency group name %q on pods using PVC %s/%s: %s", group, pvc.Namespace, pvc.Name, strings.Join(errs, "; "))
+	}
+	return group, nil
+}
+
+// GetConsistencyGroupMembers returns the PVCs of the namespace that are in the consistency group, sorted by name.
+// Those are the PVCs with the group's ConsistencyGroupLabel and the PVCs mounted by pods with the group's ConsistencyGroupLabel
+// annotation.
+func GetConsistencyGroupMembers(namespace, group string, corev1 corev1client.CoreV1Interface) ([]corev1api.PersistentVolumeClaim, error) {
+	selector := labels.SelectorFromSet(labels.Set{ConsistencyGroupLabel: group}).String()
+	pvcList, err := corev1.PersistentVolumeClaims(namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list PVCs of consistency group %s in namespace %s", group, namespace)
+	}
+	members := map[string]corev1api.PersistentVolumeClaim{}
+	for _, pvc := range pvcList.Items {
+		if pvc.Labels[ConsistencyGroupLabel] == group {
+			members[pvc.Name] = pvc
+		}
+	}
+
+	podList, err := corev1.Pods(namespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list pods in namespace %s", namespace)
+	}
+	for _, pod := range podList.Items {
+		if pod.Annotations[ConsistencyGroupLabel] != group {
+			continue
+		}
+		for _, v := range pod.Spec.Volumes {
+			if v.PersistentVolumeClaim == nil {
+				continue
+			}
+			if _, ok := members[v.PersistentVolumeClaim.ClaimName]; ok {
+				continue
+			}
+			pvc, err := corev1.PersistentVolumeClaims(namespace).Get(context.TODO(), v.PersistentVolumeClaim.ClaimName, metav1.GetOptions{})
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to get PVC %s/%s mounted by pod %s of consistency group %s",
+					namespace, v.PersistentVolumeClaim.ClaimName, pod.Name, group)
+			}
+			members[pvc.Name] = *pvc
+		}
+	}
+
+	result := make([]corev1api.PersistentVolumeClaim, 0, len(members))
+	for _, pvc := range members {
+		result = append(result, pvc)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result, nil
+}
@@ -0,0 +1,174 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	corev1api "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newGroupPVC(name, group string) *corev1api.PersistentVolumeClaim {
+	pvc := &corev1api.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+		},
+	}
+	if group != "" {
+		pvc.Labels = map[string]string{ConsistencyGroupLabel: group}
+	}
+	return pvc
+}
+
+func newGroupPod(name, group string, pvcNames ...string) *corev1api.Pod {
+	pod := &corev1api.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+		},
+	}
+	if group != "" {
+		pod.Annotations = map[string]string{ConsistencyGroupLabel: group}
+	}
+	for _, pvcName := range pvcNames {
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1api.Volume{
+			Name: pvcName + "-vol",
+			VolumeSource: corev1api.VolumeSource{
+				PersistentVolumeClaim: &corev1api.PersistentVolumeClaimVolumeSource{ClaimName: pvcName},
+			},
+		})
+	}
+	return pod
+}
+
+func TestGetConsistencyGroup(t *testing.T) {
+	testCases := []struct {
+		name          string
+		pvc           *corev1api.PersistentVolumeClaim
+		pods          []runtime.Object
+		expectedGroup string
+		expectError   bool
+	}{
+		{
+			name:          "PVC not in a group",
+			pvc:           newGroupPVC("pvc-1", ""),
+			pods:          []runtime.Object{newGroupPod("pod-1", "", "pvc-1")},
+			expectedGroup: "",
+		},
+		{
+			name:          "group from the PVC label",
+			pvc:           newGroupPVC("pvc-1", "db"),
+			pods:          []runtime.Object{newGroupPod("pod-1", "other", "pvc-1")},
+			expectedGroup: "db",
+		},
+		{
+			name:          "group from the annotation of a pod mounting the PVC",
+			pvc:           newGroupPVC("pvc-1", ""),
+			pods:          []runtime.Object{newGroupPod("pod-1", "", "pvc-1"), newGroupPod("pod-2", "db", "pvc-1")},
+			expectedGroup: "db",
+		},
+		{
+			name:          "annotation of a pod not mounting the PVC is ignored",
+			pvc:           newGroupPVC("pvc-1", ""),
+			pods:          []runtime.Object{newGroupPod("pod-1", "db", "pvc-2")},
+			expectedGroup: "",
+		},
+		{
+			name:        "pods mounting the PVC in different groups",
+			pvc:         newGroupPVC("pvc-1", ""),
+			pods:        []runtime.Object{newGroupPod("pod-1", "db", "pvc-1"), newGroupPod("pod-2", "cache", "pvc-1")},
+			expectError: true,
+		},
+		{
+			name:        "invalid group name in a pod annotation",
+			pvc:         newGroupPVC("pvc-1", ""),
+			pods:        []runtime.Object{newGroupPod("pod-1", "not a label value", "pvc-1")},
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset(tc.pods...)
+			group, err := GetConsistencyGroup(tc.pvc, client.CoreV1())
+			if tc.expectError {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expectedGroup, group)
+		})
+	}
+}
+
+func TestGetConsistencyGroupMembers(t *testing.T) {
+	testCases := []struct {
+		name            string
+		objs            []runtime.Object
+		expectedMembers []string
+		expectError     bool
+	}{
+		{
+			name:            "no members",
+			objs:            []runtime.Object{newGroupPVC("pvc-1", "")},
+			expectedMembers: []string{},
+		},
+		{
+			name: "members from PVC labels and pod annotations",
+			objs: []runtime.Object{
+				newGroupPVC("pvc-c", "db"),
+				newGroupPVC("pvc-a", ""),
+				newGroupPVC("pvc-b", ""),
+				newGroupPVC("pvc-d", "cache"),
+				newGroupPVC("pvc-e", ""),
+				newGroupPod("pod-1", "db", "pvc-a", "pvc-b", "pvc-c"),
+				newGroupPod("pod-2", "", "pvc-e"),
+			},
+			expectedMembers: []string{"pvc-a", "pvc-b", "pvc-c"},
+		},
+		{
+			name: "pod mounts a missing PVC",
+			objs: []runtime.Object{
+				newGroupPod("pod-1", "db", "missing"),
+			},
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset(tc.objs...)
+			members, err := GetConsistencyGroupMembers("default", "db", client.CoreV1())
+			if tc.expectError {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			names := []string{}
+			for _, m := range members {
+				names = append(names, m.Name)
+			}
+			assert.Equal(t, tc.expectedMembers, names)
+		})
+	}
+}
@@ -25,6 +25,92 @@ const (
 	CSIDeleteSnapshotSecretNamespace = "velero.io/csi-deletesnapshotsecret-namespace"
 	CSIVSCDeletionPolicy             = "velero.io/csi-vsc-deletion-policy"
 	VolumeSnapshotClassSelectorLabel = "velero.io/csi-volumesnapshot-class"
+	// VolumeSnapshotReadyToUseAnnotation records on a backed-up volumesnapshot whether its snapshot was ready to use
+	// when it was backed up.
+	VolumeSnapshotReadyToUseAnnotation = "velero.io/csi-volumesnapshot-ready-to-use"
+	// DataMoverManifestAnnotation on a backed-up PVC or volumesnapshot is the key of the manifest of the data
+	// copied from the volumesnapshot to the data mover object store.
+	DataMoverManifestAnnotation = "velero.io/csi-data-mover-manifest"
+	// RestoreFromDataMoverAnnotation on a restore, when "true", restores PVCs from the data mover object store
+	// even when their volumesnapshots could be used.
+	RestoreFromDataMoverAnnotation = "velero.io/csi-restore-from-data-mover"
+	// PVCNameMappingAnnotation on a restore is a JSON object that maps the names of backed-up PVCs, as "<namespace>/<name>"
+	// or as "<name>" for PVCs of every namespace, to the names to restore them under.
+	PVCNameMappingAnnotation = "velero.io/csi-pvc-name-mapping"
+
+	// ConsistencyGroupLabel on a PVC, or an annotation with the same key on a pod, makes the PVC, or the PVCs mounted by the pod,
+	// members of the named consistency group. The members of a consistency group are snapshotted together.
+	ConsistencyGroupLabel = "velero.io/csi-consistency-group"
+	// ConsistencyGroupIDLabel on a volumesnapshot identifies the snapshot of a consistency group that it was taken with.
+	ConsistencyGroupIDLabel = "velero.io/csi-consistency-group-id"
+	// ConsistencyGroupMembersAnnotation on a volumesnapshot lists, comma separated, the PVCs of the consistency group that
+	// were snapshotted together with it.
+	ConsistencyGroupMembersAnnotation = "velero.io/csi-consistency-group-members"
+	// AllowPartialConsistencyGroupAnnotation on a restore, when "true", allows restoring PVCs of a consistency group
+	// without the other members of the group.
+	AllowPartialConsistencyGroupAnnotation = "velero.io/csi-allow-partial-consistency-group"
+	// AllowEmptyVolumeAnnotation on a restore, when "true", allows restoring PVCs as empty volumes when their snapshots cannot
+	// be restored by the CSI driver of their storage class.
+	AllowEmptyVolumeAnnotation = "velero.io/csi-allow-empty-volume"
+
+	// QuiesceFreezeCommandAnnotation and QuiesceThawCommandAnnotation on a pod are the commands run in the pod to freeze the
+	// application before the volumes it mounts are snapshotted, and to thaw it once the snapshots have been cut. A command is
+	// either a JSON array of strings or a single string.
+	QuiesceFreezeCommandAnnotation = "velero.io/csi-freeze-command"
+	QuiesceThawCommandAnnotation   = "velero.io/csi-thaw-command"
+	// QuiesceContainerAnnotation on a pod is the container to run the freeze and thaw commands in. Defaults to the first container.
+	QuiesceContainerAnnotation = "velero.io/csi-quiesce-container"
+	// QuiesceHooksAnnotation on a volumesnapshot records, as JSON, the output and errors of the freeze and thaw commands run
+	// while it was taken. On a backup, it records the same for every group of PVCs quiesced during the backup, as a JSON array,
+	// including the groups whose applications could not be quiesced or whose snapshots failed.
+	QuiesceHooksAnnotation = "velero.io/csi-quiesce-hooks"
+
+	// VolumeSnapshotRecordLabel is set on the configmaps, in the Velero namespace, that record the volumesnapshots created for backups.
+	VolumeSnapshotRecordLabel = "velero.io/csi-volumesnapshot-record"
+
+	// StorageClassAnnotation on a volumesnapshot created by PVCBackupItemAction is the storage class of the PVC it snapshots.
+	StorageClassAnnotation = "velero.io/csi-storage-class"
+	// ChangeStorageClassLabel, together with the velero.io/plugin-config label, identifies the configmap of Velero's
+	// change-storage-class restore item action, which maps the storage classes of the restored PVCs and PVs.
+	ChangeStorageClassLabel = "velero.io/change-storage-class"
+	// VolumeTopologyAnnotation on a backed-up PVC is the topology of its volume: the JSON encoded node selector terms of the
+	// node affinity of its PV, without the requirements on individual nodes.
+	VolumeTopologyAnnotation = "velero.io/csi-volume-topology"
+	// TopologyStorageClassLabel on a storage class created on restore, to constrain restored PVCs to the topology of their
+	// backed-up volumes, is the name of the storage class it copies.
+	TopologyStorageClassLabel = "velero.io/csi-topology-storage-class"
+
+	// AdoptVolumeSnapshotSelectorAnnotation on a PVC, or on a backup for all its PVCs, is a label selector of the volumesnapshots,
+	// taken outside of Velero, that may be backed up instead of taking a new snapshot of the PVC.
+	AdoptVolumeSnapshotSelectorAnnotation = "velero.io/csi-adopt-volumesnapshot-selector"
+	// AdoptedVolumeSnapshotAnnotation on a volumesnapshot or volumesnapshotcontent marks it as adopted by a backup. The delete
+	// actions never delete adopted volumesnapshots, which belong to the application that took them.
+	AdoptedVolumeSnapshotAnnotation = "velero.io/csi-adopted"
+
+	// BackupNameAnnotation and BackupUIDAnnotation on an object created by the plugin for a backup are the full name and the
+	// UID of the backup. Unlike the velero.io/backup-name label, which is truncated to fit a label value, they identify the backup.
+	BackupNameAnnotation = "velero.io/csi-backup-name"
+	BackupUIDAnnotation  = "velero.io/csi-backup-uid"
+	// SourcePVCUIDLabel on a volumesnapshot created by PVCBackupItemAction is the UID of the PVC it snapshots.
+	SourcePVCUIDLabel = "velero.io/csi-source-pvc-uid"
+	// LegalHoldAuditLabel is on the configmaps that make up the audit record of legal holds.
+	LegalHoldAuditLabel = "velero.io/csi-legal-hold-audit"
+	// ExcludeFromBackupLabel keeps Velero from backing up objects that have it.
+	ExcludeFromBackupLabel = "velero.io/exclude-from-backup"
+	// ReferencingBackupsAnnotation on a volumesnapshot or volumesnapshotcontent lists, comma separated, the backups that
+	// include it, as <backup name>/<backup UID>. Its snapshot is only deleted along with the last of them.
+	ReferencingBackupsAnnotation = "velero.io/csi-referencing-backups"
+	// LegalHoldAnnotation on a backup, volumesnapshot or volumesnapshotcontent forbids deleting the snapshots of the backup,
+	// or the snapshot of the volumesnapshot or volumesnapshotcontent, for as long as it is present. Its value is the reason
+	// for the hold.
+	LegalHoldAnnotation = "velero.io/csi-legal-hold"
+
+	// VolumeSnapshotClassAnnotation on a PVC or a StorageClass names the volumesnapshotclass to use for snapshotting
+	// the PVC, or PVCs provisioned from the storage class.
+	VolumeSnapshotClassAnnotation = "velero.io/csi-volumesnapshot-class"
+	// VolumeSnapshotClassBackupAnnotationPrefix followed by "_<driver name>" on a backup names the volumesnapshotclass
+	// to use for snapshotting volumes provisioned by that driver during the backup.
+	VolumeSnapshotClassBackupAnnotationPrefix = "velero.io/csi-volumesnapshot-class_"
 
 	// There is no release w/ these constants exported. Using the strings for now.
 	// CSI Labels volumesnapshotclass
@@ -35,4 +121,11 @@ const (
 	// CSI Labels volumesnapshotcontents
 	PrefixedSnapshotterSecretNameKey      = "csi.storage.k8s.io/snapshotter-secret-name"
 	PrefixedSnapshotterSecretNamespaceKey = "csi.storage.k8s.io/snapshotter-secret-namespace"
+
+	// DeletionSecretNameAnnotation and DeletionSecretNamespaceAnnotation on a volumesnapshotcontent are the secret the CSI
+	// snapshotter sidecar passes to the driver to delete the snapshot. The sidecar sets them on the volumesnapshotcontents it
+	// creates, and reads them from pre-provisioned ones.
+	// https://github.com/kubernetes-csi/external-snapshotter/blob/master/pkg/utils/util.go#L62-L63
+	DeletionSecretNameAnnotation      = "snapshot.storage.kubernetes.io/deletion-secret-name"
+	DeletionSecretNamespaceAnnotation = "snapshot.storage.kubernetes.io/deletion-secret-namespace"
 )
@@ -0,0 +1,64 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+
+	corev1api "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// eventSource is the component reported in the events recorded by the plugins.
+const eventSource = "velero-plugin-for-csi"
+
+// HasLegalHold returns whether the object has a legal hold, which forbids deleting its snapshot.
+func HasLegalHold(o *metav1.ObjectMeta) bool {
+	_, ok := o.Annotations[LegalHoldAnnotation]
+	return ok
+}
+
+// RecordWarningEvent records a warning event about the object. Events about cluster-scoped objects are recorded in the
+// default namespace.
+func RecordWarningEvent(client corev1client.EventsGetter, object corev1api.ObjectReference, reason, message string) error {
+	namespace := object.Namespace
+	if namespace == "" {
+		namespace = metav1.NamespaceDefault
+	}
+	now := metav1.Now()
+	event := &corev1api.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: object.Name + ".",
+			Namespace:    namespace,
+		},
+		InvolvedObject: object,
+		Reason:         reason,
+		Message:        message,
+		Type:           corev1api.EventTypeWarning,
+		Source:         corev1api.EventSource{Component: eventSource},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	if _, err := client.Events(namespace).Create(context.TODO(), event, metav1.CreateOptions{}); err != nil {
+		return errors.Wrapf(err, "error recording event about %s %s", object.Kind, object.Name)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1api "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRecordWarningEvent(t *testing.T) {
+	testCases := []struct {
+		name              string
+		object            corev1api.ObjectReference
+		expectedNamespace string
+	}{
+		{
+			name:              "namespaced object",
+			object:            corev1api.ObjectReference{Kind: "VolumeSnapshot", Namespace: "app", Name: "vs-1"},
+			expectedNamespace: "app",
+		},
+		{
+			name:              "cluster-scoped object",
+			object:            corev1api.ObjectReference{Kind: "VolumeSnapshotContent", Name: "vsc-1"},
+			expectedNamespace: "default",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			require.Nil(t, RecordWarningEvent(client.CoreV1(), tc.object, "LegalHold", "refusing to delete"))
+
+			events, err := client.CoreV1().Events(tc.expectedNamespace).List(context.TODO(), metav1.ListOptions{})
+			require.Nil(t, err)
+			require.Len(t, events.Items, 1)
+			assert.Equal(t, corev1api.EventTypeWarning, events.Items[0].Type)
+			assert.Equal(t, "LegalHold", events.Items[0].Reason)
+			assert.Equal(t, "refusing to delete", events.Items[0].Message)
+			assert.Equal(t, tc.object, events.Items[0].InvolvedObject)
+		})
+	}
+}
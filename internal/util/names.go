@@ -0,0 +1,47 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// nameHashLength is the number of hex characters of the hash of the keys in a name returned by DeterministicName.
+const nameHashLength = 10
+
+// DeterministicName returns the name of an object created by the plugin: prefix, followed by base and a hash of the keys.
+// The same keys always give the same name, so that a retried backup or restore finds the object it created earlier, and
+// different keys give different names. base is truncated so that the name fits in a label value, as the names of the
+// volumesnapshots are recorded in labels.
+func DeterministicName(prefix, base string, keys ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(keys, "/")))
+	hash := hex.EncodeToString(sum[:])[:nameHashLength]
+
+	if max := validation.LabelValueMaxLength - len(prefix) - len(hash) - 1; len(base) > max {
+		base = base[:max]
+	}
+	// A truncated base may end with characters that must be followed by an alphanumeric character.
+	base = strings.TrimRight(base, "-.")
+	if base == "" {
+		return prefix + hash
+	}
+	return prefix + base + "-" + hash
+}
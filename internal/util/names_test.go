@@ -0,0 +1,75 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+func TestDeterministicName(t *testing.T) {
+	testCases := []struct {
+		name           string
+		prefix         string
+		base           string
+		keys           []string
+		expectedPrefix string
+	}{
+		{
+			name:           "short base is kept",
+			prefix:         "velero-",
+			base:           "data",
+			keys:           []string{"backup-uid", "pvc-uid"},
+			expectedPrefix: "velero-data-",
+		},
+		{
+			name:           "long base is truncated",
+			prefix:         "velero-",
+			base:           strings.Repeat("a", 100),
+			keys:           []string{"backup-uid", "pvc-uid"},
+			expectedPrefix: "velero-" + strings.Repeat("a", 45) + "-",
+		},
+		{
+			name:           "truncated base does not end with a dash",
+			prefix:         "velero-",
+			base:           strings.Repeat("a", 44) + "-bbbb",
+			keys:           []string{"backup-uid", "pvc-uid"},
+			expectedPrefix: "velero-" + strings.Repeat("a", 44) + "-",
+		},
+		{
+			name:           "empty base",
+			prefix:         "velero-",
+			keys:           []string{"backup-uid", "pvc-uid"},
+			expectedPrefix: "velero-",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			name := DeterministicName(tc.prefix, tc.base, tc.keys...)
+			assert.True(t, strings.HasPrefix(name, tc.expectedPrefix), name)
+			assert.Len(t, name, len(tc.expectedPrefix)+nameHashLength)
+			assert.LessOrEqual(t, len(name), validation.LabelValueMaxLength)
+			assert.Empty(t, validation.IsDNS1123Subdomain(name))
+			assert.Equal(t, name, DeterministicName(tc.prefix, tc.base, tc.keys...))
+			assert.NotEqual(t, name, DeterministicName(tc.prefix, tc.base, "other-backup-uid", "pvc-uid"))
+		})
+	}
+}
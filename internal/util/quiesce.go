@@ -0,0 +1,87 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	corev1api "k8s.io/api/core/v1"
+)
+
+// QuiesceHook is the pair of commands declared by the annotations of a pod to freeze and thaw the application it runs.
+type QuiesceHook struct {
+	Container string
+	Freeze    []string
+	Thaw      []string
+}
+
+// GetQuiesceHook returns the quiesce hook declared by the annotations of the pod, or nil if the pod declares none.
+func GetQuiesceHook(pod *corev1api.Pod) (*QuiesceHook, error) {
+	freeze, hasFreeze := pod.Annotations[QuiesceFreezeCommandAnnotation]
+	thaw, hasThaw := pod.Annotations[QuiesceThawCommandAnnotation]
+	if !hasFreeze && !hasThaw {
+		return nil, nil
+	}
+	if !hasFreeze || !hasThaw {
+		return nil, errors.Errorf("pod %s/%s must have both the %s and %s annotations", pod.Namespace, pod.Name,
+			QuiesceFreezeCommandAnnotation, QuiesceThawCommandAnnotation)
+	}
+
+	hook := &QuiesceHook{Container: pod.Annotations[QuiesceContainerAnnotation]}
+	var err error
+	if hook.Freeze, err = parseHookCommand(freeze); err != nil {
+		return nil, errors.Wrapf(err, "invalid %s annotation on pod %s/%s", QuiesceFreezeCommandAnnotation, pod.Namespace, pod.Name)
+	}
+	if hook.Thaw, err = parseHookCommand(thaw); err != nil {
+		return nil, errors.Wrapf(err, "invalid %s annotation on pod %s/%s", QuiesceThawCommandAnnotation, pod.Namespace, pod.Name)
+	}
+
+	if hook.Container == "" {
+		if len(pod.Spec.Containers) == 0 {
+			return nil, errors.Errorf("pod %s/%s has no containers to run quiesce hooks in", pod.Namespace, pod.Name)
+		}
+		hook.Container = pod.Spec.Containers[0].Name
+	}
+	for _, c := range pod.Spec.Containers {
+		if c.Name == hook.Container {
+			return hook, nil
+		}
+	}
+	return nil, errors.Errorf("pod %s/%s has no container %s to run quiesce hooks in", pod.Namespace, pod.Name, hook.Container)
+}
+
+// parseHookCommand parses a command given either as a JSON array of strings or as a single string.
+func parseHookCommand(value string) ([]string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, errors.New("command must not be empty")
+	}
+	if !strings.HasPrefix(value, "[") {
+		return []string{value}, nil
+	}
+	var command []string
+	if err := json.Unmarshal([]byte(value), &command); err != nil {
+		return nil, errors.Wrap(err, "command must be a JSON array of strings")
+	}
+	if len(command) == 0 {
+		return nil, errors.New("command must not be empty")
+	}
+	return command, nil
+}
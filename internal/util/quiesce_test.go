@@ -0,0 +1,120 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	corev1api "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGetQuiesceHook(t *testing.T) {
+	newPod := func(annotations map[string]string) *corev1api.Pod {
+		return &corev1api.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "pod-1",
+				Namespace:   "default",
+				Annotations: annotations,
+			},
+			Spec: corev1api.PodSpec{
+				Containers: []corev1api.Container{{Name: "app"}, {Name: "sidecar"}},
+			},
+		}
+	}
+
+	testCases := []struct {
+		name         string
+		pod          *corev1api.Pod
+		expectedHook *QuiesceHook
+		expectError  bool
+	}{
+		{
+			name: "no hook",
+			pod:  newPod(nil),
+		},
+		{
+			name: "JSON array commands run in the first container",
+			pod: newPod(map[string]string{
+				QuiesceFreezeCommandAnnotation: `["/sbin/fsfreeze", "--freeze", "/data"]`,
+				QuiesceThawCommandAnnotation:   `["/sbin/fsfreeze", "--unfreeze", "/data"]`,
+			}),
+			expectedHook: &QuiesceHook{
+				Container: "app",
+				Freeze:    []string{"/sbin/fsfreeze", "--freeze", "/data"},
+				Thaw:      []string{"/sbin/fsfreeze", "--unfreeze", "/data"},
+			},
+		},
+		{
+			name: "single string commands in a named container",
+			pod: newPod(map[string]string{
+				QuiesceFreezeCommandAnnotation: "/checkpoint.sh",
+				QuiesceThawCommandAnnotation:   "/resume.sh",
+				QuiesceContainerAnnotation:     "sidecar",
+			}),
+			expectedHook: &QuiesceHook{
+				Container: "sidecar",
+				Freeze:    []string{"/checkpoint.sh"},
+				Thaw:      []string{"/resume.sh"},
+			},
+		},
+		{
+			name:        "freeze command without a thaw command",
+			pod:         newPod(map[string]string{QuiesceFreezeCommandAnnotation: "/checkpoint.sh"}),
+			expectError: true,
+		},
+		{
+			name: "invalid JSON command",
+			pod: newPod(map[string]string{
+				QuiesceFreezeCommandAnnotation: `["/checkpoint.sh"`,
+				QuiesceThawCommandAnnotation:   "/resume.sh",
+			}),
+			expectError: true,
+		},
+		{
+			name: "empty command",
+			pod: newPod(map[string]string{
+				QuiesceFreezeCommandAnnotation: "[]",
+				QuiesceThawCommandAnnotation:   "/resume.sh",
+			}),
+			expectError: true,
+		},
+		{
+			name: "unknown container",
+			pod: newPod(map[string]string{
+				QuiesceFreezeCommandAnnotation: "/checkpoint.sh",
+				QuiesceThawCommandAnnotation:   "/resume.sh",
+				QuiesceContainerAnnotation:     "missing",
+			}),
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			hook, err := GetQuiesceHook(tc.pod)
+			if tc.expectError {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expectedHook, hook)
+		})
+	}
+}
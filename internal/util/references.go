@@ -0,0 +1,179 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	snapshotter "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned/typed/volumesnapshot/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+)
+
+// GetReferencingBackups returns the backups recorded as referencing a volumesnapshot or volumesnapshotcontent, as
+// <backup name>/<backup UID> references. Backups recorded before references carried the UID are referenced by their name
+// alone.
+func GetReferencingBackups(o *metav1.ObjectMeta) []string {
+	val := strings.TrimSpace(o.Annotations[ReferencingBackupsAnnotation])
+	if val == "" {
+		return []string{}
+	}
+	return strings.Split(val, ",")
+}
+
+// backupReference returns the reference to the backup recorded on the objects it references.
+func backupReference(backup *velerov1api.Backup) string {
+	return backup.Name + "/" + string(backup.UID)
+}
+
+// IsBackupReference returns whether the reference recorded by GetReferencingBackups is to the backup. References are
+// matched by the UID of the backup, so that a backup recreated with the name of a deleted one is not mistaken for it.
+func IsBackupReference(reference string, backup *velerov1api.Backup) bool {
+	parts := strings.SplitN(reference, "/", 2)
+	if len(parts) == 1 {
+		return parts[0] == backup.Name
+	}
+	return parts[1] == string(backup.UID)
+}
+
+// ContainsBackupReference returns whether one of the references is to the backup.
+func ContainsBackupReference(references []string, backup *velerov1api.Backup) bool {
+	for _, reference := range references {
+		if IsBackupReference(reference, backup) {
+			return true
+		}
+	}
+	return false
+}
+
+// addReferencingBackup records the backup as referencing the object and returns whether it was not recorded yet.
+func addReferencingBackup(o *metav1.ObjectMeta, backup *velerov1api.Backup) bool {
+	backups := GetReferencingBackups(o)
+	if Contains(backups, backupReference(backup)) {
+		return false
+	}
+	// A reference by the name alone is replaced by the reference with the UID.
+	remaining := make([]string, 0, len(backups)+1)
+	for _, b := range backups {
+		if !IsBackupReference(b, backup) {
+			remaining = append(remaining, b)
+		}
+	}
+	remaining = append(remaining, backupReference(backup))
+	sort.Strings(remaining)
+	AddAnnotations(o, map[string]string{ReferencingBackupsAnnotation: strings.Join(remaining, ",")})
+	return true
+}
+
+// removeReferencingBackup removes the backup from the backups referencing the object and returns whether it was recorded.
+func removeReferencingBackup(o *metav1.ObjectMeta, backup *velerov1api.Backup) bool {
+	backups := GetReferencingBackups(o)
+	remaining := make([]string, 0, len(backups))
+	for _, b := range backups {
+		if !IsBackupReference(b, backup) {
+			remaining = append(remaining, b)
+		}
+	}
+	if len(remaining) == len(backups) {
+		return false
+	}
+	if len(remaining) == 0 {
+		delete(o.Annotations, ReferencingBackupsAnnotation)
+	} else {
+		o.Annotations[ReferencingBackupsAnnotation] = strings.Join(remaining, ",")
+	}
+	return true
+}
+
+// AddVolumeSnapshotReference records the backup as referencing the volumesnapshot.
+func AddVolumeSnapshotReference(namespace, name string, backup *velerov1api.Backup, snapshotClient snapshotter.SnapshotV1Interface) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		vs, err := snapshotClient.VolumeSnapshots(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if !addReferencingBackup(&vs.ObjectMeta, backup) {
+			return nil
+		}
+		_, err = snapshotClient.VolumeSnapshots(namespace).Update(context.TODO(), vs, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// RemoveVolumeSnapshotReference removes the backup from the backups referencing the volumesnapshot and returns the remaining ones.
+func RemoveVolumeSnapshotReference(namespace, name string, backup *velerov1api.Backup, snapshotClient snapshotter.SnapshotV1Interface) ([]string, error) {
+	var remaining []string
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		vs, err := snapshotClient.VolumeSnapshots(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if !removeReferencingBackup(&vs.ObjectMeta, backup) {
+			remaining = GetReferencingBackups(&vs.ObjectMeta)
+			return nil
+		}
+		upd, err := snapshotClient.VolumeSnapshots(namespace).Update(context.TODO(), vs, metav1.UpdateOptions{})
+		if err != nil {
+			return err
+		}
+		remaining = GetReferencingBackups(&upd.ObjectMeta)
+		return nil
+	})
+	return remaining, err
+}
+
+// AddVolumeSnapshotContentReference records the backup as referencing the volumesnapshotcontent.
+func AddVolumeSnapshotContentReference(name string, backup *velerov1api.Backup, snapshotClient snapshotter.SnapshotV1Interface) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		vsc, err := snapshotClient.VolumeSnapshotContents().Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if !addReferencingBackup(&vsc.ObjectMeta, backup) {
+			return nil
+		}
+		_, err = snapshotClient.VolumeSnapshotContents().Update(context.TODO(), vsc, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// RemoveVolumeSnapshotContentReference removes the backup from the backups referencing the volumesnapshotcontent and returns
+// the remaining ones.
+func RemoveVolumeSnapshotContentReference(name string, backup *velerov1api.Backup, snapshotClient snapshotter.SnapshotV1Interface) ([]string, error) {
+	var remaining []string
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		vsc, err := snapshotClient.VolumeSnapshotContents().Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if !removeReferencingBackup(&vsc.ObjectMeta, backup) {
+			remaining = GetReferencingBackups(&vsc.ObjectMeta)
+			return nil
+		}
+		upd, err := snapshotClient.VolumeSnapshotContents().Update(context.TODO(), vsc, metav1.UpdateOptions{})
+		if err != nil {
+			return err
+		}
+		remaining = GetReferencingBackups(&upd.ObjectMeta)
+		return nil
+	})
+	return remaining, err
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"testing"
+
+	snapshotv1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	snapshotFake "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+)
+
+func TestGetReferencingBackups(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		expected    []string
+	}{
+		{
+			name:     "no annotations",
+			expected: []string{},
+		},
+		{
+			name:        "empty annotation",
+			annotations: map[string]string{ReferencingBackupsAnnotation: ""},
+			expected:    []string{},
+		},
+		{
+			name:        "several backups",
+			annotations: map[string]string{ReferencingBackupsAnnotation: "backup-1,backup-2"},
+			expected:    []string{"backup-1", "backup-2"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, GetReferencingBackups(&metav1.ObjectMeta{Annotations: tc.annotations}))
+		})
+	}
+}
+
+func TestIsBackupReference(t *testing.T) {
+	backup := &velerov1api.Backup{ObjectMeta: metav1.ObjectMeta{Name: "backup-1", UID: "uid-1"}}
+
+	testCases := []struct {
+		name      string
+		reference string
+		expected  bool
+	}{
+		{
+			name:      "reference to the backup",
+			reference: "backup-1/uid-1",
+			expected:  true,
+		},
+		{
+			name:      "reference to a deleted backup of the same name",
+			reference: "backup-1/uid-0",
+		},
+		{
+			name:      "reference to another backup",
+			reference: "backup-2/uid-2",
+		},
+		{
+			name:      "reference by the name of the backup alone",
+			reference: "backup-1",
+			expected:  true,
+		},
+		{
+			name:      "reference by the name of another backup alone",
+			reference: "backup-2",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, IsBackupReference(tc.reference, backup))
+		})
+	}
+}
+
+func TestVolumeSnapshotReferences(t *testing.T) {
+	vs := &snapshotv1api.VolumeSnapshot{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "vs-1",
+			Namespace: "default",
+			// backup-1 was recorded by its name alone.
+			Annotations: map[string]string{ReferencingBackupsAnnotation: "backup-1"},
+		},
+	}
+	vsc := &snapshotv1api.VolumeSnapshotContent{
+		ObjectMeta: metav1.ObjectMeta{Name: "vsc-1"},
+	}
+	client := snapshotFake.NewSimpleClientset(vs, vsc).SnapshotV1()
+	backup1 := &velerov1api.Backup{ObjectMeta: metav1.ObjectMeta{Name: "backup-1", UID: "uid-1"}}
+	backup2 := &velerov1api.Backup{ObjectMeta: metav1.ObjectMeta{Name: "backup-2", UID: "uid-2"}}
+	recreated2 := &velerov1api.Backup{ObjectMeta: metav1.ObjectMeta{Name: "backup-2", UID: "uid-3"}}
+
+	for _, backup := range []*velerov1api.Backup{backup2, backup1, backup2} {
+		require.Nil(t, AddVolumeSnapshotReference("default", "vs-1", backup, client))
+		require.Nil(t, AddVolumeSnapshotContentReference("vsc-1", backup, client))
+	}
+	upd, err := client.VolumeSnapshots("default").Get(context.TODO(), "vs-1", metav1.GetOptions{})
+	require.Nil(t, err)
+	assert.Equal(t, "backup-1/uid-1,backup-2/uid-2", upd.Annotations[ReferencingBackupsAnnotation])
+
+	remaining, err := RemoveVolumeSnapshotReference("default", "vs-1", backup1, client)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"backup-2/uid-2"}, remaining)
+
+	// A backup recreated with the name of another one does not release its references.
+	remaining, err = RemoveVolumeSnapshotReference("default", "vs-1", recreated2, client)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"backup-2/uid-2"}, remaining)
+
+	remaining, err = RemoveVolumeSnapshotReference("default", "vs-1", backup2, client)
+	require.Nil(t, err)
+	assert.Equal(t, []string{}, remaining)
+	upd, err = client.VolumeSnapshots("default").Get(context.TODO(), "vs-1", metav1.GetOptions{})
+	require.Nil(t, err)
+	assert.NotContains(t, upd.Annotations, ReferencingBackupsAnnotation)
+
+	remaining, err = RemoveVolumeSnapshotContentReference("vsc-1", backup2, client)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"backup-1/uid-1"}, remaining)
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"github.com/pkg/errors"
+
+	snapshotv1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	snapshotv1beta1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1beta1"
+	snapshotterClientSet "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned"
+	snapshotter "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned/typed/volumesnapshot/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+)
+
+// GetSnapshotAPIVersion returns the version of the snapshot.storage.k8s.io API group that the plugin should use.
+// v1 is used whenever the cluster serves it, falling back to v1beta1 otherwise.
+func GetSnapshotAPIVersion(discoveryClient discovery.ServerGroupsInterface) (string, error) {
+	groups, err := discoveryClient.ServerGroups()
+	if err != nil {
+		return "", errors.Wrap(err, "error discovering API groups served by the cluster")
+	}
+
+	for _, group := range groups.Groups {
+		if group.Name != snapshotv1api.GroupName {
+			continue
+		}
+		served := []string{}
+		for _, v := range group.Versions {
+			served = append(served, v.Version)
+		}
+		if Contains(served, snapshotv1api.SchemeGroupVersion.Version) {
+			return snapshotv1api.SchemeGroupVersion.Version, nil
+		}
+		if Contains(served, snapshotv1beta1api.SchemeGroupVersion.Version) {
+			return snapshotv1beta1api.SchemeGroupVersion.Version, nil
+		}
+		return "", errors.Errorf("the cluster serves %s versions %v, none of which is supported by this plugin", snapshotv1api.GroupName, served)
+	}
+
+	return "", errors.Errorf("the cluster does not serve the %s API group, ensure that the CSI snapshot CRDs are installed", snapshotv1api.GroupName)
+}
+
+// NewSnapshotClient returns a client for the snapshot.storage.k8s.io API group that always works with the v1 types.
+// When the cluster only serves v1beta1, objects are converted to and from v1beta1 on every request.
+func NewSnapshotClient(clientset snapshotterClientSet.Interface) (snapshotter.SnapshotV1Interface, error) {
+	version, err := GetSnapshotAPIVersion(clientset.Discovery())
+	if err != nil {
+		return nil, err
+	}
+
+	if version == snapshotv1beta1api.SchemeGroupVersion.Version {
+		return &v1beta1SnapshotClient{client: clientset.SnapshotV1beta1()}, nil
+	}
+	return clientset.SnapshotV1(), nil
+}
+
+// GetSnapshotGroupVersion returns the snapshot.storage.k8s.io group version used by snapshotClient.
+func GetSnapshotGroupVersion(snapshotClient snapshotter.SnapshotV1Interface) schema.GroupVersion {
+	if _, ok := snapshotClient.(*v1beta1SnapshotClient); ok {
+		return snapshotv1beta1api.SchemeGroupVersion
+	}
+	return snapshotv1api.SchemeGroupVersion
+}
+
+// ConvertSnapshotItem returns the supplied snapshot.storage.k8s.io item with its apiVersion set to the one used by snapshotClient.
+// The v1beta1 and v1 schemas of VolumeSnapshot, VolumeSnapshotContent and VolumeSnapshotClass are identical, so this allows
+// backups taken from clusters serving either version to be restored into clusters serving the other.
+func ConvertSnapshotItem(item runtime.Unstructured, snapshotClient snapshotter.SnapshotV1Interface) runtime.Unstructured {
+	gv := GetSnapshotGroupVersion(snapshotClient)
+	obj := &unstructured.Unstructured{Object: item.UnstructuredContent()}
+	if obj.GetAPIVersion() == gv.String() {
+		return item
+	}
+	converted := obj.DeepCopy()
+	converted.SetAPIVersion(gv.String())
+	return converted
+}
+
+// convertSnapshotObject converts between the structurally identical v1beta1 and v1 snapshot types.
+// The type information is cleared on out so that the typed client it is handed to can set its own.
+func convertSnapshotObject(in, out runtime.Object) error {
+	objMap, err := runtime.DefaultUnstructuredConverter.ToUnstructured(in)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(objMap, out); err != nil {
+		return errors.WithStack(err)
+	}
+	out.GetObjectKind().SetGroupVersionKind(schema.GroupVersionKind{})
+	return nil
+}
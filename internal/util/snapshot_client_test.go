@@ -0,0 +1,199 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	snapshotv1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	snapshotv1beta1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1beta1"
+	snapshotFake "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned/fake"
+	snapshotter "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned/typed/volumesnapshot/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+)
+
+func newFakeSnapshotClientset(groupVersions []string, objs ...runtime.Object) *snapshotFake.Clientset {
+	clientset := snapshotFake.NewSimpleClientset(objs...)
+	resources := []*metav1.APIResourceList{}
+	for _, gv := range groupVersions {
+		resources = append(resources, &metav1.APIResourceList{GroupVersion: gv})
+	}
+	clientset.Discovery().(*fakediscovery.FakeDiscovery).Resources = resources
+	return clientset
+}
+
+func TestGetSnapshotAPIVersion(t *testing.T) {
+	testCases := []struct {
+		name          string
+		groupVersions []string
+		expected      string
+		expectError   bool
+	}{
+		{
+			name:          "should use v1 when only v1 is served",
+			groupVersions: []string{"snapshot.storage.k8s.io/v1"},
+			expected:      "v1",
+		},
+		{
+			name:          "should use v1 when both v1 and v1beta1 are served",
+			groupVersions: []string{"snapshot.storage.k8s.io/v1beta1", "snapshot.storage.k8s.io/v1"},
+			expected:      "v1",
+		},
+		{
+			name:          "should use v1beta1 when only v1beta1 is served",
+			groupVersions: []string{"v1", "snapshot.storage.k8s.io/v1beta1"},
+			expected:      "v1beta1",
+		},
+		{
+			name:          "should error when only unsupported versions are served",
+			groupVersions: []string{"snapshot.storage.k8s.io/v1alpha1"},
+			expectError:   true,
+		},
+		{
+			name:          "should error when the snapshot API group is not served",
+			groupVersions: []string{"v1", "apps/v1"},
+			expectError:   true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			clientset := newFakeSnapshotClientset(tc.groupVersions)
+			actual, err := GetSnapshotAPIVersion(clientset.Discovery())
+			if tc.expectError {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func TestNewSnapshotClientV1beta1(t *testing.T) {
+	handle := "snap-handle"
+	vsc := &snapshotv1beta1api.VolumeSnapshotContent{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "vsc-1",
+		},
+		Spec: snapshotv1beta1api.VolumeSnapshotContentSpec{
+			Driver:         "hostpath.csi.k8s.io",
+			DeletionPolicy: snapshotv1beta1api.VolumeSnapshotContentRetain,
+		},
+		Status: &snapshotv1beta1api.VolumeSnapshotContentStatus{
+			SnapshotHandle: &handle,
+		},
+	}
+	clientset := newFakeSnapshotClientset([]string{"snapshot.storage.k8s.io/v1beta1"}, vsc)
+
+	snapshotClient, err := NewSnapshotClient(clientset)
+	require.Nil(t, err)
+	assert.Equal(t, snapshotv1beta1api.SchemeGroupVersion, GetSnapshotGroupVersion(snapshotClient))
+
+	actual, err := snapshotClient.VolumeSnapshotContents().Get(context.TODO(), "vsc-1", metav1.GetOptions{})
+	require.Nil(t, err)
+	assert.Equal(t, "hostpath.csi.k8s.io", actual.Spec.Driver)
+	assert.Equal(t, snapshotv1api.VolumeSnapshotContentRetain, actual.Spec.DeletionPolicy)
+	assert.Equal(t, handle, *actual.Status.SnapshotHandle)
+
+	pvcName := "pvc-1"
+	_, err = snapshotClient.VolumeSnapshots("default").Create(context.TODO(), &snapshotv1api.VolumeSnapshot{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "vs-1",
+			Namespace: "default",
+		},
+		Spec: snapshotv1api.VolumeSnapshotSpec{
+			Source: snapshotv1api.VolumeSnapshotSource{
+				PersistentVolumeClaimName: &pvcName,
+			},
+		},
+	}, metav1.CreateOptions{})
+	require.Nil(t, err)
+
+	created, err := clientset.SnapshotV1beta1().VolumeSnapshots("default").Get(context.TODO(), "vs-1", metav1.GetOptions{})
+	require.Nil(t, err)
+	assert.Equal(t, pvcName, *created.Spec.Source.PersistentVolumeClaimName)
+
+	list, err := snapshotClient.VolumeSnapshots("default").List(context.TODO(), metav1.ListOptions{})
+	require.Nil(t, err)
+	assert.Len(t, list.Items, 1)
+}
+
+func TestNewSnapshotClientV1(t *testing.T) {
+	clientset := newFakeSnapshotClientset([]string{"snapshot.storage.k8s.io/v1beta1", "snapshot.storage.k8s.io/v1"})
+
+	snapshotClient, err := NewSnapshotClient(clientset)
+	require.Nil(t, err)
+	assert.Equal(t, snapshotv1api.SchemeGroupVersion, GetSnapshotGroupVersion(snapshotClient))
+}
+
+func TestConvertSnapshotItem(t *testing.T) {
+	v1Client := newFakeSnapshotClientset(nil).SnapshotV1()
+	v1beta1Client := &v1beta1SnapshotClient{client: newFakeSnapshotClientset(nil).SnapshotV1beta1()}
+
+	testCases := []struct {
+		name       string
+		apiVersion string
+		client     snapshotter.SnapshotV1Interface
+		expected   string
+	}{
+		{
+			name:       "v1beta1 item restored into a v1 cluster is converted to v1",
+			apiVersion: "snapshot.storage.k8s.io/v1beta1",
+			client:     v1Client,
+			expected:   "snapshot.storage.k8s.io/v1",
+		},
+		{
+			name:       "v1 item restored into a v1 cluster is unchanged",
+			apiVersion: "snapshot.storage.k8s.io/v1",
+			client:     v1Client,
+			expected:   "snapshot.storage.k8s.io/v1",
+		},
+		{
+			name:       "v1 item restored into a v1beta1 cluster is converted to v1beta1",
+			apiVersion: "snapshot.storage.k8s.io/v1",
+			client:     v1beta1Client,
+			expected:   "snapshot.storage.k8s.io/v1beta1",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			item := &unstructured.Unstructured{
+				Object: map[string]interface{}{
+					"apiVersion": tc.apiVersion,
+					"kind":       "VolumeSnapshot",
+					"metadata": map[string]interface{}{
+						"name":      "vs-1",
+						"namespace": "default",
+					},
+				},
+			}
+
+			actual := ConvertSnapshotItem(item, tc.client)
+			assert.Equal(t, tc.expected, actual.UnstructuredContent()["apiVersion"])
+			assert.Equal(t, "VolumeSnapshot", actual.UnstructuredContent()["kind"])
+		})
+	}
+}
@@ -0,0 +1,42 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	corev1api "k8s.io/api/core/v1"
+)
+
+// GetVolumeTopology returns the node selector terms of the node affinity of the PV, which hold the topology keys of its CSI
+// driver, such as its zone. Requirements on individual nodes are left out, as the nodes do not outlive the cluster.
+func GetVolumeTopology(pv *corev1api.PersistentVolume) []corev1api.NodeSelectorTerm {
+	if pv.Spec.NodeAffinity == nil || pv.Spec.NodeAffinity.Required == nil {
+		return nil
+	}
+	var terms []corev1api.NodeSelectorTerm
+	for _, term := range pv.Spec.NodeAffinity.Required.NodeSelectorTerms {
+		var requirements []corev1api.NodeSelectorRequirement
+		for _, requirement := range term.MatchExpressions {
+			if requirement.Key != corev1api.LabelHostname {
+				requirements = append(requirements, requirement)
+			}
+		}
+		if len(requirements) > 0 {
+			terms = append(terms, corev1api.NodeSelectorTerm{MatchExpressions: requirements})
+		}
+	}
+	return terms
+}
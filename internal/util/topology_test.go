@@ -0,0 +1,75 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	corev1api "k8s.io/api/core/v1"
+)
+
+func TestGetVolumeTopology(t *testing.T) {
+	zone := corev1api.NodeSelectorRequirement{
+		Key:      "topology.ebs.csi.aws.com/zone",
+		Operator: corev1api.NodeSelectorOpIn,
+		Values:   []string{"us-east-1a"},
+	}
+	hostname := corev1api.NodeSelectorRequirement{
+		Key:      corev1api.LabelHostname,
+		Operator: corev1api.NodeSelectorOpIn,
+		Values:   []string{"node-1"},
+	}
+	testCases := []struct {
+		name         string
+		nodeAffinity *corev1api.VolumeNodeAffinity
+		expected     []corev1api.NodeSelectorTerm
+	}{
+		{
+			name: "no node affinity",
+		},
+		{
+			name:         "no required node affinity",
+			nodeAffinity: &corev1api.VolumeNodeAffinity{},
+		},
+		{
+			name: "zone",
+			nodeAffinity: &corev1api.VolumeNodeAffinity{Required: &corev1api.NodeSelector{
+				NodeSelectorTerms: []corev1api.NodeSelectorTerm{{MatchExpressions: []corev1api.NodeSelectorRequirement{zone}}},
+			}},
+			expected: []corev1api.NodeSelectorTerm{{MatchExpressions: []corev1api.NodeSelectorRequirement{zone}}},
+		},
+		{
+			name: "requirements on nodes are left out",
+			nodeAffinity: &corev1api.VolumeNodeAffinity{Required: &corev1api.NodeSelector{
+				NodeSelectorTerms: []corev1api.NodeSelectorTerm{
+					{MatchExpressions: []corev1api.NodeSelectorRequirement{zone, hostname}},
+					{MatchExpressions: []corev1api.NodeSelectorRequirement{hostname}},
+				},
+			}},
+			expected: []corev1api.NodeSelectorTerm{{MatchExpressions: []corev1api.NodeSelectorRequirement{zone}}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pv := &corev1api.PersistentVolume{Spec: corev1api.PersistentVolumeSpec{NodeAffinity: tc.nodeAffinity}}
+			assert.Equal(t, tc.expected, GetVolumeTopology(pv))
+		})
+	}
+}
@@ -19,22 +19,37 @@ package util
 import (
 	"context"
 	"fmt"
+	"io"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 
-	snapshotv1beta1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1beta1"
+	snapshotv1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
 	snapshotterClientSet "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned"
-	snapshotter "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned/typed/volumesnapshot/v1beta1"
+	snapshotter "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned/typed/volumesnapshot/v1"
 	corev1api "k8s.io/api/core/v1"
+	storagev1api "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
 	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/remotecommand"
+	watchtools "k8s.io/client-go/tools/watch"
 
 	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
 	"github.com/vmware-tanzu/velero/pkg/label"
@@ -120,8 +135,44 @@ func IsPVCBackedUpByRestic(pvcNamespace, pvcName string, podClient corev1client.
 	return false, nil
 }
 
-// GetVolumeSnapshotClassForStorageClass returns a VolumeSnapshotClass for the supplied volume provisioner/ driver name.
-func GetVolumeSnapshotClassForStorageClass(provisioner string, snapshotClient snapshotter.SnapshotV1beta1Interface) (*snapshotv1beta1api.VolumeSnapshotClass, error) {
+// GetVolumeSnapshotClass returns the VolumeSnapshotClass to use for snapshotting a PVC provisioned from the supplied storage class.
+// The volumesnapshotclass is selected, in order of precedence, from the VolumeSnapshotClassAnnotation on the PVC, the same annotation
+// on the storage class, the per-driver annotation on the backup, the per-driver volumesnapshotclasses from the plugin configuration,
+// and finally the volumesnapshotclass for the driver that carries the VolumeSnapshotClassSelectorLabel.
+func GetVolumeSnapshotClass(storageClass *storagev1api.StorageClass, pvc *corev1api.PersistentVolumeClaim, backup *velerov1api.Backup,
+	configuredClasses map[string]string, snapshotClient snapshotter.SnapshotV1Interface, log logrus.FieldLogger) (*snapshotv1api.VolumeSnapshotClass, error) {
+	candidates := []struct {
+		source string
+		name   string
+	}{
+		{source: fmt.Sprintf("annotation on PVC %s/%s", pvc.Namespace, pvc.Name), name: pvc.Annotations[VolumeSnapshotClassAnnotation]},
+		{source: fmt.Sprintf("annotation on storageclass %s", storageClass.Name), name: storageClass.Annotations[VolumeSnapshotClassAnnotation]},
+		{source: fmt.Sprintf("annotation on backup %s/%s", backup.Namespace, backup.Name), name: backup.Annotations[VolumeSnapshotClassBackupAnnotationPrefix+storageClass.Provisioner]},
+		{source: "plugin configuration", name: configuredClasses[storageClass.Provisioner]},
+	}
+
+	for _, c := range candidates {
+		if c.name == "" {
+			continue
+		}
+		log.Infof("Using volumesnapshotclass %s requested by the %s", c.name, c.source)
+		snapshotClass, err := snapshotClient.VolumeSnapshotClasses().Get(context.TODO(), c.name, metav1.GetOptions{})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get volumesnapshotclass %s requested by the %s", c.name, c.source)
+		}
+		if snapshotClass.Driver != storageClass.Provisioner {
+			return nil, errors.Errorf("volumesnapshotclass %s requested by the %s is for driver %s, not %s",
+				c.name, c.source, snapshotClass.Driver, storageClass.Provisioner)
+		}
+		return snapshotClass, nil
+	}
+
+	return GetVolumeSnapshotClassForStorageClass(storageClass.Provisioner, snapshotClient)
+}
+
+// GetVolumeSnapshotClassForStorageClass returns the VolumeSnapshotClass for the supplied volume provisioner/ driver name
+// that carries the VolumeSnapshotClassSelectorLabel. It is an error for more than one volumesnapshotclass of the driver to carry the label.
+func GetVolumeSnapshotClassForStorageClass(provisioner string, snapshotClient snapshotter.SnapshotV1Interface) (*snapshotv1api.VolumeSnapshotClass, error) {
 	snapshotClasses, err := snapshotClient.VolumeSnapshotClasses().List(context.TODO(), metav1.ListOptions{})
 	if err != nil {
 		return nil, errors.Wrap(err, "error listing volumesnapshot classes")
@@ -129,18 +180,56 @@ func GetVolumeSnapshotClassForStorageClass(provisioner string, snapshotClient sn
 	// We pick the volumesnapshotclass that matches the CSI driver name and has a 'velero.io/csi-volumesnapshot-class'
 	// label. This allows multiple VolumesnapshotClasses for the same driver with different values for the
 	// other fields in the spec.
-	// https://pkg.go.dev/github.com/kubernetes-csi/external-snapshotter/v2@v2.0.1/pkg/apis/volumesnapshot/v1beta1?tab=doc#VolumeSnapshotClass
+	// https://pkg.go.dev/github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1#VolumeSnapshotClass
+	matches := []snapshotv1api.VolumeSnapshotClass{}
 	for _, sc := range snapshotClasses.Items {
 		_, hasLabelSelector := sc.Labels[VolumeSnapshotClassSelectorLabel]
 		if sc.Driver == provisioner && hasLabelSelector {
-			return &sc, nil
+			matches = append(matches, sc)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, errors.Errorf("failed to get volumesnapshotclass for provisioner %s, ensure that the desired volumesnapshot class has the %s label", provisioner, VolumeSnapshotClassSelectorLabel)
+	case 1:
+		return &matches[0], nil
+	default:
+		names := []string{}
+		for _, sc := range matches {
+			names = append(names, sc.Name)
 		}
+		sort.Strings(names)
+		return nil, errors.Errorf("found multiple volumesnapshotclasses %v for provisioner %s with the %s label, ensure that only one of them has the label or select one with the %s annotation",
+			names, provisioner, VolumeSnapshotClassSelectorLabel, VolumeSnapshotClassAnnotation)
+	}
+}
+
+// GetStorageClassMapping returns the storage class mapping configured for Velero's change-storage-class restore item action
+// in the Velero namespace, or nil if there is none.
+func GetStorageClassMapping(client corev1client.ConfigMapsGetter, namespace string) (map[string]string, error) {
+	opts := metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("velero.io/plugin-config,%s=RestoreItemAction", ChangeStorageClassLabel),
+	}
+	list, err := client.ConfigMaps(namespace).List(context.TODO(), opts)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing change-storage-class configmaps in namespace %s", namespace)
+	}
+	switch len(list.Items) {
+	case 0:
+		return nil, nil
+	case 1:
+		return list.Items[0].Data, nil
+	default:
+		return nil, errors.Errorf("found more than one change-storage-class configmap with labels %s in namespace %s", opts.LabelSelector, namespace)
 	}
-	return nil, errors.Errorf("failed to get volumesnapshotclass for provisioner %s, ensure that the desired volumesnapshot class has the %s label", provisioner, VolumeSnapshotClassSelectorLabel)
 }
 
-// GetVolumeSnapshotContentForVolumeSnapshot returns the volumesnapshotcontent object associated with the volumesnapshot
-func GetVolumeSnapshotContentForVolumeSnapshot(volSnap *snapshotv1beta1api.VolumeSnapshot, snapshotClient snapshotter.SnapshotV1beta1Interface, log logrus.FieldLogger, shouldWait bool) (*snapshotv1beta1api.VolumeSnapshotContent, error) {
+// GetVolumeSnapshotContentForVolumeSnapshot returns the volumesnapshotcontent object associated with the volumesnapshot.
+// When shouldWait is set, it watches for up to timeout for the volumesnapshot to be bound to a volumesnapshotcontent
+// and for the volumesnapshotcontent to have a snapshot handle.
+func GetVolumeSnapshotContentForVolumeSnapshot(volSnap *snapshotv1api.VolumeSnapshot, snapshotClient snapshotter.SnapshotV1Interface, log logrus.FieldLogger, shouldWait bool,
+	timeout time.Duration) (*snapshotv1api.VolumeSnapshotContent, error) {
 	if !shouldWait {
 		if volSnap.Status == nil || volSnap.Status.BoundVolumeSnapshotContentName == nil {
 			// volumesnapshot hasn't been reconciled and we're not waiting for it.
@@ -153,56 +242,229 @@ func GetVolumeSnapshotContentForVolumeSnapshot(volSnap *snapshotv1beta1api.Volum
 		return vsc, nil
 	}
 
-	// We'll wait 10m for the VSC to be reconciled polling every 5s
-	// TODO: make this timeout configurable.
-	timeout := 10 * time.Minute
-	interval := 5 * time.Second
-	var snapshotContent *snapshotv1beta1api.VolumeSnapshotContent
-
-	err := wait.PollImmediate(interval, timeout, func() (bool, error) {
-		vs, err := snapshotClient.VolumeSnapshots(volSnap.Namespace).Get(context.TODO(), volSnap.Name, metav1.GetOptions{})
-		if err != nil {
-			return false, errors.Wrapf(err, fmt.Sprintf("failed to get volumesnapshot %s/%s", volSnap.Namespace, volSnap.Name))
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	vsLW := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", volSnap.Name).String()
+			return snapshotClient.VolumeSnapshots(volSnap.Namespace).List(ctx, options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", volSnap.Name).String()
+			return snapshotClient.VolumeSnapshots(volSnap.Namespace).Watch(ctx, options)
+		},
+	}
+	obj, err := WaitForObject(ctx, vsLW, &snapshotv1api.VolumeSnapshot{}, volSnap.Namespace, volSnap.Name, func(obj runtime.Object) (bool, error) {
+		vs := obj.(*snapshotv1api.VolumeSnapshot)
+		if vs.Status != nil && vs.Status.Error != nil {
+			return false, newSnapshotError(fmt.Sprintf("volumesnapshot %s/%s", vs.Namespace, vs.Name), vs.Status.Error)
 		}
-
 		if vs.Status == nil || vs.Status.BoundVolumeSnapshotContentName == nil {
-			log.Infof("Waiting for CSI driver to reconcile volumesnapshot %s/%s. Retrying in %ds", volSnap.Namespace, volSnap.Name, interval/time.Second)
+			log.Infof("Waiting for CSI driver to reconcile volumesnapshot %s/%s", vs.Namespace, vs.Name)
 			return false, nil
 		}
-
-		snapshotContent, err = snapshotClient.VolumeSnapshotContents().Get(context.TODO(), *vs.Status.BoundVolumeSnapshotContentName, metav1.GetOptions{})
-		if err != nil {
-			return false, errors.Wrapf(err, fmt.Sprintf("failed to get volumesnapshotcontent %s for volumesnapshot %s/%s", *vs.Status.BoundVolumeSnapshotContentName, vs.Namespace, vs.Name))
+		return true, nil
+	})
+	if err != nil {
+		if err == wait.ErrWaitTimeout {
+			log.Errorf("Timed out awaiting reconciliation of volumesnapshot %s/%s", volSnap.Namespace, volSnap.Name)
+			return nil, err
 		}
-
+		return nil, errors.Wrapf(err, "error waiting for volumesnapshot %s/%s", volSnap.Namespace, volSnap.Name)
+	}
+	vscName := *obj.(*snapshotv1api.VolumeSnapshot).Status.BoundVolumeSnapshotContentName
+
+	vscLW := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", vscName).String()
+			return snapshotClient.VolumeSnapshotContents().List(ctx, options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", vscName).String()
+			return snapshotClient.VolumeSnapshotContents().Watch(ctx, options)
+		},
+	}
+	obj, err = WaitForObject(ctx, vscLW, &snapshotv1api.VolumeSnapshotContent{}, "", vscName, func(obj runtime.Object) (bool, error) {
 		// we need to wait for the VolumeSnaphotContent to have a snapshot handle because during restore,
 		// we'll use that snapshot handle as the source for the VolumeSnapshotContent so it's statically
 		// bound to the existing snapshot.
-		if snapshotContent.Status == nil || snapshotContent.Status.SnapshotHandle == nil {
-			log.Infof("Waiting for volumesnapshotcontents %s to have snapshot handle. Retrying in %ds", snapshotContent.Name, interval/time.Second)
+		vsc := obj.(*snapshotv1api.VolumeSnapshotContent)
+		if vsc.Status != nil && vsc.Status.Error != nil {
+			return false, newSnapshotError(fmt.Sprintf("volumesnapshotcontent %s", vsc.Name), vsc.Status.Error)
+		}
+		if vsc.Status == nil || vsc.Status.SnapshotHandle == nil {
+			log.Infof("Waiting for volumesnapshotcontents %s to have snapshot handle", vsc.Name)
 			return false, nil
 		}
-
 		return true, nil
 	})
-
 	if err != nil {
 		if err == wait.ErrWaitTimeout {
 			log.Errorf("Timed out awaiting reconciliation of volumesnapshot %s/%s", volSnap.Namespace, volSnap.Name)
+			return nil, err
 		}
-		return nil, err
+		return nil, errors.Wrapf(err, "error waiting for volumesnapshotcontent %s of volumesnapshot %s/%s", vscName, volSnap.Namespace, volSnap.Name)
+	}
+
+	return obj.(*snapshotv1api.VolumeSnapshotContent), nil
+}
+
+// WaitForVolumeSnapshotContentReadyToUse watches for up to timeout for the named volumesnapshotcontent to be ready to use
+// and returns it once it is.
+func WaitForVolumeSnapshotContentReadyToUse(vscName string, snapshotClient snapshotter.SnapshotV1Interface, log logrus.FieldLogger,
+	timeout time.Duration) (*snapshotv1api.VolumeSnapshotContent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	vscLW := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", vscName).String()
+			return snapshotClient.VolumeSnapshotContents().List(ctx, options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", vscName).String()
+			return snapshotClient.VolumeSnapshotContents().Watch(ctx, options)
+		},
+	}
+	obj, err := WaitForObject(ctx, vscLW, &snapshotv1api.VolumeSnapshotContent{}, "", vscName, func(obj runtime.Object) (bool, error) {
+		vsc := obj.(*snapshotv1api.VolumeSnapshotContent)
+		if vsc.Status != nil && vsc.Status.Error != nil {
+			return false, newSnapshotError(fmt.Sprintf("volumesnapshotcontent %s", vsc.Name), vsc.Status.Error)
+		}
+		if vsc.Status == nil || vsc.Status.ReadyToUse == nil || !*vsc.Status.ReadyToUse {
+			log.Infof("Waiting for volumesnapshotcontents %s to be ready to use", vsc.Name)
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil {
+		if err == wait.ErrWaitTimeout {
+			log.Errorf("Timed out waiting for volumesnapshotcontent %s to be ready to use", vscName)
+			return nil, err
+		}
+		return nil, errors.Wrapf(err, "error waiting for volumesnapshotcontent %s to be ready to use", vscName)
+	}
+
+	return obj.(*snapshotv1api.VolumeSnapshotContent), nil
+}
+
+// SnapshotError is returned when the CSI driver reports in the status of a volumesnapshot or volumesnapshotcontent
+// that it failed to take the snapshot.
+type SnapshotError struct {
+	// Object identifies the volumesnapshot or volumesnapshotcontent carrying the error.
+	Object string
+	// Message is the error message reported by the CSI driver.
+	Message string
+	// Time is when the CSI driver encountered the error, if it reported one.
+	Time *metav1.Time
+}
+
+func newSnapshotError(object string, snapErr *snapshotv1api.VolumeSnapshotError) *SnapshotError {
+	e := &SnapshotError{Object: object, Time: snapErr.Time}
+	if snapErr.Message != nil {
+		e.Message = *snapErr.Message
+	}
+	return e
+}
+
+func (e *SnapshotError) Error() string {
+	if e.Time == nil {
+		return fmt.Sprintf("CSI driver reported an error for %s: %s", e.Object, e.Message)
 	}
+	return fmt.Sprintf("CSI driver reported an error for %s at %s: %s", e.Object, e.Time.UTC().Format(time.RFC3339), e.Message)
+}
 
-	return snapshotContent, nil
+// IsSnapshotError returns true if the cause of err is a SnapshotError.
+func IsSnapshotError(err error) bool {
+	_, ok := errors.Cause(err).(*SnapshotError)
+	return ok
 }
 
-func GetClients() (*kubernetes.Clientset, *snapshotterClientSet.Clientset, error) {
+// WaitForObject watches the named object until condition reports true for it and returns the object.
+// Rather than polling the API server, the object is listed once and then watched, so condition is evaluated
+// as soon as the object changes. An error is returned right away if the object does not exist or is deleted,
+// and wait.ErrWaitTimeout is returned if ctx expires first.
+func WaitForObject(ctx context.Context, lw cache.ListerWatcher, objType runtime.Object, namespace, name string,
+	condition func(runtime.Object) (bool, error)) (runtime.Object, error) {
+	key := name
+	if namespace != "" {
+		key = namespace + "/" + name
+	}
+
+	var result runtime.Object
+	check := func(obj runtime.Object) (bool, error) {
+		done, err := condition(obj)
+		if done && err == nil {
+			result = obj
+		}
+		return done, err
+	}
+
+	precondition := func(store cache.Store) (bool, error) {
+		obj, exists, err := store.GetByKey(key)
+		if err != nil {
+			return false, errors.WithStack(err)
+		}
+		if !exists {
+			return false, errors.Errorf("%s not found", key)
+		}
+		return check(obj.(runtime.Object))
+	}
+
+	_, err := watchtools.UntilWithSync(ctx, lw, objType, precondition, func(event watch.Event) (bool, error) {
+		accessor, err := meta.Accessor(event.Object)
+		if err != nil || accessor.GetNamespace() != namespace || accessor.GetName() != name {
+			return false, nil
+		}
+		switch event.Type {
+		case watch.Deleted:
+			return false, errors.Errorf("%s was deleted", key)
+		case watch.Added, watch.Modified:
+			return check(event.Object)
+		}
+		return false, nil
+	})
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, wait.ErrWaitTimeout
+		}
+		return nil, err
+	}
+	return result, nil
+}
+
+// GetClientConfig returns the configuration for clients of the cluster the plugin runs in.
+func GetClientConfig() (*rest.Config, error) {
 	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
 	configOverrides := &clientcmd.ConfigOverrides{}
 	kubeConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, configOverrides)
 	clientConfig, err := kubeConfig.ClientConfig()
 	if err != nil {
-		return nil, nil, errors.WithStack(err)
+		return nil, errors.WithStack(err)
+	}
+	return clientConfig, nil
+}
+
+// GetKubeClient returns a kubernetes client.
+func GetKubeClient() (*kubernetes.Clientset, error) {
+	clientConfig, err := GetClientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := kubernetes.NewForConfig(clientConfig)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return client, nil
+}
+
+// GetClients returns a kubernetes client and a client for the newest snapshot.storage.k8s.io API version served by the cluster.
+func GetClients() (*kubernetes.Clientset, snapshotter.SnapshotV1Interface, error) {
+	clientConfig, err := GetClientConfig()
+	if err != nil {
+		return nil, nil, err
 	}
 
 	client, err := kubernetes.NewForConfig(clientConfig)
@@ -215,11 +477,134 @@ func GetClients() (*kubernetes.Clientset, *snapshotterClientSet.Clientset, error
 		return nil, nil, errors.WithStack(err)
 	}
 
-	return client, snapshotterClient, nil
+	snapshotClient, err := NewSnapshotClient(snapshotterClient)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return client, snapshotClient, nil
+}
+
+// GetDynamicClient returns a dynamic client, for the APIs that the plugin has no typed client for.
+func GetDynamicClient() (dynamic.Interface, error) {
+	clientConfig, err := GetClientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := dynamic.NewForConfig(clientConfig)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return client, nil
+}
+
+// GetBackup returns the Velero backup with the supplied name.
+func GetBackup(client dynamic.Interface, namespace, name string) (*velerov1api.Backup, error) {
+	obj, err := client.Resource(velerov1api.SchemeGroupVersion.WithResource("backups")).Namespace(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	backup := &velerov1api.Backup{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.UnstructuredContent(), backup); err != nil {
+		return nil, errors.Wrapf(err, "error converting backup %s/%s", namespace, name)
+	}
+	return backup, nil
+}
+
+// ListBackups returns the Velero backups in the namespace.
+func ListBackups(client dynamic.Interface, namespace string) ([]velerov1api.Backup, error) {
+	list, err := client.Resource(velerov1api.SchemeGroupVersion.WithResource("backups")).Namespace(namespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	backups := make([]velerov1api.Backup, 0, len(list.Items))
+	for _, item := range list.Items {
+		backup := velerov1api.Backup{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.UnstructuredContent(), &backup); err != nil {
+			return nil, errors.Wrapf(err, "error converting backup %s/%s", item.GetNamespace(), item.GetName())
+		}
+		backups = append(backups, backup)
+	}
+	return backups, nil
+}
+
+// ListRestores returns the Velero restores in the namespace.
+func ListRestores(client dynamic.Interface, namespace string) ([]velerov1api.Restore, error) {
+	list, err := client.Resource(velerov1api.SchemeGroupVersion.WithResource("restores")).Namespace(namespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	restores := make([]velerov1api.Restore, 0, len(list.Items))
+	for _, item := range list.Items {
+		restore := velerov1api.Restore{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.UnstructuredContent(), &restore); err != nil {
+			return nil, errors.Wrapf(err, "error converting restore %s/%s", item.GetNamespace(), item.GetName())
+		}
+		restores = append(restores, restore)
+	}
+	return restores, nil
+}
+
+// GetBackupStorageLocation returns the Velero backup storage location with the supplied name.
+func GetBackupStorageLocation(client dynamic.Interface, namespace, name string) (*velerov1api.BackupStorageLocation, error) {
+	obj, err := client.Resource(velerov1api.SchemeGroupVersion.WithResource("backupstoragelocations")).Namespace(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	location := &velerov1api.BackupStorageLocation{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.UnstructuredContent(), location); err != nil {
+		return nil, errors.Wrapf(err, "error converting backup storage location %s/%s", namespace, name)
+	}
+	return location, nil
+}
+
+// ListBackupStorageLocations returns the Velero backup storage locations in the namespace.
+func ListBackupStorageLocations(client dynamic.Interface, namespace string) ([]velerov1api.BackupStorageLocation, error) {
+	list, err := client.Resource(velerov1api.SchemeGroupVersion.WithResource("backupstoragelocations")).Namespace(namespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	locations := make([]velerov1api.BackupStorageLocation, 0, len(list.Items))
+	for _, item := range list.Items {
+		location := velerov1api.BackupStorageLocation{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.UnstructuredContent(), &location); err != nil {
+			return nil, errors.Wrapf(err, "error converting backup storage location %s/%s", item.GetNamespace(), item.GetName())
+		}
+		locations = append(locations, location)
+	}
+	return locations, nil
+}
+
+// ExecInPod runs command in a container of the pod, streaming stdin to it and its output to stdout and stderr.
+// Any of stdin, stdout and stderr may be nil.
+func ExecInPod(client kubernetes.Interface, restConfig *rest.Config, pod *corev1api.Pod, container string, command []string,
+	stdin io.Reader, stdout, stderr io.Writer) error {
+	req := client.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(pod.Namespace).
+		Name(pod.Name).
+		SubResource("exec").
+		VersionedParams(&corev1api.PodExecOptions{
+			Container: container,
+			Command:   command,
+			Stdin:     stdin != nil,
+			Stdout:    stdout != nil,
+			Stderr:    stderr != nil,
+		}, scheme.ParameterCodec)
+
+	executor, err := remotecommand.NewSPDYExecutor(restConfig, "POST", req.URL())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := executor.Stream(remotecommand.StreamOptions{Stdin: stdin, Stdout: stdout, Stderr: stderr}); err != nil {
+		return errors.Wrapf(err, "error running %v in container %s of pod %s/%s", command, container, pod.Namespace, pod.Name)
+	}
+	return nil
 }
 
 // IsVolumeSnapshotClassHasListerSecret returns whether a volumesnapshotclass has a snapshotlister secret
-func IsVolumeSnapshotClassHasListerSecret(vc *snapshotv1beta1api.VolumeSnapshotClass) bool {
+func IsVolumeSnapshotClassHasListerSecret(vc *snapshotv1api.VolumeSnapshotClass) bool {
 	// https://github.com/kubernetes-csi/external-snapshotter/blob/master/pkg/utils/util.go#L59-L60
 	// There is no release w/ these constants exported. Using the strings for now.
 	_, nameExists := vc.Annotations[PrefixedSnapshotterListSecretNameKey]
@@ -228,17 +613,15 @@ func IsVolumeSnapshotClassHasListerSecret(vc *snapshotv1beta1api.VolumeSnapshotC
 }
 
 // IsVolumeSnapshotContentHasDeleteSecret returns whether a volumesnapshotcontent has a deletesnapshot secret
-func IsVolumeSnapshotContentHasDeleteSecret(vsc *snapshotv1beta1api.VolumeSnapshotContent) bool {
-	// https://github.com/kubernetes-csi/external-snapshotter/blob/master/pkg/utils/util.go#L56-L57
-	// use exported constants in the next release
-	_, nameExists := vsc.Annotations[PrefixedSnapshotterSecretNameKey]
-	_, nsExists := vsc.Annotations[PrefixedSnapshotterSecretNamespaceKey]
+func IsVolumeSnapshotContentHasDeleteSecret(vsc *snapshotv1api.VolumeSnapshotContent) bool {
+	_, nameExists := vsc.Annotations[DeletionSecretNameAnnotation]
+	_, nsExists := vsc.Annotations[DeletionSecretNamespaceAnnotation]
 	return nameExists && nsExists
 }
 
 // IsVolumeSnapshotHasVSCDeleteSecret returns whether a volumesnapshot should set the deletesnapshot secret
 // for the static volumesnapshotcontent that is created on restore
-func IsVolumeSnapshotHasVSCDeleteSecret(vs *snapshotv1beta1api.VolumeSnapshot) bool {
+func IsVolumeSnapshotHasVSCDeleteSecret(vs *snapshotv1api.VolumeSnapshot) bool {
 	_, nameExists := vs.Annotations[CSIDeleteSnapshotSecretName]
 	_, nsExists := vs.Annotations[CSIDeleteSnapshotSecretNamespace]
 	return nameExists && nsExists
@@ -265,7 +648,7 @@ func AddLabels(o *metav1.ObjectMeta, vals map[string]string) {
 }
 
 // IsVolumeSnapshotExists returns whether a specific volumesnapshot object exists.
-func IsVolumeSnapshotExists(volSnap *snapshotv1beta1api.VolumeSnapshot, snapshotClient snapshotter.SnapshotV1beta1Interface) bool {
+func IsVolumeSnapshotExists(volSnap *snapshotv1api.VolumeSnapshot, snapshotClient snapshotter.SnapshotV1Interface) bool {
 	exists := false
 	if volSnap != nil {
 		vs, err := snapshotClient.VolumeSnapshots(volSnap.Namespace).Get(context.TODO(), volSnap.Name, metav1.GetOptions{})
@@ -277,16 +660,153 @@ func IsVolumeSnapshotExists(volSnap *snapshotv1beta1api.VolumeSnapshot, snapshot
 	return exists
 }
 
-func SetVolumeSnapshotContentDeletionPolicy(vscName string, csiClient snapshotter.SnapshotV1beta1Interface) error {
+// GetVolumeSnapshotForPVC returns the volumesnapshot created earlier for the PVC during the backup, or nil if there is none.
+// It allows the PVC to be backed up again without snapshotting it twice.
+func GetVolumeSnapshotForPVC(pvc *corev1api.PersistentVolumeClaim, backup *velerov1api.Backup, snapshotClient snapshotter.SnapshotV1Interface) (*snapshotv1api.VolumeSnapshot, error) {
+	selector := labels.SelectorFromSet(labels.Set{
+		velerov1api.BackupNameLabel: label.GetValidName(backup.Name),
+		SourcePVCUIDLabel:           string(pvc.UID),
+	}).String()
+	vsList, err := snapshotClient.VolumeSnapshots(pvc.Namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing volumesnapshots of PVC %s/%s", pvc.Namespace, pvc.Name)
+	}
+	for i := range vsList.Items {
+		vs := &vsList.Items[i]
+		if vs.DeletionTimestamp == nil && IsCreatedForBackup(&vs.ObjectMeta, backup) &&
+			vs.Spec.Source.PersistentVolumeClaimName != nil && *vs.Spec.Source.PersistentVolumeClaimName == pvc.Name {
+			return vs, nil
+		}
+	}
+	return nil, nil
+}
+
+// GetAdoptableVolumeSnapshot returns the most recent volumesnapshot of the PVC matching the label selector that was taken
+// outside of Velero, is ready to use and is no older than maxAge, or nil if there is none.
+func GetAdoptableVolumeSnapshot(pvc *corev1api.PersistentVolumeClaim, selector string, maxAge time.Duration,
+	snapshotClient snapshotter.SnapshotV1Interface) (*snapshotv1api.VolumeSnapshot, error) {
+	if _, err := labels.Parse(selector); err != nil {
+		return nil, errors.Wrapf(err, "invalid %s annotation %q", AdoptVolumeSnapshotSelectorAnnotation, selector)
+	}
+	vsList, err := snapshotClient.VolumeSnapshots(pvc.Namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing volumesnapshots of PVC %s/%s", pvc.Namespace, pvc.Name)
+	}
+
+	var adoptable *snapshotv1api.VolumeSnapshot
+	var adoptableTime time.Time
+	for i := range vsList.Items {
+		vs := &vsList.Items[i]
+		if vs.DeletionTimestamp != nil || IsCreatedForAnyBackup(&vs.ObjectMeta) ||
+			vs.Spec.Source.PersistentVolumeClaimName == nil || *vs.Spec.Source.PersistentVolumeClaimName != pvc.Name ||
+			vs.Status == nil || vs.Status.ReadyToUse == nil || !*vs.Status.ReadyToUse {
+			continue
+		}
+		// The time the snapshot was cut, when the CSI driver reports it, is more accurate than the creation of the volumesnapshot.
+		taken := vs.CreationTimestamp.Time
+		if vs.Status.CreationTime != nil {
+			taken = vs.Status.CreationTime.Time
+		}
+		if time.Since(taken) > maxAge {
+			continue
+		}
+		if adoptable == nil || taken.After(adoptableTime) {
+			adoptable, adoptableTime = vs, taken
+		}
+	}
+	return adoptable, nil
+}
+
+// MarkVolumeSnapshotAdopted marks the volumesnapshot, and its volumesnapshotcontent, as adopted by a backup.
+func MarkVolumeSnapshotAdopted(vs *snapshotv1api.VolumeSnapshot, snapshotClient snapshotter.SnapshotV1Interface) error {
+	pb := []byte(fmt.Sprintf(`{"metadata":{"annotations":{"%s":"true"}}}`, AdoptedVolumeSnapshotAnnotation))
+	if _, err := snapshotClient.VolumeSnapshots(vs.Namespace).Patch(context.TODO(), vs.Name, types.MergePatchType, pb, metav1.PatchOptions{}); err != nil {
+		return errors.Wrapf(err, "error marking volumesnapshot %s/%s as adopted", vs.Namespace, vs.Name)
+	}
+	if vs.Status != nil && vs.Status.BoundVolumeSnapshotContentName != nil {
+		vscName := *vs.Status.BoundVolumeSnapshotContentName
+		if _, err := snapshotClient.VolumeSnapshotContents().Patch(context.TODO(), vscName, types.MergePatchType, pb, metav1.PatchOptions{}); err != nil {
+			return errors.Wrapf(err, "error marking volumesnapshotcontent %s as adopted", vscName)
+		}
+	}
+	return nil
+}
+
+// IsAdoptedVolumeSnapshot returns whether the volumesnapshot or volumesnapshotcontent was adopted by a backup.
+func IsAdoptedVolumeSnapshot(o *metav1.ObjectMeta) bool {
+	_, ok := o.Annotations[AdoptedVolumeSnapshotAnnotation]
+	return ok
+}
+
+func SetVolumeSnapshotContentDeletionPolicy(vscName string, csiClient snapshotter.SnapshotV1Interface) error {
 	pb := []byte(`{"spec":{"deletionPolicy":"Delete"}}`)
 	_, err := csiClient.VolumeSnapshotContents().Patch(context.TODO(), vscName, types.MergePatchType, pb, metav1.PatchOptions{})
 
 	return err
 }
 
+// DeleteVolumeSnapshot deletes the volumesnapshot along with its bound volumesnapshotcontent and the snapshot in the storage
+// provider, whatever the deletion policy of the content: the policy is set to Delete before the volumesnapshot is deleted.
+func DeleteVolumeSnapshot(namespace, name string, csiClient snapshotter.SnapshotV1Interface) error {
+	vs, err := csiClient.VolumeSnapshots(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "error getting volumesnapshot %s/%s", namespace, name)
+	}
+	if vs.Status != nil && vs.Status.BoundVolumeSnapshotContentName != nil {
+		err := SetVolumeSnapshotContentDeletionPolicy(*vs.Status.BoundVolumeSnapshotContentName, csiClient)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "failed to patch DeletionPolicy of volumesnapshotcontent %s", *vs.Status.BoundVolumeSnapshotContentName)
+		}
+	}
+	if err := csiClient.VolumeSnapshots(namespace).Delete(context.TODO(), name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrapf(err, "error deleting volumesnapshot %s/%s", namespace, name)
+	}
+	return nil
+}
+
 func HasBackupLabel(o *metav1.ObjectMeta, backupName string) bool {
 	if o.Labels == nil || len(strings.TrimSpace(backupName)) == 0 {
 		return false
 	}
 	return o.Labels[velerov1api.BackupNameLabel] == label.GetValidName(backupName)
 }
+
+// BackupOwnerAnnotations returns the annotations that record, on an object created by the plugin, the backup it was created for.
+func BackupOwnerAnnotations(backup *velerov1api.Backup) map[string]string {
+	return map[string]string{
+		BackupNameAnnotation: backup.Name,
+		BackupUIDAnnotation:  string(backup.UID),
+	}
+}
+
+// IsCreatedForBackup returns whether the object was created by the plugin for the backup. The UID of the backup recorded on the
+// object tells apart backups whose names are truncated to the same label value, and a backup recreated with the same name.
+// Objects created before the UID was recorded are recognized by the backup name label.
+func IsCreatedForBackup(o *metav1.ObjectMeta, backup *velerov1api.Backup) bool {
+	if uid, ok := o.Annotations[BackupUIDAnnotation]; ok {
+		return uid == string(backup.UID)
+	}
+	return HasBackupLabel(o, backup.Name)
+}
+
+// IsCreatedForAnyBackup returns whether the object was created by the plugin for a backup.
+func IsCreatedForAnyBackup(o *metav1.ObjectMeta) bool {
+	_, annotated := o.Annotations[BackupUIDAnnotation]
+	_, labelled := o.Labels[velerov1api.BackupNameLabel]
+	return annotated || labelled
+}
+
+// IsCreatedForSameBackup returns whether the objects were created by the plugin for the same backup.
+func IsCreatedForSameBackup(a, b *metav1.ObjectMeta) bool {
+	uidA, okA := a.Annotations[BackupUIDAnnotation]
+	uidB, okB := b.Annotations[BackupUIDAnnotation]
+	if okA && okB {
+		return uidA == uidB
+	}
+	nameA, okA := a.Labels[velerov1api.BackupNameLabel]
+	nameB, okB := b.Labels[velerov1api.BackupNameLabel]
+	return okA && okB && nameA == nameB
+}
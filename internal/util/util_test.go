@@ -19,17 +19,25 @@ package util
 import (
 	"context"
 	"testing"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 
-	snapshotv1beta1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1beta1"
+	snapshotv1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
 	snapshotFake "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned/fake"
 	"github.com/sirupsen/logrus"
 	corev1api "k8s.io/api/core/v1"
 	v1 "k8s.io/api/core/v1"
+	storagev1api "k8s.io/api/storage/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
 )
 
 var (
@@ -622,7 +630,7 @@ func TestIsPVCBackedUpByRestic(t *testing.T) {
 }
 
 func TestGetVolumeSnapshotCalssForStorageClass(t *testing.T) {
-	hostpathClass := &snapshotv1beta1api.VolumeSnapshotClass{
+	hostpathClass := &snapshotv1api.VolumeSnapshotClass{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: "hostpath",
 			Labels: map[string]string{
@@ -632,7 +640,7 @@ func TestGetVolumeSnapshotCalssForStorageClass(t *testing.T) {
 		Driver: "hostpath.csi.k8s.io",
 	}
 
-	fooClass := &snapshotv1beta1api.VolumeSnapshotClass{
+	fooClass := &snapshotv1api.VolumeSnapshotClass{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: "foo",
 			Labels: map[string]string{
@@ -642,7 +650,7 @@ func TestGetVolumeSnapshotCalssForStorageClass(t *testing.T) {
 		Driver: "foo.csi.k8s.io",
 	}
 
-	barClass := &snapshotv1beta1api.VolumeSnapshotClass{
+	barClass := &snapshotv1api.VolumeSnapshotClass{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: "bar",
 			Labels: map[string]string{
@@ -652,20 +660,40 @@ func TestGetVolumeSnapshotCalssForStorageClass(t *testing.T) {
 		Driver: "bar.csi.k8s.io",
 	}
 
-	bazClass := &snapshotv1beta1api.VolumeSnapshotClass{
+	bazClass := &snapshotv1api.VolumeSnapshotClass{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: "baz",
 		},
 		Driver: "baz.csi.k8s.io",
 	}
 
-	objs := []runtime.Object{hostpathClass, fooClass, barClass, bazClass}
+	quxClass1 := &snapshotv1api.VolumeSnapshotClass{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "qux-1",
+			Labels: map[string]string{
+				VolumeSnapshotClassSelectorLabel: "foo",
+			},
+		},
+		Driver: "qux.csi.k8s.io",
+	}
+
+	quxClass2 := &snapshotv1api.VolumeSnapshotClass{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "qux-2",
+			Labels: map[string]string{
+				VolumeSnapshotClassSelectorLabel: "foo",
+			},
+		},
+		Driver: "qux.csi.k8s.io",
+	}
+
+	objs := []runtime.Object{hostpathClass, fooClass, barClass, bazClass, quxClass1, quxClass2}
 	fakeClient := snapshotFake.NewSimpleClientset(objs...)
 
 	testCases := []struct {
 		name        string
 		driverName  string
-		expectedVSC *snapshotv1beta1api.VolumeSnapshotClass
+		expectedVSC *snapshotv1api.VolumeSnapshotClass
 		expectError bool
 	}{
 		{
@@ -698,11 +726,17 @@ func TestGetVolumeSnapshotCalssForStorageClass(t *testing.T) {
 			expectedVSC: nil,
 			expectError: true,
 		},
+		{
+			name:        "should not pick one of multiple labeled volumesnapshotclasses for the same driver",
+			driverName:  "qux.csi.k8s.io",
+			expectedVSC: nil,
+			expectError: true,
+		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			actualVSC, actualError := GetVolumeSnapshotClassForStorageClass(tc.driverName, fakeClient.SnapshotV1beta1())
+			actualVSC, actualError := GetVolumeSnapshotClassForStorageClass(tc.driverName, fakeClient.SnapshotV1())
 
 			if tc.expectError {
 				assert.NotNil(t, actualError)
@@ -716,105 +750,238 @@ func TestGetVolumeSnapshotCalssForStorageClass(t *testing.T) {
 	}
 }
 
+func TestGetVolumeSnapshotClass(t *testing.T) {
+	defaultClass := &snapshotv1api.VolumeSnapshotClass{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "default",
+			Labels: map[string]string{
+				VolumeSnapshotClassSelectorLabel: "true",
+			},
+		},
+		Driver: "hostpath.csi.k8s.io",
+	}
+	pvcClass := &snapshotv1api.VolumeSnapshotClass{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "pvc-class",
+		},
+		Driver: "hostpath.csi.k8s.io",
+	}
+	scClass := &snapshotv1api.VolumeSnapshotClass{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "sc-class",
+		},
+		Driver: "hostpath.csi.k8s.io",
+	}
+	backupClass := &snapshotv1api.VolumeSnapshotClass{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "backup-class",
+		},
+		Driver: "hostpath.csi.k8s.io",
+	}
+	otherDriverClass := &snapshotv1api.VolumeSnapshotClass{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "other-driver-class",
+		},
+		Driver: "foo.csi.k8s.io",
+	}
+
+	objs := []runtime.Object{defaultClass, pvcClass, scClass, backupClass, otherDriverClass}
+	fakeClient := snapshotFake.NewSimpleClientset(objs...)
+
+	testCases := []struct {
+		name              string
+		pvcAnnotations    map[string]string
+		scAnnotations     map[string]string
+		backupAnnotations map[string]string
+		configuredClasses map[string]string
+		expected          string
+		expectError       bool
+	}{
+		{
+			name:     "should use the labeled default volumesnapshotclass without annotations",
+			expected: "default",
+		},
+		{
+			name:              "should prefer the backup annotation over the labeled default",
+			backupAnnotations: map[string]string{VolumeSnapshotClassBackupAnnotationPrefix + "hostpath.csi.k8s.io": "backup-class"},
+			expected:          "backup-class",
+		},
+		{
+			name:              "should ignore backup annotations for other drivers",
+			backupAnnotations: map[string]string{VolumeSnapshotClassBackupAnnotationPrefix + "foo.csi.k8s.io": "other-driver-class"},
+			expected:          "default",
+		},
+		{
+			name:              "should prefer the configured volumesnapshotclass over the labeled default",
+			configuredClasses: map[string]string{"hostpath.csi.k8s.io": "sc-class"},
+			expected:          "sc-class",
+		},
+		{
+			name:              "should prefer the backup annotation over the configured volumesnapshotclass",
+			configuredClasses: map[string]string{"hostpath.csi.k8s.io": "sc-class"},
+			backupAnnotations: map[string]string{VolumeSnapshotClassBackupAnnotationPrefix + "hostpath.csi.k8s.io": "backup-class"},
+			expected:          "backup-class",
+		},
+		{
+			name:              "should prefer the storageclass annotation over the backup annotation",
+			scAnnotations:     map[string]string{VolumeSnapshotClassAnnotation: "sc-class"},
+			backupAnnotations: map[string]string{VolumeSnapshotClassBackupAnnotationPrefix + "hostpath.csi.k8s.io": "backup-class"},
+			expected:          "sc-class",
+		},
+		{
+			name:              "should prefer the PVC annotation over the storageclass annotation",
+			pvcAnnotations:    map[string]string{VolumeSnapshotClassAnnotation: "pvc-class"},
+			scAnnotations:     map[string]string{VolumeSnapshotClassAnnotation: "sc-class"},
+			backupAnnotations: map[string]string{VolumeSnapshotClassBackupAnnotationPrefix + "hostpath.csi.k8s.io": "backup-class"},
+			expected:          "pvc-class",
+		},
+		{
+			name:           "should error when the annotated volumesnapshotclass does not exist",
+			pvcAnnotations: map[string]string{VolumeSnapshotClassAnnotation: "does-not-exist"},
+			expectError:    true,
+		},
+		{
+			name:           "should error when the annotated volumesnapshotclass is for a different driver",
+			pvcAnnotations: map[string]string{VolumeSnapshotClassAnnotation: "other-driver-class"},
+			expectError:    true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pvc := &corev1api.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "test-pvc",
+					Namespace:   "default",
+					Annotations: tc.pvcAnnotations,
+				},
+			}
+			sc := &storagev1api.StorageClass{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "test-sc",
+					Annotations: tc.scAnnotations,
+				},
+				Provisioner: "hostpath.csi.k8s.io",
+			}
+			backup := &velerov1api.Backup{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "test-backup",
+					Namespace:   "velero",
+					Annotations: tc.backupAnnotations,
+				},
+			}
+
+			actual, err := GetVolumeSnapshotClass(sc, pvc, backup, tc.configuredClasses, fakeClient.SnapshotV1(), logrus.New().WithField("fake", "test"))
+			if tc.expectError {
+				assert.NotNil(t, err)
+				assert.Nil(t, actual)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, actual.Name)
+		})
+	}
+}
+
 func TestGetVolumeSnapshotContentForVolumeSnapshot(t *testing.T) {
 	vscName := "snapcontent-7d1bdbd1-d10d-439c-8d8e-e1c2565ddc53"
 	snapshotHandle := "snapshot-handle"
-	vscObj := &snapshotv1beta1api.VolumeSnapshotContent{
+	vscObj := &snapshotv1api.VolumeSnapshotContent{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: vscName,
 		},
-		Spec: snapshotv1beta1api.VolumeSnapshotContentSpec{
+		Spec: snapshotv1api.VolumeSnapshotContentSpec{
 			VolumeSnapshotRef: corev1api.ObjectReference{
 				Name:       "vol-snap-1",
-				APIVersion: snapshotv1beta1api.SchemeGroupVersion.String(),
+				APIVersion: snapshotv1api.SchemeGroupVersion.String(),
 			},
 		},
-		Status: &snapshotv1beta1api.VolumeSnapshotContentStatus{
+		Status: &snapshotv1api.VolumeSnapshotContentStatus{
 			SnapshotHandle: &snapshotHandle,
 		},
 	}
-	validVS := &snapshotv1beta1api.VolumeSnapshot{
+	validVS := &snapshotv1api.VolumeSnapshot{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      "vs",
 			Namespace: "default",
 		},
-		Status: &snapshotv1beta1api.VolumeSnapshotStatus{
+		Status: &snapshotv1api.VolumeSnapshotStatus{
 			BoundVolumeSnapshotContentName: &vscName,
 		},
 	}
 
 	notFound := "does-not-exist"
-	vsWithVSCNotFound := &snapshotv1beta1api.VolumeSnapshot{
+	vsWithVSCNotFound := &snapshotv1api.VolumeSnapshot{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      notFound,
 			Namespace: "default",
 		},
-		Status: &snapshotv1beta1api.VolumeSnapshotStatus{
+		Status: &snapshotv1api.VolumeSnapshotStatus{
 			BoundVolumeSnapshotContentName: &notFound,
 		},
 	}
 
-	vsWithNilStatus := &snapshotv1beta1api.VolumeSnapshot{
+	vsWithNilStatus := &snapshotv1api.VolumeSnapshot{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      "nil-status-vs",
 			Namespace: "default",
 		},
 		Status: nil,
 	}
-	vsWithNilStatusField := &snapshotv1beta1api.VolumeSnapshot{
+	vsWithNilStatusField := &snapshotv1api.VolumeSnapshot{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      "nil-status-field-vs",
 			Namespace: "default",
 		},
-		Status: &snapshotv1beta1api.VolumeSnapshotStatus{
+		Status: &snapshotv1api.VolumeSnapshotStatus{
 			BoundVolumeSnapshotContentName: nil,
 		},
 	}
 
 	nilStatusVsc := "nil-status-vsc"
-	vscWithNilStatus := &snapshotv1beta1api.VolumeSnapshotContent{
+	vscWithNilStatus := &snapshotv1api.VolumeSnapshotContent{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: nilStatusVsc,
 		},
-		Spec: snapshotv1beta1api.VolumeSnapshotContentSpec{
+		Spec: snapshotv1api.VolumeSnapshotContentSpec{
 			VolumeSnapshotRef: corev1api.ObjectReference{
 				Name:       "vol-snap-1",
-				APIVersion: snapshotv1beta1api.SchemeGroupVersion.String(),
+				APIVersion: snapshotv1api.SchemeGroupVersion.String(),
 			},
 		},
 		Status: nil,
 	}
-	vsForNilStatusVsc := &snapshotv1beta1api.VolumeSnapshot{
+	vsForNilStatusVsc := &snapshotv1api.VolumeSnapshot{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      "vs-for-nil-status-vsc",
 			Namespace: "default",
 		},
-		Status: &snapshotv1beta1api.VolumeSnapshotStatus{
+		Status: &snapshotv1api.VolumeSnapshotStatus{
 			BoundVolumeSnapshotContentName: &nilStatusVsc,
 		},
 	}
 
 	nilStatusFieldVsc := "nil-status-field-vsc"
-	vscWithNilStatusField := &snapshotv1beta1api.VolumeSnapshotContent{
+	vscWithNilStatusField := &snapshotv1api.VolumeSnapshotContent{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: nilStatusFieldVsc,
 		},
-		Spec: snapshotv1beta1api.VolumeSnapshotContentSpec{
+		Spec: snapshotv1api.VolumeSnapshotContentSpec{
 			VolumeSnapshotRef: corev1api.ObjectReference{
 				Name:       "vol-snap-1",
-				APIVersion: snapshotv1beta1api.SchemeGroupVersion.String(),
+				APIVersion: snapshotv1api.SchemeGroupVersion.String(),
 			},
 		},
-		Status: &snapshotv1beta1api.VolumeSnapshotContentStatus{
+		Status: &snapshotv1api.VolumeSnapshotContentStatus{
 			SnapshotHandle: nil,
 		},
 	}
-	vsForNilStatusFieldVsc := &snapshotv1beta1api.VolumeSnapshot{
+	vsForNilStatusFieldVsc := &snapshotv1api.VolumeSnapshot{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      "vs-for-nil-status-field",
 			Namespace: "default",
 		},
-		Status: &snapshotv1beta1api.VolumeSnapshotStatus{
+		Status: &snapshotv1api.VolumeSnapshotStatus{
 			BoundVolumeSnapshotContentName: &nilStatusFieldVsc,
 		},
 	}
@@ -823,8 +990,8 @@ func TestGetVolumeSnapshotContentForVolumeSnapshot(t *testing.T) {
 	fakeClient := snapshotFake.NewSimpleClientset(objs...)
 	testCases := []struct {
 		name        string
-		volSnap     *snapshotv1beta1api.VolumeSnapshot
-		exepctedVSC *snapshotv1beta1api.VolumeSnapshotContent
+		volSnap     *snapshotv1api.VolumeSnapshot
+		exepctedVSC *snapshotv1api.VolumeSnapshotContent
 		wait        bool
 		expectError bool
 	}{
@@ -847,12 +1014,12 @@ func TestGetVolumeSnapshotContentForVolumeSnapshot(t *testing.T) {
 			wait:        true,
 			exepctedVSC: nil,
 			expectError: true,
-			volSnap: &snapshotv1beta1api.VolumeSnapshot{
+			volSnap: &snapshotv1api.VolumeSnapshot{
 				ObjectMeta: metav1.ObjectMeta{
 					Name:      "not-found",
 					Namespace: "default",
 				},
-				Status: &snapshotv1beta1api.VolumeSnapshotStatus{
+				Status: &snapshotv1api.VolumeSnapshotStatus{
 					BoundVolumeSnapshotContentName: &nilStatusVsc,
 				},
 			},
@@ -896,7 +1063,7 @@ func TestGetVolumeSnapshotContentForVolumeSnapshot(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			actualVSC, actualError := GetVolumeSnapshotContentForVolumeSnapshot(tc.volSnap, fakeClient.SnapshotV1beta1(), logrus.New().WithField("fake", "test"), tc.wait)
+			actualVSC, actualError := GetVolumeSnapshotContentForVolumeSnapshot(tc.volSnap, fakeClient.SnapshotV1(), logrus.New().WithField("fake", "test"), tc.wait, time.Minute)
 			if tc.expectError && actualError == nil {
 				assert.NotNil(t, actualError)
 				assert.Nil(t, actualVSC)
@@ -907,15 +1074,236 @@ func TestGetVolumeSnapshotContentForVolumeSnapshot(t *testing.T) {
 	}
 }
 
+// newWatchNotifyingClientset returns a fake snapshot clientset that sends the resource being watched on the returned
+// channel once a watch on it is established, so that tests can update objects only after the waiter is watching them.
+func newWatchNotifyingClientset(objs ...runtime.Object) (*snapshotFake.Clientset, <-chan string) {
+	clientset := snapshotFake.NewSimpleClientset(objs...)
+	started := make(chan string, 10)
+	clientset.PrependWatchReactor("*", func(action clienttesting.Action) (bool, watch.Interface, error) {
+		w, err := clientset.Tracker().Watch(action.GetResource(), action.GetNamespace())
+		if err != nil {
+			return true, nil, err
+		}
+		started <- action.GetResource().Resource
+		return true, w, nil
+	})
+	return clientset, started
+}
+
+func TestGetVolumeSnapshotContentForVolumeSnapshotWaits(t *testing.T) {
+	vscName := "snapcontent-1"
+	snapshotHandle := "snapshot-handle"
+	driverMessage := "snapshot quota exceeded"
+	errorTime := metav1.NewTime(time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC))
+	unboundVS := func() *snapshotv1api.VolumeSnapshot {
+		return &snapshotv1api.VolumeSnapshot{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "vs",
+				Namespace: "default",
+			},
+		}
+	}
+	vscWithoutHandle := func() *snapshotv1api.VolumeSnapshotContent {
+		return &snapshotv1api.VolumeSnapshotContent{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: vscName,
+			},
+			Status: &snapshotv1api.VolumeSnapshotContentStatus{},
+		}
+	}
+
+	testCases := []struct {
+		name          string
+		timeout       time.Duration
+		reconcile     func(t *testing.T, client *snapshotFake.Clientset, started <-chan string)
+		expectedErr   error
+		snapshotError string
+		expectError   bool
+	}{
+		{
+			name:    "should return the volumesnapshotcontent once the volumesnapshot is bound and the snapshot handle is set",
+			timeout: time.Minute,
+			reconcile: func(t *testing.T, client *snapshotFake.Clientset, started <-chan string) {
+				assert.Equal(t, "volumesnapshots", <-started)
+				vs := unboundVS()
+				vs.Status = &snapshotv1api.VolumeSnapshotStatus{BoundVolumeSnapshotContentName: &vscName}
+				_, err := client.SnapshotV1().VolumeSnapshots("default").Update(context.TODO(), vs, metav1.UpdateOptions{})
+				assert.Nil(t, err)
+
+				assert.Equal(t, "volumesnapshotcontents", <-started)
+				vsc := vscWithoutHandle()
+				vsc.Status.SnapshotHandle = &snapshotHandle
+				_, err = client.SnapshotV1().VolumeSnapshotContents().Update(context.TODO(), vsc, metav1.UpdateOptions{})
+				assert.Nil(t, err)
+			},
+		},
+		{
+			name:    "should fail when the volumesnapshot is deleted while waiting",
+			timeout: time.Minute,
+			reconcile: func(t *testing.T, client *snapshotFake.Clientset, started <-chan string) {
+				assert.Equal(t, "volumesnapshots", <-started)
+				err := client.SnapshotV1().VolumeSnapshots("default").Delete(context.TODO(), "vs", metav1.DeleteOptions{})
+				assert.Nil(t, err)
+			},
+			expectError: true,
+		},
+		{
+			name:    "should fail as soon as the CSI driver reports an error on the volumesnapshot",
+			timeout: time.Minute,
+			reconcile: func(t *testing.T, client *snapshotFake.Clientset, started <-chan string) {
+				assert.Equal(t, "volumesnapshots", <-started)
+				vs := unboundVS()
+				vs.Status = &snapshotv1api.VolumeSnapshotStatus{Error: &snapshotv1api.VolumeSnapshotError{Message: &driverMessage, Time: &errorTime}}
+				_, err := client.SnapshotV1().VolumeSnapshots("default").Update(context.TODO(), vs, metav1.UpdateOptions{})
+				assert.Nil(t, err)
+			},
+			snapshotError: "CSI driver reported an error for volumesnapshot default/vs at 2021-06-01T10:00:00Z: snapshot quota exceeded",
+			expectError:   true,
+		},
+		{
+			name:    "should fail as soon as the CSI driver reports an error on the volumesnapshotcontent",
+			timeout: time.Minute,
+			reconcile: func(t *testing.T, client *snapshotFake.Clientset, started <-chan string) {
+				assert.Equal(t, "volumesnapshots", <-started)
+				vs := unboundVS()
+				vs.Status = &snapshotv1api.VolumeSnapshotStatus{BoundVolumeSnapshotContentName: &vscName}
+				_, err := client.SnapshotV1().VolumeSnapshots("default").Update(context.TODO(), vs, metav1.UpdateOptions{})
+				assert.Nil(t, err)
+
+				assert.Equal(t, "volumesnapshotcontents", <-started)
+				vsc := vscWithoutHandle()
+				vsc.Status.Error = &snapshotv1api.VolumeSnapshotError{Message: &driverMessage}
+				_, err = client.SnapshotV1().VolumeSnapshotContents().Update(context.TODO(), vsc, metav1.UpdateOptions{})
+				assert.Nil(t, err)
+			},
+			snapshotError: "CSI driver reported an error for volumesnapshotcontent snapcontent-1: snapshot quota exceeded",
+			expectError:   true,
+		},
+		{
+			name:        "should time out when the volumesnapshot is never bound",
+			timeout:     100 * time.Millisecond,
+			reconcile:   func(t *testing.T, client *snapshotFake.Clientset, started <-chan string) {},
+			expectedErr: wait.ErrWaitTimeout,
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client, started := newWatchNotifyingClientset(unboundVS(), vscWithoutHandle())
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				tc.reconcile(t, client, started)
+			}()
+
+			actualVSC, actualError := GetVolumeSnapshotContentForVolumeSnapshot(unboundVS(), client.SnapshotV1(), logrus.New(), true, tc.timeout)
+			<-done
+			if tc.expectError {
+				assert.NotNil(t, actualError)
+				if tc.expectedErr != nil {
+					assert.Equal(t, tc.expectedErr, actualError)
+				}
+				if tc.snapshotError != "" {
+					assert.True(t, IsSnapshotError(actualError))
+					assert.Equal(t, tc.snapshotError, errors.Cause(actualError).Error())
+				}
+				assert.Nil(t, actualVSC)
+				return
+			}
+			assert.Nil(t, actualError)
+			assert.Equal(t, snapshotHandle, *actualVSC.Status.SnapshotHandle)
+		})
+	}
+}
+
+func TestWaitForVolumeSnapshotContentReadyToUse(t *testing.T) {
+	vscName := "snapcontent-1"
+	driverMessage := "upload failed"
+	notReady := func() *snapshotv1api.VolumeSnapshotContent {
+		readyToUse := false
+		return &snapshotv1api.VolumeSnapshotContent{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: vscName,
+			},
+			Status: &snapshotv1api.VolumeSnapshotContentStatus{
+				ReadyToUse: &readyToUse,
+			},
+		}
+	}
+
+	testCases := []struct {
+		name          string
+		timeout       time.Duration
+		update        func(vsc *snapshotv1api.VolumeSnapshotContent)
+		expectedErr   error
+		snapshotError bool
+	}{
+		{
+			name:    "should return once the volumesnapshotcontent is ready to use",
+			timeout: time.Minute,
+			update: func(vsc *snapshotv1api.VolumeSnapshotContent) {
+				readyToUse := true
+				vsc.Status.ReadyToUse = &readyToUse
+			},
+		},
+		{
+			name:    "should fail as soon as the CSI driver reports an error",
+			timeout: time.Minute,
+			update: func(vsc *snapshotv1api.VolumeSnapshotContent) {
+				vsc.Status.Error = &snapshotv1api.VolumeSnapshotError{Message: &driverMessage}
+			},
+			snapshotError: true,
+		},
+		{
+			name:        "should time out when the volumesnapshotcontent never becomes ready to use",
+			timeout:     100 * time.Millisecond,
+			expectedErr: wait.ErrWaitTimeout,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client, started := newWatchNotifyingClientset(notReady())
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				if tc.update == nil {
+					return
+				}
+				assert.Equal(t, "volumesnapshotcontents", <-started)
+				vsc := notReady()
+				tc.update(vsc)
+				_, err := client.SnapshotV1().VolumeSnapshotContents().Update(context.TODO(), vsc, metav1.UpdateOptions{})
+				assert.Nil(t, err)
+			}()
+
+			actualVSC, actualError := WaitForVolumeSnapshotContentReadyToUse(vscName, client.SnapshotV1(), logrus.New(), tc.timeout)
+			<-done
+			if tc.expectedErr != nil || tc.snapshotError {
+				assert.NotNil(t, actualError)
+				if tc.expectedErr != nil {
+					assert.Equal(t, tc.expectedErr, actualError)
+				}
+				assert.Equal(t, tc.snapshotError, IsSnapshotError(actualError))
+				assert.Nil(t, actualVSC)
+				return
+			}
+			assert.Nil(t, actualError)
+			assert.True(t, *actualVSC.Status.ReadyToUse)
+		})
+	}
+}
+
 func TestIsVolumeSnapshotClassHasListerSecret(t *testing.T) {
 	testCases := []struct {
 		name      string
-		snapClass snapshotv1beta1api.VolumeSnapshotClass
+		snapClass snapshotv1api.VolumeSnapshotClass
 		expected  bool
 	}{
 		{
 			name: "should find both annotations",
-			snapClass: snapshotv1beta1api.VolumeSnapshotClass{
+			snapClass: snapshotv1api.VolumeSnapshotClass{
 				ObjectMeta: metav1.ObjectMeta{
 					Name: "class-1",
 					Annotations: map[string]string{
@@ -928,7 +1316,7 @@ func TestIsVolumeSnapshotClassHasListerSecret(t *testing.T) {
 		},
 		{
 			name: "should not find both annotations name is missing",
-			snapClass: snapshotv1beta1api.VolumeSnapshotClass{
+			snapClass: snapshotv1api.VolumeSnapshotClass{
 				ObjectMeta: metav1.ObjectMeta{
 					Name: "class-1",
 					Annotations: map[string]string{
@@ -941,7 +1329,7 @@ func TestIsVolumeSnapshotClassHasListerSecret(t *testing.T) {
 		},
 		{
 			name: "should not find both annotations namespace is missing",
-			snapClass: snapshotv1beta1api.VolumeSnapshotClass{
+			snapClass: snapshotv1api.VolumeSnapshotClass{
 				ObjectMeta: metav1.ObjectMeta{
 					Name: "class-1",
 					Annotations: map[string]string{
@@ -954,7 +1342,7 @@ func TestIsVolumeSnapshotClassHasListerSecret(t *testing.T) {
 		},
 		{
 			name: "should not find expected annotation non-empty annotation",
-			snapClass: snapshotv1beta1api.VolumeSnapshotClass{
+			snapClass: snapshotv1api.VolumeSnapshotClass{
 				ObjectMeta: metav1.ObjectMeta{
 					Name: "class-2",
 					Annotations: map[string]string{
@@ -967,7 +1355,7 @@ func TestIsVolumeSnapshotClassHasListerSecret(t *testing.T) {
 		},
 		{
 			name: "should not find expected annotation nil annotation",
-			snapClass: snapshotv1beta1api.VolumeSnapshotClass{
+			snapClass: snapshotv1api.VolumeSnapshotClass{
 				ObjectMeta: metav1.ObjectMeta{
 					Name:        "class-3",
 					Annotations: nil,
@@ -977,7 +1365,7 @@ func TestIsVolumeSnapshotClassHasListerSecret(t *testing.T) {
 		},
 		{
 			name: "should not find expected annotation empty annotation",
-			snapClass: snapshotv1beta1api.VolumeSnapshotClass{
+			snapClass: snapshotv1api.VolumeSnapshotClass{
 				ObjectMeta: metav1.ObjectMeta{
 					Name:        "class-3",
 					Annotations: map[string]string{},
@@ -998,17 +1386,17 @@ func TestIsVolumeSnapshotClassHasListerSecret(t *testing.T) {
 func TestIsVolumeSnapshotContentHasDeleteSecret(t *testing.T) {
 	testCases := []struct {
 		name     string
-		vsc      snapshotv1beta1api.VolumeSnapshotContent
+		vsc      snapshotv1api.VolumeSnapshotContent
 		expected bool
 	}{
 		{
 			name: "should find both annotations",
-			vsc: snapshotv1beta1api.VolumeSnapshotContent{
+			vsc: snapshotv1api.VolumeSnapshotContent{
 				ObjectMeta: metav1.ObjectMeta{
 					Name: "vsc-1",
 					Annotations: map[string]string{
-						PrefixedSnapshotterSecretNameKey:      "delSnapSecret",
-						PrefixedSnapshotterSecretNamespaceKey: "awesome-ns",
+						DeletionSecretNameAnnotation:      "delSnapSecret",
+						DeletionSecretNamespaceAnnotation: "awesome-ns",
 					},
 				},
 			},
@@ -1016,12 +1404,12 @@ func TestIsVolumeSnapshotContentHasDeleteSecret(t *testing.T) {
 		},
 		{
 			name: "should not find both annotations name is missing",
-			vsc: snapshotv1beta1api.VolumeSnapshotContent{
+			vsc: snapshotv1api.VolumeSnapshotContent{
 				ObjectMeta: metav1.ObjectMeta{
 					Name: "vsc-2",
 					Annotations: map[string]string{
-						"foo":                                 "delSnapSecret",
-						PrefixedSnapshotterSecretNamespaceKey: "awesome-ns",
+						"foo":                             "delSnapSecret",
+						DeletionSecretNamespaceAnnotation: "awesome-ns",
 					},
 				},
 			},
@@ -1029,12 +1417,12 @@ func TestIsVolumeSnapshotContentHasDeleteSecret(t *testing.T) {
 		},
 		{
 			name: "should not find both annotations namespace is missing",
-			vsc: snapshotv1beta1api.VolumeSnapshotContent{
+			vsc: snapshotv1api.VolumeSnapshotContent{
 				ObjectMeta: metav1.ObjectMeta{
 					Name: "vsc-3",
 					Annotations: map[string]string{
-						PrefixedSnapshotterSecretNameKey: "delSnapSecret",
-						"foo":                            "awesome-ns",
+						DeletionSecretNameAnnotation: "delSnapSecret",
+						"foo":                        "awesome-ns",
 					},
 				},
 			},
@@ -1042,7 +1430,7 @@ func TestIsVolumeSnapshotContentHasDeleteSecret(t *testing.T) {
 		},
 		{
 			name: "should not find expected annotation non-empty annotation",
-			vsc: snapshotv1beta1api.VolumeSnapshotContent{
+			vsc: snapshotv1api.VolumeSnapshotContent{
 				ObjectMeta: metav1.ObjectMeta{
 					Name: "vsc-4",
 					Annotations: map[string]string{
@@ -1055,7 +1443,7 @@ func TestIsVolumeSnapshotContentHasDeleteSecret(t *testing.T) {
 		},
 		{
 			name: "should not find expected annotation empty annotation",
-			vsc: snapshotv1beta1api.VolumeSnapshotContent{
+			vsc: snapshotv1api.VolumeSnapshotContent{
 				ObjectMeta: metav1.ObjectMeta{
 					Name:        "vsc-5",
 					Annotations: map[string]string{},
@@ -1065,7 +1453,7 @@ func TestIsVolumeSnapshotContentHasDeleteSecret(t *testing.T) {
 		},
 		{
 			name: "should not find expected annotation nil annotation",
-			vsc: snapshotv1beta1api.VolumeSnapshotContent{
+			vsc: snapshotv1api.VolumeSnapshotContent{
 				ObjectMeta: metav1.ObjectMeta{
 					Name:        "vsc-6",
 					Annotations: nil,
@@ -1086,12 +1474,12 @@ func TestIsVolumeSnapshotContentHasDeleteSecret(t *testing.T) {
 func TestIsVolumeSnapshotHasVSCDeleteSecret(t *testing.T) {
 	testCases := []struct {
 		name     string
-		vs       snapshotv1beta1api.VolumeSnapshot
+		vs       snapshotv1api.VolumeSnapshot
 		expected bool
 	}{
 		{
 			name: "should find both annotations",
-			vs: snapshotv1beta1api.VolumeSnapshot{
+			vs: snapshotv1api.VolumeSnapshot{
 				ObjectMeta: metav1.ObjectMeta{
 					Name: "vs-1",
 					Annotations: map[string]string{
@@ -1104,7 +1492,7 @@ func TestIsVolumeSnapshotHasVSCDeleteSecret(t *testing.T) {
 		},
 		{
 			name: "should not find both annotations name is missing",
-			vs: snapshotv1beta1api.VolumeSnapshot{
+			vs: snapshotv1api.VolumeSnapshot{
 				ObjectMeta: metav1.ObjectMeta{
 					Name: "vs-1",
 					Annotations: map[string]string{
@@ -1117,7 +1505,7 @@ func TestIsVolumeSnapshotHasVSCDeleteSecret(t *testing.T) {
 		},
 		{
 			name: "should not find both annotations namespace is missing",
-			vs: snapshotv1beta1api.VolumeSnapshot{
+			vs: snapshotv1api.VolumeSnapshot{
 				ObjectMeta: metav1.ObjectMeta{
 					Name: "vs-1",
 					Annotations: map[string]string{
@@ -1130,7 +1518,7 @@ func TestIsVolumeSnapshotHasVSCDeleteSecret(t *testing.T) {
 		},
 		{
 			name: "should not find annotation non-empty annotation",
-			vs: snapshotv1beta1api.VolumeSnapshot{
+			vs: snapshotv1api.VolumeSnapshot{
 				ObjectMeta: metav1.ObjectMeta{
 					Name: "vs-1",
 					Annotations: map[string]string{
@@ -1143,7 +1531,7 @@ func TestIsVolumeSnapshotHasVSCDeleteSecret(t *testing.T) {
 		},
 		{
 			name: "should not find annotation empty annotation",
-			vs: snapshotv1beta1api.VolumeSnapshot{
+			vs: snapshotv1api.VolumeSnapshot{
 				ObjectMeta: metav1.ObjectMeta{
 					Name:        "vs-1",
 					Annotations: map[string]string{},
@@ -1153,7 +1541,7 @@ func TestIsVolumeSnapshotHasVSCDeleteSecret(t *testing.T) {
 		},
 		{
 			name: "should not find annotation nil annotation",
-			vs: snapshotv1beta1api.VolumeSnapshot{
+			vs: snapshotv1api.VolumeSnapshot{
 				ObjectMeta: metav1.ObjectMeta{
 					Name:        "vs-1",
 					Annotations: nil,
@@ -1298,13 +1686,13 @@ func TestAddLabels(t *testing.T) {
 }
 
 func TestIsVolumeSnapshotExists(t *testing.T) {
-	vsExists := &snapshotv1beta1api.VolumeSnapshot{
+	vsExists := &snapshotv1api.VolumeSnapshot{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      "vs-exists",
 			Namespace: "default",
 		},
 	}
-	vsNotExists := &snapshotv1beta1api.VolumeSnapshot{
+	vsNotExists := &snapshotv1api.VolumeSnapshot{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      "vs-does-not-exists",
 			Namespace: "default",
@@ -1316,7 +1704,7 @@ func TestIsVolumeSnapshotExists(t *testing.T) {
 	testCases := []struct {
 		name     string
 		expected bool
-		vs       *snapshotv1beta1api.VolumeSnapshot
+		vs       *snapshotv1api.VolumeSnapshot
 	}{
 		{
 			name:     "should find existing VolumeSnapshot object",
@@ -1337,12 +1725,197 @@ func TestIsVolumeSnapshotExists(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			actual := IsVolumeSnapshotExists(tc.vs, fakeClient.SnapshotV1beta1())
+			actual := IsVolumeSnapshotExists(tc.vs, fakeClient.SnapshotV1())
 			assert.Equal(t, tc.expected, actual)
 		})
 	}
 }
 
+func TestGetVolumeSnapshotForPVC(t *testing.T) {
+	pvc := &corev1api.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-pvc",
+			Namespace: "default",
+			UID:       "pvc-uid",
+		},
+	}
+	newVS := func(name, backupName, pvcUID, pvcName string) *snapshotv1api.VolumeSnapshot {
+		return &snapshotv1api.VolumeSnapshot{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "default",
+				Labels: map[string]string{
+					velerov1api.BackupNameLabel: backupName,
+					SourcePVCUIDLabel:           pvcUID,
+				},
+			},
+			Spec: snapshotv1api.VolumeSnapshotSpec{
+				Source: snapshotv1api.VolumeSnapshotSource{PersistentVolumeClaimName: &pvcName},
+			},
+		}
+	}
+	deleting := newVS("vs-deleting", "backup-1", "pvc-uid", "test-pvc")
+	deleting.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+	recreated := newVS("vs-1", "backup-1", "pvc-uid", "test-pvc")
+	recreated.Annotations = map[string]string{BackupUIDAnnotation: "old-backup-uid"}
+
+	testCases := []struct {
+		name       string
+		objs       []runtime.Object
+		expectedVS string
+	}{
+		{
+			name:       "volumesnapshot of the PVC in the backup should be found",
+			objs:       []runtime.Object{newVS("vs-1", "backup-1", "pvc-uid", "test-pvc")},
+			expectedVS: "vs-1",
+		},
+		{
+			name: "volumesnapshot of the PVC in another backup should not be found",
+			objs: []runtime.Object{newVS("vs-1", "backup-2", "pvc-uid", "test-pvc")},
+		},
+		{
+			name: "volumesnapshot of a previous PVC with the same name should not be found",
+			objs: []runtime.Object{newVS("vs-1", "backup-1", "old-pvc-uid", "test-pvc")},
+		},
+		{
+			name: "volumesnapshot of a previous backup with the same name should not be found",
+			objs: []runtime.Object{recreated},
+		},
+		{
+			name: "volumesnapshot being deleted should not be found",
+			objs: []runtime.Object{deleting},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fakeClient := snapshotFake.NewSimpleClientset(tc.objs...)
+			backup := &velerov1api.Backup{ObjectMeta: metav1.ObjectMeta{Name: "backup-1", UID: "backup-uid"}}
+			vs, err := GetVolumeSnapshotForPVC(pvc, backup, fakeClient.SnapshotV1())
+			assert.Nil(t, err)
+			if tc.expectedVS == "" {
+				assert.Nil(t, vs)
+				return
+			}
+			if assert.NotNil(t, vs) {
+				assert.Equal(t, tc.expectedVS, vs.Name)
+			}
+		})
+	}
+}
+
+func TestGetAdoptableVolumeSnapshot(t *testing.T) {
+	pvc := &corev1api.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-pvc",
+			Namespace: "default",
+		},
+	}
+	newVS := func(name, pvcName string, age time.Duration, ready bool, labels map[string]string) *snapshotv1api.VolumeSnapshot {
+		created := metav1.NewTime(time.Now().Add(-age))
+		return &snapshotv1api.VolumeSnapshot{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              name,
+				Namespace:         "default",
+				Labels:            labels,
+				CreationTimestamp: created,
+			},
+			Spec: snapshotv1api.VolumeSnapshotSpec{
+				Source: snapshotv1api.VolumeSnapshotSource{PersistentVolumeClaimName: &pvcName},
+			},
+			Status: &snapshotv1api.VolumeSnapshotStatus{
+				CreationTime: &created,
+				ReadyToUse:   &ready,
+			},
+		}
+	}
+	checkpoint := map[string]string{"checkpoint": "true"}
+
+	testCases := []struct {
+		name        string
+		objs        []runtime.Object
+		selector    string
+		expectedVS  string
+		expectError bool
+	}{
+		{
+			name:       "most recent matching volumesnapshot should be adopted",
+			objs:       []runtime.Object{newVS("vs-1", "test-pvc", 2*time.Hour, true, checkpoint), newVS("vs-2", "test-pvc", time.Hour, true, checkpoint)},
+			selector:   "checkpoint=true",
+			expectedVS: "vs-2",
+		},
+		{
+			name:     "volumesnapshot older than the maximum age should not be adopted",
+			objs:     []runtime.Object{newVS("vs-1", "test-pvc", 5*time.Hour, true, checkpoint)},
+			selector: "checkpoint=true",
+		},
+		{
+			name:     "volumesnapshot that is not ready to use should not be adopted",
+			objs:     []runtime.Object{newVS("vs-1", "test-pvc", time.Hour, false, checkpoint)},
+			selector: "checkpoint=true",
+		},
+		{
+			name:     "volumesnapshot not matching the selector should not be adopted",
+			objs:     []runtime.Object{newVS("vs-1", "test-pvc", time.Hour, true, nil)},
+			selector: "checkpoint=true",
+		},
+		{
+			name:     "volumesnapshot of another PVC should not be adopted",
+			objs:     []runtime.Object{newVS("vs-1", "other-pvc", time.Hour, true, checkpoint)},
+			selector: "checkpoint=true",
+		},
+		{
+			name: "volumesnapshot created for a backup should not be adopted",
+			objs: []runtime.Object{newVS("vs-1", "test-pvc", time.Hour, true,
+				map[string]string{"checkpoint": "true", velerov1api.BackupNameLabel: "backup-1"})},
+			selector: "checkpoint=true",
+		},
+		{
+			name:        "invalid selector should be rejected",
+			selector:    "checkpoint in (",
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fakeClient := snapshotFake.NewSimpleClientset(tc.objs...)
+			vs, err := GetAdoptableVolumeSnapshot(pvc, tc.selector, 4*time.Hour, fakeClient.SnapshotV1())
+			if tc.expectError {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			if tc.expectedVS == "" {
+				assert.Nil(t, vs)
+				return
+			}
+			if assert.NotNil(t, vs) {
+				assert.Equal(t, tc.expectedVS, vs.Name)
+			}
+		})
+	}
+}
+
+func TestMarkVolumeSnapshotAdopted(t *testing.T) {
+	vscName := "vsc-1"
+	vs := &snapshotv1api.VolumeSnapshot{
+		ObjectMeta: metav1.ObjectMeta{Name: "vs-1", Namespace: "default"},
+		Status:     &snapshotv1api.VolumeSnapshotStatus{BoundVolumeSnapshotContentName: &vscName},
+	}
+	vsc := &snapshotv1api.VolumeSnapshotContent{ObjectMeta: metav1.ObjectMeta{Name: vscName}}
+	fakeClient := snapshotFake.NewSimpleClientset(vs, vsc)
+
+	assert.Nil(t, MarkVolumeSnapshotAdopted(vs, fakeClient.SnapshotV1()))
+
+	liveVS, err := fakeClient.SnapshotV1().VolumeSnapshots("default").Get(context.TODO(), "vs-1", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.True(t, IsAdoptedVolumeSnapshot(&liveVS.ObjectMeta))
+	liveVSC, err := fakeClient.SnapshotV1().VolumeSnapshotContents().Get(context.TODO(), vscName, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.True(t, IsAdoptedVolumeSnapshot(&liveVSC.ObjectMeta))
+}
+
 func TestSetVolumeSnapshotContentDeletionPolicy(t *testing.T) {
 	testCases := []struct {
 		name         string
@@ -1354,12 +1927,12 @@ func TestSetVolumeSnapshotContentDeletionPolicy(t *testing.T) {
 			name:         "should update DeletionPolicy of a VSC from retain to delete",
 			inputVSCName: "retainVSC",
 			objs: []runtime.Object{
-				&snapshotv1beta1api.VolumeSnapshotContent{
+				&snapshotv1api.VolumeSnapshotContent{
 					ObjectMeta: metav1.ObjectMeta{
 						Name: "retainVSC",
 					},
-					Spec: snapshotv1beta1api.VolumeSnapshotContentSpec{
-						DeletionPolicy: snapshotv1beta1api.VolumeSnapshotContentRetain,
+					Spec: snapshotv1api.VolumeSnapshotContentSpec{
+						DeletionPolicy: snapshotv1api.VolumeSnapshotContentRetain,
 					},
 				},
 			},
@@ -1369,12 +1942,12 @@ func TestSetVolumeSnapshotContentDeletionPolicy(t *testing.T) {
 			name:         "should be a no-op updating if DeletionPolicy of a VSC is already Delete",
 			inputVSCName: "deleteVSC",
 			objs: []runtime.Object{
-				&snapshotv1beta1api.VolumeSnapshotContent{
+				&snapshotv1api.VolumeSnapshotContent{
 					ObjectMeta: metav1.ObjectMeta{
 						Name: "deleteVSC",
 					},
-					Spec: snapshotv1beta1api.VolumeSnapshotContentSpec{
-						DeletionPolicy: snapshotv1beta1api.VolumeSnapshotContentDelete,
+					Spec: snapshotv1api.VolumeSnapshotContentSpec{
+						DeletionPolicy: snapshotv1api.VolumeSnapshotContentDelete,
 					},
 				},
 			},
@@ -1384,11 +1957,11 @@ func TestSetVolumeSnapshotContentDeletionPolicy(t *testing.T) {
 			name:         "should update DeletionPolicy of a VSC with no DeletionPolicy",
 			inputVSCName: "nothingVSC",
 			objs: []runtime.Object{
-				&snapshotv1beta1api.VolumeSnapshotContent{
+				&snapshotv1api.VolumeSnapshotContent{
 					ObjectMeta: metav1.ObjectMeta{
 						Name: "nothingVSC",
 					},
-					Spec: snapshotv1beta1api.VolumeSnapshotContentSpec{},
+					Spec: snapshotv1api.VolumeSnapshotContentSpec{},
 				},
 			},
 			expectError: false,
@@ -1404,14 +1977,14 @@ func TestSetVolumeSnapshotContentDeletionPolicy(t *testing.T) {
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			fakeClient := snapshotFake.NewSimpleClientset(tc.objs...)
-			err := SetVolumeSnapshotContentDeletionPolicy(tc.inputVSCName, fakeClient.SnapshotV1beta1())
+			err := SetVolumeSnapshotContentDeletionPolicy(tc.inputVSCName, fakeClient.SnapshotV1())
 			if tc.expectError {
 				assert.NotNil(t, err)
 			} else {
 				assert.Nil(t, err)
-				actual, err := fakeClient.SnapshotV1beta1().VolumeSnapshotContents().Get(context.TODO(), tc.inputVSCName, metav1.GetOptions{})
+				actual, err := fakeClient.SnapshotV1().VolumeSnapshotContents().Get(context.TODO(), tc.inputVSCName, metav1.GetOptions{})
 				assert.Nil(t, err)
-				assert.Equal(t, snapshotv1beta1api.VolumeSnapshotContentDelete, actual.Spec.DeletionPolicy)
+				assert.Equal(t, snapshotv1api.VolumeSnapshotContentDelete, actual.Spec.DeletionPolicy)
 			}
 		})
 	}
@@ -1474,3 +2047,90 @@ func TestIsByBackup(t *testing.T) {
 		assert.Equal(t, tc.expected, actual)
 	}
 }
+
+func TestIsCreatedForBackup(t *testing.T) {
+	backup := &velerov1api.Backup{ObjectMeta: metav1.ObjectMeta{Name: "backup-1", UID: "backup-uid"}}
+	testCases := []struct {
+		name        string
+		labels      map[string]string
+		annotations map[string]string
+		expected    bool
+	}{
+		{
+			name:        "object annotated with the UID of the backup",
+			labels:      map[string]string{velerov1api.BackupNameLabel: "backup-1"},
+			annotations: map[string]string{BackupUIDAnnotation: "backup-uid"},
+			expected:    true,
+		},
+		{
+			name:        "object annotated with the UID of a previous backup with the same name",
+			labels:      map[string]string{velerov1api.BackupNameLabel: "backup-1"},
+			annotations: map[string]string{BackupUIDAnnotation: "old-backup-uid"},
+			expected:    false,
+		},
+		{
+			name:     "object with only the backup name label",
+			labels:   map[string]string{velerov1api.BackupNameLabel: "backup-1"},
+			expected: true,
+		},
+		{
+			name:     "object with the name label of another backup",
+			labels:   map[string]string{velerov1api.BackupNameLabel: "backup-2"},
+			expected: false,
+		},
+		{
+			name:     "object not created for a backup",
+			expected: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			o := &metav1.ObjectMeta{Labels: tc.labels, Annotations: tc.annotations}
+			assert.Equal(t, tc.expected, IsCreatedForBackup(o, backup))
+		})
+	}
+}
+
+func TestIsCreatedForSameBackup(t *testing.T) {
+	testCases := []struct {
+		name     string
+		a, b     metav1.ObjectMeta
+		expected bool
+	}{
+		{
+			name: "objects annotated with the same backup UID",
+			a: metav1.ObjectMeta{Labels: map[string]string{velerov1api.BackupNameLabel: "backup-1"},
+				Annotations: map[string]string{BackupUIDAnnotation: "backup-uid"}},
+			b: metav1.ObjectMeta{Labels: map[string]string{velerov1api.BackupNameLabel: "backup-1"},
+				Annotations: map[string]string{BackupUIDAnnotation: "backup-uid"}},
+			expected: true,
+		},
+		{
+			name: "objects annotated with different backup UIDs",
+			a: metav1.ObjectMeta{Labels: map[string]string{velerov1api.BackupNameLabel: "backup-1"},
+				Annotations: map[string]string{BackupUIDAnnotation: "backup-uid"}},
+			b: metav1.ObjectMeta{Labels: map[string]string{velerov1api.BackupNameLabel: "backup-1"},
+				Annotations: map[string]string{BackupUIDAnnotation: "old-backup-uid"}},
+			expected: false,
+		},
+		{
+			name:     "objects with the same backup name label",
+			a:        metav1.ObjectMeta{Labels: map[string]string{velerov1api.BackupNameLabel: "backup-1"}},
+			b:        metav1.ObjectMeta{Labels: map[string]string{velerov1api.BackupNameLabel: "backup-1"}},
+			expected: true,
+		},
+		{
+			name:     "object not created for a backup",
+			a:        metav1.ObjectMeta{Labels: map[string]string{velerov1api.BackupNameLabel: "backup-1"}},
+			b:        metav1.ObjectMeta{},
+			expected: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, IsCreatedForSameBackup(&tc.a, &tc.b))
+		})
+	}
+}
@@ -0,0 +1,310 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+
+	snapshotv1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	snapshotv1beta1api "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1beta1"
+	snapshotter "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned/typed/volumesnapshot/v1"
+	snapshotterv1beta1 "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned/typed/volumesnapshot/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/rest"
+)
+
+// v1beta1SnapshotClient implements the v1 snapshot client interface on top of a v1beta1 client, for clusters
+// that do not serve snapshot.storage.k8s.io/v1 yet.
+type v1beta1SnapshotClient struct {
+	client snapshotterv1beta1.SnapshotV1beta1Interface
+}
+
+func (c *v1beta1SnapshotClient) RESTClient() rest.Interface {
+	return c.client.RESTClient()
+}
+
+func (c *v1beta1SnapshotClient) VolumeSnapshots(namespace string) snapshotter.VolumeSnapshotInterface {
+	return &v1beta1VolumeSnapshots{client: c.client.VolumeSnapshots(namespace)}
+}
+
+func (c *v1beta1SnapshotClient) VolumeSnapshotClasses() snapshotter.VolumeSnapshotClassInterface {
+	return &v1beta1VolumeSnapshotClasses{client: c.client.VolumeSnapshotClasses()}
+}
+
+func (c *v1beta1SnapshotClient) VolumeSnapshotContents() snapshotter.VolumeSnapshotContentInterface {
+	return &v1beta1VolumeSnapshotContents{client: c.client.VolumeSnapshotContents()}
+}
+
+// convertWatch converts the objects of the events received from a v1beta1 watch into their v1 counterparts.
+func convertWatch(w watch.Interface, err error) (watch.Interface, error) {
+	if err != nil {
+		return nil, err
+	}
+	return watch.Filter(w, func(in watch.Event) (watch.Event, bool) {
+		var out runtime.Object
+		switch in.Object.(type) {
+		case *snapshotv1beta1api.VolumeSnapshot:
+			out = &snapshotv1api.VolumeSnapshot{}
+		case *snapshotv1beta1api.VolumeSnapshotClass:
+			out = &snapshotv1api.VolumeSnapshotClass{}
+		case *snapshotv1beta1api.VolumeSnapshotContent:
+			out = &snapshotv1api.VolumeSnapshotContent{}
+		default:
+			return in, true
+		}
+		if err := convertSnapshotObject(in.Object, out); err != nil {
+			return watch.Event{Type: watch.Error, Object: &metav1.Status{Status: metav1.StatusFailure, Message: err.Error()}}, true
+		}
+		in.Object = out
+		return in, true
+	}), nil
+}
+
+// v1beta1VolumeSnapshots implements snapshotter.VolumeSnapshotInterface on top of a v1beta1 client.
+type v1beta1VolumeSnapshots struct {
+	client snapshotterv1beta1.VolumeSnapshotInterface
+}
+
+func toVolumeSnapshotV1beta1(in *snapshotv1api.VolumeSnapshot) (*snapshotv1beta1api.VolumeSnapshot, error) {
+	out := &snapshotv1beta1api.VolumeSnapshot{}
+	if err := convertSnapshotObject(in, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func toVolumeSnapshotV1(in *snapshotv1beta1api.VolumeSnapshot, err error) (*snapshotv1api.VolumeSnapshot, error) {
+	if err != nil {
+		return nil, err
+	}
+	out := &snapshotv1api.VolumeSnapshot{}
+	if err := convertSnapshotObject(in, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *v1beta1VolumeSnapshots) Create(ctx context.Context, obj *snapshotv1api.VolumeSnapshot, opts metav1.CreateOptions) (*snapshotv1api.VolumeSnapshot, error) {
+	in, err := toVolumeSnapshotV1beta1(obj)
+	if err != nil {
+		return nil, err
+	}
+	return toVolumeSnapshotV1(c.client.Create(ctx, in, opts))
+}
+
+func (c *v1beta1VolumeSnapshots) Update(ctx context.Context, obj *snapshotv1api.VolumeSnapshot, opts metav1.UpdateOptions) (*snapshotv1api.VolumeSnapshot, error) {
+	in, err := toVolumeSnapshotV1beta1(obj)
+	if err != nil {
+		return nil, err
+	}
+	return toVolumeSnapshotV1(c.client.Update(ctx, in, opts))
+}
+
+func (c *v1beta1VolumeSnapshots) UpdateStatus(ctx context.Context, obj *snapshotv1api.VolumeSnapshot, opts metav1.UpdateOptions) (*snapshotv1api.VolumeSnapshot, error) {
+	in, err := toVolumeSnapshotV1beta1(obj)
+	if err != nil {
+		return nil, err
+	}
+	return toVolumeSnapshotV1(c.client.UpdateStatus(ctx, in, opts))
+}
+
+func (c *v1beta1VolumeSnapshots) Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error {
+	return c.client.Delete(ctx, name, opts)
+}
+
+func (c *v1beta1VolumeSnapshots) DeleteCollection(ctx context.Context, opts metav1.DeleteOptions, listOpts metav1.ListOptions) error {
+	return c.client.DeleteCollection(ctx, opts, listOpts)
+}
+
+func (c *v1beta1VolumeSnapshots) Get(ctx context.Context, name string, opts metav1.GetOptions) (*snapshotv1api.VolumeSnapshot, error) {
+	return toVolumeSnapshotV1(c.client.Get(ctx, name, opts))
+}
+
+func (c *v1beta1VolumeSnapshots) List(ctx context.Context, opts metav1.ListOptions) (*snapshotv1api.VolumeSnapshotList, error) {
+	list, err := c.client.List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	out := &snapshotv1api.VolumeSnapshotList{}
+	if err := convertSnapshotObject(list, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *v1beta1VolumeSnapshots) Watch(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error) {
+	return convertWatch(c.client.Watch(ctx, opts))
+}
+
+func (c *v1beta1VolumeSnapshots) Patch(ctx context.Context, name string, pt types.PatchType, data []byte, opts metav1.PatchOptions, subresources ...string) (*snapshotv1api.VolumeSnapshot, error) {
+	return toVolumeSnapshotV1(c.client.Patch(ctx, name, pt, data, opts, subresources...))
+}
+
+// v1beta1VolumeSnapshotClasses implements snapshotter.VolumeSnapshotClassInterface on top of a v1beta1 client.
+type v1beta1VolumeSnapshotClasses struct {
+	client snapshotterv1beta1.VolumeSnapshotClassInterface
+}
+
+func toVolumeSnapshotClassV1beta1(in *snapshotv1api.VolumeSnapshotClass) (*snapshotv1beta1api.VolumeSnapshotClass, error) {
+	out := &snapshotv1beta1api.VolumeSnapshotClass{}
+	if err := convertSnapshotObject(in, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func toVolumeSnapshotClassV1(in *snapshotv1beta1api.VolumeSnapshotClass, err error) (*snapshotv1api.VolumeSnapshotClass, error) {
+	if err != nil {
+		return nil, err
+	}
+	out := &snapshotv1api.VolumeSnapshotClass{}
+	if err := convertSnapshotObject(in, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *v1beta1VolumeSnapshotClasses) Create(ctx context.Context, obj *snapshotv1api.VolumeSnapshotClass, opts metav1.CreateOptions) (*snapshotv1api.VolumeSnapshotClass, error) {
+	in, err := toVolumeSnapshotClassV1beta1(obj)
+	if err != nil {
+		return nil, err
+	}
+	return toVolumeSnapshotClassV1(c.client.Create(ctx, in, opts))
+}
+
+func (c *v1beta1VolumeSnapshotClasses) Update(ctx context.Context, obj *snapshotv1api.VolumeSnapshotClass, opts metav1.UpdateOptions) (*snapshotv1api.VolumeSnapshotClass, error) {
+	in, err := toVolumeSnapshotClassV1beta1(obj)
+	if err != nil {
+		return nil, err
+	}
+	return toVolumeSnapshotClassV1(c.client.Update(ctx, in, opts))
+}
+
+func (c *v1beta1VolumeSnapshotClasses) Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error {
+	return c.client.Delete(ctx, name, opts)
+}
+
+func (c *v1beta1VolumeSnapshotClasses) DeleteCollection(ctx context.Context, opts metav1.DeleteOptions, listOpts metav1.ListOptions) error {
+	return c.client.DeleteCollection(ctx, opts, listOpts)
+}
+
+func (c *v1beta1VolumeSnapshotClasses) Get(ctx context.Context, name string, opts metav1.GetOptions) (*snapshotv1api.VolumeSnapshotClass, error) {
+	return toVolumeSnapshotClassV1(c.client.Get(ctx, name, opts))
+}
+
+func (c *v1beta1VolumeSnapshotClasses) List(ctx context.Context, opts metav1.ListOptions) (*snapshotv1api.VolumeSnapshotClassList, error) {
+	list, err := c.client.List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	out := &snapshotv1api.VolumeSnapshotClassList{}
+	if err := convertSnapshotObject(list, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *v1beta1VolumeSnapshotClasses) Watch(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error) {
+	return convertWatch(c.client.Watch(ctx, opts))
+}
+
+func (c *v1beta1VolumeSnapshotClasses) Patch(ctx context.Context, name string, pt types.PatchType, data []byte, opts metav1.PatchOptions, subresources ...string) (*snapshotv1api.VolumeSnapshotClass, error) {
+	return toVolumeSnapshotClassV1(c.client.Patch(ctx, name, pt, data, opts, subresources...))
+}
+
+// v1beta1VolumeSnapshotContents implements snapshotter.VolumeSnapshotContentInterface on top of a v1beta1 client.
+type v1beta1VolumeSnapshotContents struct {
+	client snapshotterv1beta1.VolumeSnapshotContentInterface
+}
+
+func toVolumeSnapshotContentV1beta1(in *snapshotv1api.VolumeSnapshotContent) (*snapshotv1beta1api.VolumeSnapshotContent, error) {
+	out := &snapshotv1beta1api.VolumeSnapshotContent{}
+	if err := convertSnapshotObject(in, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func toVolumeSnapshotContentV1(in *snapshotv1beta1api.VolumeSnapshotContent, err error) (*snapshotv1api.VolumeSnapshotContent, error) {
+	if err != nil {
+		return nil, err
+	}
+	out := &snapshotv1api.VolumeSnapshotContent{}
+	if err := convertSnapshotObject(in, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *v1beta1VolumeSnapshotContents) Create(ctx context.Context, obj *snapshotv1api.VolumeSnapshotContent, opts metav1.CreateOptions) (*snapshotv1api.VolumeSnapshotContent, error) {
+	in, err := toVolumeSnapshotContentV1beta1(obj)
+	if err != nil {
+		return nil, err
+	}
+	return toVolumeSnapshotContentV1(c.client.Create(ctx, in, opts))
+}
+
+func (c *v1beta1VolumeSnapshotContents) Update(ctx context.Context, obj *snapshotv1api.VolumeSnapshotContent, opts metav1.UpdateOptions) (*snapshotv1api.VolumeSnapshotContent, error) {
+	in, err := toVolumeSnapshotContentV1beta1(obj)
+	if err != nil {
+		return nil, err
+	}
+	return toVolumeSnapshotContentV1(c.client.Update(ctx, in, opts))
+}
+
+func (c *v1beta1VolumeSnapshotContents) UpdateStatus(ctx context.Context, obj *snapshotv1api.VolumeSnapshotContent, opts metav1.UpdateOptions) (*snapshotv1api.VolumeSnapshotContent, error) {
+	in, err := toVolumeSnapshotContentV1beta1(obj)
+	if err != nil {
+		return nil, err
+	}
+	return toVolumeSnapshotContentV1(c.client.UpdateStatus(ctx, in, opts))
+}
+
+func (c *v1beta1VolumeSnapshotContents) Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error {
+	return c.client.Delete(ctx, name, opts)
+}
+
+func (c *v1beta1VolumeSnapshotContents) DeleteCollection(ctx context.Context, opts metav1.DeleteOptions, listOpts metav1.ListOptions) error {
+	return c.client.DeleteCollection(ctx, opts, listOpts)
+}
+
+func (c *v1beta1VolumeSnapshotContents) Get(ctx context.Context, name string, opts metav1.GetOptions) (*snapshotv1api.VolumeSnapshotContent, error) {
+	return toVolumeSnapshotContentV1(c.client.Get(ctx, name, opts))
+}
+
+func (c *v1beta1VolumeSnapshotContents) List(ctx context.Context, opts metav1.ListOptions) (*snapshotv1api.VolumeSnapshotContentList, error) {
+	list, err := c.client.List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	out := &snapshotv1api.VolumeSnapshotContentList{}
+	if err := convertSnapshotObject(list, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *v1beta1VolumeSnapshotContents) Watch(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error) {
+	return convertWatch(c.client.Watch(ctx, opts))
+}
+
+func (c *v1beta1VolumeSnapshotContents) Patch(ctx context.Context, name string, pt types.PatchType, data []byte, opts metav1.PatchOptions, subresources ...string) (*snapshotv1api.VolumeSnapshotContent, error) {
+	return toVolumeSnapshotContentV1(c.client.Patch(ctx, name, pt, data, opts, subresources...))
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2021 the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/config"
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/legalhold"
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/util"
+)
+
+// legalHoldCommand runs the plugin binary to place or remove a legal hold instead of as a Velero plugin.
+const legalHoldCommand = "legal-hold"
+
+// runLegalHold places or removes the legal hold of a backup, volumesnapshot or volumesnapshotcontent and returns the exit
+// code of the process. It is invoked as: legal-hold place|remove <target> [flags].
+func runLegalHold(args []string) int {
+	logger := logrus.New()
+	flags := pflag.NewFlagSet(legalHoldCommand, pflag.ContinueOnError)
+	namespace := flags.String("namespace", config.Namespace(), "the Velero namespace, which holds the backups and the audit record")
+	reason := flags.String("reason", "", "the reason for placing the legal hold")
+	requester := flags.String("requester", os.Getenv("USER"), "who requested the placement or removal of the legal hold")
+	flags.Usage = func() {
+		logger.Infof("Usage: %s place|remove backup/<name>|volumesnapshot/<namespace>/<name>|volumesnapshotcontent/<name> [flags]\n%s",
+			legalHoldCommand, flags.FlagUsages())
+	}
+	if err := flags.Parse(args); err != nil {
+		if err == pflag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	if flags.NArg() != 2 || (flags.Arg(0) != legalhold.ActionPlace && flags.Arg(0) != legalhold.ActionRemove) {
+		flags.Usage()
+		return 2
+	}
+	target, err := legalhold.ParseTarget(flags.Arg(1), *namespace)
+	if err != nil {
+		logger.WithError(err).Error("Invalid legal hold target")
+		return 2
+	}
+
+	client, snapshotClient, err := util.GetClients()
+	if err != nil {
+		logger.WithError(err).Error("Failed to create the kubernetes client")
+		return 1
+	}
+	backupClient, err := util.GetDynamicClient()
+	if err != nil {
+		logger.WithError(err).Error("Failed to create the kubernetes client")
+		return 1
+	}
+	manager := &legalhold.Manager{
+		Log:             logger,
+		Namespace:       *namespace,
+		ConfigMapClient: client.CoreV1(),
+		BackupClient:    backupClient,
+		SnapshotClient:  snapshotClient,
+	}
+
+	if flags.Arg(0) == legalhold.ActionPlace {
+		err = manager.Place(target, *reason, *requester)
+	} else {
+		err = manager.Remove(target, *requester)
+	}
+	if err != nil {
+		logger.WithError(err).Errorf("Failed to %s legal hold", flags.Arg(0))
+		return 1
+	}
+	return 0
+}
@@ -17,15 +17,28 @@ limitations under the License.
 package main
 
 import (
+	"os"
+
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
 	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/backup"
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/config"
 	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/delete"
 	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/restore"
+	"github.com/vmware-tanzu/velero-plugin-for-csi/internal/util"
 	veleroplugin "github.com/vmware-tanzu/velero/pkg/plugin/framework"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case gcCommand:
+			os.Exit(runGC(os.Args[2:]))
+		case legalHoldCommand:
+			os.Exit(runLegalHold(os.Args[2:]))
+		}
+	}
+
 	veleroplugin.NewServer().
 		BindFlags(pflag.CommandLine).
 		RegisterBackupItemAction("velero.io/csi-pvc-backupper", newPVCBackupItemAction).
@@ -36,17 +49,35 @@ func main() {
 		RegisterRestoreItemAction("velero.io/csi-volumesnapshot-restorer", newVolumeSnapshotRestoreItemAction).
 		RegisterRestoreItemAction("velero.io/csi-volumesnapshotclass-restorer", newVolumeSnapshotClassRestoreItemAction).
 		RegisterRestoreItemAction("velero.io/csi-volumesnapshotcontent-restorer", newVolumeSnapshotContentRestoreItemAction).
+		RegisterRestoreItemAction("velero.io/csi-workload-restorer", newWorkloadRestoreItemAction).
 		RegisterDeleteItemAction("velero.io/csi-volumesnapshot-delete", newVolumeSnapshotDeleteItemAction).
 		RegisterDeleteItemAction("velero.io/csi-volumesnapshotcontent-delete", newVolumeSnapshotContentDeleteItemAction).
 		Serve()
 }
 
+// loadConfig reads the plugin configuration from the plugin configmap in the Velero namespace.
+func loadConfig(logger logrus.FieldLogger) (config.Config, error) {
+	client, err := util.GetKubeClient()
+	if err != nil {
+		return config.Config{}, err
+	}
+	return config.Load(client.CoreV1(), config.Namespace(), logger)
+}
+
 func newPVCBackupItemAction(logger logrus.FieldLogger) (interface{}, error) {
-	return &backup.PVCBackupItemAction{Log: logger}, nil
+	cfg, err := loadConfig(logger)
+	if err != nil {
+		return nil, err
+	}
+	return &backup.PVCBackupItemAction{Log: logger, Config: cfg}, nil
 }
 
 func newVolumeSnapshotBackupItemAction(logger logrus.FieldLogger) (interface{}, error) {
-	return &backup.VolumeSnapshotBackupItemAction{Log: logger}, nil
+	cfg, err := loadConfig(logger)
+	if err != nil {
+		return nil, err
+	}
+	return &backup.VolumeSnapshotBackupItemAction{Log: logger, Config: cfg}, nil
 }
 
 func newVolumesnapshotClassBackupItemAction(logger logrus.FieldLogger) (interface{}, error) {
@@ -58,25 +89,53 @@ func newVolumeSnapContentBackupItemAction(logger logrus.FieldLogger) (interface{
 }
 
 func newPVCRestoreItemAction(logger logrus.FieldLogger) (interface{}, error) {
-	return &restore.PVCRestoreItemAction{Log: logger}, nil
+	cfg, err := loadConfig(logger)
+	if err != nil {
+		return nil, err
+	}
+	return &restore.PVCRestoreItemAction{Log: logger, Config: cfg}, nil
 }
 
 func newVolumeSnapshotContentRestoreItemAction(logger logrus.FieldLogger) (interface{}, error) {
-	return &restore.VolumeSnapshotContentRestoreItemAction{Log: logger}, nil
+	cfg, err := loadConfig(logger)
+	if err != nil {
+		return nil, err
+	}
+	return &restore.VolumeSnapshotContentRestoreItemAction{Log: logger, Config: cfg}, nil
 }
 
 func newVolumeSnapshotRestoreItemAction(logger logrus.FieldLogger) (interface{}, error) {
-	return &restore.VolumeSnapshotRestoreItemAction{Log: logger}, nil
+	cfg, err := loadConfig(logger)
+	if err != nil {
+		return nil, err
+	}
+	return &restore.VolumeSnapshotRestoreItemAction{Log: logger, Config: cfg}, nil
 }
 
 func newVolumeSnapshotClassRestoreItemAction(logger logrus.FieldLogger) (interface{}, error) {
-	return &restore.VolumeSnapshotClassRestoreItemAction{Log: logger}, nil
+	cfg, err := loadConfig(logger)
+	if err != nil {
+		return nil, err
+	}
+	return &restore.VolumeSnapshotClassRestoreItemAction{Log: logger, Config: cfg}, nil
+}
+
+func newWorkloadRestoreItemAction(logger logrus.FieldLogger) (interface{}, error) {
+	return &restore.WorkloadRestoreItemAction{Log: logger}, nil
 }
 
 func newVolumeSnapshotDeleteItemAction(logger logrus.FieldLogger) (interface{}, error) {
-	return &delete.VolumeSnapshotDeleteItemAction{Log: logger}, nil
+	cfg, err := loadConfig(logger)
+	if err != nil {
+		return nil, err
+	}
+	return &delete.VolumeSnapshotDeleteItemAction{Log: logger, Config: cfg}, nil
 }
 
 func newVolumeSnapshotContentDeleteItemAction(logger logrus.FieldLogger) (interface{}, error) {
-	return &delete.VolumeSnapshotContentDeleteItemAction{Log: logger}, nil
+	cfg, err := loadConfig(logger)
+	if err != nil {
+		return nil, err
+	}
+	return &delete.VolumeSnapshotContentDeleteItemAction{Log: logger, Config: cfg}, nil
 }